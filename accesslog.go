@@ -0,0 +1,299 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogEntry is one line of the access log, as JSON or logfmt
+type AccessLogEntry struct {
+	Time          time.Time `json:"time"`
+	Client        string    `json:"client"`
+	ClientIP      string    `json:"client_ip"`
+	Method        string    `json:"method"`
+	URI           string    `json:"uri"`
+	Host          string    `json:"host"`
+	Status        int       `json:"status"`
+	Bytes         int64     `json:"bytes"`
+	Duration      float64   `json:"duration_ms"`
+	Backend       string    `json:"backend,omitempty"`
+	Retries       int       `json:"retries,omitempty"`        // same-backend retries and failovers
+	UpstreamError string    `json:"upstream_error,omitempty"` // the cause of the last failed attempt, see classifyUpstreamError
+	Class         string    `json:"class,omitempty"`
+	APIKey        string    `json:"api_key,omitempty"`  // the key's name
+	Decision      string    `json:"decision,omitempty"` // with -trace-decisions
+	RequestID     string    `json:"request_id,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+}
+
+type accessLogKey struct{}
+
+// AccessLog appends an entry per request to Path and rotates it once it
+// reaches RotateSize or RotateEvery. rotated segments are named
+// <path>.<timestamp> and handed to Ship, if set, which compresses and uploads
+// them and removes them once stored. a Path of "-" writes to stdout, without
+// rotation. Close writes out what is queued on shutdown
+type AccessLog struct {
+	Path        string
+	Format      string // json (default) or logfmt
+	RotateSize  int64
+	RotateEvery time.Duration
+	Ship        LogSink
+
+	entries  chan *AccessLogEntry
+	dropped  atomic.Uint64
+	segments chan string
+	closing  chan struct{}
+	closed   chan struct{} // once the queue is written out
+}
+
+func NewAccessLog(path, format string, rotateSize int64, rotateEvery time.Duration, ship LogSink) (*AccessLog, error) {
+	if format != "json" && format != "logfmt" {
+		return nil, fmt.Errorf("unknown access log format %q (use json or logfmt)", format)
+	}
+	if path == "-" {
+		rotateSize, rotateEvery, ship = 0, 0, nil
+	}
+	al := &AccessLog{
+		Path:        path,
+		Format:      format,
+		RotateSize:  rotateSize,
+		RotateEvery: rotateEvery,
+		Ship:        ship,
+		entries:     make(chan *AccessLogEntry, 4096),
+		segments:    make(chan string, 64),
+		closing:     make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	f, size, err := al.open()
+	if err != nil {
+		return nil, err
+	}
+	if ship != nil {
+		// segments left behind by a previous run that never made it out
+		pending, _ := filepath.Glob(path + ".*")
+		sort.Strings(pending)
+		go al.ship(pending)
+	}
+	go al.write(f, size)
+	return al, nil
+}
+
+func (al *AccessLog) open() (*os.File, int64, error) {
+	if al.Path == "-" {
+		return os.Stdout, 0, nil
+	}
+	f, err := os.OpenFile(al.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, st.Size(), nil
+}
+
+// single writer so request goroutines never block on disk
+func (al *AccessLog) write(f *os.File, size int64) {
+	var tick <-chan time.Time
+	if al.RotateEvery > 0 {
+		t := time.NewTicker(al.RotateEvery)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	put := func(e *AccessLogEntry) {
+		line, err := al.encode(e)
+		if err != nil {
+			return
+		}
+		n, err := f.Write(append(line, '\n'))
+		if err != nil {
+			log.Println("Access log write failed: ", err)
+		}
+		size += int64(n)
+		if al.RotateSize > 0 && size >= al.RotateSize {
+			f, size = al.rotate(f, size)
+		}
+	}
+	for {
+		select {
+		case e := <-al.entries:
+			put(e)
+		case <-tick:
+			if size > 0 {
+				f, size = al.rotate(f, size)
+			}
+		case <-al.closing:
+			for {
+				select {
+				case e := <-al.entries:
+					put(e)
+					continue
+				default:
+				}
+				break
+			}
+			if f != os.Stdout {
+				_ = f.Sync()
+				_ = f.Close()
+			}
+			close(al.closed)
+			return
+		}
+	}
+}
+
+// Close writes out the entries still queued, once requests are drained
+func (al *AccessLog) Close(ctx context.Context) error {
+	close(al.closing)
+	select {
+	case <-al.closed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("access log: %d entries not written: %w", len(al.entries), ctx.Err())
+	}
+}
+
+func (al *AccessLog) rotate(f *os.File, size int64) (*os.File, int64) {
+	_ = f.Close()
+	segment := fmt.Sprintf("%s.%s", al.Path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(al.Path, segment); err != nil {
+		log.Println("Access log rotation failed: ", err)
+	}
+
+	next, nextSize, err := al.open()
+	if err != nil {
+		// keep logging somewhere rather than nowhere
+		log.Println("Access log reopen failed: ", err)
+		return f, size
+	}
+	if al.Ship != nil {
+		select {
+		case al.segments <- segment:
+		default:
+			log.Printf("Access log shipping backlog full, %s stays on disk until restart\n", segment)
+		}
+	}
+	return next, nextSize
+}
+
+func (al *AccessLog) ship(pending []string) {
+	for _, segment := range pending {
+		al.shipSegment(segment)
+	}
+	for segment := range al.segments {
+		al.shipSegment(segment)
+	}
+}
+
+// shipSegment uploads with a few retries; a segment that can't be shipped
+// stays on disk and is retried on the next start
+func (al *AccessLog) shipSegment(segment string) {
+	for attempt := 1; ; attempt++ {
+		err := shipLogSegment(al.Ship, segment)
+		if err == nil {
+			return
+		}
+		log.Printf("Shipping %s failed (attempt %d): %v\n", segment, attempt, err)
+		if attempt == 3 {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * 10 * time.Second)
+	}
+}
+
+func (al *AccessLog) encode(e *AccessLogEntry) ([]byte, error) {
+	if al.Format == "logfmt" {
+		return e.logfmt(), nil
+	}
+	return json.Marshal(e)
+}
+
+// logfmt writes the entry's fields as key=value pairs under their JSON
+// names, leaving out empty omitempty ones just like the JSON form
+func (e *AccessLogEntry) logfmt() []byte {
+	var buf bytes.Buffer
+	v := reflect.ValueOf(e).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, opts, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		f := v.Field(i)
+		if opts == "omitempty" && f.IsZero() {
+			continue
+		}
+		var s string
+		switch x := f.Interface().(type) {
+		case time.Time:
+			s = x.Format(time.RFC3339Nano)
+		case float64:
+			s = strconv.FormatFloat(x, 'f', 3, 64)
+		default:
+			s = fmt.Sprint(x)
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		if s == "" || strings.ContainsAny(s, " =\"\\") || strings.ContainsFunc(s, func(r rune) bool { return r < ' ' }) {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+	return buf.Bytes()
+}
+
+// Middleware logs every request once it has been answered
+func (al *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		e := &AccessLogEntry{
+			Time:      start,
+			Client:    r.RemoteAddr,
+			ClientIP:  ip,
+			Method:    r.Method,
+			URI:       r.URL.RequestURI(),
+			Host:      r.Host,
+			RequestID: GetRequestID(r),
+			UserAgent: r.UserAgent(),
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), accessLogKey{}, e)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		e.Status, e.Bytes = sw.status, sw.bytes
+		e.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		select {
+		case al.entries <- e:
+		default:
+			if al.dropped.Add(1)%100 == 1 {
+				log.Println("Access log falling behind, dropping entries")
+			}
+		}
+	})
+}
+
+// inner handlers fill in what only they know
+func accessLogEntry(r *http.Request) *AccessLogEntry {
+	e, _ := r.Context().Value(accessLogKey{}).(*AccessLogEntry)
+	return e
+}
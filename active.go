@@ -0,0 +1,191 @@
+package loadbalancer
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestTracker keeps the requests being proxied, so GET /admin/requests
+// can show what is stuck where and DELETE can cancel a runaway request, or
+// everything on a backend that hangs. a cancelled request that has no
+// response yet gets a 503; one already streaming is cut off
+type RequestTracker struct {
+	mux    sync.Mutex
+	next   uint64
+	active map[uint64]*trackedRequest
+
+	killed atomic.Uint64
+}
+
+type trackedRequest struct {
+	ActiveRequest
+	cancel  context.CancelCauseFunc
+	backend *Backend
+}
+
+// ActiveRequest is a proxied request as the admin API shows it
+type ActiveRequest struct {
+	ID        uint64    `json:"id"`
+	RequestID string    `json:"request_id,omitempty"`
+	Started   time.Time `json:"started"`
+	Age       float64   `json:"age_seconds"`
+	Client    string    `json:"client"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Pool      string    `json:"pool"`
+	Backend   string    `json:"backend"`
+}
+
+// errRequestKilled is the cause of a request cancelled through the admin API
+var errRequestKilled = errors.New("cancelled through the admin API")
+
+var activeRequests = &RequestTracker{active: map[uint64]*trackedRequest{}}
+
+// track registers r as being proxied to b until done is called. the request
+// returned is the one to proxy, as it is the one Kill cancels
+func (t *RequestTracker) track(r *http.Request, pool string, b *Backend) (*http.Request, func()) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	tr := &trackedRequest{
+		ActiveRequest: ActiveRequest{
+			RequestID: GetRequestID(r),
+			Started:   time.Now(),
+			Client:    r.RemoteAddr,
+			Method:    r.Method,
+			Host:      r.Host,
+			Path:      r.URL.Path,
+			Pool:      pool,
+			Backend:   b.Name(),
+		},
+		cancel:  cancel,
+		backend: b,
+	}
+	t.mux.Lock()
+	t.next++
+	tr.ID = t.next
+	t.active[tr.ID] = tr
+	t.mux.Unlock()
+
+	return r.WithContext(ctx), func() {
+		t.mux.Lock()
+		delete(t.active, tr.ID)
+		t.mux.Unlock()
+		cancel(nil)
+	}
+}
+
+// List returns the active requests, oldest first
+func (t *RequestTracker) List() []ActiveRequest {
+	t.mux.Lock()
+	list := make([]ActiveRequest, 0, len(t.active))
+	for _, tr := range t.active {
+		list = append(list, tr.ActiveRequest)
+	}
+	t.mux.Unlock()
+
+	now := time.Now()
+	for i := range list {
+		list[i].Age = now.Sub(list[i].Started).Seconds()
+	}
+	slices.SortFunc(list, func(a, b ActiveRequest) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// oldest returns when the oldest request to b, or to any backend for nil,
+// started, and false if there is none
+func (t *RequestTracker) oldest(b *Backend) (time.Time, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var started time.Time
+	for _, tr := range t.active {
+		if (b == nil || tr.backend == b) && (started.IsZero() || tr.Started.Before(started)) {
+			started = tr.Started
+		}
+	}
+	return started, !started.IsZero()
+}
+
+// Kill cancels the request with the given id and reports whether it was
+// active
+func (t *RequestTracker) Kill(id uint64) bool {
+	t.mux.Lock()
+	tr, ok := t.active[id]
+	t.mux.Unlock()
+	if ok {
+		t.killed.Add(1)
+		tr.cancel(errRequestKilled)
+		log.Printf("Cancelled request %d (%s %s%s from %s on %s)\n", id, tr.Method, tr.Host, tr.Path, tr.Client, tr.Backend)
+	}
+	return ok
+}
+
+// KillBackend cancels every request to the named backend, in pool if it is
+// given, and returns how many there were
+func (t *RequestTracker) KillBackend(pool, backend string) int {
+	var ids []uint64
+	t.mux.Lock()
+	for id, tr := range t.active {
+		if tr.Backend == backend && (pool == "" || tr.Pool == pool) {
+			ids = append(ids, id)
+		}
+	}
+	t.mux.Unlock()
+	n := 0
+	for _, id := range ids {
+		if t.Kill(id) {
+			n++
+		}
+	}
+	return n
+}
+
+// killed reports whether r was cancelled through the admin API
+func killed(r *http.Request) bool {
+	return context.Cause(r.Context()) == errRequestKilled
+}
+
+// lists what is being proxied, optionally only to ?backend= in ?pool=
+func getRequests(w http.ResponseWriter, r *http.Request) {
+	pool, backend := r.URL.Query().Get("pool"), r.URL.Query().Get("backend")
+	list := []ActiveRequest{}
+	for _, a := range activeRequests.List() {
+		if (pool == "" || a.Pool == pool) && (backend == "" || a.Backend == backend) {
+			list = append(list, a)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func deleteRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad request id %q", r.PathValue("id")), http.StatusBadRequest)
+		return
+	}
+	if !activeRequests.Kill(id) {
+		http.Error(w, fmt.Sprintf("no active request %d", id), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancels everything going to ?backend=, in ?pool= if given
+func deleteRequests(w http.ResponseWriter, r *http.Request) {
+	pool, backend := r.URL.Query().Get("pool"), r.URL.Query().Get("backend")
+	if backend == "" {
+		http.Error(w, "give the ?backend= whose requests to cancel", http.StatusBadRequest)
+		return
+	}
+	n := activeRequests.KillBackend(pool, backend)
+	log.Printf("Cancelled %d requests to %s through the admin API\n", n, backend)
+	writeJSON(w, http.StatusOK, map[string]int{"cancelled": n})
+}
@@ -0,0 +1,103 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// admin endpoints live on their own listener so they are never reachable
+// through the balanced port
+func startAdmin(port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", getMetrics)
+	mux.HandleFunc("GET /status", getStatus)
+	mux.HandleFunc("GET /dashboard", getDashboard)
+	mux.HandleFunc("GET /readyz", getReadyz)
+	mux.HandleFunc("POST /admin/go", postGo)
+	mux.HandleFunc("GET /admin/chaos", getChaos)
+	mux.HandleFunc("PUT /admin/chaos", putChaos)
+	mux.HandleFunc("GET /admin/limits", getLimits)
+	mux.HandleFunc("GET /admin/classes", getClasses)
+	mux.HandleFunc("GET /admin/api-keys", getAPIKeys)
+	mux.HandleFunc("GET /admin/ip-lists", getIPLists)
+	mux.HandleFunc("GET /admin/coalesce", getCoalesce)
+	mux.HandleFunc("GET /admin/cache", getCache)
+	mux.HandleFunc("POST /admin/cache/purge", postCachePurge)
+	mux.HandleFunc("GET /admin/routes/explain", getRouteExplain)
+	mux.HandleFunc("GET /admin/graph", getGraph)
+	mux.HandleFunc("POST /admin/route-test", postRouteTest)
+	mux.HandleFunc("GET /admin/mirrors", getMirrors)
+	mux.HandleFunc("GET /admin/backends", getBackends)
+	mux.HandleFunc("POST /admin/backends", postBackend)
+	mux.HandleFunc("PUT /admin/backends/{name}", putBackend)
+	mux.HandleFunc("DELETE /admin/backends/{name}", deleteBackend)
+	mux.HandleFunc("DELETE /admin/backends", deleteBackendsSelected)
+	mux.HandleFunc("PUT /admin/backends/weight", putWeightSelected)
+	mux.HandleFunc("POST /admin/backends/drain", postDrainSelected)
+	mux.HandleFunc("DELETE /admin/backends/drain", deleteDrainSelected)
+	mux.HandleFunc("PUT /admin/backends/{name}/maintenance", putMaintenance)
+	mux.HandleFunc("POST /admin/backends/{name}/drain", postDrain)
+	mux.HandleFunc("GET /admin/backends/{name}/drain", getDrain)
+	mux.HandleFunc("DELETE /admin/backends/{name}/drain", deleteDrain)
+	mux.HandleFunc("PUT /admin/backends/{name}/pin", putPin)
+	mux.HandleFunc("POST /admin/backends/swap", postSwap)
+	mux.HandleFunc("GET /admin/shutdown", getShutdown)
+	mux.HandleFunc("GET /admin/discovery", getDiscovery)
+	mux.HandleFunc("PUT /admin/discovery", putDiscovery)
+	mux.HandleFunc("GET /admin/requests", getRequests)
+	mux.HandleFunc("DELETE /admin/requests", deleteRequests)
+	mux.HandleFunc("DELETE /admin/requests/{id}", deleteRequest)
+	mux.HandleFunc("GET /admin/cluster", getCluster)
+	mux.HandleFunc("GET /admin/ha", getHA)
+	mux.HandleFunc("POST /admin/shift", postShift)
+	mux.HandleFunc("GET /admin/shift", getShift)
+	mux.HandleFunc("DELETE /admin/shift", deleteShift)
+	mux.HandleFunc("GET /admin/maintenance", getMaintenance)
+	mux.HandleFunc("PUT /admin/maintenance", putMaintenancePool)
+	mux.HandleFunc("GET /admin/canary", getCanary)
+	mux.HandleFunc("PUT /admin/canary", putCanary)
+	mux.HandleFunc("GET /admin/bandit", getBandit)
+	mux.HandleFunc("GET /admin/test-servers", getTestServers)
+	mux.HandleFunc("PUT /admin/test-servers", putTestServer)
+	mux.HandleFunc("PUT /admin/test-servers/{port}", putTestServer)
+	mux.HandleFunc("POST /admin/reload", postReload)
+	mux.HandleFunc("GET /admin/features", getFeatures)
+	mux.HandleFunc("PUT /admin/features", putFeature)
+	mux.HandleFunc("GET /admin/alloc-audit", getAllocAudit)
+	mux.HandleFunc("POST /admin/alloc-audit", postAllocAudit)
+
+	log.Printf("Admin API at :%d\n", port)
+	l, err := listenTCP(fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func getChaos(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, chaos.Settings())
+}
+
+// accepts a partial or full chaos setting, e.g. {"enabled": true, "drop_rate": 0.02}
+func putChaos(w http.ResponseWriter, r *http.Request) {
+	s := chaos.Settings()
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chaos.Update(s)
+	log.Printf("Chaos mode updated: enabled=%t drop=%.3f delay=%.3f\n", s.Enabled, s.DropRate, s.DelayRate)
+	writeJSON(w, http.StatusOK, chaos.Settings())
+}
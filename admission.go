@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// WithAdmission makes the checks that decide whether a request may reach
+// its route's pool at all, its ip_access, auth, body size, OpenAPI spec and
+// rate limit and the pool's maintenance and rate limit, ahead of the
+// response cache, coalescing and -mirror-backends, so a copy made for one
+// caller is never served to, and no shadow request is sent for, a request
+// its route or pool would turn away. the router and the pool don't check
+// the same request twice
+func WithAdmission(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := &admission{pool: &serverPool}
+		if router != nil {
+			if a.route = router.match(r); a.route != nil {
+				if r = a.route.admit(w, r); r == nil {
+					return
+				}
+				a.pool = a.route.pool
+			}
+		}
+		if !a.pool.admit(w, r) {
+			return
+		}
+		if a.pool.ReadWrites != nil {
+			a.pinned = a.pool.ReadWrites.lookup(a.pool, r) != nil
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), admissionKey{}, a)))
+	})
+}
+
+// admission is what WithAdmission checked a request against
+type admission struct {
+	route  *Route // nil for the default pool
+	pool   *ServerPool
+	pinned bool // to the backend it last wrote to, see ReadYourWrites
+}
+
+type admissionKey struct{}
+
+// admitted returns what r was checked against, nil if it wasn't
+func admitted(r *http.Request) *admission {
+	a, _ := r.Context().Value(admissionKey{}).(*admission)
+	return a
+}
+
+// callerKey tells apart the callers a response may be meant for alone: the
+// -api-keys key or the route auth user they were let in as, and their
+// client certificate. responses are only shared between requests with the
+// same caller key
+func callerKey(r *http.Request) string {
+	key := r.Header.Get("X-Api-Key-Name") + "\n" + r.Header.Get("X-Auth-User") + "\n" + r.Header.Get("X-Auth-Method")
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		key += "\n" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
@@ -0,0 +1,141 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"load-balancer/redis"
+)
+
+// AffinityStore maps an application session id to the backend serving it.
+// a shared store (redis) keeps affinity intact whichever balancer instance
+// receives the request
+type AffinityStore interface {
+	Get(key string) (string, error)
+	Set(key, backend string, ttl time.Duration) error
+}
+
+// Affinity pins sessions, identified by a cookie the application sets, to the
+// backend that first served them
+type Affinity struct {
+	Cookie string
+	TTL    time.Duration
+	Store  AffinityStore
+}
+
+// NewAffinityStore returns an in-memory store for "memory" or a redis store
+// for a redis:// url
+func NewAffinityStore(spec string) (AffinityStore, error) {
+	if spec == "" || spec == "memory" {
+		return &memoryAffinityStore{entries: map[string]affinityEntry{}}, nil
+	}
+	if strings.HasPrefix(spec, "redis://") {
+		c, err := redis.NewClient(spec, 200*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		return redisAffinityStore{c}, nil
+	}
+	return nil, fmt.Errorf("unknown affinity store %q (use memory or redis://host:port)", spec)
+}
+
+// key hashes the session so the store never holds the cookie itself
+func (a *Affinity) key(pool, session string) string {
+	sum := sha256.Sum256([]byte(session))
+	return "lb:affinity:" + pool + ":" + hex.EncodeToString(sum[:16])
+}
+
+// lookup returns the live backend pinned to the request's session, if any
+func (a *Affinity) lookup(s *ServerPool, r *http.Request) *Backend {
+	c, err := r.Cookie(a.Cookie)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	name, err := a.Store.Get(a.key(s.Name, c.Value))
+	if err != nil {
+		if err != redis.ErrNil {
+			log.Println("Affinity lookup failed: ", err)
+		}
+		return nil
+	}
+	if b := s.FindBackend(name); b != nil && b.IsAlive() {
+		return b
+	}
+	return nil
+}
+
+// remember pins the session seen on the request or set by the response
+func (a *Affinity) remember(s *ServerPool, b *Backend, res *http.Response) {
+	session := ""
+	for _, c := range res.Cookies() {
+		if c.Name == a.Cookie && c.Value != "" {
+			session = c.Value
+		}
+	}
+	if session == "" {
+		c, err := res.Request.Cookie(a.Cookie)
+		if err != nil || c.Value == "" {
+			return
+		}
+		session = c.Value
+	}
+	if err := a.Store.Set(a.key(s.Name, session), b.Name(), a.TTL); err != nil {
+		log.Println("Affinity store failed: ", err)
+	}
+}
+
+type affinityEntry struct {
+	backend string
+	expires time.Time
+}
+
+type memoryAffinityStore struct {
+	mux     sync.Mutex
+	entries map[string]affinityEntry
+	sets    int
+}
+
+func (m *memoryAffinityStore) Get(key string) (string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	e, ok := m.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", redis.ErrNil
+	}
+	return e.backend, nil
+}
+
+func (m *memoryAffinityStore) Set(key, backend string, ttl time.Duration) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := time.Now()
+	m.entries[key] = affinityEntry{backend: backend, expires: now.Add(ttl)}
+
+	// sweep expired sessions every so often so the map can't grow forever
+	if m.sets++; m.sets%1024 == 0 {
+		for k, e := range m.entries {
+			if now.After(e.expires) {
+				delete(m.entries, k)
+			}
+		}
+	}
+	return nil
+}
+
+type redisAffinityStore struct {
+	c *redis.Client
+}
+
+func (r redisAffinityStore) Get(key string) (string, error) {
+	return r.c.Get(key)
+}
+
+func (r redisAffinityStore) Set(key, backend string, ttl time.Duration) error {
+	return r.c.Set(key, backend, ttl)
+}
@@ -0,0 +1,336 @@
+package loadbalancer
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the allocation audit samples allocations far more often than Go does by
+// default and charges each to the stage of a request that made it, so
+// performance work can go where the garbage is:
+//
+//	routing     matching routes and rewriting paths
+//	middleware  everything in the handler chain besides
+//	proxy       picking a backend and the round trip to it
+//	logging     access logs, log shipping and request recording
+//	server      reading requests and writing responses, before and after
+//	            the handler chain
+//	background  health checks, discovery and the like, not per request
+//
+// -alloc-audit turns it on at boot, sampling every -alloc-audit-rate bytes
+// allocated on average; the rate can't change later, as the runtime wants
+// it set before anything is allocated. GET /admin/alloc-audit reports what
+// was allocated since boot or the last POST, which starts a new window,
+// scaled up from the samples, with the top allocating call sites in this
+// code (?top=N, 20 by default). a report forces a garbage collection, as
+// the runtime only publishes samples after one, and sampling costs some
+// throughput, so this is a diagnostic, not something to leave on
+const defaultAllocAuditRate = 512
+
+var allocAudit struct {
+	mux       sync.Mutex
+	running   bool
+	rate      int // runtime.MemProfileRate, set at boot
+	since     time.Time
+	requests  uint64                // pool requests when the window started
+	baseline  map[string]allocCount // by stack, when the window started
+	ownPrefix string                // function name prefix of this package
+}
+
+type allocCount struct {
+	bytes, objects int64
+}
+
+func init() {
+	// this package's functions are named <package path>.<function>
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	pkg := strings.LastIndex(name, "/") + 1
+	allocAudit.ownPrefix = name[:pkg+strings.Index(name[pkg:], ".")+1]
+}
+
+// enableAllocAudit sets the sampling rate, which has to happen before the
+// allocations it should see, and starts the first window
+func enableAllocAudit(rate int) {
+	runtime.MemProfileRate = rate
+	allocAudit.mux.Lock()
+	allocAudit.running, allocAudit.rate = true, rate
+	allocAudit.mux.Unlock()
+	resetAllocAudit()
+	log.Printf("Allocation audit on, sampling every %d bytes\n", rate)
+}
+
+// resetAllocAudit starts a new window and returns when, false if the audit
+// is off
+func resetAllocAudit() (time.Time, bool) {
+	allocAudit.mux.Lock()
+	defer allocAudit.mux.Unlock()
+	if !allocAudit.running {
+		return time.Time{}, false
+	}
+	runtime.GC()
+	allocAudit.baseline = map[string]allocCount{}
+	for _, rec := range memProfile() {
+		allocAudit.baseline[stackKey(rec.Stack())] = allocCount{rec.AllocBytes, rec.AllocObjects}
+	}
+	allocAudit.since = time.Now()
+	allocAudit.requests = poolRequests()
+	return allocAudit.since, true
+}
+
+func memProfile() []runtime.MemProfileRecord {
+	n, _ := runtime.MemProfile(nil, true)
+	for {
+		records := make([]runtime.MemProfileRecord, n+50)
+		var ok bool
+		if n, ok = runtime.MemProfile(records, true); ok {
+			return records[:n]
+		}
+	}
+}
+
+func stackKey(stack []uintptr) string {
+	var b strings.Builder
+	for _, pc := range stack {
+		b.WriteString(strconv.FormatUint(uint64(pc), 16))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+func poolRequests() uint64 {
+	var n uint64
+	for _, p := range pools {
+		n += p.requests.Load()
+	}
+	return n
+}
+
+// AllocAuditReport is GET /admin/alloc-audit
+type AllocAuditReport struct {
+	Since      time.Time         `json:"since"`
+	SampleRate int               `json:"sample_rate"`
+	Requests   uint64            `json:"requests"`
+	Stages     []AllocStageStats `json:"stages"`
+	Top        []AllocSite       `json:"top"`
+}
+
+type AllocStageStats struct {
+	Stage              string  `json:"stage"`
+	Bytes              int64   `json:"bytes"`
+	Objects            int64   `json:"objects"`
+	BytesPerRequest    float64 `json:"bytes_per_request,omitempty"`
+	ObjectsPerRequest  float64 `json:"objects_per_request,omitempty"`
+	ShareOfRequestPath float64 `json:"share_of_request_path,omitempty"` // of the bytes, background aside
+}
+
+// AllocSite is where in this code allocations were made, directly or by
+// what it called, e.g. the standard library
+type AllocSite struct {
+	Site    string `json:"site"`            // function and file:line
+	Alloc   string `json:"alloc,omitempty"` // the allocating function, when it is elsewhere
+	Stage   string `json:"stage"`
+	Bytes   int64  `json:"bytes"`
+	Objects int64  `json:"objects"`
+}
+
+var allocStages = []string{"routing", "middleware", "proxy", "logging", "server", "background"}
+
+// the functions requests enter a stage through, and the closures they
+// return. they are listed by value, so renaming or moving one can't quietly
+// send its allocations elsewhere
+var allocStageEntries = map[string][]any{
+	"routing": {WithAdmission, (*Router).ServeHTTP, (*Router).match, prepareRewrite},
+	"proxy":   {(*ServerPool).ServeHTTP, (*Backend).ServeHTTP, (*ServerPool).newTarget},
+	"logging": {(*AccessLog).Middleware, (*Recorder).Middleware},
+}
+
+// allocStageFuncs is allocStageEntries by function name
+var allocStageFuncs = map[string]string{}
+
+func init() {
+	for stage, fns := range allocStageEntries {
+		for _, fn := range fns {
+			allocStageFuncs[runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()] = stage
+		}
+	}
+}
+
+// ownStage is the stage a function of this package runs in: that of the
+// entry it is or was returned by, middleware for any other handler, and ""
+// if it takes the stage of whatever called it
+func ownStage(fn string) string {
+	entry, _, _ := strings.Cut(fn, ".func")
+	if stage, ok := allocStageFuncs[strings.TrimSuffix(entry, "-fm")]; ok {
+		return stage
+	}
+	name := strings.TrimPrefix(fn, allocAudit.ownPrefix)
+	if strings.HasSuffix(name, ".ServeHTTP") || strings.Contains(name, ".Middleware.func") ||
+		strings.HasPrefix(name, "With") && strings.Contains(name, ".func") {
+		return "middleware"
+	}
+	return ""
+}
+
+// classify finds the stage and site of a stack, innermost frame first
+func classify(stack []uintptr) (stage string, site, alloc string) {
+	frames := runtime.CallersFrames(stack)
+	var leaf, root string
+	served := false
+	for {
+		f, more := frames.Next()
+		fn := f.Function
+		if leaf == "" && !strings.HasPrefix(fn, "runtime.") && !strings.HasPrefix(fn, "internal/") {
+			leaf = fn
+		}
+		if fn != "runtime.goexit" {
+			root = fn
+		}
+		own := strings.HasPrefix(fn, allocAudit.ownPrefix)
+		if site == "" && own {
+			site = strings.TrimPrefix(fn, allocAudit.ownPrefix) + " " + filepath.Base(f.File) + ":" + strconv.Itoa(f.Line)
+			if fn != leaf {
+				alloc = leaf
+			}
+		}
+		if stage == "" && own {
+			stage = ownStage(fn)
+		}
+		if stage == "" && (strings.HasPrefix(fn, "net/http/httputil.") || strings.HasPrefix(fn, "net/http.(*Transport)") ||
+			strings.HasPrefix(fn, "net/http.(*persistConn)") || strings.HasPrefix(fn, "net/http.(*http2Transport)") ||
+			strings.HasPrefix(fn, "net/http.(*http2ClientConn)")) {
+			stage, site = "proxy", fn
+			if fn != leaf {
+				alloc = leaf
+			}
+		}
+		if fn == "net/http.(*conn).serve" || strings.HasPrefix(fn, "net/http.(*http2serverConn)") {
+			served = true
+		}
+		if !more {
+			break
+		}
+	}
+	// the transport's own goroutines carry proxied requests and health
+	// checks alike
+	transport := strings.HasPrefix(root, "net/http.(*persistConn)") || strings.HasPrefix(root, "net/http.(*Transport)")
+	switch {
+	case !served && !transport:
+		stage = "background"
+	case stage == "":
+		stage = "server"
+	}
+	if site == "" {
+		site = leaf
+	}
+	return stage, site, alloc
+}
+
+// scale estimates what was allocated from what was sampled, as pprof does
+func scale(c allocCount, rate int) allocCount {
+	if c.objects <= 0 || c.bytes <= 0 || rate <= 1 {
+		return c
+	}
+	avg := float64(c.bytes) / float64(c.objects)
+	s := 1 / (1 - math.Exp(-avg/float64(rate)))
+	return allocCount{int64(float64(c.bytes) * s), int64(float64(c.objects) * s)}
+}
+
+func allocAuditReport(top int) (AllocAuditReport, bool) {
+	allocAudit.mux.Lock()
+	defer allocAudit.mux.Unlock()
+	if !allocAudit.running {
+		return AllocAuditReport{}, false
+	}
+	runtime.GC()
+	report := AllocAuditReport{
+		Since:      allocAudit.since,
+		SampleRate: allocAudit.rate,
+		Requests:   poolRequests() - allocAudit.requests,
+		Stages:     []AllocStageStats{},
+		Top:        []AllocSite{},
+	}
+	stages := map[string]allocCount{}
+	sites := map[string]*AllocSite{}
+	for _, rec := range memProfile() {
+		base := allocAudit.baseline[stackKey(rec.Stack())]
+		c := scale(allocCount{rec.AllocBytes - base.bytes, rec.AllocObjects - base.objects}, allocAudit.rate)
+		if c.bytes <= 0 {
+			continue
+		}
+		stage, site, alloc := classify(rec.Stack())
+		s := stages[stage]
+		stages[stage] = allocCount{s.bytes + c.bytes, s.objects + c.objects}
+		key := site + "\x00" + alloc
+		if sites[key] == nil {
+			sites[key] = &AllocSite{Site: site, Alloc: alloc, Stage: stage}
+		}
+		sites[key].Bytes += c.bytes
+		sites[key].Objects += c.objects
+	}
+	var requestPath int64
+	for stage, c := range stages {
+		if stage != "background" {
+			requestPath += c.bytes
+		}
+	}
+	for _, stage := range allocStages {
+		c := stages[stage]
+		st := AllocStageStats{Stage: stage, Bytes: c.bytes, Objects: c.objects}
+		if stage != "background" {
+			if report.Requests > 0 {
+				st.BytesPerRequest = float64(c.bytes) / float64(report.Requests)
+				st.ObjectsPerRequest = float64(c.objects) / float64(report.Requests)
+			}
+			if requestPath > 0 {
+				st.ShareOfRequestPath = float64(c.bytes) / float64(requestPath)
+			}
+		}
+		report.Stages = append(report.Stages, st)
+	}
+	for _, s := range sites {
+		report.Top = append(report.Top, *s)
+	}
+	sort.Slice(report.Top, func(i, j int) bool { return report.Top[i].Bytes > report.Top[j].Bytes })
+	if len(report.Top) > top {
+		report.Top = report.Top[:top]
+	}
+	return report, true
+}
+
+func getAllocAudit(w http.ResponseWriter, r *http.Request) {
+	top := 20
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "top must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	report, ok := allocAuditReport(top)
+	if !ok {
+		http.Error(w, "the allocation audit is off, start with -alloc-audit", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// starts a new window
+func postAllocAudit(w http.ResponseWriter, r *http.Request) {
+	since, ok := resetAllocAudit()
+	if !ok {
+		http.Error(w, "the allocation audit is off, start with -alloc-audit", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"since": since, "sample_rate": allocAudit.rate})
+}
@@ -0,0 +1,330 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"load-balancer/redis"
+)
+
+// APIKey lets a client through the balancer when it runs as an API gateway
+// (-api-keys). a key may be rate limited like a request class, and given a
+// quota of requests per fixed window
+type APIKey struct {
+	Name        string   `json:"name"`
+	Key         string   `json:"key"`
+	RateLimit   float64  `json:"rate_limit,omitempty"` // requests per second
+	Burst       int      `json:"burst,omitempty"`
+	Quota       int64    `json:"quota,omitempty"`        // requests per QuotaPeriod, 0 is unlimited
+	QuotaPeriod Duration `json:"quota_period,omitempty"` // defaults to 24h
+}
+
+func (k *APIKey) period() time.Duration {
+	if k.QuotaPeriod.Duration > 0 {
+		return k.QuotaPeriod.Duration
+	}
+	return 24 * time.Hour
+}
+
+// APIKeyStore finds keys and counts their quota. a shared store (redis)
+// keeps quotas whole across balancer instances
+type APIKeyStore interface {
+	// Lookup returns nil for an unknown key
+	Lookup(key string) (*APIKey, error)
+	// Spend counts a request against the key's quota window starting at
+	// window, returning the window's total so far
+	Spend(k *APIKey, window time.Time) (int64, error)
+}
+
+// NewAPIKeyStore reads a JSON file of keys, or uses redis for a redis:// url
+func NewAPIKeyStore(spec string) (APIKeyStore, error) {
+	if strings.HasPrefix(spec, "redis://") {
+		c, err := redis.NewClient(spec, 200*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		return &redisAPIKeyStore{c: c, cache: map[string]cachedAPIKey{}}, nil
+	}
+	return loadAPIKeyFile(spec)
+}
+
+// APIKeys is the gateway middleware's state: the store, a token bucket and
+// usage counters per key
+type APIKeys struct {
+	Header string
+	Store  APIKeyStore
+
+	mux      sync.Mutex
+	limiters map[string]*tokenBucket
+	usage    map[string]*apiKeyUsage
+}
+
+type apiKeyUsage struct {
+	requests    atomic.Uint64
+	rateLimited atomic.Uint64
+	overQuota   atomic.Uint64
+	quotaUsed   atomic.Int64 // in the current window, as last counted
+	quota       atomic.Int64
+}
+
+var apiKeys *APIKeys
+
+func NewAPIKeys(header string, store APIKeyStore) *APIKeys {
+	return &APIKeys{Header: header, Store: store, limiters: map[string]*tokenBucket{}, usage: map[string]*apiKeyUsage{}}
+}
+
+func (g *APIKeys) track(k *APIKey) (*apiKeyUsage, *tokenBucket) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	u, ok := g.usage[k.Name]
+	if !ok {
+		u = &apiKeyUsage{}
+		g.usage[k.Name] = u
+	}
+	u.quota.Store(k.Quota)
+	lim := g.limiters[k.Name]
+	if k.RateLimit > 0 && (lim == nil || lim.rate != k.RateLimit) {
+		lim = newTokenBucket(k.RateLimit, k.Burst)
+		g.limiters[k.Name] = lim
+	}
+	if k.RateLimit <= 0 {
+		lim = nil
+	}
+	return u, lim
+}
+
+// requestKey is the key from the configured header, or a bearer token
+func (g *APIKeys) requestKey(r *http.Request) string {
+	if key := r.Header.Get(g.Header); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// Middleware admits requests with a known key within its limits. the key
+// itself isn't passed on; backends get its name in X-Api-Key-Name
+func (g *APIKeys) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := g.requestKey(r)
+		if key == "" {
+			writeError(w, r, http.StatusUnauthorized, "missing_api_key", "An API key is required in "+g.Header+".", 0)
+			return
+		}
+		k, err := g.Store.Lookup(key)
+		if err != nil {
+			log.Println("API key lookup failed: ", err)
+			writeError(w, r, http.StatusServiceUnavailable, "api_key_store_unavailable", "Could not check the API key.", time.Second)
+			return
+		}
+		if k == nil {
+			writeError(w, r, http.StatusUnauthorized, "invalid_api_key", "Unknown API key.", 0)
+			return
+		}
+		if e := accessLogEntry(r); e != nil {
+			e.APIKey = k.Name
+		}
+
+		usage, limiter := g.track(k)
+		usage.requests.Add(1)
+		if limiter != nil {
+			if wait := limiter.take(); wait > 0 {
+				usage.rateLimited.Add(1)
+				writeError(w, r, http.StatusTooManyRequests, "rate_limited", "Too many requests for this API key.", wait)
+				return
+			}
+		}
+		if k.Quota > 0 {
+			now := time.Now()
+			window := now.Truncate(k.period())
+			used, err := g.Store.Spend(k, window)
+			if err != nil {
+				// an unreachable counter shouldn't take the API down with it
+				log.Println("API key quota update failed: ", err)
+			}
+			usage.quotaUsed.Store(used)
+			if used > k.Quota {
+				usage.overQuota.Add(1)
+				writeError(w, r, http.StatusTooManyRequests, "quota_exceeded",
+					fmt.Sprintf("Quota of %d requests per %s used up.", k.Quota, k.period()), window.Add(k.period()).Sub(now))
+				return
+			}
+		}
+
+		r.Header.Del(g.Header)
+		if r.Header.Get("Authorization") == "Bearer "+key {
+			r.Header.Del("Authorization")
+		}
+		r.Header.Set("X-Api-Key-Name", k.Name)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIKeyStats is one key's usage in GET /admin/api-keys
+type APIKeyStats struct {
+	Name        string `json:"name"`
+	Requests    uint64 `json:"requests"`
+	RateLimited uint64 `json:"rate_limited"`
+	OverQuota   uint64 `json:"over_quota"`
+	Quota       int64  `json:"quota,omitempty"`
+	QuotaUsed   int64  `json:"quota_used,omitempty"`
+}
+
+func (g *APIKeys) Stats() []APIKeyStats {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	stats := make([]APIKeyStats, 0, len(g.usage))
+	for name, u := range g.usage {
+		stats = append(stats, APIKeyStats{
+			Name:        name,
+			Requests:    u.requests.Load(),
+			RateLimited: u.rateLimited.Load(),
+			OverQuota:   u.overQuota.Load(),
+			Quota:       u.quota.Load(),
+			QuotaUsed:   u.quotaUsed.Load(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+func getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if apiKeys == nil {
+		writeJSON(w, http.StatusOK, []APIKeyStats{})
+		return
+	}
+	writeJSON(w, http.StatusOK, apiKeys.Stats())
+}
+
+// fileAPIKeyStore holds the keys of a JSON file, e.g.
+//
+//	[{"name": "mobile", "key": "k_3f9a...", "rate_limit": 20, "quota": 100000},
+//	 {"name": "partner", "key": "k_81c2...", "quota": 5000, "quota_period": "1h"}]
+//
+// quotas are counted per instance
+type fileAPIKeyStore struct {
+	keys map[string]*APIKey
+
+	mux     sync.Mutex
+	windows map[string]quotaWindow
+}
+
+type quotaWindow struct {
+	start time.Time
+	used  int64
+}
+
+func loadAPIKeyFile(file string) (*fileAPIKeyStore, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	s := &fileAPIKeyStore{keys: map[string]*APIKey{}, windows: map[string]quotaWindow{}}
+	names := map[string]bool{}
+	for _, k := range keys {
+		if k.Name == "" || k.Key == "" || names[k.Name] || s.keys[k.Key] != nil {
+			return nil, fmt.Errorf("%s: keys need a unique name and key", file)
+		}
+		names[k.Name] = true
+		s.keys[k.Key] = k
+	}
+	return s, nil
+}
+
+func (s *fileAPIKeyStore) Lookup(key string) (*APIKey, error) {
+	return s.keys[key], nil
+}
+
+func (s *fileAPIKeyStore) Spend(k *APIKey, window time.Time) (int64, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	w := s.windows[k.Name]
+	if !w.start.Equal(window) {
+		w = quotaWindow{start: window}
+	}
+	w.used++
+	s.windows[k.Name] = w
+	return w.used, nil
+}
+
+// redisAPIKeyStore reads keys stored as JSON under lb:apikey:<key>, e.g.
+//
+//	SET lb:apikey:k_3f9a... '{"name": "mobile", "rate_limit": 20, "quota": 100000}'
+//
+// and counts quotas in redis, shared by every instance. definitions are
+// cached briefly so a request costs one round trip for its quota at most
+type redisAPIKeyStore struct {
+	c *redis.Client
+
+	mux   sync.Mutex
+	cache map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	key     *APIKey
+	expires time.Time
+}
+
+const apiKeyCacheTTL = 10 * time.Second
+
+func (s *redisAPIKeyStore) Lookup(key string) (*APIKey, error) {
+	s.mux.Lock()
+	cached, ok := s.cache[key]
+	s.mux.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	var k *APIKey
+	raw, err := s.c.Get("lb:apikey:" + key)
+	switch {
+	case err == redis.ErrNil:
+	case err != nil:
+		return nil, err
+	default:
+		k = &APIKey{}
+		if err := json.Unmarshal([]byte(raw), k); err != nil {
+			return nil, fmt.Errorf("api key definition: %w", err)
+		}
+		k.Key = key
+	}
+	s.mux.Lock()
+	if len(s.cache) > 10000 {
+		clear(s.cache)
+	}
+	s.cache[key] = cachedAPIKey{key: k, expires: time.Now().Add(apiKeyCacheTTL)}
+	s.mux.Unlock()
+	return k, nil
+}
+
+func (s *redisAPIKeyStore) Spend(k *APIKey, window time.Time) (int64, error) {
+	counter := "lb:apikey-quota:" + k.Name + ":" + strconv.FormatInt(window.Unix(), 10)
+	reply, err := s.c.Do("INCR", counter)
+	if err != nil {
+		return 0, err
+	}
+	used, _ := reply.(int64)
+	if used == 1 {
+		// the counter outlives its window a little so late requests still find it
+		ttl := k.period() + time.Minute
+		if _, err := s.c.Do("PEXPIRE", counter, strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+			return used, err
+		}
+	}
+	return used, nil
+}
@@ -0,0 +1,492 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RouteAuth is what a route's requests must present before they reach its
+// pool, so public and internal routes can share a listener. every method in
+// Require must pass; "none" marks a route public on purpose. e.g. in -routes
+//
+//	{"path_prefix": "/internal/", "pool": "ops",
+//	 "auth": {"require": ["mtls", "jwt"],
+//	          "mtls": {"subjects": ["deploy-bot"]},
+//	          "jwt": {"key_file": "sso.pem", "issuer": "https://sso.example.com"}}}
+//	{"path_prefix": "/status/", "pool": "web",
+//	 "auth": {"require": ["basic"], "basic": {"users_file": "status.htpasswd"}}}
+//	{"path_prefix": "/api/", "pool": "api",
+//	 "auth": {"require": ["jwt"],
+//	          "jwt": {"jwks_url": "https://sso.example.com/.well-known/jwks.json",
+//	                  "issuer": "https://sso.example.com",
+//	                  "claim_headers": {"email": "X-Auth-Email", "groups": "X-Auth-Groups"}}}}
+//	{"path_prefix": "/hooks/", "pool": "hooks",
+//	 "auth": {"require": ["api_key"], "api_key": {"keys_file": "hook-keys.json"}}}
+//
+// a catch-all route (path_prefix "/") with auth protects whatever no other
+// route matches. backends get the caller in X-Auth-User, from the basic
+// user, the token's sub, the API key's name or the certificate's common name
+// in that order, and the passed methods in X-Auth-Method; whatever the
+// client sent in those is dropped. basic credentials and API keys are not
+// passed on, bearer tokens are
+type RouteAuth struct {
+	Require []string    `json:"require" yaml:"require"`
+	Basic   *BasicAuth  `json:"basic,omitempty" yaml:"basic"`
+	JWT     *JWTAuth    `json:"jwt,omitempty" yaml:"jwt"`
+	APIKey  *APIKeyAuth `json:"api_key,omitempty" yaml:"api_key"`
+	MTLS    *MTLSAuth   `json:"mtls,omitempty" yaml:"mtls"`
+
+	refused [4]atomic.Uint64 // by method, as in authMethods
+}
+
+var authMethods = []string{"basic", "jwt", "api_key", "mtls"}
+
+// BasicAuth checks user:password against a file of user:bcrypt-hash lines,
+// as htpasswd -B writes them
+type BasicAuth struct {
+	UsersFile string `json:"users_file" yaml:"users_file"`
+	Realm     string `json:"realm,omitempty" yaml:"realm"`
+
+	users   map[string][]byte
+	unknown []byte // hash checked for unknown users
+}
+
+// JWTAuth checks a bearer token signed with HS256 by the key in SecretFile,
+// with RS256 or ES256 by the public key in KeyFile, or by the key its kid
+// names in the identity provider's JWKS document at JWKSURL. exp and nbf are
+// checked, with a minute's leeway, and iss and aud when set. ClaimHeaders
+// passes claims on to the backend, claim name to header name; strings go as
+// they are, lists joined with commas and anything else as JSON
+type JWTAuth struct {
+	SecretFile   string            `json:"secret_file,omitempty" yaml:"secret_file"`
+	KeyFile      string            `json:"key_file,omitempty" yaml:"key_file"`
+	JWKSURL      string            `json:"jwks_url,omitempty" yaml:"jwks_url"`
+	Issuer       string            `json:"issuer,omitempty" yaml:"issuer"`
+	Audience     string            `json:"audience,omitempty" yaml:"audience"`
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty" yaml:"claim_headers"`
+
+	alg  string
+	key  any // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+	jwks *jwks
+}
+
+// APIKeyAuth wants one of the keys in KeysFile, in the -api-keys file format,
+// in Header (X-API-Key by default). the rate limits and quotas there only
+// apply to -api-keys
+type APIKeyAuth struct {
+	KeysFile string `json:"keys_file" yaml:"keys_file"`
+	Header   string `json:"header,omitempty" yaml:"header"`
+
+	keys *fileAPIKeyStore
+}
+
+// MTLSAuth wants a client certificate -tls-client-ca verified, from one of
+// Subjects (common names) if set
+type MTLSAuth struct {
+	Subjects []string `json:"subjects,omitempty" yaml:"subjects"`
+}
+
+// clock skew allowed on exp and nbf
+const jwtLeeway = time.Minute
+
+func (a *RouteAuth) init(route string) error {
+	if len(a.Require) == 0 {
+		return fmt.Errorf("route %s: auth.require needs none, or some of basic, jwt, api_key and mtls", route)
+	}
+	if slices.Contains(a.Require, "basic") && slices.Contains(a.Require, "jwt") {
+		return fmt.Errorf("route %s: auth.require can't have both basic and jwt, which share the Authorization header", route)
+	}
+	for _, m := range a.Require {
+		switch m {
+		case "none":
+			if len(a.Require) > 1 {
+				return fmt.Errorf("route %s: auth.require can't have none with other methods", route)
+			}
+		case "basic":
+			if a.Basic == nil {
+				return fmt.Errorf("route %s: auth.require has basic but there is no auth.basic", route)
+			}
+			if err := a.Basic.load(); err != nil {
+				return fmt.Errorf("route %s: auth.basic: %w", route, err)
+			}
+		case "jwt":
+			if a.JWT == nil {
+				return fmt.Errorf("route %s: auth.require has jwt but there is no auth.jwt", route)
+			}
+			if err := a.JWT.load(); err != nil {
+				return fmt.Errorf("route %s: auth.jwt: %w", route, err)
+			}
+		case "api_key":
+			if a.APIKey == nil {
+				return fmt.Errorf("route %s: auth.require has api_key but there is no auth.api_key", route)
+			}
+			if err := a.APIKey.load(); err != nil {
+				return fmt.Errorf("route %s: auth.api_key: %w", route, err)
+			}
+		case "mtls":
+			if a.MTLS == nil {
+				a.MTLS = &MTLSAuth{}
+			}
+		default:
+			return fmt.Errorf("route %s: unknown auth method %q (use none, basic, jwt, api_key or mtls)", route, m)
+		}
+	}
+	return nil
+}
+
+func (b *BasicAuth) load() error {
+	f, err := os.Open(b.UsersFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b.users = map[string][]byte{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("%s:%d: expected user:bcrypt-hash", b.UsersFile, n)
+		}
+		b.users[user] = []byte(hash)
+	}
+	if b.Realm == "" {
+		b.Realm = "restricted"
+	}
+	b.unknown, _ = bcrypt.GenerateFromPassword([]byte("unknown"), bcrypt.DefaultCost)
+	return sc.Err()
+}
+
+func (j *JWTAuth) load() error {
+	for claim, header := range j.ClaimHeaders {
+		if claim == "" || header == "" || strings.ContainsAny(header, " :") {
+			return fmt.Errorf("claim_headers: bad entry %q: %q, expected a claim name and a header name", claim, header)
+		}
+	}
+	set := 0
+	for _, source := range []string{j.SecretFile, j.KeyFile, j.JWKSURL} {
+		if source != "" {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		return errors.New("needs one of secret_file, key_file and jwks_url")
+	case j.JWKSURL != "":
+		u, err := url.Parse(j.JWKSURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("jwks_url %q: expected an http(s) url", j.JWKSURL)
+		}
+		j.jwks = &jwks{url: j.JWKSURL}
+		if err := j.jwks.refresh(); err != nil {
+			// keys are fetched again when a token needs them
+			log.Printf("Could not fetch JWKS from %s yet: %v\n", j.JWKSURL, err)
+		}
+		return nil
+	case j.SecretFile != "":
+		secret, err := os.ReadFile(j.SecretFile)
+		if err != nil {
+			return err
+		}
+		j.alg, j.key = "HS256", bytes.TrimSpace(secret)
+		return nil
+	}
+	data, err := os.ReadFile(j.KeyFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM block", j.KeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", j.KeyFile, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		j.alg = "RS256"
+	case *ecdsa.PublicKey:
+		j.alg = "ES256"
+	default:
+		return fmt.Errorf("%s: expected an RSA or ECDSA public key", j.KeyFile)
+	}
+	j.key = key
+	return nil
+}
+
+func (k *APIKeyAuth) load() error {
+	if k.KeysFile == "" {
+		return errors.New("needs keys_file")
+	}
+	if k.Header == "" {
+		k.Header = "X-API-Key"
+	}
+	keys, err := loadAPIKeyFile(k.KeysFile)
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	return nil
+}
+
+// check returns the user the request authenticates as, or why it doesn't
+// in words for the client
+func (b *BasicAuth) check(r *http.Request) (user, refusal string) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", "Basic credentials are required."
+	}
+	hash, known := b.users[user]
+	if !known {
+		// spend the same time as for a wrong password
+		hash = b.unknown
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !known {
+		return "", "Wrong user name or password."
+	}
+	return user, ""
+}
+
+// check returns the token's subject and claims, or why the token won't do
+func (j *JWTAuth) check(r *http.Request) (sub string, all map[string]json.RawMessage, refusal string) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", nil, "A bearer token is required."
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return "", nil, "Malformed token."
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims struct {
+		Sub string          `json:"sub"`
+		Iss string          `json:"iss"`
+		Aud json.RawMessage `json:"aud"`
+		Exp *float64        `json:"exp"`
+		Nbf *float64        `json:"nbf"`
+	}
+	if decodeJWTPart(parts[0], &header) != nil || decodeJWTPart(parts[1], &claims) != nil || decodeJWTPart(parts[1], &all) != nil {
+		return "", nil, "Malformed token."
+	}
+	alg, key := j.alg, j.key
+	if j.jwks != nil {
+		k, ok := j.jwks.lookup(header.Kid)
+		if !ok {
+			return "", nil, "The token is signed by an unknown key."
+		}
+		alg, key = k.alg, k.key
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	// the key decides the algorithm, whatever the token says
+	if err != nil || header.Alg != alg || !verifyJWT(key, parts[0]+"."+parts[1], sig) {
+		return "", nil, "Invalid token signature."
+	}
+	now := time.Now()
+	if claims.Exp != nil && now.After(time.Unix(int64(*claims.Exp), 0).Add(jwtLeeway)) {
+		return "", nil, "The token has expired."
+	}
+	if claims.Nbf != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return "", nil, "The token is not valid yet."
+	}
+	if j.Issuer != "" && claims.Iss != j.Issuer {
+		return "", nil, "The token is from another issuer."
+	}
+	if j.Audience != "" {
+		var auds []string
+		if json.Unmarshal(claims.Aud, &auds) != nil {
+			var aud string
+			_ = json.Unmarshal(claims.Aud, &aud)
+			auds = []string{aud}
+		}
+		if !slices.Contains(auds, j.Audience) {
+			return "", nil, "The token is for another audience."
+		}
+	}
+	return claims.Sub, all, ""
+}
+
+// claimHeader is how a claim is passed on in a header
+func claimHeader(v json.RawMessage) string {
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return s
+	}
+	var list []any
+	if json.Unmarshal(v, &list) == nil {
+		items := make([]string, len(list))
+		for i, item := range list {
+			if s, ok := item.(string); ok {
+				items[i] = s
+			} else {
+				b, _ := json.Marshal(item)
+				items[i] = string(b)
+			}
+		}
+		return strings.Join(items, ",")
+	}
+	var buf bytes.Buffer
+	if json.Compact(&buf, v) != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// check returns the name of the key the request carries, or why there is
+// none that will do
+func (k *APIKeyAuth) check(r *http.Request) (name, refusal string) {
+	key := r.Header.Get(k.Header)
+	if key == "" {
+		return "", "An API key is required in " + k.Header + "."
+	}
+	found, _ := k.keys.Lookup(key)
+	if found == nil {
+		return "", "Unknown API key."
+	}
+	return found.Name, ""
+}
+
+func decodeJWTPart(s string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWT(key any, signed string, sig []byte) bool {
+	sum := sha256.Sum256([]byte(signed))
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// r and s, 32 bytes each
+		if len(sig) != 64 {
+			return false
+		}
+		return ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	return false
+}
+
+func (j *JWTAuth) claimHeaders() map[string]string {
+	if j == nil {
+		return nil
+	}
+	return j.ClaimHeaders
+}
+
+// check returns the certificate's common name, or why there is none that
+// will do. with VerifyClientCertIfGiven only verified certificates get here
+func (m *MTLSAuth) check(r *http.Request) (cn, refusal string) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", "A client certificate is required."
+	}
+	cn = r.TLS.PeerCertificates[0].Subject.CommonName
+	if len(m.Subjects) > 0 && !slices.Contains(m.Subjects, cn) {
+		return "", "This client certificate is not allowed here."
+	}
+	return cn, ""
+}
+
+// allow checks r against every required method, answering 401 for the first
+// that fails, and tells the backend who the caller is
+func (a *RouteAuth) allow(w http.ResponseWriter, r *http.Request) bool {
+	r.Header.Del("X-Auth-User")
+	r.Header.Del("X-Auth-Method")
+	if a.JWT != nil {
+		for _, header := range a.JWT.ClaimHeaders {
+			r.Header.Del(header)
+		}
+	}
+	if a.Require[0] == "none" {
+		return true
+	}
+	var users [4]string
+	var claims map[string]json.RawMessage
+	for _, m := range a.Require {
+		i := slices.Index(authMethods, m)
+		var refusal string
+		switch m {
+		case "basic":
+			if users[i], refusal = a.Basic.check(r); refusal != "" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.Basic.Realm))
+			}
+		case "jwt":
+			if users[i], claims, refusal = a.JWT.check(r); refusal != "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+		case "api_key":
+			users[i], refusal = a.APIKey.check(r)
+		case "mtls":
+			users[i], refusal = a.MTLS.check(r)
+		}
+		if refusal != "" {
+			a.refused[i].Add(1)
+			writeError(w, r, http.StatusUnauthorized, "unauthorized", refusal, 0)
+			return false
+		}
+	}
+	if slices.Contains(a.Require, "basic") {
+		r.Header.Del("Authorization")
+	}
+	if slices.Contains(a.Require, "api_key") {
+		r.Header.Del(a.APIKey.Header)
+	}
+	for claim, header := range a.JWT.claimHeaders() {
+		if v, ok := claims[claim]; ok {
+			r.Header.Set(header, claimHeader(v))
+		}
+	}
+	for _, u := range users {
+		if u != "" {
+			r.Header.Set("X-Auth-User", u)
+			break
+		}
+	}
+	r.Header.Set("X-Auth-Method", strings.Join(a.Require, ","))
+	return true
+}
+
+// Refused is the requests turned away, by the method that failed
+func (a *RouteAuth) Refused() map[string]uint64 {
+	refused := map[string]uint64{}
+	for i, m := range authMethods {
+		if slices.Contains(a.Require, m) {
+			refused[m] = a.refused[i].Load()
+		}
+	}
+	return refused
+}
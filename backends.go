@@ -0,0 +1,234 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SetMaintenance takes a backend out of rotation, or puts it back, whatever
+// its health checks say
+func (b *Backend) SetMaintenance(on bool) {
+	b.maintenance.Store(on)
+}
+
+func (b *Backend) InMaintenance() bool {
+	return b.maintenance.Load()
+}
+
+// BackendStatus is a backend as the admin API shows it
+type BackendStatus struct {
+	Pool        string            `json:"pool"`
+	Name        string            `json:"name"`
+	URL         string            `json:"url"`
+	Alive       bool              `json:"alive"`
+	Maintenance bool              `json:"maintenance"`
+	Drain       string            `json:"drain,omitempty"` // draining or drained, see StartDrain
+	Ejected     bool              `json:"ejected"`
+	Weight      int               `json:"weight"`
+	Signal      string            `json:"signal,omitempty"` // draining, degraded or backing-off, as the backend reports
+	Rack        string            `json:"rack,omitempty"`
+	Host        string            `json:"host"`
+	InFlight    int64             `json:"in_flight"`
+	MaxConns    int               `json:"max_conns,omitempty"`
+	H2C         bool              `json:"h2c,omitempty"`
+	Canary      bool              `json:"canary,omitempty"`
+	Cost        float64           `json:"cost,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	SigV4       string            `json:"sigv4,omitempty"`
+	Discovery   string            `json:"discovery,omitempty"`  // the discovery url it was found through
+	Pinned      bool              `json:"pinned,omitempty"`     // kept though discovery may lose it
+	Version     string            `json:"version,omitempty"`    // see -version-header
+	Share       float64           `json:"share"`                // of its weight, below 1 while ramping up or cut for errors
+	ErrorRate   float64           `json:"error_rate,omitempty"` // smoothed, with -weight-decay
+	Requests    uint64            `json:"requests"`
+	Failures    uint64            `json:"failures"`
+	Errors      map[string]uint64 `json:"upstream_errors,omitempty"` // failures by cause
+	ProbeRTT    float64           `json:"probe_rtt_ms"`
+}
+
+func backendStatus(pool string, b *Backend) BackendStatus {
+	requests, failures := b.Counts()
+	return BackendStatus{
+		Pool:        pool,
+		Name:        b.Name(),
+		URL:         b.URL().String(),
+		Alive:       b.isUp(),
+		Maintenance: b.InMaintenance(),
+		Drain:       b.drainState(),
+		Ejected:     b.Ejected(),
+		Weight:      b.Weight,
+		Signal:      b.Signal(),
+		Rack:        b.Rack,
+		Host:        b.Host,
+		InFlight:    b.InFlight(),
+		MaxConns:    b.MaxConns,
+		H2C:         b.H2C,
+		Canary:      b.Canary,
+		Cost:        b.Cost,
+		Tags:        b.Tags,
+		SigV4:       b.SigV4,
+		Discovery:   b.discoveredFrom(),
+		Pinned:      b.Pinned(),
+		Version:     b.Version(),
+		Share:       b.rampShare() * b.decayShare(),
+		ErrorRate:   b.ErrorRate(),
+		Requests:    requests,
+		Failures:    failures,
+		Errors:      b.UpstreamErrors(),
+		ProbeRTT:    float64(b.ProbeRTT()) / float64(time.Millisecond),
+	}
+}
+
+// lists every pool's backends, or one pool's with ?pool=, or those a tag
+// ?selector= picks
+func getBackends(w http.ResponseWriter, r *http.Request) {
+	var sel Selector
+	if s := r.URL.Query().Get("selector"); s != "" {
+		var err error
+		if sel, err = ParseSelector(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	list := []BackendStatus{}
+	for _, p := range pools {
+		if name := r.URL.Query().Get("pool"); name != "" && name != p.Name {
+			continue
+		}
+		for _, b := range p.Backends() {
+			if sel.Matches(b) {
+				list = append(list, backendStatus(p.Name, b))
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// adds a backend, e.g. {"url": "http://10.0.0.9:8080", "weight": 2}. changes
+// made here last until the next config reload
+func postBackend(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pool string `json:"pool"`
+		BackendConfig
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pool := findPool(req.Pool)
+	if pool == nil {
+		http.Error(w, fmt.Sprintf("unknown pool %q", req.Pool), http.StatusNotFound)
+		return
+	}
+	u, err := parseBackendURL(req.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pool.FindBackend(u.Host) != nil {
+		http.Error(w, fmt.Sprintf("backend %q already in pool %s", u.Host, pool.Name), http.StatusConflict)
+		return
+	}
+
+	b, err := pool.backendFromConfig(req.BackendConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := pool.checkVersion(b); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	pool.AddBackend(b)
+	log.Printf("[%s] Added backend %s through the admin API\n", pool.Name, b.URL())
+	writeJSON(w, http.StatusCreated, backendStatus(pool.Name, b))
+}
+
+// adminBackend resolves the {name} backend of the ?pool= pool
+func adminBackend(w http.ResponseWriter, r *http.Request) (*ServerPool, *Backend, bool) {
+	pool := findPool(r.URL.Query().Get("pool"))
+	if pool == nil {
+		http.Error(w, fmt.Sprintf("unknown pool %q", r.URL.Query().Get("pool")), http.StatusNotFound)
+		return nil, nil, false
+	}
+	b := pool.FindBackend(r.PathValue("name"))
+	if b == nil {
+		http.Error(w, fmt.Sprintf("unknown backend %q", r.PathValue("name")), http.StatusNotFound)
+		return nil, nil, false
+	}
+	return pool, b, true
+}
+
+func deleteBackend(w http.ResponseWriter, r *http.Request) {
+	pool, b, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	if !pool.RemoveBackend(b) {
+		http.Error(w, fmt.Sprintf("backend %q already removed", b.Name()), http.StatusNotFound)
+		return
+	}
+	log.Printf("[%s] Removed backend %s through the admin API, draining\n", pool.Name, b.URL())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replaces a backend with a freshly configured one in the same place in the
+// rotation, e.g. {"url": "http://10.0.0.5:8080", "weight": 4}. the old one
+// drains
+func putBackend(w http.ResponseWriter, r *http.Request) {
+	pool, old, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	var bc BackendConfig
+	if err := json.NewDecoder(r.Body).Decode(&bc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := parseBackendURL(bc.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if other := pool.FindBackend(u.Host); other != nil && other != old {
+		http.Error(w, fmt.Sprintf("backend %q already in pool %s", u.Host, pool.Name), http.StatusConflict)
+		return
+	}
+
+	b := pool.NewBackend(u)
+	if err := bc.BackendOptions.apply(b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := pool.checkVersion(b); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if !pool.ReplaceBackend(old, b) {
+		http.Error(w, fmt.Sprintf("backend %q already removed", old.Name()), http.StatusNotFound)
+		return
+	}
+	log.Printf("[%s] Replaced backend %s with %s through the admin API\n", pool.Name, old.URL(), b.URL())
+	writeJSON(w, http.StatusOK, backendStatus(pool.Name, b))
+}
+
+// marks a backend down for maintenance, or back up: {"maintenance": true}
+func putMaintenance(w http.ResponseWriter, r *http.Request) {
+	pool, b, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Maintenance bool `json:"maintenance"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.SetMaintenance(req.Maintenance)
+	log.Printf("[%s] Backend %s maintenance: %t\n", pool.Name, b.Name(), req.Maintenance)
+	writeJSON(w, http.StatusOK, backendStatus(pool.Name, b))
+}
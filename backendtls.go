@@ -0,0 +1,156 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+)
+
+// BackendTLS configures how the balancer connects to an https:// backend:
+// a CA bundle to verify it against instead of the system roots, a client
+// certificate for mTLS, the ALPN protocols to offer and as a last resort
+// skipping verification. unset fields fall back to -backend-ca,
+// -backend-cert, -backend-key and -backend-insecure. offering ALPN
+// protocols without h2 keeps the backend on HTTP/1.1
+type BackendTLS struct {
+	CA         string   `json:"ca,omitempty" yaml:"ca"`
+	Cert       string   `json:"cert,omitempty" yaml:"cert"`
+	Key        string   `json:"key,omitempty" yaml:"key"`
+	ServerName string   `json:"server_name,omitempty" yaml:"server_name"` // defaults to the url's hostname
+	ALPN       []string `json:"alpn,omitempty" yaml:"alpn"`               // e.g. [h2, http/1.1]
+	Insecure   bool     `json:"insecure,omitempty" yaml:"insecure"`
+}
+
+func (t BackendTLS) equal(o BackendTLS) bool {
+	return t.CA == o.CA && t.Cert == o.Cert && t.Key == o.Key && t.ServerName == o.ServerName &&
+		slices.Equal(t.ALPN, o.ALPN) && t.Insecure == o.Insecure
+}
+
+var backendTLSDefaults BackendTLS
+
+// withDefaults fills the unset fields from the flags
+func (t BackendTLS) withDefaults() BackendTLS {
+	d := backendTLSDefaults
+	if t.CA == "" {
+		t.CA = d.CA
+	}
+	if t.Cert == "" && t.Key == "" {
+		t.Cert, t.Key = d.Cert, d.Key
+	}
+	t.Insecure = t.Insecure || d.Insecure
+	return t
+}
+
+// clientConfig loads the files, or returns nil when the transport's default
+// suits
+func (t BackendTLS) clientConfig() (*tls.Config, error) {
+	if t.equal(BackendTLS{}) {
+		return nil, nil
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return nil, fmt.Errorf("backend TLS needs both a client cert and key")
+	}
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		NextProtos:         t.ALPN,
+		InsecureSkipVerify: t.Insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("backend CA: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("backend CA %s: no certificates found", t.CA)
+		}
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("backend client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// setTLS configures the backend's connections, including those of targets
+// it is later swapped to
+func (b *Backend) setTLS(t BackendTLS) error {
+	t = t.withDefaults()
+	cfg, err := t.clientConfig()
+	if err != nil {
+		return fmt.Errorf("backend %s: %w", b.Name(), err)
+	}
+	b.tls, b.tlsConfig = t, cfg
+	b.configureTransport(b.target.Load().transport.h1)
+	return nil
+}
+
+// configureTransport applies the backend's TLS settings and response
+// timeout to a transport
+func (b *Backend) configureTransport(t *http.Transport) {
+	t.ResponseHeaderTimeout = b.responseTimeout()
+	t.TLSClientConfig = b.tlsConfig
+	t.TLSNextProto = nil
+	if len(b.tls.ALPN) > 0 && !slices.Contains(b.tls.ALPN, "h2") {
+		// a non-nil empty map is how a transport is kept off HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+}
+
+// probeTLSConfig is what health probes of an https backend verify with
+func (b *Backend) probeTLSConfig() *tls.Config {
+	cfg := &tls.Config{}
+	if b.tlsConfig != nil {
+		cfg = b.tlsConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = b.URL().Hostname()
+	}
+	return cfg
+}
+
+// probeTLS completes a handshake on a health probe connection
+func (b *Backend) probeTLS(ctx context.Context, conn net.Conn) error {
+	tc := tls.Client(conn, b.probeTLSConfig())
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// healthClientFor is the probe client for b: the shared one unless b speaks
+// h2c or has its own TLS settings
+func healthClientFor(b *Backend) *http.Client {
+	if b.H2C && b.URL().Scheme == "http" {
+		return h2cHealthClient
+	}
+	if b.tlsConfig == nil {
+		return healthClient
+	}
+	return &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext:       healthDial,
+		TLSClientConfig:   b.tlsConfig,
+	}}
+}
+
+// hostPort is the url's host with the scheme's default port filled in
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -0,0 +1,89 @@
+package loadbalancer
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// with -backend-backpressure a 429 or 503 carrying Retry-After is taken as
+// a backend asking for less traffic rather than failing: until the time it
+// gave (at most backpressureMax away) its share is cut as for a degraded
+// backend, and the response doesn't count towards outlier ejection. once
+// every live backend of a pool is backing off, requests are answered 503
+// with a Retry-After of the soonest recovery instead of adding to the load
+var (
+	backendBackpressure bool
+	backpressureMax     = time.Minute
+)
+
+var backpressureShed atomic.Uint64
+
+// parseRetryAfter reads delay-seconds or an HTTP date
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// observeBackpressure starts b's backoff if res asks for one and reports
+// whether it did
+func (b *Backend) observeBackpressure(res *http.Response) bool {
+	if !backendBackpressure || (res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable) {
+		return false
+	}
+	wait, ok := parseRetryAfter(res.Header.Get("Retry-After"))
+	if !ok {
+		return false
+	}
+	wait = min(wait, backpressureMax)
+	until := time.Now().Add(wait).UnixNano()
+	if old := b.backoffUntil.Load(); until > old {
+		b.backoffUntil.Store(until)
+		if old < time.Now().UnixNano() {
+			log.Printf("Backend %s: backing off for %s (%d with Retry-After)\n", b.Name(), wait, res.StatusCode)
+		}
+	}
+	return true
+}
+
+// BackingOff reports whether b asked for less traffic recently
+func (b *Backend) BackingOff() bool {
+	return time.Now().UnixNano() < b.backoffUntil.Load()
+}
+
+// backpressure is how long until a backend of the pool is taking full
+// traffic again, or 0 when one already is
+func (s *ServerPool) backpressure() time.Duration {
+	if !backendBackpressure {
+		return 0
+	}
+	var soonest int64
+	for _, b := range s.Backends() {
+		if !b.IsAlive() {
+			continue
+		}
+		until := b.backoffUntil.Load()
+		if until <= time.Now().UnixNano() {
+			return 0
+		}
+		if soonest == 0 || until < soonest {
+			soonest = until
+		}
+	}
+	if soonest == 0 {
+		return 0
+	}
+	return time.Until(time.Unix(0, soonest))
+}
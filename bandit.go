@@ -0,0 +1,156 @@
+package loadbalancer
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Bandit is an experimental strategy that treats the choice of backend as a
+// multi-armed bandit. each backend learns a moving average of its latency and
+// of its error rate, and is worth its success rate times how close it comes
+// to the fastest backend's latency, 1 at best. picks are drawn with softmax
+// weights over that worth, so a clearly better backend takes most of the
+// traffic, and a share of banditExplore is spread evenly so every backend
+// keeps being measured and a recovered one wins its traffic back. backends
+// not measured yet are worth 1, so new ones are tried at once. the weights
+// can be seen at GET /admin/bandit
+type Bandit struct {
+	rng *lockedRand
+}
+
+const (
+	// how quickly the averages follow new observations
+	banditAlpha = 0.1
+	// softmax temperature: a backend worth 0.1 less gets e times less traffic
+	banditTemperature = 0.1
+	// share of picks spread evenly over the live backends
+	banditExplore = 0.05
+)
+
+// banditArm is what a backend has learned for the bandit
+type banditArm struct {
+	mux      sync.Mutex
+	latency  float64 // seconds, moving average
+	errRate  float64 // moving average of failures, 0 to 1
+	measured bool    // latency has an observation
+	results  uint64
+}
+
+func (a *banditArm) observeLatency(d time.Duration) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if !a.measured {
+		a.latency, a.measured = d.Seconds(), true
+		return
+	}
+	a.latency += banditAlpha * (d.Seconds() - a.latency)
+}
+
+func (a *banditArm) observeResult(failed bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	x := 0.0
+	if failed {
+		x = 1
+	}
+	a.errRate += banditAlpha * (x - a.errRate)
+	a.results++
+}
+
+func (a *banditArm) snapshot() banditArm {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return banditArm{latency: a.latency, errRate: a.errRate, measured: a.measured, results: a.results}
+}
+
+// BanditWeight is what the bandit has learned of one backend
+type BanditWeight struct {
+	Backend   string  `json:"backend"`
+	Alive     bool    `json:"alive"`
+	LatencyMs float64 `json:"latency_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	Results   uint64  `json:"results"`
+	Value     float64 `json:"value"`  // worth, 0 to 1
+	Weight    float64 `json:"weight"` // share of picks, 0 for dead backends
+}
+
+// weigh computes the worth and share of picks of the live backends
+func (st *Bandit) weigh(s *ServerPool) ([]*Backend, []BanditWeight) {
+	backends := s.Backends()
+	weights := make([]BanditWeight, len(backends))
+	arms := make([]banditArm, len(backends))
+	fastest := math.Inf(1)
+	for i, b := range backends {
+		arms[i] = b.bandit.snapshot()
+		weights[i] = BanditWeight{
+			Backend:   b.Name(),
+			Alive:     b.IsAlive(),
+			LatencyMs: arms[i].latency * 1000,
+			ErrorRate: arms[i].errRate,
+			Results:   arms[i].results,
+		}
+		if weights[i].Alive && arms[i].measured && arms[i].latency < fastest {
+			fastest = arms[i].latency
+		}
+	}
+
+	alive := 0
+	var total float64
+	for i := range weights {
+		if !weights[i].Alive {
+			continue
+		}
+		alive++
+		value := 1 - arms[i].errRate
+		if arms[i].measured && arms[i].latency > 0 {
+			value *= math.Min(fastest/arms[i].latency, 1)
+		}
+		weights[i].Value = value
+		// relative to the best possible worth of 1, so exp can't overflow
+		weights[i].Weight = math.Exp((value - 1) / banditTemperature)
+		total += weights[i].Weight
+	}
+	for i := range weights {
+		if weights[i].Alive {
+			weights[i].Weight = (1-banditExplore)*weights[i].Weight/total + banditExplore/float64(alive)
+		}
+	}
+	return backends, weights
+}
+
+func (st *Bandit) Next(s *ServerPool) *Backend {
+	backends, weights := st.weigh(s)
+	var last *Backend
+	n := st.rng.Float64()
+	for i, b := range backends {
+		if !weights[i].Alive {
+			continue
+		}
+		last = b
+		if n -= weights[i].Weight; n < 0 {
+			return b
+		}
+	}
+	return last // rounding, or nil with none alive
+}
+
+// BanditStatus is a bandit pool's learned weights
+type BanditStatus struct {
+	Pool     string         `json:"pool"`
+	Backends []BanditWeight `json:"backends"`
+}
+
+func getBandit(w http.ResponseWriter, r *http.Request) {
+	list := []BanditStatus{}
+	for _, p := range pools {
+		st, ok := p.Strategy.(*Bandit)
+		if !ok {
+			continue
+		}
+		_, weights := st.weigh(p)
+		list = append(list, BanditStatus{Pool: p.Name, Backends: weights})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,242 @@
+package loadbalancer
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SLO is one assertion checked at the end of a bench run, e.g. p99<50ms
+type SLO struct {
+	Metric string
+	Op     string
+	Value  float64 // seconds for latencies, a fraction for errors, per second for rps
+	raw    string
+}
+
+// ParseSLOs parses a comma separated list such as "p99<50ms,errors<0.1%,rps>=500"
+func ParseSLOs(spec string) ([]SLO, error) {
+	var slos []SLO
+	for _, tok := range strings.Split(spec, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+
+		i := strings.IndexAny(tok, "<>")
+		if i <= 0 {
+			return nil, fmt.Errorf("slo %q: expected <metric><op><value>", tok)
+		}
+		slo := SLO{Metric: tok[:i], Op: tok[i : i+1], raw: tok}
+		rest := tok[i+1:]
+		if strings.HasPrefix(rest, "=") {
+			slo.Op += "="
+			rest = rest[1:]
+		}
+
+		var err error
+		switch {
+		case slo.Metric == "errors":
+			pct := strings.HasSuffix(rest, "%")
+			slo.Value, err = strconv.ParseFloat(strings.TrimSuffix(rest, "%"), 64)
+			if pct {
+				slo.Value /= 100
+			}
+		case slo.Metric == "rps":
+			slo.Value, err = strconv.ParseFloat(rest, 64)
+		case slo.Metric == "mean" || slo.Metric == "max" || strings.HasPrefix(slo.Metric, "p"):
+			if slo.Metric[0] == 'p' {
+				if _, err := latencyPercentile(slo.Metric); err != nil {
+					return nil, fmt.Errorf("slo %q: %w", tok, err)
+				}
+			}
+			var d time.Duration
+			d, err = time.ParseDuration(rest)
+			slo.Value = d.Seconds()
+		default:
+			return nil, fmt.Errorf("slo %q: unknown metric %q", tok, slo.Metric)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("slo %q: %w", tok, err)
+		}
+		slos = append(slos, slo)
+	}
+	return slos, nil
+}
+
+func latencyPercentile(metric string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimPrefix(metric, "p"), 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("invalid percentile %q", metric)
+	}
+	return p, nil
+}
+
+func (s SLO) holds(actual float64) bool {
+	switch s.Op {
+	case "<":
+		return actual < s.Value
+	case "<=":
+		return actual <= s.Value
+	case ">":
+		return actual > s.Value
+	default:
+		return actual >= s.Value
+	}
+}
+
+type benchResult struct {
+	latencies []time.Duration // sorted
+	errors    int64
+	elapsed   time.Duration
+}
+
+func (br benchResult) measure(metric string) float64 {
+	total := float64(len(br.latencies)) + float64(br.errors)
+	switch metric {
+	case "errors":
+		if total == 0 {
+			return 0
+		}
+		return float64(br.errors) / total
+	case "rps":
+		return total / br.elapsed.Seconds()
+	case "mean":
+		var sum time.Duration
+		for _, l := range br.latencies {
+			sum += l
+		}
+		return (sum / time.Duration(max(len(br.latencies), 1))).Seconds()
+	case "max":
+		return percentile(br.latencies, 100).Seconds()
+	}
+	p, _ := latencyPercentile(metric)
+	return percentile(br.latencies, p).Seconds()
+}
+
+// runBench implements `loadbalancer bench`: a closed-loop load generator that
+// prints a latency histogram and optionally enforces SLOs via the exit code
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "", "URL to load (e.g. http://localhost:3000/)")
+	concurrency := fs.Int("c", 16, "Concurrent workers")
+	duration := fs.Duration("d", 10*time.Second, "Run duration")
+	method := fs.String("method", http.MethodGet, "Request method")
+	sloSpec := fs.String("slo", "", "Assertions such as p99<50ms,errors<0.1%,rps>=500; exit 1 if any fails")
+	_ = fs.Parse(args)
+
+	slos, err := ParseSLOs(*sloSpec)
+	if *target == "" || *concurrency <= 0 || err != nil {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mux    sync.Mutex
+		res    benchResult
+		errors atomic.Int64
+	)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			for time.Now().Before(deadline) {
+				req, _ := http.NewRequest(*method, *target, nil)
+				t := time.Now()
+				r, err := client.Do(req)
+				if err != nil {
+					errors.Add(1)
+					continue
+				}
+				_, _ = io.Copy(io.Discard, r.Body)
+				_ = r.Body.Close()
+				if r.StatusCode >= 500 {
+					errors.Add(1)
+					continue
+				}
+				local = append(local, time.Since(t))
+			}
+			mux.Lock()
+			res.latencies = append(res.latencies, local...)
+			mux.Unlock()
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	res.errors = errors.Load()
+	slices.Sort(res.latencies)
+
+	fmt.Printf("%d ok, %d errors in %s (%.1f rps)\n", len(res.latencies), res.errors,
+		res.elapsed.Round(time.Millisecond), res.measure("rps"))
+	for _, m := range []string{"p50", "p90", "p99", "p99.9", "max"} {
+		fmt.Printf("  %-6s %s\n", m, time.Duration(res.measure(m)*float64(time.Second)).Round(time.Microsecond))
+	}
+	printHistogram(res.latencies)
+
+	failed := false
+	for _, slo := range slos {
+		actual := res.measure(slo.Metric)
+		status := "ok  "
+		if !slo.holds(actual) {
+			status, failed = "FAIL", true
+		}
+		fmt.Printf("%s %-16s actual %s\n", status, slo.raw, formatMeasure(slo.Metric, actual))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func formatMeasure(metric string, v float64) string {
+	switch metric {
+	case "errors":
+		return fmt.Sprintf("%.3f%%", v*100)
+	case "rps":
+		return fmt.Sprintf("%.1f", v)
+	}
+	return time.Duration(v * float64(time.Second)).Round(time.Microsecond).String()
+}
+
+// printHistogram buckets latencies on a power-of-two scale starting at 1ms
+func printHistogram(sorted []time.Duration) {
+	if len(sorted) == 0 {
+		return
+	}
+	counts := map[int]int{}
+	top := 0
+	for _, l := range sorted {
+		b := 0
+		if l > time.Millisecond {
+			b = int(math.Ceil(math.Log2(float64(l) / float64(time.Millisecond))))
+		}
+		counts[b]++
+		top = max(top, b)
+	}
+
+	fmt.Println("  latency histogram:")
+	for b := 0; b <= top; b++ {
+		bar := strings.Repeat("#", int(math.Ceil(40*float64(counts[b])/float64(len(sorted)))))
+		fmt.Printf("  <= %-8s %8d %s\n", time.Duration(1<<b)*time.Millisecond, counts[b], bar)
+	}
+}
@@ -0,0 +1,59 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// -max-request-body caps request bodies, and a route's max_request_bytes caps
+// them for that route, whichever is lower applying. a request announcing a
+// bigger Content-Length is answered with a 413 before any backend sees it; a
+// chunked one that grows past the cap is cut off there and answered with a
+// 413 if its response hasn't started. either way the client connection is
+// closed, as the rest of the body is never read.
+//
+// a body is kept in memory so the request can be retried on another backend
+// only if it is at most -retry-buffer-body bytes and its length is known up
+// front: bigger bodies, and streams of unknown length, go to the backend as
+// they arrive and their requests are never retried
+var maxRequestBody int64
+
+var bodiesTooLarge atomic.Uint64
+
+// WithMaxRequestBody holds request bodies to -max-request-body
+func WithMaxRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limitBody(w, r, maxRequestBody) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// limitBody answers r with a 413 if it announces a body over max bytes, and
+// otherwise makes reading past max fail. it reports whether r may go on
+func limitBody(w http.ResponseWriter, r *http.Request, max int64) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > max {
+		bodiesTooLarge.Add(1)
+		w.Header().Set("Connection", "close")
+		writeError(w, r, http.StatusRequestEntityTooLarge, "body_too_large", "The request body is too large.", 0)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	return true
+}
+
+// bodyTooLarge reports whether err is a body read past its limit, answering
+// with a 413 if so
+func bodyTooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	bodiesTooLarge.Add(1)
+	writeError(w, r, http.StatusRequestEntityTooLarge, "body_too_large", "The request body is too large.", 0)
+	return true
+}
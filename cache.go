@@ -0,0 +1,520 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResponseCache keeps copies of GET responses the backends allow shared
+// caches to keep (Cache-Control s-maxage or max-age, and nothing private,
+// no-store or no-cache), for requests coalescing would share, each caller
+// of an authenticated route or API key getting its own copies.
+// it holds up to MaxBytes, dropping the least recently used response first.
+// a client sending no-cache skips the copy and refreshes it.
+//
+// MaxTTL caps how long a response is kept, whatever the backend allows, and
+// Paths limits caching to the paths under the given prefixes, less those
+// under a !prefix. a client holding the cached ETag or Last-Modified version
+// gets a 304. once a response with either goes stale it is kept, and the
+// next request for it asks the backend whether it changed: on a 304 the copy
+// is served and kept for another lifetime.
+//
+// backends may tag responses with Cache-Tag: a, b; the header stays here and
+// POST /admin/cache/purge drops responses by tag, exact url or url prefix,
+// e.g. after a deploy
+type ResponseCache struct {
+	MaxBytes int64
+	MaxBody  int64
+	MaxTTL   time.Duration // 0 keeps responses as long as they allow
+	Paths    []string      // path prefixes to cache, !prefix to skip; empty caches all
+
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cachedResponse, most recently used first
+	size    int64
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	purged      atomic.Uint64
+	revalidated atomic.Uint64 // stale responses the backend said were unchanged
+}
+
+type cachedResponse struct {
+	key     string
+	host    string
+	uri     string
+	status  int
+	header  http.Header
+	body    []byte
+	tags    []string
+	stored  time.Time
+	expires time.Time
+}
+
+// cacheTagHeader lists a response's tags for purging
+const cacheTagHeader = "Cache-Tag"
+
+// statuses worth keeping; anything else goes back to the backend every time
+var cacheableStatuses = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusMovedPermanently: true,
+	http.StatusNotFound: true, http.StatusGone: true,
+}
+
+var responseCache *ResponseCache
+
+func NewResponseCache(maxBytes, maxBody int64) *ResponseCache {
+	return &ResponseCache{MaxBytes: maxBytes, MaxBody: maxBody, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (cr *cachedResponse) cost() int64 {
+	return int64(len(cr.body) + len(cr.key) + 512)
+}
+
+// sharedCacheable reports whether a shared cache may keep a response at
+// all, however old: it sets no cookie, isn't private, no-store or no-cache,
+// and varies on nothing the key doesn't tell apart
+func sharedCacheable(h http.Header) bool {
+	if h.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			// the key only tells apart what coalescing does
+			if !slices.Contains(coalesceKeyHeaders, http.CanonicalHeaderKey(strings.TrimSpace(name))) {
+				return false
+			}
+		}
+	}
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "private", "no-store", "no-cache":
+			return false
+		}
+	}
+	return true
+}
+
+// cacheLifetime is how long a response may be kept, 0 for not at all
+func cacheLifetime(h http.Header) time.Duration {
+	if !sharedCacheable(h) {
+		return 0
+	}
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "max-age":
+			maxAge, _ = strconv.Atoi(strings.Trim(value, `"`))
+		case "s-maxage":
+			sMaxAge, _ = strconv.Atoi(strings.Trim(value, `"`))
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	age, _ := strconv.Atoi(h.Get("Age"))
+	if maxAge-age <= 0 {
+		return 0
+	}
+	return time.Duration(maxAge-age) * time.Second
+}
+
+func parseCacheTags(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// cachesPath reports whether the Paths rules let p be cached: the longest
+// matching prefix decides. with only !prefix rules every other path is
+// cached
+func (c *ResponseCache) cachesPath(p string) bool {
+	if len(c.Paths) == 0 {
+		return true
+	}
+	best, ok := -1, !slices.ContainsFunc(c.Paths, func(rule string) bool { return !strings.HasPrefix(rule, "!") })
+	for _, rule := range c.Paths {
+		prefix, skip := strings.CutPrefix(rule, "!")
+		if strings.HasPrefix(p, prefix) && len(prefix) > best {
+			best, ok = len(prefix), !skip
+		}
+	}
+	return ok
+}
+
+// lifetime is cacheLifetime capped at MaxTTL
+func (c *ResponseCache) lifetime(h http.Header) time.Duration {
+	ttl := cacheLifetime(h)
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl
+}
+
+// get returns key's response, if there is one, and whether it is fresh. a
+// stale one is only kept if it can be revalidated
+func (c *ResponseCache) get(key string) (*cachedResponse, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	cr := e.Value.(*cachedResponse)
+	c.lru.MoveToFront(e)
+	if time.Now().After(cr.expires) {
+		if !cr.revalidatable() {
+			c.remove(e)
+			return nil, false
+		}
+		return cr, false
+	}
+	return cr, true
+}
+
+// peek returns key's response, if there is one, whatever its age
+func (c *ResponseCache) peek(key string) *cachedResponse {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedResponse)
+}
+
+func (cr *cachedResponse) revalidatable() bool {
+	return cr.header.Get("ETag") != "" || cr.header.Get("Last-Modified") != ""
+}
+
+// clientHas reports whether r's conditional headers name cr's version
+func (cr *cachedResponse) clientHas(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(cr.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(cr.header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// serve answers r from cr, with a 304 if the client already has it
+func (cr *cachedResponse) serve(w http.ResponseWriter, r *http.Request, result string) {
+	// keep what outer middleware already set for this caller, e.g. its request id
+	for k, v := range cr.header {
+		if _, set := w.Header()[k]; !set {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(cr.stored).Seconds())))
+	w.Header().Set("X-Cache", result)
+	if cacheableStatuses[cr.status] && cr.status < 300 && cr.clientHas(r) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(cr.status)
+	_, _ = w.Write(cr.body)
+}
+
+// revalidatedHeaders are what a 304 updates in the response it confirms
+var revalidatedHeaders = []string{"Cache-Control", "Expires", "ETag", "Last-Modified", "Date", "Age", "Vary"}
+
+// renewed is cr with the headers of the 304 that confirmed it, stored now
+func (cr *cachedResponse) renewed(h http.Header) *cachedResponse {
+	next := *cr
+	next.header = cr.header.Clone()
+	for _, k := range revalidatedHeaders {
+		if v, ok := h[k]; ok {
+			next.header[k] = v
+		}
+	}
+	next.stored = time.Now()
+	return &next
+}
+
+func (c *ResponseCache) put(cr *cachedResponse) {
+	if cr.cost() > c.MaxBytes {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if e, ok := c.entries[cr.key]; ok {
+		c.remove(e)
+	}
+	c.entries[cr.key] = c.lru.PushFront(cr)
+	c.size += cr.cost()
+	for c.size > c.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry. called with mux held
+func (c *ResponseCache) remove(e *list.Element) {
+	cr := c.lru.Remove(e).(*cachedResponse)
+	delete(c.entries, cr.key)
+	c.size -= cr.cost()
+}
+
+func (c *ResponseCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := coalesceKey(r)
+		if !ok || !c.cachesPath(r.URL.Path) || featureOff(r, "cache") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		refresh := strings.Contains(r.Header.Get("Cache-Control"), "no-cache") || r.Header.Get("Pragma") == "no-cache"
+		var stale *cachedResponse
+		if !refresh {
+			cr, fresh := c.get(key)
+			if fresh {
+				c.hits.Add(1)
+				cr.serve(w, r, "HIT")
+				return
+			}
+			stale = cr
+		}
+		c.misses.Add(1)
+		cw := &cacheWriter{ResponseWriter: w, max: c.MaxBody}
+		upstream := r
+		if stale != nil {
+			// ask whether it changed; a 304 is kept from the client, who
+			// may not have the response at all
+			cw.revalidating, cw.outer = true, w.Header().Clone()
+			upstream = r.Clone(r.Context())
+			upstream.Header.Del("If-Modified-Since")
+			upstream.Header.Del("If-None-Match")
+			if etag := stale.header.Get("ETag"); etag != "" {
+				upstream.Header.Set("If-None-Match", etag)
+			} else {
+				upstream.Header.Set("If-Modified-Since", stale.header.Get("Last-Modified"))
+			}
+		}
+		next.ServeHTTP(cw, upstream)
+
+		if cw.notModified {
+			c.revalidated.Add(1)
+			// a 304 without caching headers keeps those of the copy
+			renewed := stale.renewed(cw.header)
+			if ttl := c.lifetime(renewed.header); ttl > 0 {
+				renewed.expires = renewed.stored.Add(ttl)
+				c.put(renewed)
+			}
+			renewed.serve(w, r, "REVALIDATED")
+			return
+		}
+		ttl := c.lifetime(cw.header)
+		if cw.overflow || !cacheableStatuses[cw.status] || ttl <= 0 || r.Context().Err() != nil {
+			return
+		}
+		now := time.Now()
+		c.put(&cachedResponse{
+			key:     key,
+			host:    strings.ToLower(r.Host),
+			uri:     r.URL.RequestURI(),
+			status:  cw.status,
+			header:  cw.header,
+			body:    cw.body.Bytes(),
+			tags:    cw.tags,
+			stored:  now,
+			expires: now.Add(ttl),
+		})
+	})
+}
+
+// cacheWriter passes the response through and keeps a copy, up to max
+// bytes. the Cache-Tag header is taken off on the way
+type cacheWriter struct {
+	http.ResponseWriter
+	max      int64
+	status   int
+	header   http.Header
+	tags     []string
+	body     bytes.Buffer
+	overflow bool
+
+	revalidating bool        // a 304 confirms a stale copy and isn't passed on
+	outer        http.Header // what outer middleware set before asking
+	notModified  bool
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	if cw.revalidating && status == http.StatusNotModified {
+		cw.status, cw.notModified = status, true
+		// the 304's headers go, what outer middleware set stays
+		h := cw.ResponseWriter.Header()
+		cw.header = h.Clone()
+		clear(h)
+		for k, v := range cw.outer {
+			h[k] = v
+		}
+		return
+	}
+	h := cw.ResponseWriter.Header()
+	cw.tags = parseCacheTags(h.Get(cacheTagHeader))
+	h.Del(cacheTagHeader)
+	h.Set("X-Cache", "MISS")
+	cw.status, cw.header = status, h.Clone()
+	cw.header.Del("X-Cache")
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return len(p), nil
+	}
+	if !cw.overflow {
+		if int64(cw.body.Len()+len(p)) > cw.max {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// CachePurge says which responses to drop: those for an exact url, those
+// under a url prefix, or those with a tag; any that match one of the given
+// fields go. a url without a host ("/path?q") matches on every host
+type CachePurge struct {
+	URL    string `json:"url,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+}
+
+// splitPurgeURL takes "https://host/path", "host/path" or "/path" apart
+func splitPurgeURL(s string) (host, uri string) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "http://"), "https://")
+	if strings.HasPrefix(s, "/") {
+		return "", s
+	}
+	host, path, _ := strings.Cut(s, "/")
+	return strings.ToLower(host), "/" + path
+}
+
+func (p CachePurge) matches(cr *cachedResponse) bool {
+	onHost := func(host string) bool { return host == "" || host == cr.host }
+	if p.URL != "" {
+		if host, uri := splitPurgeURL(p.URL); onHost(host) && cr.uri == uri {
+			return true
+		}
+	}
+	if p.Prefix != "" {
+		if host, uri := splitPurgeURL(p.Prefix); onHost(host) && strings.HasPrefix(cr.uri, uri) {
+			return true
+		}
+	}
+	return p.Tag != "" && slices.Contains(cr.tags, p.Tag)
+}
+
+// Purge drops the matching responses and returns how many there were
+func (c *ResponseCache) Purge(p CachePurge) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	n := 0
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if p.matches(e.Value.(*cachedResponse)) {
+			c.remove(e)
+			n++
+		}
+		e = next
+	}
+	c.purged.Add(uint64(n))
+	return n
+}
+
+// CacheStats is the cache as the admin API shows it
+type CacheStats struct {
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+	MaxBytes    int64  `json:"max_bytes"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Purged      uint64 `json:"purged"`
+	Revalidated uint64 `json:"revalidated"`
+}
+
+func (c *ResponseCache) Stats() CacheStats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return CacheStats{
+		Entries:     len(c.entries),
+		Bytes:       c.size,
+		MaxBytes:    c.MaxBytes,
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Purged:      c.purged.Load(),
+		Revalidated: c.revalidated.Load(),
+	}
+}
+
+func getCache(w http.ResponseWriter, r *http.Request) {
+	if responseCache == nil {
+		http.Error(w, "response caching is off", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, responseCache.Stats())
+}
+
+// takes {"url": ...}, {"prefix": ...} and/or {"tag": ...}
+func postCachePurge(w http.ResponseWriter, r *http.Request) {
+	if responseCache == nil {
+		http.Error(w, "response caching is off", http.StatusNotFound)
+		return
+	}
+	var p CachePurge
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.URL == "" && p.Prefix == "" && p.Tag == "" {
+		http.Error(w, "give a url, prefix or tag to purge", http.StatusBadRequest)
+		return
+	}
+	n := responseCache.Purge(p)
+	log.Printf("Cache purge %s dropped %d responses\n", p, n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+func (p CachePurge) String() string {
+	var parts []string
+	for _, f := range [][2]string{{"url", p.URL}, {"prefix", p.Prefix}, {"tag", p.Tag}} {
+		if f[1] != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", f[0], f[1]))
+		}
+	}
+	return strings.Join(parts, " ")
+}
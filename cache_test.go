@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSharedCacheable(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"public", http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{"private", http.Header{"Cache-Control": {"max-age=60, private"}}, false},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, false},
+		{"no-cache", http.Header{"Cache-Control": {"No-Cache"}}, false},
+		{"sets a cookie", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}, false},
+		{"varies on a key header", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"accept-encoding"}}, true},
+		{"varies on the caller", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept, X-User"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sharedCacheable(tc.header); got != tc.want {
+				t.Errorf("sharedCacheable = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestCacheCallers checks that a cached response only goes to requests that
+// would have been sent the same one
+func TestCacheCallers(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		first, again func(*http.Request)
+		header       http.Header // of the response
+		shared       bool
+	}{
+		{"anonymous", nil, nil, nil, true},
+		{"authorization", func(r *http.Request) { r.Header.Set("Authorization", "Bearer a") }, func(r *http.Request) { r.Header.Set("Authorization", "Bearer a") }, nil, false},
+		{"cookie", func(r *http.Request) { r.Header.Set("Cookie", "s=1") }, nil, nil, false},
+		{"other api keys", func(r *http.Request) { r.Header.Set("X-Api-Key-Name", "a") }, func(r *http.Request) { r.Header.Set("X-Api-Key-Name", "b") }, nil, false},
+		{"same api key", func(r *http.Request) { r.Header.Set("X-Api-Key-Name", "a") }, func(r *http.Request) { r.Header.Set("X-Api-Key-Name", "a") }, nil, true},
+		{"other route users", func(r *http.Request) { r.Header.Set("X-Auth-User", "a") }, nil, nil, false},
+		{"maintenance bypass", func(r *http.Request) { r.Header.Set(maintenanceBypassHeader, "t") }, nil, nil, false},
+		{"other ranges", func(r *http.Request) { r.Header.Set("Range", "bytes=0-1") }, func(r *http.Request) { r.Header.Set("Range", "bytes=2-3") }, nil, false},
+		{"private response", nil, nil, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"response setting a cookie", nil, nil, http.Header{"Set-Cookie": {"s=1"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Header().Set("Cache-Control", "max-age=60")
+				for k, v := range tc.header {
+					w.Header()[k] = v
+				}
+				_, _ = w.Write([]byte("body"))
+			})
+			h := NewResponseCache(1<<20, 1<<20).Middleware(backend)
+			for _, set := range []func(*http.Request){tc.first, tc.again} {
+				r := httptest.NewRequest(http.MethodGet, "/x", nil)
+				if set != nil {
+					set(r)
+				}
+				h.ServeHTTP(httptest.NewRecorder(), r)
+			}
+			if shared := calls == 1; shared != tc.shared {
+				t.Errorf("%d backend calls, shared %v, want %v", calls, shared, tc.shared)
+			}
+		})
+	}
+}
+
+func TestCachesPath(t *testing.T) {
+	for _, tc := range []struct {
+		paths []string
+		path  string
+		want  bool
+	}{
+		{nil, "/x", true},
+		{[]string{"/static"}, "/static/a.css", true},
+		{[]string{"/static"}, "/api", false},
+		{[]string{"/static", "!/static/private"}, "/static/private/a", false},
+		{[]string{"!/x"}, "/x/1", false},
+		{[]string{"!/x"}, "/y", true},
+	} {
+		c := &ResponseCache{Paths: tc.paths}
+		if got := c.cachesPath(tc.path); got != tc.want {
+			t.Errorf("paths %q: caches %s = %v, want %v", tc.paths, tc.path, got, tc.want)
+		}
+	}
+}
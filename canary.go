@@ -0,0 +1,178 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+)
+
+// backends marked ;canary=true make up a pool's canary group and get
+// -canary-percent of its requests, the stable backends the rest, whatever
+// their number and weights. the percentage can be changed at runtime with
+// PUT /admin/canary, and the groups' requests and failures are counted
+// apart so a bad deploy shows. with no live canary everything goes to the
+// stable backends, and with no live stable backend to the canaries.
+// affinity and sticky sessions stay where they are pinned
+var canaryPercent float64
+
+// Canary is a pool's split between its stable and canary backends
+type Canary struct {
+	percent atomic.Uint64 // float64 bits, see set
+	set     atomic.Bool   // percent overrides canaryPercent
+
+	groups [2]groupStats // stable, canary
+}
+
+type groupStats struct {
+	requests atomic.Uint64
+	failures atomic.Uint64
+}
+
+// Percent is the share of requests sent to the canaries
+func (c *Canary) Percent() float64 {
+	if !c.set.Load() {
+		return canaryPercent
+	}
+	return math.Float64frombits(c.percent.Load())
+}
+
+func (c *Canary) setPercent(p float64) {
+	c.percent.Store(math.Float64bits(p))
+	c.set.Store(true)
+}
+
+// record counts a response or transport error under b's group
+func (c *Canary) record(b *Backend, failed bool) {
+	g := &c.groups[group(b)]
+	g.requests.Add(1)
+	if failed {
+		g.failures.Add(1)
+	}
+}
+
+func group(b *Backend) int {
+	if b.Canary {
+		return 1
+	}
+	return 0
+}
+
+func groupName(canary bool) string {
+	if canary {
+		return "canary"
+	}
+	return "stable"
+}
+
+// drawGroup decides which group a request goes to. split is false when the
+// pool has no canaries up, or nothing but canaries, so any backend will do
+func (s *ServerPool) drawGroup() (canary, split bool) {
+	var live [2]int
+	for _, b := range s.Backends() {
+		if b.IsAlive() {
+			live[group(b)]++
+		}
+	}
+	if live[0] == 0 || live[1] == 0 {
+		return false, false
+	}
+	return rand.Float64()*100 < s.canary.Percent(), true
+}
+
+// nextInGroup is the group's next live backend in pool order, for when the
+// strategy keeps picking the other group, as hashing strategies do
+func (s *ServerPool) nextInGroup(canary bool) *Backend {
+	backends := s.Backends()
+	start := s.NextIndex()
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		if b.Canary == canary && b.IsAlive() {
+			return b
+		}
+	}
+	return nil
+}
+
+// CanaryStatus is a pool's split as the admin API shows it
+type CanaryStatus struct {
+	Pool    string      `json:"pool"`
+	Percent float64     `json:"percent"`
+	Stable  GroupStatus `json:"stable"`
+	Canary  GroupStatus `json:"canary"`
+}
+
+type GroupStatus struct {
+	Backends  []string `json:"backends"`
+	Alive     int      `json:"alive"`
+	Requests  uint64   `json:"requests"`
+	Failures  uint64   `json:"failures"`
+	ErrorRate float64  `json:"error_rate"`
+}
+
+func (s *ServerPool) CanaryStatus() CanaryStatus {
+	st := CanaryStatus{Pool: s.Name, Percent: s.canary.Percent()}
+	groups := [2]*GroupStatus{&st.Stable, &st.Canary}
+	for _, g := range groups {
+		g.Backends = []string{}
+	}
+	for _, b := range s.Backends() {
+		g := groups[group(b)]
+		g.Backends = append(g.Backends, b.Name())
+		if b.IsAlive() {
+			g.Alive++
+		}
+	}
+	for i, g := range groups {
+		g.Requests, g.Failures = s.canary.groups[i].requests.Load(), s.canary.groups[i].failures.Load()
+		if g.Requests > 0 {
+			g.ErrorRate = float64(g.Failures) / float64(g.Requests)
+		}
+	}
+	return st
+}
+
+// shows every pool's split, or ?pool='s
+func getCanary(w http.ResponseWriter, r *http.Request) {
+	if name := r.URL.Query().Get("pool"); name != "" {
+		pool := findPool(name)
+		if pool == nil {
+			http.Error(w, fmt.Sprintf("unknown pool %q", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, []CanaryStatus{pool.CanaryStatus()})
+		return
+	}
+	list := []CanaryStatus{}
+	for _, p := range pools {
+		list = append(list, p.CanaryStatus())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// sets a pool's canary percentage, e.g. {"pool": "api", "percent": 25}
+func putCanary(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pool    string   `json:"pool"`
+		Percent *float64 `json:"percent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Percent == nil || *req.Percent < 0 || *req.Percent > 100 {
+		http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	pool := findPool(req.Pool)
+	if pool == nil {
+		http.Error(w, fmt.Sprintf("unknown pool %q", req.Pool), http.StatusNotFound)
+		return
+	}
+	pool.canary.setPercent(*req.Percent)
+	log.Printf("[%s] Canary backends now get %g%% of requests\n", pool.Name, *req.Percent)
+	writeJSON(w, http.StatusOK, pool.CanaryStatus())
+}
@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"time"
+)
+
+// a backend with MaxConns set takes at most that many requests at once. a
+// request whose pick is full goes to another live backend with room and,
+// when every one is full, waits up to backendQueue (-backend-queue) for a
+// slot before it is answered with a 503
+var backendQueue time.Duration
+
+// reserve takes one of the backend's slots if it has room
+func (b *Backend) reserve() bool {
+	if b.MaxConns <= 0 {
+		return true
+	}
+	for {
+		n := b.reserved.Load()
+		if n >= int64(b.MaxConns) {
+			return false
+		}
+		if b.reserved.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (s *ServerPool) releaseBackend(b *Backend) {
+	if b.MaxConns <= 0 {
+		return
+	}
+	b.reserved.Add(-1)
+	s.backendFreed.broadcast()
+}
+
+// withRoom reserves a slot on a live backend with room: the pool's strategy
+// is asked first, so the request is still balanced the way the pool is, and
+// if it keeps picking full ones the first with room in rotation order
+func (s *ServerPool) withRoom(r *http.Request) *Backend {
+	backends := s.Backends()
+	for range backends {
+		b := s.nextFor(r)
+		if b == nil {
+			break
+		}
+		if b.reserve() {
+			return b
+		}
+	}
+	start := s.NextIndex()
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		if b.IsAlive() && b.reserve() {
+			return b
+		}
+	}
+	return nil
+}
+
+// claim reserves a slot on b or, when b is full, on another backend, waiting
+// for one to free up if all are. nil means none came free in time
+func (s *ServerPool) claim(r *http.Request, b *Backend) *Backend {
+	if b.reserve() {
+		return b
+	}
+	var timeout <-chan time.Time
+	if backendQueue > 0 {
+		t := time.NewTimer(backendQueue)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for {
+		freed := s.backendFreed.wait()
+		if other := s.withRoom(r); other != nil {
+			return other
+		}
+		if timeout == nil {
+			return nil
+		}
+		select {
+		case <-freed:
+			continue
+		case <-timeout:
+		case <-r.Context().Done():
+		}
+		return nil
+	}
+}
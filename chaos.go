@@ -0,0 +1,84 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// chaos mode randomly delays or drops a small share of upstream requests and
+// health probes so alerting and retry behaviour can be exercised on a live
+// deployment. it can be flipped on and off at runtime through the admin api.
+type Chaos struct {
+	mux      sync.RWMutex
+	settings ChaosSettings
+}
+
+type ChaosSettings struct {
+	Enabled   bool     `json:"enabled"`
+	DropRate  float64  `json:"drop_rate"`
+	DelayRate float64  `json:"delay_rate"`
+	MaxDelay  Duration `json:"max_delay"` // e.g. "500ms"
+}
+
+var errChaosDrop = errors.New("chaos: request dropped")
+
+var chaos Chaos
+
+func (c *Chaos) Settings() ChaosSettings {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.settings
+}
+
+func (c *Chaos) Update(s ChaosSettings) {
+	s.DropRate = clampRate(s.DropRate)
+	s.DelayRate = clampRate(s.DelayRate)
+	s.MaxDelay.Duration = max(s.MaxDelay.Duration, 0)
+	c.mux.Lock()
+	c.settings = s
+	c.mux.Unlock()
+}
+
+// Inject applies chaos to one upstream call: it may sleep for a random
+// duration and returns errChaosDrop when the call should fail instead
+func (c *Chaos) Inject(ctx context.Context) error {
+	s := c.Settings()
+	if !s.Enabled {
+		return nil
+	}
+
+	if rand.Float64() < s.DropRate {
+		return errChaosDrop
+	}
+
+	if s.MaxDelay.Duration > 0 && rand.Float64() < s.DelayRate {
+		t := time.NewTimer(rand.N(s.MaxDelay.Duration))
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func clampRate(r float64) float64 {
+	return min(max(r, 0), 1)
+}
+
+// chaosTransport wraps the upstream transport so proxied requests go through chaos
+type chaosTransport struct {
+	base http.RoundTripper
+}
+
+func (t *chaosTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := chaos.Inject(r.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,239 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestClass names a logical endpoint so traffic can be counted, logged and
+// rate limited per endpoint rather than per raw path. a request belongs to
+// the first class all of whose conditions match
+type RequestClass struct {
+	Name       string            `json:"name"`
+	Methods    []string          `json:"methods,omitempty"`
+	PathPrefix string            `json:"path_prefix,omitempty"`
+	Path       string            `json:"path,omitempty"`    // path.Match pattern, e.g. /users/*/orders
+	Headers    map[string]string `json:"headers,omitempty"` // value "*" only requires presence
+	RateLimit  float64           `json:"rate_limit,omitempty"`
+	Burst      int               `json:"burst,omitempty"`
+	Lane       string            `json:"lane,omitempty"` // low, normal or critical, see Lane
+
+	lane    Lane
+	limiter *tokenBucket
+	stats   classStats
+}
+
+type classStats struct {
+	requests    atomic.Uint64
+	errors      atomic.Uint64
+	rateLimited atomic.Uint64
+	latency     atomic.Int64 // nanoseconds, summed
+}
+
+// requests that match no class are counted here
+const unclassified = "unclassified"
+
+type requestClassKey struct{}
+
+// LoadRequestClasses reads a JSON list of classes, e.g.
+//
+//	[{"name": "checkout", "path_prefix": "/checkout/", "lane": "critical"},
+//	 {"name": "order-lookup", "methods": ["GET"], "path": "/users/*/orders", "rate_limit": 50},
+//	 {"name": "api", "path_prefix": "/api/", "headers": {"Authorization": "*"}},
+//	 {"name": "batch", "headers": {"X-Batch": "*"}, "lane": "low"}]
+func LoadRequestClasses(file string) ([]*RequestClass, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var classes []*RequestClass
+	if err := json.Unmarshal(data, &classes); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	seen := map[string]bool{}
+	for _, c := range classes {
+		if c.Name == "" || c.Name == unclassified || seen[c.Name] {
+			return nil, fmt.Errorf("%s: class names must be unique, non-empty and not %q", file, unclassified)
+		}
+		seen[c.Name] = true
+		if _, err := path.Match(c.Path, "/"); err != nil {
+			return nil, fmt.Errorf("%s: class %s: bad path %q", file, c.Name, c.Path)
+		}
+		if c.RateLimit > 0 {
+			c.limiter = newTokenBucket(c.RateLimit, c.Burst)
+		}
+		if c.lane, err = parseLane(c.Lane); err != nil {
+			return nil, fmt.Errorf("%s: class %s: %w", file, c.Name, err)
+		}
+	}
+	return append(classes, &RequestClass{Name: unclassified, lane: LaneNormal}), nil
+}
+
+func (c *RequestClass) matches(r *http.Request) bool {
+	if c.Name == unclassified {
+		return true
+	}
+	if len(c.Methods) > 0 {
+		found := false
+		for _, m := range c.Methods {
+			found = found || strings.EqualFold(m, r.Method)
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, c.PathPrefix) {
+		return false
+	}
+	if c.Path != "" {
+		if ok, _ := path.Match(c.Path, r.URL.Path); !ok {
+			return false
+		}
+	}
+	for name, want := range c.Headers {
+		got, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (want != "*" && !contains(got, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// WithRequestClasses tags each request with its class, enforces the class's
+// rate limit and keeps per-class counters for GET /admin/classes
+func WithRequestClasses(classes []*RequestClass, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var class *RequestClass
+		for _, c := range classes {
+			if c.matches(r) {
+				class = c
+				break
+			}
+		}
+		class.stats.requests.Add(1)
+		if e := accessLogEntry(r); e != nil {
+			e.Class = class.Name
+		}
+
+		if class.limiter != nil {
+			if wait := class.limiter.take(); wait > 0 {
+				class.stats.rateLimited.Add(1)
+				writeError(w, r, http.StatusTooManyRequests, "rate_limited",
+					fmt.Sprintf("Too many %s requests.", class.Name), wait)
+				return
+			}
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), requestClassKey{}, class.Name)
+		ctx = context.WithValue(ctx, laneKey{}, class.lane)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		class.stats.latency.Add(int64(time.Since(start)))
+		if sw.status >= 500 {
+			class.stats.errors.Add(1)
+		}
+	})
+}
+
+func GetRequestClass(r *http.Request) string {
+	class, _ := r.Context().Value(requestClassKey{}).(string)
+	return class
+}
+
+// statusWriter remembers the status code and body size; Unwrap keeps
+// flushing and upgrades working through http.ResponseController
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// tokenBucket allows rate requests per second on average and bursts of up
+// to burst
+type tokenBucket struct {
+	mux    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := math.Max(float64(burst), math.Ceil(rate))
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// take consumes a token, or returns how long until one is available
+func (tb *tokenBucket) take() time.Duration {
+	tb.mux.Lock()
+	defer tb.mux.Unlock()
+	now := time.Now()
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+var requestClasses []*RequestClass
+
+type ClassStats struct {
+	Name        string  `json:"name"`
+	Requests    uint64  `json:"requests"`
+	Errors      uint64  `json:"errors"`
+	RateLimited uint64  `json:"rate_limited"`
+	AvgLatency  float64 `json:"avg_latency_ms"`
+}
+
+func getClasses(w http.ResponseWriter, r *http.Request) {
+	stats := make([]ClassStats, 0, len(requestClasses))
+	for _, c := range requestClasses {
+		cs := ClassStats{
+			Name:        c.Name,
+			Requests:    c.stats.requests.Load(),
+			Errors:      c.stats.errors.Load(),
+			RateLimited: c.stats.rateLimited.Load(),
+		}
+		if served := cs.Requests - cs.RateLimited; served > 0 {
+			cs.AvgLatency = float64(c.stats.latency.Load()) / float64(served) / float64(time.Millisecond)
+		}
+		stats = append(stats, cs)
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,43 @@
+package loadbalancer
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// client keep-alive connections, from flags or the config file. an idle
+// connection is closed after clientIdleTimeout; one older than clientMaxAge
+// is closed after its next response, so clients reconnect and spread over
+// balancer instances added since. each connection's age limit is jittered by
+// up to a tenth so connections opened together don't all drop together.
+// HTTP/2 connections only get the idle timeout
+var (
+	clientIdleTimeout = 2 * time.Minute
+	clientMaxAge      time.Duration
+)
+
+type connDeadlineKey struct{}
+
+// clientConnContext is the front servers' ConnContext
+func clientConnContext(ctx context.Context, c net.Conn) context.Context {
+	ctx = strictConnContext(ctx, c)
+	if clientMaxAge <= 0 {
+		return ctx
+	}
+	age := clientMaxAge - time.Duration(rand.Int64N(int64(clientMaxAge/10)+1))
+	return context.WithValue(ctx, connDeadlineKey{}, time.Now().Add(age))
+}
+
+// WithConnMaxAge asks HTTP/1 clients to reconnect once their connection is
+// past its age limit
+func WithConnMaxAge(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deadline, ok := r.Context().Value(connDeadlineKey{}).(time.Time); ok && r.ProtoMajor == 1 && time.Now().After(deadline) {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,325 @@
+package loadbalancer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster lets several balancer instances share what they observe. every
+// interval each node gossips its own health observations to a few random
+// members over UDP; membership spreads the same way, so listing one seed
+// peer is enough to join. messages are signed with the -cluster-key every
+// member shares, and ones that aren't, or were sent too long ago, are
+// dropped.
+//
+// a backend's health is then decided by majority over every member's latest
+// observation, so all nodes converge on the same up/down view instead of each
+// trusting only its own probes.
+//
+// rate limit counters are not gossiped: a limit only holds across members
+// that take their tokens from one place, so with -client-rate or a pool or
+// route rate_limit cluster mode requires -rate-limit-store.
+type Cluster struct {
+	Node     string
+	Interval time.Duration
+	Key      []byte
+
+	conn *net.UDPConn
+
+	mux     sync.Mutex
+	members map[string]*clusterMember // by gossip ip:port, or host:port until it resolves
+	health  map[string]bool           // local observations by pool/backend
+}
+
+type clusterMember struct {
+	node     string
+	lastSeen time.Time
+	health   map[string]bool
+}
+
+type gossipMessage struct {
+	Node    string          `json:"node"`
+	Sent    int64           `json:"sent"` // unix ms
+	Members []string        `json:"members"`
+	Health  map[string]bool `json:"health"`
+}
+
+// max gossip fan-out per interval
+const gossipFanout = 3
+
+// gossipSkew is how far apart members' clocks may be for their messages to
+// count as fresh
+const gossipSkew = 30 * time.Second
+
+var cluster *Cluster
+
+func NewCluster(bind string, peers []string, node, key string, interval time.Duration) (*Cluster, error) {
+	if key == "" {
+		return nil, errors.New("cluster mode needs a -cluster-key shared by every member")
+	}
+	conn, err := listenUDP(bind)
+	if err != nil {
+		return nil, err
+	}
+	if node == "" {
+		node = conn.LocalAddr().String()
+	}
+
+	c := &Cluster{
+		Node:     node,
+		Interval: interval,
+		Key:      []byte(key),
+		conn:     conn,
+		members:  map[string]*clusterMember{},
+		health:   map[string]bool{},
+	}
+	for _, p := range peers {
+		if p = strings.TrimSpace(p); p != "" {
+			c.members[resolveGossipAddr(p)] = &clusterMember{}
+		}
+	}
+	go c.receive()
+	go c.gossip()
+	log.Printf("Cluster node %s gossiping on %s\n", node, conn.LocalAddr())
+	return c, nil
+}
+
+func healthKey(pool, backend string) string {
+	return pool + "/" + backend
+}
+
+// Observe records this node's own view of a backend
+func (c *Cluster) Observe(pool, backend string, alive bool) {
+	c.mux.Lock()
+	c.health[healthKey(pool, backend)] = alive
+	c.mux.Unlock()
+}
+
+// Decide returns the cluster-wide verdict for a backend: a majority of the
+// live members' latest observations. a tie keeps this node's own verdict
+func (c *Cluster) Decide(pool, backend string, local bool) bool {
+	key := healthKey(pool, backend)
+	up, down := 0, 0
+	if local {
+		up++
+	} else {
+		down++
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, m := range c.members {
+		if !c.live(m) {
+			continue
+		}
+		if alive, ok := m.health[key]; ok {
+			if alive {
+				up++
+			} else {
+				down++
+			}
+		}
+	}
+	if up == down {
+		return local
+	}
+	return up > down
+}
+
+// members that haven't gossiped for a few intervals no longer vote
+func (c *Cluster) live(m *clusterMember) bool {
+	return time.Since(m.lastSeen) < 3*c.Interval
+}
+
+func (c *Cluster) gossip() {
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+	for range t.C {
+		c.mux.Lock()
+		msg := gossipMessage{Node: c.Node, Sent: time.Now().UnixMilli(), Health: c.health}
+		addrs := make([]string, 0, len(c.members))
+		for addr := range c.members {
+			addrs = append(addrs, addr)
+		}
+		msg.Members = addrs
+		data, err := json.Marshal(msg)
+		c.mux.Unlock()
+		if err != nil {
+			log.Println("Gossip encode failed: ", err)
+			continue
+		}
+		data = append(c.sign(data), data...)
+
+		rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+		for _, addr := range addrs[:min(gossipFanout, len(addrs))] {
+			ua, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				continue
+			}
+			if ua.String() != addr {
+				c.rekey(addr, ua.String())
+			}
+			_, _ = c.conn.WriteToUDP(data, ua)
+		}
+	}
+}
+
+// rekey files a member listed by host name under the address it resolved
+// to, which is what its gossip arrives from
+func (c *Cluster) rekey(name, addr string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	m, ok := c.members[name]
+	if !ok {
+		return
+	}
+	delete(c.members, name)
+	if _, known := c.members[addr]; !known && !c.isSelf(addr) {
+		c.members[addr] = m
+	}
+}
+
+// resolveGossipAddr turns host:port into ip:port, or leaves it for the
+// gossip loop to resolve once it can
+func resolveGossipAddr(addr string) string {
+	if ua, err := net.ResolveUDPAddr("udp", addr); err == nil {
+		return ua.String()
+	}
+	return addr
+}
+
+// sign is the HMAC-SHA256 of a message under the cluster key, sent ahead of it
+func (c *Cluster) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, c.Key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// verify returns the message of a signed packet, false if it isn't signed
+// with the cluster key or is older than a few intervals
+func (c *Cluster) verify(packet []byte) (gossipMessage, bool) {
+	var msg gossipMessage
+	if len(packet) < sha256.Size {
+		return msg, false
+	}
+	sig, data := packet[:sha256.Size], packet[sha256.Size:]
+	if !hmac.Equal(sig, c.sign(data)) || json.Unmarshal(data, &msg) != nil {
+		return msg, false
+	}
+	age := time.Since(time.UnixMilli(msg.Sent))
+	return msg, age.Abs() < max(3*c.Interval, gossipSkew)
+}
+
+func (c *Cluster) receive() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("Gossip receive failed: ", err)
+			return
+		}
+		msg, ok := c.verify(buf[:n])
+		if !ok || msg.Node == c.Node {
+			continue
+		}
+		c.merge(from.String(), msg)
+	}
+}
+
+func (c *Cluster) merge(from string, msg gossipMessage) {
+	c.mux.Lock()
+	m, ok := c.members[from]
+	if !ok {
+		m = &clusterMember{}
+		c.members[from] = m
+		log.Printf("Cluster member %s joined from %s\n", msg.Node, from)
+	}
+	m.node, m.lastSeen, m.health = msg.Node, time.Now(), msg.Health
+
+	// learn about members we haven't talked to yet
+	for _, addr := range msg.Members {
+		if _, known := c.members[addr]; !known && !c.isSelf(addr) {
+			c.members[addr] = &clusterMember{}
+		}
+	}
+	c.mux.Unlock()
+
+	// re-evaluate backends the sender has an opinion on
+	for key := range msg.Health {
+		poolName, backend, _ := strings.Cut(key, "/")
+		if p := findPool(poolName); p != nil {
+			if b := p.FindBackend(backend); b != nil {
+				c.mux.Lock()
+				local, ok := c.health[key]
+				c.mux.Unlock()
+				if ok {
+					b.setAliveFor(c.Decide(poolName, backend, local), "cluster peers' health checks")
+				}
+			}
+		}
+	}
+}
+
+// a peer may list us under an address we didn't bind literally (e.g. 0.0.0.0)
+func (c *Cluster) isSelf(addr string) bool {
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return false
+	}
+	local := c.conn.LocalAddr().(*net.UDPAddr)
+	if ua.Port != local.Port {
+		return false
+	}
+	if ua.IP.IsLoopback() || local.IP.IsUnspecified() && ua.IP.IsUnspecified() {
+		return true
+	}
+	ifaces, _ := net.InterfaceAddrs()
+	for _, a := range ifaces {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ua.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+type ClusterMemberStatus struct {
+	Addr     string          `json:"addr"`
+	Node     string          `json:"node,omitempty"`
+	Live     bool            `json:"live"`
+	LastSeen time.Time       `json:"last_seen"`
+	Health   map[string]bool `json:"health,omitempty"`
+}
+
+func getCluster(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil {
+		http.Error(w, "cluster mode is off", http.StatusNotFound)
+		return
+	}
+	cluster.mux.Lock()
+	members := make([]ClusterMemberStatus, 0, len(cluster.members))
+	for addr, m := range cluster.members {
+		members = append(members, ClusterMemberStatus{Addr: addr, Node: m.node, Live: cluster.live(m), LastSeen: m.lastSeen, Health: m.health})
+	}
+	local := map[string]bool{}
+	for k, v := range cluster.health {
+		local[k] = v
+	}
+	cluster.mux.Unlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Addr < members[j].Addr })
+	writeJSON(w, http.StatusOK, map[string]any{
+		"node":    cluster.Node,
+		"health":  local,
+		"members": members,
+	})
+}
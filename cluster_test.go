@@ -0,0 +1,62 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGossipSigning(t *testing.T) {
+	c := &Cluster{Node: "a", Interval: time.Second, Key: []byte("secret")}
+	packet := func(key string, sent time.Time) []byte {
+		data, _ := json.Marshal(gossipMessage{Node: "b", Sent: sent.UnixMilli(), Health: map[string]bool{"default/x": false}})
+		signer := &Cluster{Key: []byte(key)}
+		return append(signer.sign(data), data...)
+	}
+	tampered := packet("secret", time.Now())
+	tampered[len(tampered)-3] ^= 1
+
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		ok     bool
+	}{
+		{"signed", packet("secret", time.Now()), true},
+		{"other key", packet("guess", time.Now()), false},
+		{"tampered", tampered, false},
+		{"replayed", packet("secret", time.Now().Add(-time.Hour)), false},
+		{"from the future", packet("secret", time.Now().Add(time.Hour)), false},
+		{"unsigned", []byte(`{"node":"b"}`), false},
+		{"empty", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, ok := c.verify(tc.packet)
+			if ok != tc.ok {
+				t.Fatalf("verify = %v, want %v", ok, tc.ok)
+			}
+			if ok && msg.Node != "b" {
+				t.Errorf("node %q, want b", msg.Node)
+			}
+		})
+	}
+}
+
+func TestClusterDecide(t *testing.T) {
+	c := &Cluster{Interval: time.Second, members: map[string]*clusterMember{}}
+	vote := func(addr string, alive bool) {
+		c.members[addr] = &clusterMember{lastSeen: time.Now(), health: map[string]bool{"default/x": alive}}
+	}
+	vote("b", false)
+	// one against one: this node's own view stands
+	if !c.Decide("default", "x", true) || c.Decide("default", "x", false) {
+		t.Error("a tie should keep the local verdict")
+	}
+	vote("c", false)
+	if c.Decide("default", "x", true) {
+		t.Error("two members against one should take the backend down")
+	}
+	c.members["c"].lastSeen = time.Now().Add(-time.Minute)
+	if !c.Decide("default", "x", true) {
+		t.Error("a member that stopped gossiping still votes")
+	}
+}
@@ -0,0 +1,8 @@
+// lb is the balancer's command line. run it with -h for the flags
+package main
+
+import loadbalancer "load-balancer"
+
+func main() {
+	loadbalancer.Main()
+}
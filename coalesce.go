@@ -0,0 +1,369 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Coalescer collapses concurrent identical GETs into one upstream request:
+// the first caller goes to the backend while later ones wait and get a copy
+// of its response. requests with credentials of their own are not shared,
+// nor are those of different callers as callerKey tells them apart, and a
+// response is only copied when it is small enough and not private to the
+// first caller. streams (server-sent events, gRPC) are never shared: their
+// waiters are let go as soon as the first response turns out to be one, and
+// neither is a response cut short by its backend failing.
+//
+// requests are identical when their host, URL, Range and KeyHeaders match.
+// with Vary set, a response that varies on other headers is only shared
+// with waiters that sent the same values as the first caller, and one that
+// varies on * with none; waiters that sent other values share a request of
+// their own. with Window set, a 2xx response a cache could reuse (not
+// no-cache or max-age=0) is also kept that long after it completes, so
+// requests arriving just after it share it too, up to WindowBytes of them
+// at a time
+type Coalescer struct {
+	MaxBody     int64
+	Window      time.Duration
+	WindowBytes int64
+	KeyHeaders  []string
+	Vary        bool
+
+	mux      sync.Mutex
+	calls    map[string]*coalescedCall
+	retained atomic.Int64  // bytes of completed responses kept for Window
+	shared   atomic.Uint64 // waiters given a copy
+	windowed atomic.Uint64 // given a copy of a completed response, in Window
+	unshared atomic.Uint64 // waiters that went upstream after all
+	upstream atomic.Uint64
+}
+
+type coalescedCall struct {
+	done       chan struct{}
+	status     int
+	header     http.Header
+	body       bytes.Buffer
+	shareable  bool
+	replayable bool        // may be kept for Window
+	vary       http.Header // the first caller's values of the headers the response varies on
+}
+
+const defaultCoalesceWindowBytes = 64 << 20
+
+// headers that make otherwise identical URLs produce different responses
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Range"}
+
+func NewCoalescer(maxBody int64) *Coalescer {
+	return &Coalescer{MaxBody: maxBody, WindowBytes: defaultCoalesceWindowBytes, KeyHeaders: coalesceKeyHeaders, Vary: true, calls: map[string]*coalescedCall{}}
+}
+
+// coalesceKey is the key of r with the default key headers, or false if r
+// is not shareable
+func coalesceKey(r *http.Request) (string, bool) {
+	return requestKey(r, coalesceKeyHeaders)
+}
+
+func (c *Coalescer) key(r *http.Request) (string, bool) {
+	return requestKey(r, c.KeyHeaders)
+}
+
+func requestKey(r *http.Request, headers []string) (string, bool) {
+	if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" ||
+		r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" ||
+		r.Header.Get(debugBackendHeader) != "" || r.Header.Get(maintenanceBypassHeader) != "" {
+		return "", false
+	}
+	if a := admitted(r); a != nil && a.pinned {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(callerKey(r))
+	b.WriteString("\n" + r.Host)
+	b.WriteString(r.URL.RequestURI())
+	for _, h := range headers {
+		b.WriteString("\n" + strings.Join(r.Header.Values(h), ","))
+	}
+	// a part of a response is never the same as another part
+	if !slices.Contains(headers, "Range") {
+		b.WriteString("\nrange " + r.Header.Get("Range"))
+	}
+	return b.String(), true
+}
+
+// sharesWith reports whether the call's response may go to r
+func (call *coalescedCall) sharesWith(r *http.Request) bool {
+	if !call.shareable {
+		return false
+	}
+	for name, values := range call.vary {
+		if strings.Join(r.Header.Values(name), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// varyKey extends the key of a request the call's response can't go to
+// because it varies on headers r sent otherwise, so requests sending what r
+// did can share one of their own
+func (call *coalescedCall) varyKey(r *http.Request) (string, bool) {
+	if !call.shareable || len(call.vary) == 0 {
+		return "", false
+	}
+	names := make([]string, 0, len(call.vary))
+	for name := range call.vary {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString("\nvary " + name + ": " + strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String(), true
+}
+
+// replayable reports whether a response may be kept for Window: a 2xx a
+// cache could reuse without asking the backend again
+func replayable(status int, h http.Header) bool {
+	if status < 200 || status > 299 {
+		return false
+	}
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache":
+			return false
+		case "max-age", "s-maxage":
+			if strings.Trim(value, `"`) == "0" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *Coalescer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := c.key(r)
+		if !ok || featureOff(r, "coalesce") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for extended := false; ; extended = true {
+			c.mux.Lock()
+			call, found := c.calls[key]
+			if !found {
+				break
+			}
+			c.mux.Unlock()
+			completed := true
+			select {
+			case <-call.done:
+			default:
+				completed = false
+				select {
+				case <-call.done:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if !call.sharesWith(r) {
+				if vk, ok := call.varyKey(r); ok && !extended {
+					key += vk
+					continue
+				}
+				c.unshared.Add(1)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if completed {
+				c.windowed.Add(1)
+			} else {
+				c.shared.Add(1)
+			}
+			// keep what outer middleware already set for this caller, e.g. its request id
+			for k, v := range call.header {
+				if _, set := w.Header()[k]; !set {
+					w.Header()[k] = v
+				}
+			}
+			w.WriteHeader(call.status)
+			_, _ = w.Write(call.body.Bytes())
+			return
+		}
+		// c.mux is held
+		call := &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.mux.Unlock()
+
+		c.upstream.Add(1)
+		cw := &coalesceWriter{ResponseWriter: w, c: c, key: key, call: call, max: c.MaxBody, status: http.StatusOK}
+		defer func() {
+			if v := recover(); v != nil {
+				// the backend failed mid-response and the proxy aborted it
+				cw.unshare()
+				panic(v)
+			}
+			if cw.released {
+				return
+			}
+			h := w.Header()
+			call.status, call.header = cw.status, h.Clone()
+			call.shareable = !cw.overflow && !cw.truncated() && r.Context().Err() == nil && h.Get("Set-Cookie") == "" &&
+				!strings.Contains(h.Get("Cache-Control"), "private") && !strings.Contains(h.Get("Cache-Control"), "no-store")
+			if c.Vary && call.shareable {
+				call.vary = http.Header{}
+				for _, name := range varyHeaders(h) {
+					if name == "*" {
+						call.shareable = false
+						break
+					}
+					if !slices.ContainsFunc(c.KeyHeaders, func(k string) bool { return strings.EqualFold(k, name) }) {
+						call.vary[name] = r.Header.Values(name)
+					}
+				}
+			}
+			call.replayable = call.shareable && replayable(call.status, h)
+			close(call.done)
+
+			if size := int64(call.body.Len()); c.Window > 0 && call.replayable && c.retain(size) {
+				time.AfterFunc(c.Window, func() {
+					c.forget(key, call)
+					c.retained.Add(-size)
+				})
+				return
+			}
+			c.forget(key, call)
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// retain reserves room for a response kept for Window, if there is some
+func (c *Coalescer) retain(size int64) bool {
+	if c.retained.Add(size) > c.WindowBytes {
+		c.retained.Add(-size)
+		return false
+	}
+	return true
+}
+
+// forget drops the call, unless a newer one has taken its key
+func (c *Coalescer) forget(key string, call *coalescedCall) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+}
+
+// varyHeaders lists the header names in h's Vary fields
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// streaming reports whether h starts a response that is consumed as it
+// arrives and may never end
+func streaming(h http.Header) bool {
+	ct := strings.ToLower(h.Get("Content-Type"))
+	return strings.HasPrefix(ct, "text/event-stream") || strings.HasPrefix(ct, "application/grpc") ||
+		strings.HasPrefix(ct, "multipart/x-mixed-replace")
+}
+
+// coalesceWriter passes the response through to the first caller and keeps a
+// copy for the waiters, up to max bytes
+type coalesceWriter struct {
+	http.ResponseWriter
+	c        *Coalescer
+	key      string
+	call     *coalescedCall
+	max      int64
+	status   int
+	written  int64
+	overflow bool
+	released bool // the waiters were let go without a copy
+}
+
+func (cw *coalesceWriter) WriteHeader(status int) {
+	cw.status = status
+	if streaming(cw.Header()) {
+		cw.unshare()
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// unshare lets the waiters go to send requests of their own
+func (cw *coalesceWriter) unshare() {
+	if cw.released {
+		return
+	}
+	cw.released = true
+	cw.call.status, cw.call.shareable = cw.status, false
+	close(cw.call.done)
+	cw.c.forget(cw.key, cw.call)
+}
+
+// truncated reports whether the body ended short of its Content-Length or
+// with the trailer saying the backend failed, see streamErrorTrailer
+func (cw *coalesceWriter) truncated() bool {
+	h := cw.Header()
+	if h.Get(streamErrorTrailer) != "" {
+		return true
+	}
+	n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	return err == nil && n != cw.written && cw.status != http.StatusNotModified
+}
+
+func (cw *coalesceWriter) Write(p []byte) (int, error) {
+	cw.written += int64(len(p))
+	if cw.released {
+		return cw.ResponseWriter.Write(p)
+	}
+	if !cw.overflow {
+		if int64(cw.call.body.Len()+len(p)) > cw.max {
+			cw.overflow = true
+			cw.call.body.Reset()
+		} else {
+			cw.call.body.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *coalesceWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+var coalescer *Coalescer
+
+func getCoalesce(w http.ResponseWriter, r *http.Request) {
+	if coalescer == nil {
+		http.Error(w, "request coalescing is off", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"upstream":    coalescer.upstream.Load(),
+		"shared":      coalescer.shared.Load(),
+		"windowed":    coalescer.windowed.Load(),
+		"unshared":    coalescer.unshared.Load(),
+		"window":      coalescer.Window.String(),
+		"retained":    coalescer.retained.Load(),
+		"key_headers": coalescer.KeyHeaders,
+		"vary":        coalescer.Vary,
+	})
+}
@@ -0,0 +1,251 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+)
+
+// with -compress, responses of the -compress-types media types are
+// compressed for clients that accept br or gzip, br when both are. a
+// response is only compressed once it reaches -compress-min-size: one of
+// unknown length is held until then, or until the handler flushes. responses
+// the backend already encoded or marked Cache-Control: no-transform, ranges,
+// and upgrades pass as they are. the
+// cache and the coalescer sit inside, so they hold plain responses. a strong
+// ETag is made weak, since the bytes sent differ from the backend's
+var compression *Compression
+
+// Compression compresses responses for clients that accept it
+type Compression struct {
+	MinSize      int64
+	ContentTypes []string // media types, or type/* for all of a type
+
+	responses [2]atomic.Uint64 // br, gzip
+	bytesIn   atomic.Uint64
+	bytesOut  atomic.Uint64
+}
+
+var compressEncodings = [2]string{"br", "gzip"}
+
+// pooled encoders, as each holds a few hundred KB of state
+var compressPools = [2]sync.Pool{
+	{New: func() any { return brotli.NewWriterLevel(nil, 5) }},
+	{New: func() any { return gzip.NewWriter(nil) }},
+}
+
+type resetWriteCloser interface {
+	io.WriteCloser
+	Reset(io.Writer)
+	Flush() error
+}
+
+// acceptedEncoding is the index in compressEncodings of the encoding r
+// prefers, or -1 for none
+func acceptedEncoding(r *http.Request) int {
+	best, bestQ := -1, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for i, enc := range compressEncodings {
+			// ties go to the encoding listed first in compressEncodings
+			if (strings.EqualFold(name, enc) || name == "*") && q > 0 && (q > bestQ || q == bestQ && i < best) {
+				best, bestQ = i, q
+			}
+		}
+	}
+	return best
+}
+
+// compresses reports whether a response of media type ct is compressed
+func (c *Compression) compresses(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.ContentTypes {
+		t = strings.TrimSpace(t)
+		if strings.EqualFold(t, mediaType) || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.ToLower(strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// noTransform reports whether h forbids intermediaries to change the body
+func noTransform(h http.Header) bool {
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Compression) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || r.Method == http.MethodConnect || isGRPC(r) || featureOff(r, "compress") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, c: c, encoding: acceptedEncoding(r), head: r.Method == http.MethodHead}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides at WriteHeader whether to compress, holding the
+// start of a body of unknown length until it is big enough
+type compressWriter struct {
+	http.ResponseWriter
+	c        *Compression
+	encoding int
+	head     bool
+
+	status  int
+	pending bool   // compressible, waiting for MinSize bytes
+	held    []byte // while pending
+	enc     resetWriteCloser
+	in      int64
+	out     countingWriter
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	h := cw.Header()
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent ||
+		h.Get("Content-Range") != "" || !cw.c.compresses(h.Get("Content-Type")) {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if ce := h.Get("Content-Encoding"); ce != "" && ce != "identity" || noTransform(h) {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// the response depends on Accept-Encoding whether or not this client sent one
+	h.Add("Vary", "Accept-Encoding")
+	size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	switch {
+	case cw.encoding < 0 || cw.head || err == nil && size < cw.c.MinSize:
+		cw.ResponseWriter.WriteHeader(status)
+	case err == nil:
+		cw.start()
+	default:
+		cw.pending = true
+	}
+}
+
+// start sends the headers for a compressed response and sets up the encoder
+func (cw *compressWriter) start() {
+	h := cw.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", compressEncodings[cw.encoding])
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.out.w = cw.ResponseWriter
+	cw.enc = compressPools[cw.encoding].Get().(resetWriteCloser)
+	cw.enc.Reset(&cw.out)
+	cw.pending = false
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.pending {
+		cw.held = append(cw.held, p...)
+		if int64(len(cw.held)) < cw.c.MinSize {
+			return len(p), nil
+		}
+		held := cw.held
+		cw.held = nil
+		cw.start()
+		if _, err := cw.write(held); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.enc != nil {
+		return cw.write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) write(p []byte) (int, error) {
+	cw.in += int64(len(p))
+	return cw.enc.Write(p)
+}
+
+// Flush sends what is held, compressed, so streamed responses keep moving
+func (cw *compressWriter) Flush() {
+	if cw.pending {
+		held := cw.held
+		cw.held = nil
+		cw.start()
+		_, _ = cw.write(held)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close sends a held body that stayed small as it was, or ends the
+// compressed stream
+func (cw *compressWriter) close() {
+	if cw.pending {
+		cw.Header().Set("Content-Length", strconv.Itoa(len(cw.held)))
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, _ = cw.ResponseWriter.Write(cw.held)
+		return
+	}
+	if cw.enc == nil {
+		return
+	}
+	_ = cw.enc.Close()
+	cw.enc.Reset(nil)
+	compressPools[cw.encoding].Put(cw.enc)
+	cw.c.responses[cw.encoding].Add(1)
+	cw.c.bytesIn.Add(uint64(cw.in))
+	cw.c.bytesOut.Add(uint64(cw.out.n))
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,301 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the structured form of the balancer's settings, loaded with
+// -config from YAML (.yaml/.yml) or JSON. flags given explicitly on the
+// command line win over the file. e.g.
+//
+//	port: 3000
+//	listen: ["127.0.0.1", "::1"]
+//	strategy: round-robin
+//	backends:
+//	  - http://10.0.0.5:8080=5
+//	  - url: http://10.0.0.6:8080
+//	    weight: 2
+//	    rack: r2
+//	health_check:
+//	  interval: 10s
+//	  timeout: 1s
+//	  path: /healthz
+//	  expected_status: 200-299
+//	  unhealthy_threshold: 3
+//	timeouts:
+//	  response_header: 30s
+//	tls:
+//	  cert: /etc/lb/cert.pem
+//	  key: /etc/lb/key.pem
+//	  redirect_port: 80
+//	  acme:
+//	    hosts: [lb.example.com]
+//	    cache: /var/lib/lb/acme
+//	pools:
+//	  static:
+//	    strategy: least-conn
+//	    backends: [http://10.0.0.9:8080]
+//	    health_check: {path: /ping, interval: 5s}
+//	routes:
+//	  - path_prefix: /static/
+//	    pool: static
+//	header_vars:
+//	  region: eu-west-1
+type Config struct {
+	Port        int               `json:"port" yaml:"port"`
+	Listen      []string          `json:"listen" yaml:"listen"`
+	Strategy    string            `json:"strategy" yaml:"strategy"`
+	Seed        uint64            `json:"seed" yaml:"seed"`
+	Backends    []BackendConfig   `json:"backends" yaml:"backends"`
+	HealthCheck HealthCheckConfig `json:"health_check" yaml:"health_check"`
+	Timeouts    TimeoutsConfig    `json:"timeouts" yaml:"timeouts"`
+	TLS         TLSConfig         `json:"tls" yaml:"tls"`
+	HeaderVars  map[string]string `json:"header_vars" yaml:"header_vars"` // {var.NAME} in header rules
+
+	// routed pools, as in a -routes file
+	Pools  map[string]PoolConfig `json:"pools" yaml:"pools"`
+	Routes []*Route              `json:"routes" yaml:"routes"`
+}
+
+// BackendConfig is a backend url with its options. it can also be written
+// as a single string in -backends syntax
+type BackendConfig struct {
+	URL            string `json:"url" yaml:"url"`
+	BackendOptions `yaml:",inline"`
+}
+
+type HealthCheckConfig struct {
+	Interval Duration `json:"interval" yaml:"interval"`
+	Timeout  Duration `json:"timeout" yaml:"timeout"`
+	Path     string   `json:"path" yaml:"path"` // empty means a TCP connect check
+
+	ExpectedStatus     string `json:"expected_status" yaml:"expected_status"` // e.g. 200-299,304
+	HealthyThreshold   int    `json:"healthy_threshold" yaml:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold" yaml:"unhealthy_threshold"`
+	ExpectedVersion    string `json:"expected_version" yaml:"expected_version"` // see -version-header
+}
+
+type TimeoutsConfig struct {
+	Dial           Duration `json:"dial" yaml:"dial"`
+	ResponseHeader Duration `json:"response_header" yaml:"response_header"`
+	Request        Duration `json:"request" yaml:"request"`
+	Idle           Duration `json:"idle" yaml:"idle"`
+	ClientIdle     Duration `json:"client_idle" yaml:"client_idle"`
+	ClientMaxAge   Duration `json:"client_max_age" yaml:"client_max_age"`
+	WebSocketIdle  Duration `json:"websocket_idle" yaml:"websocket_idle"`
+}
+
+// Duration reads "1.5s" style strings in both formats
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func backendConfigFromSpec(tok string) (BackendConfig, error) {
+	u, opts, err := parseBackendSpec(tok)
+	if err != nil {
+		return BackendConfig{}, err
+	}
+	return BackendConfig{URL: u.String(), BackendOptions: opts}, nil
+}
+
+func (bc *BackendConfig) UnmarshalJSON(data []byte) error {
+	var tok string
+	if json.Unmarshal(data, &tok) == nil {
+		parsed, err := backendConfigFromSpec(tok)
+		*bc = parsed
+		return err
+	}
+	type plain BackendConfig
+	return json.Unmarshal(data, (*plain)(bc))
+}
+
+func (bc *BackendConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		parsed, err := backendConfigFromSpec(node.Value)
+		*bc = parsed
+		return err
+	}
+	type plain BackendConfig
+	return node.Decode((*plain)(bc))
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(data, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig reads a config file's contents, YAML for a .yaml or .yml ext
+// and JSON otherwise
+func parseConfig(data []byte, ext string) (*Config, error) {
+	var cfg Config
+	var err error
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &cfg)
+	default:
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, bc := range cfg.Backends {
+		if _, err := parseBackendURL(bc.URL); err != nil {
+			return nil, err
+		}
+		if bc.Weight < 0 {
+			return nil, fmt.Errorf("backend %s: weight must be positive", bc.URL)
+		}
+	}
+	return &cfg, nil
+}
+
+// overlayFlags lets explicitly set flags override the file, fills what the
+// file leaves out from flag defaults and applies health, timeout and TLS
+// settings
+func (cfg *Config) overlayFlags(port int, strategy string, seed uint64) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["port"] || cfg.Port == 0 {
+		cfg.Port = port
+	}
+	if set["strategy"] || cfg.Strategy == "" {
+		cfg.Strategy = strategy
+	}
+	if set["seed"] || cfg.Seed == 0 {
+		cfg.Seed = seed
+	}
+	if !set["listen"] && len(cfg.Listen) > 0 {
+		bindAddrs = cfg.Listen
+	}
+	if !set["header-vars"] && len(cfg.HeaderVars) > 0 {
+		headerVars = cfg.HeaderVars
+	}
+	hc := cfg.HealthCheck
+	if !set["health-interval"] && hc.Interval.Duration > 0 {
+		healthCheckInterval = hc.Interval.Duration
+	}
+	if !set["health-timeout"] && hc.Timeout.Duration > 0 {
+		healthCheckTimeout = hc.Timeout.Duration
+	}
+	if !set["health-path"] && hc.Path != "" {
+		healthCheckPath = hc.Path
+	}
+	if !set["health-status"] && hc.ExpectedStatus != "" {
+		if err := healthCheckStatus.Set(hc.ExpectedStatus); err != nil {
+			return fmt.Errorf("health_check.expected_status: %w", err)
+		}
+	}
+	if !set["health-healthy-threshold"] && hc.HealthyThreshold > 0 {
+		healthyThreshold = hc.HealthyThreshold
+	}
+	if !set["health-unhealthy-threshold"] && hc.UnhealthyThreshold > 0 {
+		unhealthyThreshold = hc.UnhealthyThreshold
+	}
+	if !set["expected-version"] && hc.ExpectedVersion != "" {
+		expectedVersion = hc.ExpectedVersion
+	}
+	if !set["upstream-dial-timeout"] && cfg.Timeouts.Dial.Duration > 0 {
+		upstreamDialTimeout = cfg.Timeouts.Dial.Duration
+	}
+	if !set["websocket-idle-timeout"] && cfg.Timeouts.WebSocketIdle.Duration > 0 {
+		websocketIdleTimeout = cfg.Timeouts.WebSocketIdle.Duration
+	}
+	if !set["upstream-response-timeout"] && cfg.Timeouts.ResponseHeader.Duration > 0 {
+		upstreamResponseHeaderTimeout = cfg.Timeouts.ResponseHeader.Duration
+	}
+	if !set["request-timeout"] && cfg.Timeouts.Request.Duration > 0 {
+		requestTimeout = cfg.Timeouts.Request.Duration
+	}
+	if !set["upstream-idle-timeout"] && cfg.Timeouts.Idle.Duration > 0 {
+		upstreamIdleTimeout = cfg.Timeouts.Idle.Duration
+	}
+	if !set["client-idle-timeout"] && cfg.Timeouts.ClientIdle.Duration > 0 {
+		clientIdleTimeout = cfg.Timeouts.ClientIdle.Duration
+	}
+	if !set["client-max-age"] && cfg.Timeouts.ClientMaxAge.Duration > 0 {
+		clientMaxAge = cfg.Timeouts.ClientMaxAge.Duration
+	}
+	if !set["tls-cert"] && cfg.TLS.Cert != "" {
+		frontTLS.Cert = cfg.TLS.Cert
+	}
+	if !set["tls-key"] && cfg.TLS.Key != "" {
+		frontTLS.Key = cfg.TLS.Key
+	}
+	if !set["tls-client-ca"] && cfg.TLS.ClientCA != "" {
+		frontTLS.ClientCA = cfg.TLS.ClientCA
+	}
+	if !set["tls-redirect-port"] && cfg.TLS.RedirectPort > 0 {
+		frontTLS.RedirectPort = cfg.TLS.RedirectPort
+	}
+	acme := cfg.TLS.ACME
+	if !set["acme-hosts"] && len(acme.Hosts) > 0 {
+		frontTLS.ACME.Hosts = acme.Hosts
+	}
+	if !set["acme-cache"] && acme.Cache != "" {
+		frontTLS.ACME.Cache = acme.Cache
+	}
+	if !set["acme-email"] && acme.Email != "" {
+		frontTLS.ACME.Email = acme.Email
+	}
+	if !set["acme-directory"] && acme.Directory != "" {
+		frontTLS.ACME.Directory = acme.Directory
+	}
+	return nil
+}
+
+// AddBackendConfig adds a configured backend to the pool. discovery urls
+// (dns+, srv+, consul+, etcd+) name many backends and go through Discover
+// instead
+func (s *ServerPool) AddBackendConfig(bc BackendConfig) (*Backend, error) {
+	b, err := s.backendFromConfig(bc)
+	if err != nil {
+		return nil, err
+	}
+	s.AddBackend(b)
+	return b, nil
+}
+
+// backendFromConfig makes the backend AddBackendConfig adds
+func (s *ServerPool) backendFromConfig(bc BackendConfig) (*Backend, error) {
+	u, err := parseBackendURL(bc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if kind, _ := discoveryScheme(u.Scheme); kind != "" {
+		return nil, fmt.Errorf("backend %q: %s+ urls discover backends, they can't be added as one", bc.URL, kind)
+	}
+	b := s.NewBackend(u)
+	if err := bc.BackendOptions.apply(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
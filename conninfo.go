@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// details of the client's connection that backends can't see for
+// themselves, for auditing. -conn-info-headers picks which are sent and
+// under which header, e.g. "tls_version,client_cert_sha256=X-Cert-Hash",
+// or "all" for every field under its default header. a client's own values
+// for those headers are always replaced (or removed when the field is
+// empty, e.g. tls_cipher on plain HTTP), so they can't be spoofed. the same
+// fields are available to header rules as {tls_version} etc.
+var connInfoFields = []struct {
+	name, header string
+	value        func(r *http.Request) string
+}{
+	{"client_port", "X-Client-Port", func(r *http.Request) string {
+		_, port, _ := net.SplitHostPort(r.RemoteAddr)
+		return port
+	}},
+	{"tls_version", "X-TLS-Version", func(r *http.Request) string {
+		if r.TLS == nil {
+			return ""
+		}
+		return tls.VersionName(r.TLS.Version)
+	}},
+	{"tls_cipher", "X-TLS-Cipher", func(r *http.Request) string {
+		if r.TLS == nil {
+			return ""
+		}
+		return tls.CipherSuiteName(r.TLS.CipherSuite)
+	}},
+	{"tls_alpn", "X-TLS-ALPN", func(r *http.Request) string {
+		if r.TLS == nil {
+			return ""
+		}
+		return r.TLS.NegotiatedProtocol
+	}},
+	{"tls_sni", "X-TLS-SNI", func(r *http.Request) string {
+		if r.TLS == nil {
+			return ""
+		}
+		return r.TLS.ServerName
+	}},
+	{"client_cert_sha256", "X-Client-Cert-SHA256", func(r *http.Request) string {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return ""
+		}
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		return hex.EncodeToString(sum[:])
+	}},
+	{"client_cert_subject", "X-Client-Cert-Subject", func(r *http.Request) string {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return ""
+		}
+		return r.TLS.PeerCertificates[0].Subject.String()
+	}},
+}
+
+// connInfoHeader is one field sent to backends
+type connInfoHeader struct {
+	header string
+	value  func(r *http.Request) string
+}
+
+var connInfoHeaders []connInfoHeader
+
+// parseConnInfoHeaders reads -conn-info-headers
+func parseConnInfoHeaders(spec string) ([]connInfoHeader, error) {
+	var headers []connInfoHeader
+	for _, item := range strings.Split(spec, ",") {
+		name, header, _ := strings.Cut(strings.TrimSpace(item), "=")
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, f := range connInfoFields {
+			if name != f.name && name != "all" {
+				continue
+			}
+			found = true
+			h := f.header
+			if header != "" && name != "all" {
+				h = header
+			}
+			headers = append(headers, connInfoHeader{header: http.CanonicalHeaderKey(h), value: f.value})
+		}
+		if !found {
+			names := make([]string, len(connInfoFields))
+			for i, f := range connInfoFields {
+				names[i] = f.name
+			}
+			return nil, fmt.Errorf("unknown connection info field %q (use all, %s)", name, strings.Join(names, ", "))
+		}
+	}
+	return headers, nil
+}
+
+// setConnInfoHeaders runs in the proxy director
+func setConnInfoHeaders(out *http.Request) {
+	for _, h := range connInfoHeaders {
+		if v := h.value(out); v != "" {
+			out.Header.Set(h.header, v)
+		} else {
+			out.Header.Del(h.header)
+		}
+	}
+}
+
+// connInfoTemplate lists the fields as header rule placeholders
+func connInfoTemplate(r *http.Request) []string {
+	var pairs []string
+	for _, f := range connInfoFields {
+		pairs = append(pairs, "{"+f.name+"}", f.value(r))
+	}
+	return pairs
+}
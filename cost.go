@@ -0,0 +1,61 @@
+package loadbalancer
+
+import "time"
+
+// LeastCost sends each request to the cheapest backend that can take it, for
+// pools that mix, say, on-premises or spot servers with on-demand ones, or
+// backends in other clouds that charge egress. a backend's cost is its
+// ;cost= attribute, in whatever unit the pool's backends share, 0 when unset.
+// a backend can take a request when it is live, has room under its
+// max_conns, and its probe round-trip time is within -cost-max-latency; when
+// none is within the bound, any live backend with room will do, as serving
+// slowly beats not serving. backends of the same cost share the load as with
+// least-conn, and once the cheapest are full the next cheapest take the rest
+type LeastCost struct{}
+
+// bound on a backend's smoothed probe round trip for least-cost, 0 for none
+var costMaxLatency time.Duration
+
+func (LeastCost) Next(s *ServerPool) *Backend {
+	if b := cheapest(s, true); b != nil {
+		return b
+	}
+	return cheapest(s, false)
+}
+
+// cheapest is the least loaded of the cheapest backends that can take a
+// request, within -cost-max-latency if bounded, or nil
+func cheapest(s *ServerPool, bounded bool) *Backend {
+	backends := s.Backends()
+	start := s.NextIndex()
+	var best, fallback *Backend
+	var bestLoad, bestWeight int64
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		if !b.IsAlive() {
+			continue
+		}
+		if fallback == nil {
+			fallback = b
+		}
+		if b.MaxConns > 0 && b.reserved.Load() >= int64(b.MaxConns) {
+			continue
+		}
+		if rtt := b.ProbeRTT(); bounded && costMaxLatency > 0 && rtt > costMaxLatency {
+			continue
+		}
+		load, w := b.InFlight()+1, int64(b.effectiveWeight())
+		switch {
+		case best == nil || b.Cost < best.Cost:
+		case b.Cost == best.Cost && load*bestWeight < bestLoad*w:
+		default:
+			continue
+		}
+		best, bestLoad, bestWeight = b, load, w
+	}
+	if best == nil && !bounded {
+		// all full: claim waits for a slot or turns the request away
+		return fallback
+	}
+	return best
+}
@@ -0,0 +1,77 @@
+package loadbalancer
+
+import "net/http"
+
+// getDashboard serves a page that shows /status as tables, refreshed every
+// few seconds. it is self-contained, so it works without internet access
+func getDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Load balancer status</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; margin: 0 0 .2em; }
+h2 { font-size: 1.1em; margin: 1.6em 0 .4em; }
+#meta { color: #666; }
+table { border-collapse: collapse; min-width: 40em; }
+th, td { text-align: left; padding: .3em .8em; border-bottom: 1px solid #ddd; }
+th { font-weight: 600; background: #f4f4f4; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+.up { color: #17803d; } .down, .ejected { color: #c62828; font-weight: 600; }
+.maintenance, .draining, .drained, .degraded, .backing-off { color: #b26a00; }
+.bad { color: #c62828; font-weight: 600; }
+#error { color: #c62828; }
+</style>
+</head>
+<body>
+<h1>Load balancer</h1>
+<div id="meta">loading...</div>
+<div id="error"></div>
+<div id="pools"></div>
+<script>
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c]));
+}
+function pct(x) { return (x * 100).toFixed(1) + "%"; }
+function render(st) {
+  document.getElementById("meta").textContent =
+    "up " + st.uptime + " since " + new Date(st.started).toLocaleString() + ", refreshed " + new Date().toLocaleTimeString();
+  let html = "";
+  for (const p of st.pools) {
+    html += "<h2>" + esc(p.name) + ": " + p.healthy + "/" + (p.healthy + p.unhealthy) + " healthy, " +
+      p.in_flight + (p.max_conns ? "/" + p.max_conns : "") + " in flight, " +
+      p.requests_last_minute + " requests and " + pct(p.retry_rate) + " retried in the last minute</h2>";
+    html += "<table><tr><th>Backend</th><th>State</th><th>Weight</th><th>In flight</th>" +
+      "<th>Requests/min</th><th>Errors/min</th><th>Error rate</th></tr>";
+    for (const b of p.backends) {
+      html += "<tr><td>" + esc(b.name) + "</td><td class=\"" + esc(b.state) + "\">" + esc(b.state) + "</td>" +
+        "<td class=n>" + b.weight + "</td><td class=n>" + b.in_flight + "</td>" +
+        "<td class=n>" + b.requests_last_minute + "</td><td class=n>" + b.errors_last_minute + "</td>" +
+        "<td class=\"n" + (b.error_rate >= 0.05 ? " bad" : "") + "\">" + pct(b.error_rate) + "</td></tr>";
+    }
+    html += "</table>";
+  }
+  document.getElementById("pools").innerHTML = html;
+}
+async function refresh() {
+  try {
+    const res = await fetch("status", {cache: "no-store"});
+    render(await res.json());
+    document.getElementById("error").textContent = "";
+  } catch (e) {
+    document.getElementById("error").textContent = "refresh failed: " + e;
+  }
+}
+refresh();
+setInterval(refresh, 3000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,41 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// an X-Debug-Backend header carrying a valid X-Debug-Token bypasses the
+// strategy, affinity and health checks and sends the request to the named
+// backend, so backend-specific bugs can be reproduced through the balancer
+const (
+	debugBackendHeader = "X-Debug-Backend"
+	debugTokenHeader   = "X-Debug-Token"
+)
+
+// debugToken enables forced routing when set (-debug-token)
+var debugToken string
+
+// debugBackend resolves a forced backend. ok is false when an error has
+// already been written
+func (s *ServerPool) debugBackend(w http.ResponseWriter, r *http.Request, name string) (b *Backend, ok bool) {
+	token := r.Header.Get(debugTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(debugToken)) != 1 {
+		log.Printf("%s(%s) Rejected %s without a valid token\n", r.RemoteAddr, r.URL.Path, debugBackendHeader)
+		writeError(w, r, http.StatusForbidden, "debug_forbidden", "Invalid debug token.", 0)
+		return nil, false
+	}
+	if b = s.FindBackend(name); b == nil {
+		writeError(w, r, http.StatusNotFound, "unknown_backend", fmt.Sprintf("No backend named %q.", name), 0)
+		return nil, false
+	}
+	return b, true
+}
+
+// stripDebugHeaders keeps the token from reaching backends
+func stripDebugHeaders(r *http.Request) {
+	r.Header.Del(debugBackendHeader)
+	r.Header.Del(debugTokenHeader)
+}
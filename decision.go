@@ -0,0 +1,66 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// decisionHeader carries the balancing decision back to the client when
+// -trace-decisions is on
+const decisionHeader = "X-LB-Decision"
+
+var traceDecisions bool
+
+// Decision records how the pool picked a backend for one attempt
+type Decision struct {
+	Pool       string
+	Strategy   string
+	Candidates []string // live backends at the time of the pick
+	Backend    string
+	Attempt    int
+	Via        string // strategy, affinity, sticky, read-your-writes, failover, shift or debug
+}
+
+func (d Decision) String() string {
+	return fmt.Sprintf("pool=%s; strategy=%s; candidates=%s; backend=%s; attempt=%d; via=%s",
+		d.Pool, d.Strategy, strings.Join(d.Candidates, ","), d.Backend, d.Attempt, d.Via)
+}
+
+// strategyName finds the registry name of a strategy
+func strategyName(st Strategy) string {
+	if st == nil {
+		return "round-robin"
+	}
+	for name, newStrategy := range strategies {
+		if fmt.Sprintf("%T", newStrategy(nil)) == fmt.Sprintf("%T", st) {
+			return name
+		}
+	}
+	return fmt.Sprintf("%T", st)
+}
+
+// traceDecision reports the pick in the response header, the access log and
+// the process log. retries overwrite the header, so the client sees the
+// attempt that answered
+func (s *ServerPool) traceDecision(w http.ResponseWriter, r *http.Request, b *Backend, via string) {
+	d := Decision{
+		Pool:     s.Name,
+		Strategy: strategyName(s.Strategy),
+		Backend:  b.Name(),
+		Attempt:  GetAttemptsFromContext(r) + 1,
+		Via:      via,
+	}
+	for _, c := range s.Backends() {
+		if c.IsAlive() {
+			d.Candidates = append(d.Candidates, c.Name())
+		}
+	}
+	trace := d.String()
+	w.Header().Set(decisionHeader, trace)
+	if e := accessLogEntry(r); e != nil {
+		e.Decision = trace
+	}
+	log.Printf("%s(%s) Decision: %s\n", r.RemoteAddr, r.URL.Path, trace)
+}
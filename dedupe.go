@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DedupeGuard catches double submits: a POST from the same client to the
+// same URL with the same body within Window of an earlier one. in "reject"
+// mode the repeat is answered 409 without reaching a backend; in
+// "serialize" mode it waits for the earlier one to finish and then goes
+// through, so the backend sees them one after the other. the client is its
+// IP plus its credentials (Authorization, Cookie, API key), so users behind
+// one NAT aren't mistaken for each other. bodies over MaxBody aren't checked
+type DedupeGuard struct {
+	Window  time.Duration
+	Mode    string
+	MaxBody int64
+
+	mux       sync.Mutex
+	seen      map[string]*dedupeEntry
+	lastSweep time.Time
+
+	rejected   atomic.Uint64
+	serialized atomic.Uint64
+}
+
+type dedupeEntry struct {
+	at   time.Time
+	done chan struct{} // closed once the first request is answered
+}
+
+var dedupe = &DedupeGuard{Mode: "reject", MaxBody: 1 << 20}
+
+func dedupeKey(r *http.Request, body []byte) string {
+	key := ""
+	if apiKeys != nil {
+		key = r.Header.Get(apiKeys.Header)
+	}
+	h := sha256.New()
+	for _, part := range []string{requestClientIP(r), r.Header.Get("Authorization"), r.Header.Get("Cookie"), key,
+		r.Method, r.Host, r.URL.RequestURI()} {
+		io.WriteString(h, part)
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sweep drops entries past the window. called with mux held
+func (d *DedupeGuard) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.Window {
+		return
+	}
+	d.lastSweep = now
+	for key, e := range d.seen {
+		if now.Sub(e.at) >= d.Window {
+			select {
+			case <-e.done:
+				delete(d.seen, key)
+			default: // still running, serialized requests may wait on it
+			}
+		}
+	}
+}
+
+func (d *DedupeGuard) Middleware(next http.Handler) http.Handler {
+	d.seen = map[string]*dedupeEntry{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Body == nil || r.Body == http.NoBody || r.ContentLength > d.MaxBody || isGRPC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, d.MaxBody+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || int64(len(body)) > d.MaxBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := dedupeKey(r, body)
+
+		now := time.Now()
+		d.mux.Lock()
+		d.sweep(now)
+		prev, dup := d.seen[key]
+		if dup && now.Sub(prev.at) >= d.Window {
+			dup = false
+		}
+		if dup && d.Mode == "reject" {
+			d.mux.Unlock()
+			d.rejected.Add(1)
+			writeError(w, r, http.StatusConflict, "duplicate_request", "The same request was just submitted.", d.Window-now.Sub(prev.at))
+			return
+		}
+		entry := &dedupeEntry{at: now, done: make(chan struct{})}
+		d.seen[key] = entry
+		d.mux.Unlock()
+		defer close(entry.done)
+
+		if dup {
+			d.serialized.Add(1)
+			select {
+			case <-prev.done:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,491 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backends behind a DNS name whose addresses keep changing, e.g. a headless
+// Kubernetes service, can be given by name instead of one by one:
+//
+//	dns+http://api.default.svc.cluster.local:8080      a backend per A/AAAA address
+//	srv+http://_http._tcp.api.default.svc.cluster.local a backend per SRV target, on its port
+//
+// the name is looked up again every -discovery-interval, and backends are
+// added as addresses appear and drained as they go. the ;options apply to
+// every backend found; SRV weights are used unless a weight is given. a
+// lookup that fails keeps the current backends, while a name that doesn't
+// exist (e.g. no pod is ready) leaves none. service registries work the
+// same way, see registry.go
+var discoveryInterval = 10 * time.Second
+
+// how long a lookup may take when -resolver-servers doesn't say
+const discoveryTimeout = 5 * time.Second
+
+// Discovery keeps a pool's backends in line with a DNS name or a registry
+type Discovery struct {
+	Config BackendConfig
+
+	pool   *ServerPool
+	base   *url.URL // what the backends' urls are made from
+	source discoverySource
+
+	// apply runs one at a time, probing new backends' versions outside mux
+	applyMux sync.Mutex
+
+	mux      sync.Mutex
+	backends map[discoveredAddr]discoveredBackend
+	pinned   map[discoveredAddr]bool             // kept even once the lookups lose them
+	pending  int                                 // changes held back while the pool's discovery is paused
+	found    map[discoveredAddr]discoveredTarget // by the last lookup
+	refused  int                                 // of found, for their version
+	retry    *time.Timer                         // applying found again while some are refused
+	stopped  bool
+	ctx      context.Context // done once stopped
+	stop     context.CancelFunc
+
+	failures atomic.Uint64
+}
+
+// discoverySource finds the addresses behind a dns+, srv+, consul+ or etcd+
+// url
+type discoverySource interface {
+	lookup(ctx context.Context) (map[discoveredAddr]discoveredTarget, error)
+	// watches reports whether lookup waits for a change itself, rather than
+	// being called every discoveryInterval
+	watches() bool
+}
+
+type discoveredAddr struct {
+	host, port string
+}
+
+// what a lookup says about an address
+type discoveredTarget struct {
+	name   string // the name the address was found under, for TLS
+	weight int    // from SRV or the registry, 0 for none
+}
+
+type discoveredBackend struct {
+	*Backend
+	target discoveredTarget
+	gone   bool // pinned, but no longer found
+}
+
+// discoveryKinds are the prefixes a backend url's scheme may have
+var discoveryKinds = []string{"dns", "srv", "consul", "etcd"}
+
+// discoveryScheme splits dns+http into dns and http. kind is empty for a
+// plain backend url
+func discoveryScheme(scheme string) (kind, base string) {
+	if k, b, ok := strings.Cut(scheme, "+"); ok && slices.Contains(discoveryKinds, k) {
+		return k, b
+	}
+	return "", scheme
+}
+
+// isDiscoveryURL reports whether a backend url names a DNS record or
+// registry to discover backends from rather than a backend
+func isDiscoveryURL(s string) bool {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return false
+	}
+	kind, _ := discoveryScheme(u.Scheme)
+	return kind != ""
+}
+
+// Discover looks bc's name up, adds the backends found to the pool and keeps
+// them up to date until Stop
+func (s *ServerPool) Discover(bc BackendConfig) (*Discovery, error) {
+	d, err := s.newDiscovery(bc)
+	if err != nil {
+		return nil, err
+	}
+	d.start()
+	return d, nil
+}
+
+func (s *ServerPool) newDiscovery(bc BackendConfig) (*Discovery, error) {
+	u, err := parseBackendURL(bc.URL)
+	if err != nil {
+		return nil, err
+	}
+	kind, scheme := discoveryScheme(u.Scheme)
+	base := &url.URL{Scheme: scheme}
+	var source discoverySource
+	switch kind {
+	case "dns", "srv":
+		// the path is the backends'
+		base.Path, base.RawPath, base.RawQuery = u.Path, u.RawPath, u.RawQuery
+		source = &dnsSource{name: u.Hostname(), port: u.Port(), srv: kind == "srv"}
+	case "consul":
+		source, err = newConsulSource(u)
+	case "etcd":
+		source, err = newEtcdSource(u)
+	default:
+		return nil, fmt.Errorf("backend %q: not a discovery url", bc.URL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %w", bc.URL, err)
+	}
+	d := &Discovery{Config: bc, pool: s, base: base, source: source, backends: map[discoveredAddr]discoveredBackend{}}
+	d.ctx, d.stop = context.WithCancel(context.Background())
+	// try the options on a stand-in, so bad ones fail now and not on every lookup
+	if _, err := d.newBackend(discoveredAddr{"127.0.0.1", "1"}, discoveredTarget{name: u.Hostname()}); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// start does the first lookup, so the backends are there before serving,
+// and then looks again every discoveryInterval, or whenever the source says
+// there is a change
+func (d *Discovery) start() {
+	d.pool.discoveryMux.Lock()
+	d.pool.discoveries = append(d.pool.discoveries, d)
+	d.pool.discoveryMux.Unlock()
+
+	ok := d.refresh()
+	go func() {
+		for {
+			if !ok || !d.source.watches() {
+				select {
+				case <-d.ctx.Done():
+					return
+				case <-time.After(discoveryInterval):
+				}
+			}
+			if d.ctx.Err() != nil {
+				return
+			}
+			ok = d.refresh()
+		}
+	}()
+}
+
+// Stop ends the lookups and drains the backends that were found
+func (d *Discovery) Stop() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.stopped {
+		return
+	}
+	d.stopped = true
+	d.stop()
+	if d.retry != nil {
+		d.retry.Stop()
+	}
+	for _, b := range d.backends {
+		d.pool.RemoveBackend(b.Backend)
+	}
+	d.backends, d.pinned = nil, nil
+}
+
+func (d *Discovery) String() string {
+	return d.Config.URL
+}
+
+func (b *Backend) discoveredFrom() string {
+	if b.discovery == nil {
+		return ""
+	}
+	return b.discovery.String()
+}
+
+// Backends is how many backends the name has now
+func (d *Discovery) Backends() int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return len(d.backends)
+}
+
+func (d *Discovery) newBackend(addr discoveredAddr, t discoveredTarget) (*Backend, error) {
+	u := *d.base
+	u.Host = addr.host
+	if addr.port != "" {
+		u.Host = net.JoinHostPort(addr.host, addr.port)
+	} else if strings.Contains(addr.host, ":") {
+		u.Host = "[" + addr.host + "]"
+	}
+	opts := d.Config.BackendOptions
+	if opts.TLS.ServerName == "" && t.name != "" && u.Scheme == "https" {
+		// certificates are for the name, not the address
+		opts.TLS.ServerName = t.name
+	}
+	if opts.Weight == 0 && t.weight > 0 {
+		opts.Weight = t.weight
+	}
+	b := d.pool.NewBackend(&u)
+	if err := opts.apply(b); err != nil {
+		return nil, err
+	}
+	b.discovery = d
+	return b, nil
+}
+
+// dnsSource looks up A/AAAA records, or SRV records and their targets'
+// addresses
+type dnsSource struct {
+	name, port string
+	srv        bool
+}
+
+func (*dnsSource) watches() bool { return false }
+
+func (*dnsSource) resolver() (*net.Resolver, time.Duration) {
+	if upstreamResolver == nil {
+		return net.DefaultResolver, discoveryTimeout
+	}
+	if upstreamResolver.Timeout <= 0 {
+		return upstreamResolver.resolver, discoveryTimeout
+	}
+	return upstreamResolver.resolver, upstreamResolver.Timeout
+}
+
+// lookup asks DNS for the name's addresses. it skips the -resolver-cache-ttl
+// cache, which would hide changes
+func (ds *dnsSource) lookup(ctx context.Context) (map[discoveredAddr]discoveredTarget, error) {
+	res, timeout := ds.resolver()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	found := map[discoveredAddr]discoveredTarget{}
+	if !ds.srv {
+		ips, err := res.LookupIP(ctx, "ip", ds.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			found[discoveredAddr{ip.String(), ds.port}] = discoveredTarget{name: ds.name}
+		}
+		return found, nil
+	}
+	_, srvs, err := res.LookupSRV(ctx, "", "", ds.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, srv := range srvs {
+		name := strings.TrimSuffix(srv.Target, ".")
+		ips, err := res.LookupIP(ctx, "ip", name)
+		if err != nil {
+			if isNotFound(err) {
+				// the target went away between the two lookups
+				continue
+			}
+			return nil, err
+		}
+		for _, ip := range ips {
+			found[discoveredAddr{ip.String(), fmt.Sprint(srv.Port)}] = discoveredTarget{name: name, weight: int(srv.Weight)}
+		}
+	}
+	return found, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// refresh looks the addresses up and adds, replaces (e.g. on a new weight)
+// and removes backends to match. it reports whether the lookup worked
+func (d *Discovery) refresh() bool {
+	found, err := d.source.lookup(d.ctx)
+	if d.ctx.Err() != nil {
+		return false
+	}
+	if err != nil && !isNotFound(err) {
+		d.failures.Add(1)
+		log.Printf("[%s] Discovering backends from %s failed, keeping the last ones: %v\n", d.pool.Name, d, err)
+		return false
+	}
+	return d.apply(found)
+}
+
+// vetted is a backend for an address a lookup found, or why it isn't added
+type vetted struct {
+	b   *Backend
+	err error
+}
+
+// vet makes backends for the addresses in found that are new or changed
+// and checks their versions, without holding d.mux while they answer
+func (d *Discovery) vet(found map[discoveredAddr]discoveredTarget) map[discoveredAddr]vetted {
+	d.mux.Lock()
+	todo := map[discoveredAddr]discoveredTarget{}
+	for addr, t := range found {
+		if old, ok := d.backends[addr]; !ok || old.target != t {
+			todo[addr] = t
+		}
+	}
+	d.mux.Unlock()
+
+	checked := make(map[discoveredAddr]vetted, len(todo))
+	for addr, t := range todo {
+		b, err := d.newBackend(addr, t)
+		if err == nil {
+			err = d.pool.checkVersion(b)
+		}
+		checked[addr] = vetted{b, err}
+	}
+	return checked
+}
+
+// apply adds, replaces and removes backends to match found. a backend
+// refused for its version is tried again every discoveryInterval, as a
+// source that watches may not report another change for a long time
+func (d *Discovery) apply(found map[discoveredAddr]discoveredTarget) bool {
+	d.applyMux.Lock()
+	defer d.applyMux.Unlock()
+	checked := d.vet(found)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.stopped {
+		return false
+	}
+	d.found, d.refused = found, 0
+	defer d.retryRefused()
+	if d.pool.discoveryPaused.Load() {
+		if n := d.changes(found); n != d.pending {
+			d.pending = n
+			log.Printf("[%s] Discovery is paused, holding back %d change(s) from %s\n", d.pool.Name, n, d)
+		}
+		return true
+	}
+	d.pending = 0
+	for addr, b := range d.backends {
+		if _, ok := found[addr]; ok {
+			continue
+		}
+		if d.pinned[addr] {
+			if !b.gone {
+				b.gone = true
+				d.backends[addr] = b
+				log.Printf("[%s] Discovered backend %s is gone but pinned, keeping it\n", d.pool.Name, b.URL())
+			}
+			continue
+		}
+		delete(d.backends, addr)
+		d.pool.RemoveBackend(b.Backend)
+		log.Printf("[%s] Removed discovered backend: %s, draining\n", d.pool.Name, b.URL())
+	}
+	for addr, t := range found {
+		old, ok := d.backends[addr]
+		if ok && old.target == t {
+			if old.gone {
+				old.gone = false
+				d.backends[addr] = old
+			}
+			continue
+		}
+		v, seen := checked[addr]
+		if !seen {
+			continue // changed while the others were vetted; the next apply has it
+		}
+		if v.err != nil {
+			d.refused++
+			log.Printf("[%s] Not adding discovered backend %s: %v\n", d.pool.Name, addr.host, v.err)
+			continue
+		}
+		b := v.b
+		d.backends[addr] = discoveredBackend{Backend: b, target: t}
+		if ok {
+			d.pool.ReplaceBackend(old.Backend, b)
+			log.Printf("[%s] Updated discovered backend: %s, weight %d\n", d.pool.Name, b.URL(), b.Weight)
+			continue
+		}
+		d.pool.AddBackend(b)
+		log.Printf("[%s] Added discovered backend: %s\n", d.pool.Name, b.URL())
+	}
+	return true
+}
+
+// retryRefused applies the last lookup again in a while, if any backend it
+// found was refused. sources that don't watch look again by then anyway
+func (d *Discovery) retryRefused() {
+	if d.refused == 0 || !d.source.watches() || d.retry != nil {
+		return
+	}
+	d.retry = time.AfterFunc(discoveryInterval, func() {
+		d.mux.Lock()
+		found := d.found
+		d.retry = nil
+		d.mux.Unlock()
+		d.apply(found)
+	})
+}
+
+// changes counts what applying found would add, replace and remove
+func (d *Discovery) changes(found map[discoveredAddr]discoveredTarget) int {
+	n := 0
+	for addr := range d.backends {
+		if _, ok := found[addr]; !ok && !d.pinned[addr] {
+			n++
+		}
+	}
+	for addr, t := range found {
+		if old, ok := d.backends[addr]; !ok || old.target != t {
+			n++
+		}
+	}
+	return n
+}
+
+// Discoveries is a snapshot of the pool's running discoveries
+func (s *ServerPool) Discoveries() []*Discovery {
+	s.discoveryMux.Lock()
+	defer s.discoveryMux.Unlock()
+	return append([]*Discovery(nil), s.discoveries...)
+}
+
+// setDiscoveries keeps the running discoveries that are still wanted, stops
+// the rest and starts the new ones. nothing changes if a new one is invalid
+func (s *ServerPool) setDiscoveries(want []BackendConfig) error {
+	running := s.Discoveries()
+	var kept, started []*Discovery
+	for _, bc := range want {
+		i := -1
+		for j, d := range running {
+			if d != nil && reflect.DeepEqual(d.Config, bc) {
+				i = j
+				break
+			}
+		}
+		if i >= 0 {
+			kept = append(kept, running[i])
+			running[i] = nil
+			continue
+		}
+		d, err := s.newDiscovery(bc)
+		if err != nil {
+			return err
+		}
+		started = append(started, d)
+	}
+
+	s.discoveryMux.Lock()
+	s.discoveries = kept
+	s.discoveryMux.Unlock()
+	for _, d := range running {
+		if d != nil {
+			d.Stop()
+			log.Printf("[%s] Stopped discovering backends from %s\n", s.Name, d)
+		}
+	}
+	for _, d := range started {
+		d.start()
+		log.Printf("[%s] Discovering backends from %s\n", s.Name, d)
+	}
+	return nil
+}
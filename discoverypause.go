@@ -0,0 +1,178 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// during an incident, discovery can be told to keep its hands off a pool:
+// while it is paused the lookups go on, but what they find is only counted,
+// not applied, so the pool stays as it was until discovery resumes and the
+// next lookup catches up. a pinned backend stays in its pool even once
+// discovery loses it, e.g. a pod whose readiness flaps but which serves
+// fine, until it is unpinned:
+//
+//	PUT /admin/discovery {"pool": "api", "paused": true}
+//	PUT /admin/backends/10.0.0.5:8080/pin?pool=api {"pinned": true}
+
+// PauseDiscovery pauses or resumes the discovery of the pool's backends.
+// resuming looks everything up again at once
+func (s *ServerPool) PauseDiscovery(paused bool) {
+	if s.discoveryPaused.Swap(paused) == paused {
+		return
+	}
+	if paused {
+		log.Printf("[%s] Discovery paused, the backends stay as they are\n", s.Name)
+		return
+	}
+	log.Printf("[%s] Discovery resumed\n", s.Name)
+	for _, d := range s.Discoveries() {
+		go d.refresh()
+	}
+}
+
+// pin pins or unpins a backend d found, and reports whether d still has it.
+// a backend unpinned after d lost it is removed right away
+func (d *Discovery) pin(b *Backend, pinned bool) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for addr, db := range d.backends {
+		if db.Backend != b {
+			continue
+		}
+		if pinned {
+			if d.pinned == nil {
+				d.pinned = map[discoveredAddr]bool{}
+			}
+			d.pinned[addr] = true
+			return true
+		}
+		delete(d.pinned, addr)
+		if db.gone && !d.pool.discoveryPaused.Load() {
+			delete(d.backends, addr)
+			d.pool.RemoveBackend(b)
+			log.Printf("[%s] Removed discovered backend: %s, draining\n", d.pool.Name, b.URL())
+		}
+		return true
+	}
+	return false
+}
+
+// Pinned reports whether discovery is kept from removing the backend
+func (b *Backend) Pinned() bool {
+	d := b.discovery
+	if d == nil {
+		return false
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for addr, db := range d.backends {
+		if db.Backend == b {
+			return d.pinned[addr]
+		}
+	}
+	return false
+}
+
+// DiscoveryStatus is a discovery url in GET /admin/discovery
+type DiscoveryStatus struct {
+	Pool     string   `json:"pool"`
+	URL      string   `json:"url"`
+	Backends int      `json:"backends"`
+	Paused   bool     `json:"paused"`
+	Pending  int      `json:"pending,omitempty"` // changes held back while paused
+	Pinned   []string `json:"pinned,omitempty"`
+	Gone     []string `json:"gone,omitempty"` // pinned backends discovery no longer finds
+	Failures uint64   `json:"failures"`
+}
+
+func (d *Discovery) status() DiscoveryStatus {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	st := DiscoveryStatus{
+		Pool:     d.pool.Name,
+		URL:      d.String(),
+		Backends: len(d.backends),
+		Paused:   d.pool.discoveryPaused.Load(),
+		Pending:  d.pending,
+		Failures: d.failures.Load(),
+	}
+	for addr, b := range d.backends {
+		if !d.pinned[addr] {
+			continue
+		}
+		st.Pinned = append(st.Pinned, b.Name())
+		if b.gone {
+			st.Gone = append(st.Gone, b.Name())
+		}
+	}
+	sort.Strings(st.Pinned)
+	sort.Strings(st.Gone)
+	return st
+}
+
+// lists every pool's discovery urls, or one pool's with ?pool=
+func getDiscovery(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("pool")
+	list := []DiscoveryStatus{}
+	for _, p := range pools {
+		if name != "" && p.Name != name {
+			continue
+		}
+		for _, d := range p.Discoveries() {
+			list = append(list, d.status())
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// pauses or resumes a pool's discovery, e.g. {"pool": "api", "paused": true}
+func putDiscovery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pool   string `json:"pool"`
+		Paused bool   `json:"paused"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pool := findPool(req.Pool)
+	if pool == nil {
+		http.Error(w, fmt.Sprintf("unknown pool %q", req.Pool), http.StatusNotFound)
+		return
+	}
+	pool.PauseDiscovery(req.Paused)
+	list := []DiscoveryStatus{}
+	for _, d := range pool.Discoveries() {
+		list = append(list, d.status())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// pins a discovered backend or unpins it, e.g. {"pinned": true}
+func putPin(w http.ResponseWriter, r *http.Request) {
+	pool, b, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Pinned bool `json:"pinned"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b.discovery == nil {
+		http.Error(w, fmt.Sprintf("backend %q wasn't discovered, only discovery removes backends on its own", b.Name()), http.StatusBadRequest)
+		return
+	}
+	if !b.discovery.pin(b, req.Pinned) {
+		http.Error(w, fmt.Sprintf("backend %q already removed", b.Name()), http.StatusNotFound)
+		return
+	}
+	log.Printf("[%s] Backend %s pinned: %t\n", pool.Name, b.Name(), req.Pinned)
+	writeJSON(w, http.StatusOK, backendStatus(pool.Name, b))
+}
@@ -0,0 +1,448 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSResponder answers A/AAAA queries for Name with the addresses of the
+// default pool's healthy backends, and for <pool>.Name with those of a named
+// pool, so clients can balance themselves off the same health checks.
+// backends given by hostname are resolved on every query.
+//
+// SRV queries for the same names, with any _service._proto labels in front,
+// get a record per healthy backend, on its port, whose target is named
+// after its address, e.g. 10-0-0-5.backends.lb.internal., which resolves
+// to it for as long as the backend is live. with Weighted, the SRV weights are the backends' weights as the
+// balancer uses them, lowered while a backend ramps up or reports itself
+// degraded, and A/AAAA answers list the addresses in a weighted random
+// order, so clients taking the first get the heavier backends more often.
+// otherwise every backend counts the same
+type DNSResponder struct {
+	Name     string // fully qualified, e.g. "backends.lb.internal."
+	TTL      time.Duration
+	Weighted bool
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+)
+
+var errDNSMalformed = errors.New("dns: malformed query")
+
+// at most this many queries are answered at once, the rest dropped for the
+// client to retry
+const dnsMaxInFlight = 64
+
+// Serve answers queries on a UDP address until the socket fails. each is
+// answered on its own goroutine, so one waiting on a backend's host name to
+// resolve doesn't hold up the rest
+func (d *DNSResponder) Serve(addr string) error {
+	conn, err := listenUDP(addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("DNS responder for %s at %s\n", d.Name, conn.LocalAddr())
+
+	inFlight := make(chan struct{}, dnsMaxInFlight)
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			continue
+		}
+		go func(query []byte) {
+			defer func() { <-inFlight }()
+			if res := d.answer(query); res != nil {
+				_, _ = conn.WriteTo(res, from)
+			}
+		}(append([]byte(nil), buf[:n]...))
+	}
+}
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	class uint16
+	end   int // offset just past the question
+}
+
+// parseDNSQuery reads the header and the single question of a query
+func parseDNSQuery(msg []byte) (dnsQuestion, error) {
+	var q dnsQuestion
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return q, errDNSMalformed
+	}
+
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return q, errDNSMalformed
+		}
+		l := int(msg[i])
+		i++
+		if l == 0 {
+			break
+		}
+		// queries never need compression pointers
+		if l > 63 || i+l > len(msg) {
+			return q, errDNSMalformed
+		}
+		labels = append(labels, strings.ToLower(string(msg[i:i+l])))
+		i += l
+	}
+	if i+4 > len(msg) {
+		return q, errDNSMalformed
+	}
+	q.name = strings.Join(labels, ".") + "."
+	q.qtype = binary.BigEndian.Uint16(msg[i : i+2])
+	q.class = binary.BigEndian.Uint16(msg[i+2 : i+4])
+	q.end = i + 4
+	return q, nil
+}
+
+// answer builds the response to one query packet, or nil to drop it
+func (d *DNSResponder) answer(msg []byte) []byte {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return nil // too short to reply to, or a response
+	}
+	q, err := parseDNSQuery(msg)
+	if err != nil {
+		return dnsReply(msg, 12, dnsRcodeFormErr, nil)
+	}
+	if opcode := msg[2] >> 3 & 0xf; opcode != 0 {
+		return dnsReply(msg, q.end, dnsRcodeNotImp, nil)
+	}
+
+	if ip := d.addressName(q.name); ip != nil {
+		live, err := liveAddress(ip)
+		if err != nil {
+			log.Println("DNS lookup failed: ", err)
+			return dnsReply(msg, q.end, dnsRcodeServFail, nil)
+		}
+		if !live {
+			return dnsReply(msg, q.end, dnsRcodeNXDomain, nil)
+		}
+		if q.class != dnsClassIN || (q.qtype != dnsTypeA && q.qtype != dnsTypeAAAA) {
+			return dnsReply(msg, q.end, 0, nil)
+		}
+		answers, count, _ := d.addressRecords(dnsPointer, q.qtype, []dnsTarget{{ip: ip}}, 512-q.end)
+		return dnsCounted(dnsReply(msg, q.end, 0, answers), count, 0)
+	}
+
+	name := q.name
+	if q.qtype == dnsTypeSRV {
+		for strings.HasPrefix(name, "_") {
+			_, name, _ = strings.Cut(name, ".")
+		}
+	}
+	pool := d.pool(name)
+	if pool == nil {
+		return dnsReply(msg, q.end, dnsRcodeNXDomain, nil)
+	}
+	if q.class != dnsClassIN || (q.qtype != dnsTypeA && q.qtype != dnsTypeAAAA && q.qtype != dnsTypeSRV) {
+		return dnsReply(msg, q.end, 0, nil)
+	}
+
+	targets, err := healthyTargets(pool)
+	if err != nil {
+		log.Println("DNS lookup failed: ", err)
+		return dnsReply(msg, q.end, dnsRcodeServFail, nil)
+	}
+	if q.qtype == dnsTypeSRV {
+		return d.answerSRV(msg, q, targets)
+	}
+	targets = d.order(byAddress(targets))
+	answers, count, dropped := d.addressRecords(dnsPointer, q.qtype, targets, 512-q.end)
+	res := dnsCounted(dnsReply(msg, q.end, 0, answers), count, 0)
+	if dropped {
+		dnsTruncated(res)
+	}
+	return res
+}
+
+// name is a pointer to the question at offset 12
+var dnsPointer = []byte{0xc0, 0x0c}
+
+// addressRecords are the A or AAAA records of the targets under name, as
+// many as fit in room bytes, how many that is and whether any didn't fit
+func (d *DNSResponder) addressRecords(name []byte, qtype uint16, targets []dnsTarget, room int) ([]byte, int, bool) {
+	var records []byte
+	count := 0
+	for _, t := range targets {
+		rdata := t.ip.To4()
+		if qtype == dnsTypeAAAA {
+			if rdata != nil {
+				continue
+			}
+			rdata = t.ip.To16()
+		} else if rdata == nil {
+			continue
+		}
+		rr := d.record(name, qtype, rdata)
+		// stay inside a plain 512 byte UDP response
+		if len(records)+len(rr) > room {
+			return records, count, true
+		}
+		records = append(records, rr...)
+		count++
+	}
+	return records, count, false
+}
+
+// answerSRV answers with a record per target, and the targets' addresses in
+// the additional section as far as they fit. the reply is marked truncated
+// when not every SRV record fits, not for missing addresses, which clients
+// look up themselves
+func (d *DNSResponder) answerSRV(msg []byte, q dnsQuestion, targets []dnsTarget) []byte {
+	var answers []byte
+	var published []dnsTarget
+	for _, t := range d.order(targets) {
+		weight := uint16(1)
+		if d.Weighted {
+			weight = uint16(min(max(math.Round(t.weight), 1), math.MaxUint16))
+		}
+		rdata := binary.BigEndian.AppendUint16(nil, 0) // priority
+		rdata = binary.BigEndian.AppendUint16(rdata, weight)
+		rdata = binary.BigEndian.AppendUint16(rdata, t.port)
+		rdata = append(rdata, d.targetName(t.ip)...)
+		rr := d.record(dnsPointer, dnsTypeSRV, rdata)
+		if q.end+len(answers)+len(rr) > 512 {
+			break
+		}
+		answers = append(answers, rr...)
+		published = append(published, t)
+	}
+
+	var extra []byte
+	extraCount := 0
+	for _, t := range byAddress(published) {
+		qtype := uint16(dnsTypeA)
+		if t.ip.To4() == nil {
+			qtype = dnsTypeAAAA
+		}
+		glue, n, _ := d.addressRecords(d.targetName(t.ip), qtype, []dnsTarget{t}, 512-q.end-len(answers)-len(extra))
+		extra = append(extra, glue...)
+		extraCount += n
+	}
+	res := dnsCounted(dnsReply(msg, q.end, 0, append(answers, extra...)), len(published), extraCount)
+	if len(published) < len(targets) {
+		dnsTruncated(res)
+	}
+	return res
+}
+
+// targetName is the SRV target for an address, uncompressed as SRV wants
+func (d *DNSResponder) targetName(ip net.IP) []byte {
+	return dnsEncodeName(d.addressLabel(ip) + "." + d.Name)
+}
+
+func (d *DNSResponder) record(name []byte, qtype uint16, rdata []byte) []byte {
+	rr := append([]byte(nil), name...)
+	rr = binary.BigEndian.AppendUint16(rr, qtype)
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+	rr = binary.BigEndian.AppendUint32(rr, uint32(d.TTL.Seconds()))
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// dnsCounted sets a reply's answer and additional record counts
+func dnsCounted(res []byte, answers, additional int) []byte {
+	binary.BigEndian.PutUint16(res[6:8], uint16(answers))
+	binary.BigEndian.PutUint16(res[10:12], uint16(additional))
+	return res
+}
+
+// dnsTruncated sets a reply's TC bit, telling the client that records were
+// left out to fit in 512 bytes
+func dnsTruncated(res []byte) {
+	res[2] |= 0x02
+}
+
+func dnsEncodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// addressLabel names an address under Name: 10-0-0-5, or fd00--5 for fd00::5
+func (d *DNSResponder) addressLabel(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.ReplaceAll(ip4.String(), ".", "-")
+	}
+	return strings.ReplaceAll(ip.String(), ":", "-")
+}
+
+// addressName is the address a name from addressLabel stands for, nil if it
+// isn't one
+func (d *DNSResponder) addressName(name string) net.IP {
+	label, ok := strings.CutSuffix(name, "."+d.Name)
+	if !ok || !strings.Contains(label, "-") || strings.Contains(label, ".") {
+		return nil
+	}
+	if ip := net.ParseIP(strings.ReplaceAll(label, "-", ".")); ip != nil && ip.To4() != nil {
+		return ip
+	}
+	return net.ParseIP(strings.ReplaceAll(label, "-", ":"))
+}
+
+// liveAddress reports whether ip is the address of a live backend of any
+// pool, which are the only ones addressName answers for
+func liveAddress(ip net.IP) (bool, error) {
+	for _, p := range pools {
+		targets, err := healthyTargets(p)
+		if err != nil {
+			return false, err
+		}
+		for _, t := range targets {
+			if t.ip.Equal(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// order shuffles the targets so that each comes first with a chance in
+// proportion to its weight, and leaves them be unless Weighted
+func (d *DNSResponder) order(targets []dnsTarget) []dnsTarget {
+	if !d.Weighted || len(targets) < 2 {
+		return targets
+	}
+	keys := make([]float64, len(targets))
+	for i, t := range targets {
+		keys[i] = math.Pow(rand.Float64(), 1/max(t.weight, 1))
+	}
+	idx := make([]int, len(targets))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return keys[idx[a]] > keys[idx[b]] })
+	ordered := make([]dnsTarget, len(targets))
+	for i, j := range idx {
+		ordered[i] = targets[j]
+	}
+	return ordered
+}
+
+func (d *DNSResponder) pool(name string) *ServerPool {
+	if name == d.Name {
+		return &serverPool
+	}
+	if prefix, ok := strings.CutSuffix(name, "."+d.Name); ok && !strings.Contains(prefix, ".") {
+		for _, p := range pools {
+			if strings.EqualFold(p.Name, prefix) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// dnsReply copies the header and question and appends the answer section
+func dnsReply(query []byte, end, rcode int, answers []byte) []byte {
+	res := make([]byte, 0, end+len(answers))
+	res = append(res, query[:end]...)
+	// QR and AA set, opcode and RD echoed back
+	res[2] = 0x84 | query[2]&0x79
+	res[3] = byte(rcode)
+	if end == 12 {
+		binary.BigEndian.PutUint16(res[4:6], 0) // question wasn't understood
+	}
+	clear(res[6:12])
+	return append(res, answers...)
+}
+
+// dnsTarget is a live backend address as the responder publishes it
+type dnsTarget struct {
+	ip     net.IP
+	port   uint16
+	weight float64 // see dnsWeight
+}
+
+// dnsWeight is what a backend weighs in DNS answers: its weight as the
+// strategies see it, in hundredths, as far as it has ramped up
+func dnsWeight(b *Backend) float64 {
+	return float64(b.effectiveWeight()) * b.rampShare()
+}
+
+// healthyTargets returns the addresses and ports of the pool's live
+// backends
+func healthyTargets(s *ServerPool) ([]dnsTarget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var targets []dnsTarget
+	seen := map[string]bool{}
+	for _, b := range s.Backends() {
+		if !b.IsAlive() {
+			continue
+		}
+		u := b.URL()
+		host := u.Hostname()
+		port, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			port = 80
+			if u.Scheme == "https" {
+				port = 443
+			}
+		}
+		addrs := []net.IP{net.ParseIP(host)}
+		if addrs[0] == nil {
+			found, err := lookupBackendIP(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			addrs = found
+		}
+		for _, ip := range addrs {
+			key := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+			if !seen[key] {
+				seen[key] = true
+				targets = append(targets, dnsTarget{ip: ip, port: uint16(port), weight: dnsWeight(b)})
+			}
+		}
+	}
+	return targets, nil
+}
+
+// byAddress merges targets on the same address, adding up their weights
+func byAddress(targets []dnsTarget) []dnsTarget {
+	var merged []dnsTarget
+	at := map[string]int{}
+	for _, t := range targets {
+		if i, ok := at[t.ip.String()]; ok {
+			merged[i].weight += t.weight
+			continue
+		}
+		at[t.ip.String()] = len(merged)
+		merged = append(merged, dnsTarget{ip: t.ip, weight: t.weight})
+	}
+	return merged
+}
@@ -0,0 +1,48 @@
+package loadbalancer
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// TestDNSAddressNames checks that the per-address names only resolve for
+// live backends
+func TestDNSAddressNames(t *testing.T) {
+	pool := &ServerPool{Name: "api"}
+	for _, spec := range []string{"http://10.0.0.5:8080", "http://10.0.0.6:8080", "http://[fd00::5]:8080"} {
+		if _, err := pool.AddBackendSpec(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.FindBackend("10.0.0.6:8080").SetAlive(false)
+	saved := pools
+	pools = []*ServerPool{pool}
+	defer func() { pools = saved }()
+
+	d := &DNSResponder{Name: "backends.lb.internal.", TTL: time.Second}
+	for _, tc := range []struct {
+		name    string
+		qtype   uint16
+		rcode   byte
+		answers uint16
+	}{
+		{"10-0-0-5", dnsTypeA, 0, 1},
+		{"fd00--5", dnsTypeAAAA, 0, 1},
+		{"10-0-0-6", dnsTypeA, dnsRcodeNXDomain, 0},
+		{"169-254-169-254", dnsTypeA, dnsRcodeNXDomain, 0},
+		{"169-254-169-254", dnsTypeSRV, dnsRcodeNXDomain, 0},
+	} {
+		query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+		query = append(query, dnsEncodeName(tc.name+"."+d.Name)...)
+		query = binary.BigEndian.AppendUint16(query, tc.qtype)
+		query = binary.BigEndian.AppendUint16(query, dnsClassIN)
+		res := d.answer(query)
+		if len(res) < 12 {
+			t.Fatalf("%s: no reply", tc.name)
+		}
+		if rcode, answers := res[3]&0xf, binary.BigEndian.Uint16(res[6:8]); rcode != tc.rcode || answers != tc.answers {
+			t.Errorf("%s: rcode %d with %d answers, want %d with %d", tc.name, rcode, answers, tc.rcode, tc.answers)
+		}
+	}
+}
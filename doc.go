@@ -0,0 +1,20 @@
+// Package loadbalancer is an HTTP and TCP load balancer. cmd/lb is its
+// command line, configured with flags and an optional config file, and Main
+// runs it the same way.
+//
+// a program can also embed a pool of its own, which is an http.Handler:
+//
+//	pool := &loadbalancer.ServerPool{Name: "api"}
+//	if _, err := pool.AddBackendSpec("http://10.0.0.5:8080;weight=2"); err != nil {
+//		log.Fatal(err)
+//	}
+//	go pool.RunHealthChecks(ctx)
+//	http.ListenAndServe(":8080", pool)
+//
+// settings that the command line takes as flags, such as timeouts and retry
+// policy, are still shared by every pool in the process.
+//
+// the parts that don't depend on the balancer are packages of their own:
+// redis is the small RESP client shared state lives in, framing checks the
+// HTTP/1 framing of front-end connections, and sigv4 signs requests to AWS
+package loadbalancer
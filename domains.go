@@ -0,0 +1,38 @@
+package loadbalancer
+
+// domainDistance scores how far apart two backends' failure domains are:
+// 2 for different racks, 1 for different hosts in the same (or unknown)
+// rack, 0 for the same host
+func domainDistance(a, b *Backend) int {
+	if a.Rack != "" && b.Rack != "" && a.Rack != b.Rack {
+		return 2
+	}
+	if a.Host != b.Host {
+		return 1
+	}
+	return 0
+}
+
+// awayFrom picks the live backend furthest from failed's failure domain, so
+// a retry lands somewhere that doesn't share the failure that just happened:
+// another rack if racks are known, otherwise another host. equally distant
+// ones keep round-robin order
+func (s *ServerPool) awayFrom(failed *Backend) *Backend {
+	backends := s.Backends()
+	if len(backends) == 0 {
+		return nil
+	}
+	start := s.NextIndex()
+	var best *Backend
+	bestDistance := -1
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		if b == failed || !b.IsAlive() {
+			continue
+		}
+		if d := domainDistance(failed, b); d > bestDistance {
+			best, bestDistance = b, d
+		}
+	}
+	return best
+}
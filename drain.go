@@ -0,0 +1,181 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// a drain started through the admin API takes a backend out of rotation
+// the way maintenance does, while its requests in flight finish: it isn't
+// marked down, so nothing is logged as failing or retried elsewhere. once
+// nothing is in flight it is reported drained, in the log and through
+//
+//	GET /admin/backends/{name}/drain?wait=30s
+//
+// which answers at once, or waits up to ?wait= for the backend to drain, so
+// a deploy script can stop the server as soon as it is safe to. while
+// draining it shows how far along it is: the requests left, how long the
+// oldest has been running and, once some have finished, an estimate of when
+// the rest will have at the rate so far
+type manualDrain struct {
+	mux     sync.Mutex
+	started time.Time
+	atStart int64         // requests in flight when the drain started
+	done    chan struct{} // closed once drained
+	stop    chan struct{} // closed when the drain is called off
+	drained time.Time
+}
+
+// DrainStatus is a manual drain as the admin API shows it
+type DrainStatus struct {
+	Backend  string     `json:"backend"`
+	State    string     `json:"state"` // draining or drained
+	InFlight int64      `json:"in_flight"`
+	Finished int64      `json:"finished"`                     // of those in flight when it started
+	Oldest   float64    `json:"oldest_age_seconds,omitempty"` // of the requests left
+	ETA      float64    `json:"eta_seconds,omitempty"`        // until drained, once it can be told
+	Started  time.Time  `json:"started"`
+	Drained  *time.Time `json:"drained,omitempty"`
+}
+
+// drainETA estimates how long the requests left take to finish from how
+// many finished in elapsed, 0 if none did yet
+func drainETA(atStart, left int64, elapsed time.Duration) time.Duration {
+	finished := atStart - left
+	if left <= 0 || finished <= 0 {
+		return 0
+	}
+	return time.Duration(float64(elapsed) * float64(left) / float64(finished))
+}
+
+// StartDrain takes b out of rotation until StopDrain, and reports whether it
+// wasn't draining already
+func (b *Backend) StartDrain() bool {
+	d := &manualDrain{started: time.Now(), atStart: b.InFlight(), done: make(chan struct{}), stop: make(chan struct{})}
+	if !b.drain.CompareAndSwap(nil, d) {
+		return false
+	}
+	go func() {
+		tick := time.NewTicker(100 * time.Millisecond)
+		defer tick.Stop()
+		// a tick first, for requests picked just before the drain to get going
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-tick.C:
+			}
+			if b.InFlight() == 0 {
+				break
+			}
+		}
+		d.mux.Lock()
+		d.drained = time.Now()
+		d.mux.Unlock()
+		close(d.done)
+		log.Printf("Backend %s: drained after %s, safe to stop\n", b.Name(), time.Since(d.started).Round(time.Millisecond))
+	}()
+	return true
+}
+
+// StopDrain puts b back in rotation, and reports whether it was draining
+func (b *Backend) StopDrain() bool {
+	d := b.drain.Swap(nil)
+	if d == nil {
+		return false
+	}
+	close(d.stop)
+	return true
+}
+
+// DrainStatus is nil unless a drain was started
+func (b *Backend) DrainStatus() *DrainStatus {
+	d := b.drain.Load()
+	if d == nil {
+		return nil
+	}
+	left := b.InFlight()
+	st := &DrainStatus{Backend: b.Name(), State: "draining", InFlight: left, Finished: max(d.atStart-left, 0), Started: d.started}
+	if started, ok := activeRequests.oldest(b); ok {
+		st.Oldest = time.Since(started).Seconds()
+	}
+	st.ETA = drainETA(d.atStart, left, time.Since(d.started)).Seconds()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if !d.drained.IsZero() {
+		drained := d.drained
+		st.State, st.Drained = "drained", &drained
+	}
+	return st
+}
+
+func (b *Backend) drainState() string {
+	if st := b.DrainStatus(); st != nil {
+		return st.State
+	}
+	return ""
+}
+
+// starts draining a backend, answering with its drain status
+func postDrain(w http.ResponseWriter, r *http.Request) {
+	pool, b, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	if b.StartDrain() {
+		log.Printf("[%s] Draining backend %s through the admin API, %d in flight\n", pool.Name, b.Name(), b.InFlight())
+	}
+	writeJSON(w, http.StatusAccepted, b.DrainStatus())
+}
+
+// reports a drain, waiting up to ?wait= for it to finish
+func getDrain(w http.ResponseWriter, r *http.Request) {
+	_, b, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	d := b.drain.Load()
+	if d == nil {
+		http.Error(w, fmt.Sprintf("backend %q is not draining", b.Name()), http.StatusNotFound)
+		return
+	}
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		timeout, err := time.ParseDuration(wait)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad wait %q", wait), http.StatusBadRequest)
+			return
+		}
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-d.done:
+		case <-d.stop:
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	st := b.DrainStatus()
+	if st == nil {
+		http.Error(w, fmt.Sprintf("backend %q is no longer draining", b.Name()), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// calls a drain off, putting the backend back in rotation
+func deleteDrain(w http.ResponseWriter, r *http.Request) {
+	pool, b, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	if !b.StopDrain() {
+		http.Error(w, fmt.Sprintf("backend %q is not draining", b.Name()), http.StatusNotFound)
+		return
+	}
+	log.Printf("[%s] Backend %s back in rotation through the admin API\n", pool.Name, b.Name())
+	writeJSON(w, http.StatusOK, backendStatus(pool.Name, b))
+}
@@ -0,0 +1,202 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ErrorPages replace the balancer's own error responses, e.g. the bare
+// "Server unavailable." 503, with pages of your own. they are keyed by
+// status, "503", or by the error code the JSON errors carry, e.g.
+// "no_healthy_backend" or "maintenance", a code winning over its status:
+//
+//	{"503": {"file": "errors/down.html"},
+//	 "504": {"status": 503, "body": "{\"error\": {{json .Message}}, \"id\": {{json .RequestID}}}"},
+//	 "maintenance": {"file": "errors/maintenance.html"}}
+//
+// -error-pages loads them for every request, a route's error_pages override
+// them key by key for its own requests. a page is a Go template of the
+// ErrorResponse fields (.Status, .Code, .Message, .RequestID, .RetryAfter),
+// sent as is whatever the client accepts; HTML pages are escaped as HTML,
+// and json quotes a value for JSON ones
+type ErrorPages map[string]*ErrorPage
+
+type ErrorPage struct {
+	Status      int    `json:"status,omitempty" yaml:"status"`             // answers with this instead
+	ContentType string `json:"content_type,omitempty" yaml:"content_type"` // guessed from the file name or body otherwise
+	Body        string `json:"body,omitempty" yaml:"body"`
+	File        string `json:"file,omitempty" yaml:"file"`
+
+	tmpl interface {
+		Execute(w io.Writer, data any) error
+	}
+}
+
+// errorPages are -error-pages
+var errorPages ErrorPages
+
+func LoadErrorPages(path string) (ErrorPages, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pages ErrorPages
+	if err := json.Unmarshal(data, &pages); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := pages.init(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pages, nil
+}
+
+func (pages ErrorPages) init() error {
+	for key, p := range pages {
+		if status, err := strconv.Atoi(key); err == nil {
+			if status < 400 || status > 599 {
+				return fmt.Errorf("error page %q: statuses go from 400 to 599", key)
+			}
+		} else if key == "" || strings.Trim(key, "abcdefghijklmnopqrstuvwxyz_") != "" {
+			return fmt.Errorf("error page %q: expected a status like 503 or an error code like no_healthy_backend", key)
+		}
+		if p == nil {
+			return fmt.Errorf("error page %q: empty", key)
+		}
+		if err := p.init(); err != nil {
+			return fmt.Errorf("error page %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (p *ErrorPage) init() error {
+	if (p.Body == "") == (p.File == "") {
+		return fmt.Errorf("needs one of body and file")
+	}
+	if p.Status != 0 && (p.Status < 200 || p.Status > 599) {
+		return fmt.Errorf("status %d out of range", p.Status)
+	}
+	body := p.Body
+	if p.File != "" {
+		data, err := os.ReadFile(p.File)
+		if err != nil {
+			return err
+		}
+		body = string(data)
+	}
+	if p.ContentType == "" {
+		p.ContentType = guessErrorPageType(p.File, body)
+	}
+	funcs := map[string]any{"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	}}
+	var err error
+	if strings.HasPrefix(p.ContentType, "text/html") {
+		p.tmpl, err = htmltemplate.New("error page").Funcs(funcs).Parse(body)
+	} else {
+		p.tmpl, err = template.New("error page").Funcs(funcs).Parse(body)
+	}
+	return err
+}
+
+func guessErrorPageType(file, body string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".html", ".htm":
+		return "text/html; charset=utf-8"
+	case ".json":
+		return "application/json"
+	case ".txt":
+		return "text/plain; charset=utf-8"
+	}
+	switch trimmed := strings.TrimSpace(body); {
+	case strings.HasPrefix(trimmed, "<"):
+		return "text/html; charset=utf-8"
+	case strings.HasPrefix(trimmed, "{"), strings.HasPrefix(trimmed, "["):
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+type errorPagesKey struct{}
+
+// withErrorPages makes pages the route's for r
+func withErrorPages(r *http.Request, pages ErrorPages) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), errorPagesKey{}, pages))
+}
+
+// errorPage is the page replacing an error, the route's before
+// -error-pages, nil for none
+func errorPage(r *http.Request, status int, code string) *ErrorPage {
+	route, _ := r.Context().Value(errorPagesKey{}).(ErrorPages)
+	for _, pages := range []ErrorPages{route, errorPages} {
+		if p := pages[code]; p != nil {
+			return p
+		}
+		if p := pages[strconv.Itoa(status)]; p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// write renders the page for e
+func (p *ErrorPage) write(w http.ResponseWriter, e ErrorResponse) {
+	var buf strings.Builder
+	if err := p.tmpl.Execute(&buf, e); err != nil {
+		// a template that can't render still beats no answer
+		buf.Reset()
+		buf.WriteString(e.Message + "\n")
+		p = &ErrorPage{Status: p.Status, ContentType: "text/plain; charset=utf-8"}
+	}
+	status := e.Status
+	if p.Status != 0 {
+		status = p.Status
+	}
+	w.Header().Set("Content-Type", p.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, buf.String())
+}
+
+// SetFallback gives the pool a backend to send requests to while none of its
+// own is live, or once every one tried has failed, e.g. a static "we'll be
+// right back" site or a read-only replica, instead of an error. it is health checked as the pool
+// <name>-fallback, and requests it can't take get the usual error
+func (s *ServerPool) SetFallback(bc BackendConfig) error {
+	f := &ServerPool{Name: s.Name + "-fallback", Health: s.Health}
+	b, err := f.AddBackendConfig(bc)
+	if err != nil {
+		return err
+	}
+	s.Fallback = f
+	pools = append(pools, f)
+	log.Printf("[%s] Fallback backend: %s\n", s.Name, b.URL())
+	return nil
+}
+
+// serveFallback hands r to the fallback pool if it has a live backend. the
+// body has been rewound for it like for any retry
+func (s *ServerPool) serveFallback(w http.ResponseWriter, r *http.Request) bool {
+	if s.Fallback == nil || requestTimedOut(r) || !slices.ContainsFunc(s.Fallback.Backends(), (*Backend).IsAlive) {
+		return false
+	}
+	log.Printf("[%s] No backend left to try, %s(%s) goes to the fallback\n", s.Name, r.RemoteAddr, r.URL.Path)
+	// a fresh start in the fallback pool, with retries of its own
+	ctx := context.WithValue(r.Context(), Attempts, 0)
+	ctx = context.WithValue(ctx, Retry, 0)
+	ctx = context.WithValue(ctx, FailedBackend, nil)
+	s.Fallback.ServeHTTP(w, r.WithContext(ctx))
+	return true
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorResponse is the body of every error the balancer itself produces
+type ErrorResponse struct {
+	Status     int    `json:"status"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds
+}
+
+// writeError replies with a JSON error for API clients, an HTML page for
+// browsers and plain text for clients asking only for text. a non-zero
+// retryAfter is also sent as Retry-After
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, retryAfter time.Duration) {
+	e := ErrorResponse{
+		Status:     status,
+		Code:       code,
+		Message:    message,
+		RequestID:  GetRequestID(r),
+		RetryAfter: int(math.Ceil(retryAfter.Seconds())),
+	}
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	journalError(r, code)
+	if page := errorPage(r, status, code); page != nil {
+		page.write(w, e)
+		return
+	}
+
+	switch negotiateErrorType(r.Header.Get("Accept")) {
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>%d %s</title></head><body>\n<h1>%s</h1>\n<p>%s</p>\n",
+			status, http.StatusText(status), http.StatusText(status), html.EscapeString(message))
+		if e.RetryAfter > 0 {
+			fmt.Fprintf(w, "<p>Please try again in %d seconds.</p>\n", e.RetryAfter)
+		}
+		if e.RequestID != "" {
+			fmt.Fprintf(w, "<p><small>Request ID: %s</small></p>\n", html.EscapeString(e.RequestID))
+		}
+		fmt.Fprint(w, "</body></html>\n")
+	case "text/plain":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, message)
+		if e.RequestID != "" {
+			fmt.Fprintf(w, "request id: %s\n", e.RequestID)
+		}
+	default:
+		writeJSON(w, status, map[string]ErrorResponse{"error": e})
+	}
+}
+
+// negotiateErrorType picks the error format from an Accept header. browsers
+// list text/html, API clients json or nothing, so JSON is the fallback
+func negotiateErrorType(accept string) string {
+	best, bestQ := "application/json", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/json", "text/html", "text/plain":
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFailover(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		setup  func(h *Harness)
+		status int
+		avoid  []int // backends no response may come from
+	}{
+		{"all up", func(h *Harness) {}, http.StatusOK, nil},
+		{"one killed", func(h *Harness) { _ = h.Kill(1) }, http.StatusOK, []int{1}},
+		{"killed and checked", func(h *Harness) {
+			_ = h.Kill(0)
+			h.CheckHealth()
+		}, http.StatusOK, []int{0}},
+		{"two killed", func(h *Harness) {
+			_ = h.Kill(0)
+			_ = h.Kill(2)
+		}, http.StatusOK, []int{0, 2}},
+		{"revived", func(h *Harness) {
+			_ = h.Kill(1)
+			h.CheckHealth()
+			_ = h.Revive(1)
+			h.CheckHealth()
+		}, http.StatusOK, nil},
+		{"all killed", func(h *Harness) {
+			for i := range 3 {
+				_ = h.Kill(i)
+			}
+			h.CheckHealth()
+		}, http.StatusServiceUnavailable, []int{0, 1, 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := NewHarness(3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			tc.setup(h)
+
+			served := map[int]bool{}
+			for range 9 {
+				echo, status, err := h.Get("/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status != tc.status {
+					t.Fatalf("status %d, want %d", status, tc.status)
+				}
+				served[echo.BackendPort] = true
+			}
+			for _, i := range tc.avoid {
+				if served[h.Port(i)] {
+					t.Errorf("backend %d answered", i)
+				}
+			}
+			if tc.avoid == nil && len(served) != 3 {
+				t.Errorf("%d of 3 backends answered", len(served))
+			}
+		})
+	}
+}
+
+func TestFailingBackendStaysInRotation(t *testing.T) {
+	h, err := NewHarness(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.SetBehavior(0, TestBehavior{Status: http.StatusServiceUnavailable}); err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[int]int{}
+	for range 4 {
+		echo, status, err := h.Get("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == http.StatusOK && echo.BackendPort != h.Port(1) {
+			t.Errorf("200 from backend port %d", echo.BackendPort)
+		}
+		statuses[status]++
+	}
+	// a backend answering is up, whatever it answers; round robin keeps
+	// sending it its share
+	if statuses[http.StatusOK] != 2 || statuses[http.StatusServiceUnavailable] != 2 {
+		t.Errorf("statuses %v, want two of each", statuses)
+	}
+}
@@ -0,0 +1,133 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// features can be switched off while running, for one route or for every
+// request, to tell quickly whether one of them is behind a problem:
+//
+//	PUT /admin/features {"route": "api", "feature": "cache", "enabled": false}
+//
+// an empty route means every request, whatever its route. a switch lasts
+// until switched back or the balancer restarts, reloads included. switched
+// off, cache and coalesce pass requests straight through, compress sends
+// responses as they are, rate_limit lets everything in (-client-rate, pool
+// and route limits alike) and mirror sends no copies
+var switchableFeatures = []string{"cache", "coalesce", "compress", "mirror", "rate_limit"}
+
+// FeatureFlag is a feature switched off, in GET /admin/features
+type FeatureFlag struct {
+	Route   string    `json:"route,omitempty"`
+	Feature string    `json:"feature"`
+	Enabled bool      `json:"enabled"`
+	Since   time.Time `json:"since"`
+}
+
+type featureKey struct {
+	route, feature string
+}
+
+var featureFlags struct {
+	mux sync.RWMutex
+	off map[featureKey]time.Time // since when
+	n   atomic.Int32             // len(off), so requests skip the lock while nothing is off
+}
+
+// featureDisabled reports whether feature is switched off for a route's
+// requests, "" being those of no route
+func featureDisabled(route, feature string) bool {
+	if featureFlags.n.Load() == 0 {
+		return false
+	}
+	featureFlags.mux.RLock()
+	defer featureFlags.mux.RUnlock()
+	if _, ok := featureFlags.off[featureKey{"", feature}]; ok {
+		return true
+	}
+	_, ok := featureFlags.off[featureKey{route, feature}]
+	return ok && route != ""
+}
+
+// featureOff is featureDisabled for the route r takes, for middleware
+// running before the router
+func featureOff(r *http.Request, feature string) bool {
+	if featureFlags.n.Load() == 0 {
+		return false
+	}
+	route := ""
+	if router != nil {
+		if rt := router.match(r); rt != nil {
+			route = rt.Name
+		}
+	}
+	return featureDisabled(route, feature)
+}
+
+func setFeature(route, feature string, enabled bool) {
+	featureFlags.mux.Lock()
+	defer featureFlags.mux.Unlock()
+	key := featureKey{route, feature}
+	if enabled {
+		delete(featureFlags.off, key)
+	} else if _, ok := featureFlags.off[key]; !ok {
+		if featureFlags.off == nil {
+			featureFlags.off = map[featureKey]time.Time{}
+		}
+		featureFlags.off[key] = time.Now()
+	}
+	featureFlags.n.Store(int32(len(featureFlags.off)))
+}
+
+func disabledFeatures() []FeatureFlag {
+	featureFlags.mux.RLock()
+	defer featureFlags.mux.RUnlock()
+	list := []FeatureFlag{}
+	for key, since := range featureFlags.off {
+		list = append(list, FeatureFlag{Route: key.route, Feature: key.feature, Since: since})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Route != list[j].Route {
+			return list[i].Route < list[j].Route
+		}
+		return list[i].Feature < list[j].Feature
+	})
+	return list
+}
+
+func getFeatures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"features": switchableFeatures, "disabled": disabledFeatures()})
+}
+
+// switches a feature off or back on, e.g.
+// {"route": "api", "feature": "compress", "enabled": false}
+func putFeature(w http.ResponseWriter, r *http.Request) {
+	var req FeatureFlag
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(switchableFeatures, req.Feature) {
+		http.Error(w, fmt.Sprintf("unknown feature %q, expected one of %v", req.Feature, switchableFeatures), http.StatusBadRequest)
+		return
+	}
+	if req.Route != "" && (router == nil || !slices.ContainsFunc(router.Routes, func(rt *Route) bool { return rt.Name == req.Route })) {
+		http.Error(w, fmt.Sprintf("unknown route %q", req.Route), http.StatusNotFound)
+		return
+	}
+	setFeature(req.Route, req.Feature, req.Enabled)
+	scope := "every request"
+	if req.Route != "" {
+		scope = "route " + req.Route
+	}
+	log.Printf("Feature %s enabled for %s: %t\n", req.Feature, scope, req.Enabled)
+	writeJSON(w, http.StatusOK, map[string]any{"features": switchableFeatures, "disabled": disabledFeatures()})
+}
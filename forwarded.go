@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedOptions controls the X-Forwarded-*, X-Real-IP and RFC 7239
+// Forwarded headers sent to backends
+type ForwardedOptions struct {
+	// Trust keeps values set by whoever connected to us (another proxy) and
+	// appends to them; otherwise incoming values are stripped as spoofable
+	Trust bool
+	// TrustedProxies narrows Trust to peers in these networks
+	TrustedProxies []*net.IPNet
+	// RFC7239 also emits the standardized Forwarded header
+	RFC7239 bool
+}
+
+var forwardedOptions ForwardedOptions
+
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-Ip", "Forwarded"}
+
+// parseTrustedProxies reads a comma separated list of CIDRs or single IPs
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q: not an IP or CIDR", s)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustsPeer reports whether the forwarding headers the peer sent are kept
+func (o ForwardedOptions) trustsPeer(remoteAddr string) bool {
+	if !o.Trust {
+		return false
+	}
+	if len(o.TrustedProxies) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, n := range o.TrustedProxies {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders runs in the proxy director. X-Forwarded-For itself is
+// appended by httputil.ReverseProxy after the director returns, so here it is
+// only a matter of dropping untrusted prior values
+func setForwardedHeaders(out *http.Request) {
+	if !forwardedOptions.trustsPeer(out.RemoteAddr) {
+		for _, h := range forwardedHeaders {
+			out.Header.Del(h)
+		}
+	}
+
+	proto := "http"
+	if out.TLS != nil {
+		proto = "https"
+	}
+	if out.Header.Get("X-Forwarded-Proto") == "" {
+		out.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if out.Header.Get("X-Forwarded-Host") == "" {
+		out.Header.Set("X-Forwarded-Host", out.Host)
+	}
+	clientIP, _, err := net.SplitHostPort(out.RemoteAddr)
+	if err != nil {
+		clientIP = out.RemoteAddr
+	}
+	// a trusted proxy in front already named the original client
+	if out.Header.Get("X-Real-Ip") == "" {
+		out.Header.Set("X-Real-Ip", clientIP)
+	}
+
+	if forwardedOptions.RFC7239 {
+		elem := "for=" + forwardedNode(clientIP) + ";proto=" + proto + ";host=" + forwardedValue(out.Host)
+		if prior := out.Header.Values("Forwarded"); len(prior) > 0 {
+			elem = strings.Join(prior, ", ") + ", " + elem
+		}
+		out.Header.Set("Forwarded", elem)
+	}
+}
+
+// ipv6 nodes must be bracketed and quoted in Forwarded
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// quotes a value unless it is a plain RFC 7230 token
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
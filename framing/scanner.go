@@ -0,0 +1,181 @@
+// Package framing catches HTTP/1 requests that HTTP stacks may frame
+// differently, and so smuggle a second request past a proxy. Go's server
+// quietly normalizes some of them: it drops Content-Length when
+// Transfer-Encoding is present, accepts bare LF line endings and unfolds
+// obsolete header line folding, while a backend or another proxy may not.
+package framing
+
+import (
+	"strconv"
+	"strings"
+)
+
+// scanner states
+const (
+	scanHead = iota
+	scanBody
+	scanChunkSize
+	scanChunkData
+	scanChunkEnd
+	scanTrailer
+	scanDone
+)
+
+// an h2c upgrade needs Upgrade: h2c, Connection: Upgrade and HTTP2-Settings,
+// or the server goes on in HTTP/1
+const h2cUpgradeHeaders = 1 | 2 | 4
+
+// longest line the scanner follows; the server rejects longer heads anyway
+const maxScanLine = 64 << 10
+
+// Scanner follows HTTP/1 request framing over a connection's byte stream
+// the way a strict parser would, and remembers the first ambiguity. with H2C
+// set, a connection that turns to HTTP/2, by its preface or an h2c upgrade,
+// is no longer scanned
+type Scanner struct {
+	H2C bool
+
+	state   int
+	line    []byte
+	remain  int64
+	started bool // request line seen
+	version string
+	lengths []string
+	chunked bool
+	upgrade int // h2c upgrade headers seen, of h2cUpgradeHeaders
+
+	violation string
+}
+
+// Violation is the first ambiguity found, empty if there is none
+func (sc *Scanner) Violation() string {
+	return sc.violation
+}
+
+func (sc *Scanner) fail(reason string) {
+	sc.violation, sc.state = reason, scanDone
+}
+
+func (sc *Scanner) next() {
+	sc.state, sc.started, sc.version, sc.lengths, sc.chunked, sc.upgrade = scanHead, false, "", nil, false, 0
+}
+
+// Feed scans the next bytes read from the connection
+func (sc *Scanner) Feed(p []byte) {
+	for i := 0; i < len(p) && sc.state != scanDone; {
+		switch sc.state {
+		case scanBody, scanChunkData:
+			n := min(int64(len(p)-i), sc.remain)
+			i += int(n)
+			if sc.remain -= n; sc.remain > 0 {
+				continue
+			}
+			if sc.state == scanBody {
+				sc.next()
+			} else {
+				sc.state = scanChunkEnd
+			}
+		default:
+			c := p[i]
+			i++
+			if c != '\n' {
+				if len(sc.line) >= maxScanLine {
+					sc.state = scanDone
+				}
+				sc.line = append(sc.line, c)
+				continue
+			}
+			line := sc.line
+			sc.line = sc.line[:0]
+			if len(line) == 0 || line[len(line)-1] != '\r' {
+				sc.fail("bare LF line ending")
+				continue
+			}
+			sc.onLine(string(line[:len(line)-1]))
+		}
+	}
+}
+
+func (sc *Scanner) onLine(line string) {
+	switch sc.state {
+	case scanHead:
+		switch {
+		case !sc.started:
+			// stray CRLFs before a request line are allowed
+			if line == "PRI * HTTP/2.0" && sc.H2C {
+				sc.state = scanDone
+				return
+			}
+			if fields := strings.Fields(line); len(fields) > 0 {
+				sc.started, sc.version = true, fields[len(fields)-1]
+			}
+		case line == "":
+			sc.endHead()
+		case line[0] == ' ' || line[0] == '\t':
+			sc.fail("obsolete header line folding")
+		default:
+			name, value, _ := strings.Cut(line, ":")
+			switch strings.ToLower(name) {
+			case "content-length":
+				sc.lengths = append(sc.lengths, strings.TrimSpace(value))
+			case "transfer-encoding":
+				sc.chunked = true
+			case "upgrade":
+				if strings.EqualFold(strings.TrimSpace(value), "h2c") {
+					sc.upgrade |= 1
+				}
+			case "connection":
+				if strings.Contains(strings.ToLower(value), "upgrade") {
+					sc.upgrade |= 2
+				}
+			case "http2-settings":
+				sc.upgrade |= 4
+			}
+		}
+	case scanChunkSize:
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		switch {
+		case err != nil || n < 0:
+			sc.state = scanDone // the server fails the body itself
+		case n == 0:
+			sc.state = scanTrailer
+		default:
+			sc.state, sc.remain = scanChunkData, n
+		}
+	case scanChunkEnd:
+		if line != "" {
+			sc.state = scanDone
+			return
+		}
+		sc.state = scanChunkSize
+	case scanTrailer:
+		if line == "" {
+			sc.next()
+		}
+	}
+}
+
+func (sc *Scanner) endHead() {
+	switch {
+	case sc.chunked && len(sc.lengths) > 0:
+		sc.fail("both Content-Length and Transfer-Encoding")
+	case sc.chunked && sc.version == "HTTP/1.0":
+		sc.fail("Transfer-Encoding in an HTTP/1.0 request")
+	case sc.upgrade == h2cUpgradeHeaders && sc.H2C:
+		// what follows the upgrade request is HTTP/2
+		sc.state = scanDone
+	case sc.chunked:
+		sc.state = scanChunkSize
+	case len(sc.lengths) > 0:
+		// conflicting lengths are refused by the server itself
+		n, err := strconv.ParseInt(sc.lengths[0], 10, 64)
+		if err != nil || n <= 0 {
+			sc.next()
+			return
+		}
+		sc.state, sc.remain = scanBody, n
+	default:
+		sc.next()
+	}
+}
@@ -0,0 +1,57 @@
+package framing
+
+import "testing"
+
+func TestScanner(t *testing.T) {
+	for _, tc := range []struct {
+		name, stream, violation string
+		h2c                     bool
+	}{
+		{"plain", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", "", false},
+		{"keep-alive with a body", "POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nokGET / HTTP/1.1\r\n\r\n", "", false},
+		{"CL.TE", "POST / HTTP/1.1\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", "both Content-Length and Transfer-Encoding", false},
+		{"TE.CL in a later request", "GET / HTTP/1.1\r\n\r\nPOST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 4\r\n\r\n", "both Content-Length and Transfer-Encoding", false},
+		{"chunked HTTP/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n", "Transfer-Encoding in an HTTP/1.0 request", false},
+		{"folding", "GET / HTTP/1.1\r\nX-A: 1\r\n x\r\n\r\n", "obsolete header line folding", false},
+		{"bare LF", "GET / HTTP/1.1\nHost: a\n\n", "bare LF line ending", false},
+		// a smuggled request in a chunk's data isn't a request
+		{"chunk data", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n17\r\nGET / HTTP/1.1\nX: 1\r\n\r\n\r\n0\r\n\r\n", "", false},
+		{"h2c preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x12\x04\x00\x00\x00\x00\x00\n\n", "", true},
+		{"h2c preface without H2C", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x12\x04\x00\x00\x00\x00\x00\n\n", "bare LF line ending", false},
+		{"h2c upgrade", "GET / HTTP/1.1\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQCAAAAAAIAAAAA\r\n\r\n\x00\x00\x00\n\n", "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sc := Scanner{H2C: tc.h2c}
+			for i := range len(tc.stream) {
+				// byte by byte, as a slow client would send it
+				sc.Feed([]byte{tc.stream[i]})
+			}
+			if got := sc.Violation(); got != tc.violation {
+				t.Errorf("violation %q, want %q", got, tc.violation)
+			}
+		})
+	}
+}
+
+// the scanner sees reads of any size; splitting the stream anywhere must not
+// change its verdict
+func FuzzScanner(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), false)
+	f.Add([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"), false)
+	f.Add([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), true)
+	f.Fuzz(func(t *testing.T, data []byte, h2c bool) {
+		whole := Scanner{H2C: h2c}
+		whole.Feed(data)
+		for _, cut := range []int{1, len(data) / 2, len(data) - 1} {
+			if cut <= 0 || cut >= len(data) {
+				continue
+			}
+			split := Scanner{H2C: h2c}
+			split.Feed(data[:cut])
+			split.Feed(data[cut:])
+			if split.Violation() != whole.Violation() {
+				t.Fatalf("verdict depends on read boundaries: %q split at %d gives %q, whole %q", data, cut, split.Violation(), whole.Violation())
+			}
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fuzz targets for everything that parses operator input or hostile
+// requests, so neither can panic the process. run one with e.g.
+//
+//	go test -run '^$' -fuzz FuzzConfig
+
+func FuzzBackendURL(f *testing.F) {
+	for _, s := range []string{"http://10.0.0.5:8080", "https://api.internal", "10.0.0.5:8080", "http://[::1]:80/x", "ftp://x", "",
+		"tcp://a:1", "dns+http://a:1", "srv+http://_x._tcp.a", "consul+http://c:8500/web", "etcd+http://e:2379/p/"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		u, err := parseBackendURL(s)
+		if err != nil {
+			return
+		}
+		_, scheme := discoveryScheme(u.Scheme)
+		if u.Hostname() == "" || (scheme != "http" && scheme != "https" && scheme != "tcp") {
+			t.Fatalf("parseBackendURL accepted %q", s)
+		}
+		// a parsed backend must survive a round trip through its own string form
+		again, err := parseBackendURL(u.String())
+		if err != nil || again.Host != u.Host {
+			t.Fatalf("backend URL %q does not round trip: %v", u, err)
+		}
+	})
+}
+
+func FuzzBackendSpec(f *testing.F) {
+	for _, s := range []string{"http://10.0.0.5:8080;weight=3", "http://a;rack=r1;host=b", "http://a;weight=-1", ";"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		u, _, err := parseBackendSpec(s)
+		if err != nil {
+			return
+		}
+		for _, attr := range []string{";rack=", ";host=", ";weight="} {
+			if strings.Contains(u.String(), attr) {
+				t.Fatalf("backend attributes leaked into the url: %s", u)
+			}
+		}
+	})
+}
+
+func FuzzTestBehavior(f *testing.F) {
+	for _, s := range []string{"1=status:503", "2=delay:50ms+error-rate:0.5", "x", "1=status:99999"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		b := TestBehaviors{}
+		if err := b.Set(s); err != nil {
+			return
+		}
+		for _, tb := range b {
+			if tb.Status != 0 && (tb.Status < 100 || tb.Status > 599) {
+				t.Fatalf("invalid status %d accepted from %q", tb.Status, s)
+			}
+		}
+	})
+}
+
+func FuzzConfig(f *testing.F) {
+	f.Add([]byte(`{"port": 3000, "strategy": "round-robin", "backends": ["http://10.0.0.5:8080;weight=2", {"url": "http://10.0.0.6:8080"}]}`), false)
+	f.Add([]byte(`{"backends": [{"url": "http://a", "weight": -1}], "timeouts": {"dial": "1s"}}`), false)
+	f.Add([]byte("port: 3000\nbackends:\n  - http://10.0.0.5:8080\n  - url: http://10.0.0.6:8080\n    weight: 3\nhealth_check:\n  interval: 5s\n"), true)
+	f.Add([]byte("pools:\n  api: [http://10.0.0.7:8080]\n"), true)
+	f.Fuzz(func(t *testing.T, data []byte, isYAML bool) {
+		ext := ".json"
+		if isYAML {
+			ext = ".yaml"
+		}
+		cfg, err := parseConfig(data, ext)
+		if err != nil {
+			return
+		}
+		for _, bc := range cfg.Backends {
+			if _, err := parseBackendURL(bc.URL); err != nil || bc.Weight < 0 {
+				t.Fatalf("config accepted backend %+v", bc)
+			}
+		}
+	})
+}
+
+// FuzzRoutes builds a router from a routes file, keeping only what matching
+// looks at, and matches a hostile request against it
+func FuzzRoutes(f *testing.F) {
+	f.Add(`{"routes": [{"hosts": ["*.example.com"], "path_prefix": "/api"}, {"path_regex": "^/v[0-9]+/"}]}`, "a.example.com", "/api/x", "application/json")
+	f.Add(`{"routes": [{"path": "/", "priority": 2}, {"accept": ["application/grpc"]}]}`, "EXAMPLE.com.", "/%2e%2e/", "application/grpc;q=0")
+	f.Add(`{"routes": [{"hosts": ["*"]}, {"path_regex": "("}]}`, "", "", "")
+	f.Fuzz(func(t *testing.T, routes, host, path, accept string) {
+		var rc RoutesConfig
+		if json.Unmarshal([]byte(routes), &rc) != nil {
+			return
+		}
+		// the default pool, and nothing that would start lookups, read files
+		// or register limits
+		rc.Pools = nil
+		for _, rt := range rc.Routes {
+			if rt == nil {
+				return
+			}
+			*rt = Route{Name: rt.Name, Hosts: rt.Hosts, Path: rt.Path, PathPrefix: rt.PathPrefix, PathRegex: rt.PathRegex, Accept: rt.Accept, ContentType: rt.ContentType, Priority: rt.Priority}
+		}
+		router, err := NewRouter(&rc, http.NotFoundHandler())
+		if err != nil {
+			return
+		}
+		r := &http.Request{Method: http.MethodGet, Host: host, URL: &url.URL{Path: path}, Header: http.Header{"Accept": {accept}, "Content-Type": {accept}}}
+		rt := router.match(r)
+		ex := router.Explain(r)
+		if rt == nil && ex.Route != "" || rt != nil && ex.Route != rt.Name {
+			t.Fatalf("match took %v, explain %q", rt, ex.Route)
+		}
+		if rt != nil {
+			if ok, _ := rt.matches(r); !ok {
+				t.Fatalf("route %s taken but doesn't match", rt.Name)
+			}
+		}
+	})
+}
+
+func FuzzDNSQuery(f *testing.F) {
+	f.Add([]byte("\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x08backends\x02lb\x08internal\x00\x00\x01\x00\x01"))
+	f.Add([]byte("\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x02_x\x04_tcp\x08backends\x02lb\x08internal\x00\x00\x21\x00\x01"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := &DNSResponder{Name: "backends.lb.internal.", TTL: time.Second}
+		res := d.answer(data)
+		if res == nil {
+			return
+		}
+		if len(res) < 12 || res[0] != data[0] || res[1] != data[1] {
+			t.Fatal("dns reply does not echo the query id")
+		}
+	})
+}
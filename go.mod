@@ -1,3 +1,12 @@
 module load-balancer
 
 go 1.22.2
+
+require (
+	github.com/andybalholm/brotli v1.1.1
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/text v0.22.0 // indirect
@@ -0,0 +1,198 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GET /admin/graph exports how requests flow through the balancer as it is
+// configured right now: listeners to routes, in the order they are tried,
+// routes to their pools, and pools to their backends with weights and
+// health, so a change can be reviewed by comparing the graph from before
+// and after it. it is JSON, or Graphviz DOT with ?format=dot:
+//
+//	curl -s localhost:8081/admin/graph?format=dot | dot -Tsvg > flow.svg
+type FlowGraph struct {
+	Listeners []FlowListener `json:"listeners"`
+	Routes    []FlowRoute    `json:"routes"`
+	Pools     []FlowPool     `json:"pools"`
+	Edges     []FlowEdge     `json:"edges"`
+}
+
+// the graph's nodes are named by kind, e.g. listener:[::]:3000, route:api,
+// pool:default and backend:default/10.0.0.5:8080
+type FlowListener struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	Addr   string `json:"addr"`
+}
+
+type FlowRoute struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Match string `json:"match"` // hosts, path and media types it takes
+}
+
+type FlowPool struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Strategy string        `json:"strategy"`
+	Backends []FlowBackend `json:"backends"`
+}
+
+type FlowBackend struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	URL    string  `json:"url"`
+	Weight int     `json:"weight"`
+	Share  float64 `json:"share"` // of its weight it gets now, see BackendStatus
+	State  string  `json:"state"` // up, or what keeps it out of rotation
+}
+
+// FlowEdge is a path requests take, labelled with when they take it
+type FlowEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label,omitempty"`
+}
+
+func flowGraph() FlowGraph {
+	g := FlowGraph{Listeners: []FlowListener{}, Routes: []FlowRoute{}, Pools: []FlowPool{}, Edges: []FlowEdge{}}
+	edge := func(from, to, label string) {
+		g.Edges = append(g.Edges, FlowEdge{from, to, label})
+	}
+	for _, l := range listening() {
+		fl := FlowListener{ID: "listener:" + l.Addr().String(), Tenant: l.tenant, Addr: l.Addr().String()}
+		g.Listeners = append(g.Listeners, fl)
+		if l.tenant != "default" {
+			edge(fl.ID, "pool:"+l.tenant, "")
+			continue
+		}
+		if router != nil {
+			for i, rt := range router.Routes {
+				edge(fl.ID, "route:"+rt.Name, strconv.Itoa(i+1))
+			}
+			edge(fl.ID, "pool:"+serverPool.Name, "no route matches")
+		} else {
+			edge(fl.ID, "pool:"+serverPool.Name, "")
+		}
+		if trafficMirror != nil {
+			edge(fl.ID, "pool:"+trafficMirror.Pool, fmt.Sprintf("mirror %g%%", trafficMirror.Percent))
+		}
+	}
+	if router != nil {
+		for _, rt := range router.Routes {
+			fr := FlowRoute{ID: "route:" + rt.Name, Name: rt.Name, Match: rt.describeMatch()}
+			g.Routes = append(g.Routes, fr)
+			edge(fr.ID, "pool:"+rt.Pool, "")
+			if rt.Mirror != nil {
+				edge(fr.ID, "pool:"+rt.Mirror.Pool, fmt.Sprintf("mirror %g%%", rt.Mirror.Percent))
+			}
+		}
+	}
+	for _, p := range pools {
+		fp := FlowPool{ID: "pool:" + p.Name, Name: p.Name, Strategy: strategyName(p.Strategy), Backends: []FlowBackend{}}
+		for _, b := range p.Backends() {
+			fb := FlowBackend{
+				ID:     "backend:" + p.Name + "/" + b.Name(),
+				Name:   b.Name(),
+				URL:    b.URL().String(),
+				Weight: b.Weight,
+				Share:  b.rampShare() * b.decayShare(),
+				State:  b.state(),
+			}
+			fp.Backends = append(fp.Backends, fb)
+			edge(fp.ID, fb.ID, "weight "+strconv.Itoa(b.Weight))
+		}
+		if p.Fallback != nil {
+			edge(fp.ID, "pool:"+p.Fallback.Name, "fallback")
+		}
+		g.Pools = append(g.Pools, fp)
+	}
+	return g
+}
+
+// describeMatch sums up the requests a route takes
+func (rt *Route) describeMatch() string {
+	var parts []string
+	if len(rt.Hosts) > 0 {
+		parts = append(parts, "host "+strings.Join(rt.Hosts, ", "))
+	}
+	switch rt.kind() {
+	case routeExact:
+		parts = append(parts, "path "+rt.Path)
+	case routePrefix:
+		parts = append(parts, "path "+rt.PathPrefix+"*")
+	case routeRegex:
+		parts = append(parts, "path ~ "+rt.PathRegex)
+	}
+	if len(rt.Accept) > 0 {
+		parts = append(parts, "accept "+strings.Join(rt.Accept, ", "))
+	}
+	if len(rt.ContentType) > 0 {
+		parts = append(parts, "content type "+strings.Join(rt.ContentType, ", "))
+	}
+	if len(parts) == 0 {
+		return "any request"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// dot writes the graph in Graphviz's language, backends coloured by state
+func (g FlowGraph) dot() string {
+	var b strings.Builder
+	b.WriteString("digraph lb {\n\trankdir=LR;\n\tnode [fontname=\"Helvetica\", fontsize=10];\n\tedge [fontname=\"Helvetica\", fontsize=9];\n")
+	node := func(id, label, attrs string) {
+		fmt.Fprintf(&b, "\t%s [label=%s%s];\n", strconv.Quote(id), strconv.Quote(label), attrs)
+	}
+	for _, l := range g.Listeners {
+		node(l.ID, l.Addr+"\n"+l.Tenant, ", shape=cds")
+	}
+	for _, rt := range g.Routes {
+		node(rt.ID, rt.Name+"\n"+rt.Match, ", shape=box, style=rounded")
+	}
+	for _, p := range g.Pools {
+		node(p.ID, p.Name+"\n"+p.Strategy, ", shape=folder")
+		for _, be := range p.Backends {
+			color := "khaki"
+			switch be.State {
+			case "up":
+				color = "palegreen"
+			case "down":
+				color = "lightcoral"
+			}
+			label := fmt.Sprintf("%s\n%s", be.Name, be.State)
+			if be.Share < 1 {
+				label += fmt.Sprintf(", %.0f%% share", be.Share*100)
+			}
+			node(be.ID, label, ", shape=box, style=filled, fillcolor="+color)
+		}
+	}
+	for _, e := range g.Edges {
+		var attrs []string
+		if e.Label != "" {
+			attrs = append(attrs, "label="+strconv.Quote(e.Label))
+		}
+		if strings.HasPrefix(e.Label, "mirror") || e.Label == "fallback" {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(&b, "\t%s -> %s [%s];\n", strconv.Quote(e.From), strconv.Quote(e.To), strings.Join(attrs, ", "))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func getGraph(w http.ResponseWriter, r *http.Request) {
+	g := flowGraph()
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, g)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		_, _ = w.Write([]byte(g.dot()))
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q, expected json or dot", format), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,123 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// gRPC needs HTTP/2 end to end. https backends get it through ALPN; a plain
+// http backend marked h2c=true is spoken to in HTTP/2 without TLS. on the
+// client side -h2c accepts HTTP/2 without TLS too (TLS listeners negotiate
+// it anyway). trailers pass through ReverseProxy, and responses without a
+// length, which gRPC's always are, are flushed as they arrive
+var frontH2C bool
+
+// withH2C lets cleartext clients speak HTTP/2, with prior knowledge or by
+// upgrading, when -h2c is set
+func withH2C(handler http.Handler) http.Handler {
+	if !frontH2C {
+		return handler
+	}
+	return h2c.NewHandler(handler, &http2.Server{IdleTimeout: clientIdleTimeout})
+}
+
+// newH2CTransport speaks HTTP/2 over plain TCP connections from dial
+func newH2CTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+		// ping a quiet connection so a dead one is noticed before a stream is
+		// sent down it
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+}
+
+// backendTransport sends a backend's requests over HTTP/1 (or HTTP/2 via
+// ALPN) or h2c, by the backend's current setting
+type backendTransport struct {
+	b   *Backend
+	h1  *http.Transport
+	h2c *http2.Transport
+}
+
+func (t *backendTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.b.signer != nil {
+		signed, err := t.b.signer.signRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		r = signed
+	}
+	if t.b.H2C && r.URL.Scheme == "http" {
+		return t.roundTripH2C(r)
+	}
+	return t.h1.RoundTrip(r)
+}
+
+// roundTripH2C gives up on response headers after the backend's response
+// timeout, which http2.Transport has no setting for, failing the way
+// http.Transport's ResponseHeaderTimeout does
+func (t *backendTransport) roundTripH2C(r *http.Request) (*http.Response, error) {
+	timeout := t.b.responseTimeout()
+	if timeout <= 0 {
+		return t.h2c.RoundTrip(r)
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	res, err := t.h2c.RoundTrip(r.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			res.Body.Close()
+		}
+		cancel()
+		return nil, h2cTimeoutError{}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the stream lives on with the body
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type h2cTimeoutError struct{}
+
+func (h2cTimeoutError) Error() string   { return "http2: timeout awaiting response headers" }
+func (h2cTimeoutError) Timeout() bool   { return true }
+func (h2cTimeoutError) Temporary() bool { return true }
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (t *backendTransport) CloseIdleConnections() {
+	t.h1.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+var h2cHealthClient = &http.Client{Transport: newH2CTransport(healthDial)}
+
+// isGRPC reports whether r is a gRPC call, whose body is a stream that must
+// not be read ahead
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
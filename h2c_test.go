@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// TestH2CResponseTimeout checks that an h2c backend's response timeout
+// applies as it does over HTTP/1, and only until the headers come
+func TestH2CResponseTimeout(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("body"))
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	pool := &ServerPool{Name: "h2c"}
+	b, err := pool.AddBackendSpec(backend.URL + ";h2c=true;response_timeout=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := b.target.Load().transport
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL+"/slow", nil)
+	if _, err := rt.RoundTrip(req); !isTimeout(err) || classifyUpstreamError(err) != upstreamResponseTimeout {
+		t.Fatalf("slow headers: got %v, want a response timeout", err)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, backend.URL+"/", nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("spoke HTTP/%d to an h2c backend", res.ProtoMajor)
+	}
+	buf := make([]byte, 16)
+	if n, _ := res.Body.Read(buf); string(buf[:n]) != "body" {
+		t.Errorf("body cut short after the headers came: %q", buf[:n])
+	}
+}
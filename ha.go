@@ -0,0 +1,277 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Elector runs active-passive HA through a Consul lock. every instance holds a
+// session with a TTL and tries to acquire Key with it; whoever holds the lock
+// is leader and serves traffic, the others stand by. if the leader dies its
+// session expires, Consul releases the lock and a standby takes over; one
+// that shuts down destroys its session so a standby needn't wait that long.
+// a leader rides out a single failed round, which its session outlives.
+//
+// OnLeader/OnStandby are where the listener is opened or closed and where a
+// virtual IP can be moved (see -ha-on-leader)
+type Elector struct {
+	Consul    string // e.g. http://127.0.0.1:8500
+	Key       string
+	Token     string // sent as X-Consul-Token
+	Node      string
+	TTL       time.Duration
+	OnLeader  func()
+	OnStandby func()
+	Ready     func() // once the first campaign is settled, either way
+
+	client   *http.Client
+	mux      sync.Mutex
+	session  string
+	handed   bool // over to the process upgrading this one
+	released bool // on shutdown
+	leader   bool
+	since    time.Time
+	failures int // rounds in a row that failed, only touched by Run
+}
+
+var elector *Elector
+
+// envHASession hands the session, and with it the lock, to the process an
+// upgrade starts, which is leader as soon as it renews it
+const envHASession = "LB_HA_SESSION"
+
+// Run campaigns for the lock until the session is handed over or released
+func (e *Elector) Run() {
+	e.client = &http.Client{Timeout: 5 * time.Second}
+	if e.Node == "" {
+		e.Node, _ = os.Hostname()
+	}
+	if session := os.Getenv(envHASession); session != "" {
+		_ = os.Unsetenv(envHASession)
+		e.session = session
+		log.Printf("HA: took session %s over from process %d\n", session, os.Getppid())
+	}
+	log.Printf("HA: campaigning for %s as %s\n", e.Key, e.Node)
+
+	t := time.NewTicker(e.TTL / 3)
+	defer t.Stop()
+	for first := true; ; first = false {
+		held, err := e.campaign()
+		if err != nil {
+			log.Println("HA: ", err)
+			e.failures++
+		} else {
+			e.failures = 0
+		}
+		if e.handedOver() || e.releasedSession() {
+			return
+		}
+		if err == nil || e.failures > 1 {
+			e.setLeader(held && err == nil)
+		}
+		if first && e.Ready != nil {
+			e.Ready()
+		}
+		<-t.C
+	}
+}
+
+// handOver gives the session up to the process upgrading this one: this
+// one stops campaigning and leaves it alone
+func (e *Elector) handOver() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.handed = true
+}
+
+func (e *Elector) handedOver() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.handed
+}
+
+// release destroys the session on shutdown, which frees the lock at once.
+// one handed over to an upgrade is left to the new process
+func (e *Elector) release() error {
+	e.mux.Lock()
+	e.released = true
+	session, handed := e.session, e.handed
+	e.mux.Unlock()
+	if handed || session == "" {
+		return nil
+	}
+	if err := e.put("/v1/session/destroy/"+session, nil, nil); err != nil {
+		return fmt.Errorf("HA session release failed: %w", err)
+	}
+	log.Printf("HA: released session %s\n", session)
+	return nil
+}
+
+func (e *Elector) releasedSession() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.released
+}
+
+// Session is the Consul session campaigning, empty if there is none yet
+func (e *Elector) Session() string {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.session
+}
+
+func (e *Elector) setSession(id string) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.session = id
+}
+
+// campaign keeps the session alive and (re)acquires the lock with it
+func (e *Elector) campaign() (bool, error) {
+	if session := e.Session(); session != "" {
+		if err := e.put("/v1/session/renew/"+session, nil, nil); err != nil {
+			var status *consulStatus
+			if errors.As(err, &status) && status.code == http.StatusNotFound {
+				// the session is gone, so is any lock it held
+				e.setSession("")
+			}
+			return false, fmt.Errorf("session renew failed: %w", err)
+		}
+	}
+	if e.Session() == "" {
+		var created struct{ ID string }
+		body := map[string]string{
+			"Name":      "load-balancer " + e.Node,
+			"TTL":       e.TTL.String(),
+			"Behavior":  "release",
+			"LockDelay": "1s",
+		}
+		if err := e.put("/v1/session/create", body, &created); err != nil {
+			return false, fmt.Errorf("session create failed: %w", err)
+		}
+		e.setSession(created.ID)
+	}
+
+	var acquired bool
+	if err := e.put("/v1/kv/"+e.Key+"?acquire="+e.Session(), e.Node, &acquired); err != nil {
+		return false, fmt.Errorf("lock acquire failed: %w", err)
+	}
+	return acquired, nil
+}
+
+func (e *Elector) put(path string, body, out any) error {
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(http.MethodPut, strings.TrimRight(e.Consul, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	if e.Token != "" {
+		req.Header.Set("X-Consul-Token", e.Token)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return &consulStatus{code: res.StatusCode, msg: fmt.Sprintf("%s: %s %s", path, res.Status, strings.TrimSpace(string(msg)))}
+	}
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+// consulStatus is an answer from Consul other than 200 OK
+type consulStatus struct {
+	code int
+	msg  string
+}
+
+func (e *consulStatus) Error() string {
+	return e.msg
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mux.Lock()
+	changed := e.leader != leader
+	if changed {
+		e.leader, e.since = leader, time.Now()
+	}
+	e.mux.Unlock()
+	if !changed {
+		return
+	}
+
+	if leader {
+		log.Printf("HA: %s is now leader\n", e.Node)
+		if e.OnLeader != nil {
+			e.OnLeader()
+		}
+	} else {
+		log.Printf("HA: %s is now standby\n", e.Node)
+		if e.OnStandby != nil {
+			e.OnStandby()
+		}
+	}
+}
+
+type HAStatus struct {
+	Node   string    `json:"node"`
+	Key    string    `json:"key"`
+	Leader bool      `json:"leader"`
+	Since  time.Time `json:"since"`
+}
+
+func (e *Elector) Status() HAStatus {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return HAStatus{Node: e.Node, Key: e.Key, Leader: e.leader, Since: e.since}
+}
+
+// runHook runs a -ha-on-leader/-ha-on-standby command, e.g. one that adds or
+// removes the virtual IP, with sh, or cmd on Windows
+func runHook(name, command string) {
+	if command == "" {
+		return
+	}
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("HA: %s hook failed: %v\n", name, err)
+	}
+}
+
+func getHA(w http.ResponseWriter, r *http.Request) {
+	if elector == nil {
+		http.Error(w, "ha mode is off", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, elector.Status())
+}
@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Harness runs n in-process echo backends behind a balancer listening on an
+// ephemeral port, and can kill and revive backends, or make them slow,
+// failing or flapping (see TestBehavior), mid-test. It is meant for
+// table-driven end-to-end tests of failover behaviour:
+//
+//	h, err := NewHarness(3)
+//	defer h.Close()
+//	h.Kill(1)
+//	echo, status, err := h.Get("/")
+//	// status is still 200 and echo.BackendPort != h.Port(1)
+type Harness struct {
+	Pool *ServerPool
+	URL  string // balancer base URL, e.g. http://127.0.0.1:41234
+
+	backends []*testServer
+	lb       *http.Server
+	client   *http.Client
+}
+
+func NewHarness(n int) (*Harness, error) {
+	h := &Harness{
+		Pool:   &ServerPool{},
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for range n {
+		b := newTestServer("127.0.0.1:0", TestBehavior{})
+		if err := b.up(); err != nil {
+			h.Close()
+			return nil, err
+		}
+		h.backends = append(h.backends, b)
+
+		u, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", b.port))
+		h.Pool.AddBackend(h.Pool.NewBackend(u))
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.URL = "http://" + l.Addr().String()
+	h.lb = &http.Server{Handler: h.Pool}
+	go func() { _ = h.lb.Serve(l) }()
+	return h, nil
+}
+
+// Port returns the port of backend i, which matches Echo.BackendPort
+func (h *Harness) Port(i int) int {
+	return h.backends[i].port
+}
+
+// Kill stops backend i; the balancer only notices through failed requests or
+// a health check
+func (h *Harness) Kill(i int) error {
+	return h.backends[i].down()
+}
+
+// Revive restarts backend i on its original port
+func (h *Harness) Revive(i int) error {
+	return h.backends[i].up()
+}
+
+// SetBehavior makes backend i slow, failing or flapping, e.g.
+// TestBehavior{ErrorRate: 0.5} to see retries absorb its errors
+func (h *Harness) SetBehavior(i int, tb TestBehavior) error {
+	return h.backends[i].setBehavior(tb)
+}
+
+// CheckHealth runs one health check pass right away instead of waiting for
+// the periodic one
+func (h *Harness) CheckHealth() {
+	h.Pool.HealthCheck()
+}
+
+// Get sends a request through the balancer and decodes the echo reply, if any
+func (h *Harness) Get(path string) (Echo, int, error) {
+	var echo Echo
+	res, err := h.client.Get(h.URL + path)
+	if err != nil {
+		return echo, 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return echo, res.StatusCode, err
+	}
+	_ = json.Unmarshal(body, &echo)
+	return echo, res.StatusCode, nil
+}
+
+func (h *Harness) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if h.lb != nil {
+		_ = h.lb.Shutdown(ctx)
+	}
+	for i := range h.backends {
+		_ = h.SetBehavior(i, TestBehavior{Down: true})
+	}
+}
@@ -0,0 +1,143 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// RequestStrategy is a Strategy that looks at the request, e.g. to keep a
+// client on one backend. Next is used where there is no request
+type RequestStrategy interface {
+	Strategy
+	NextFor(s *ServerPool, r *http.Request) *Backend
+}
+
+// hashKey is -hash-key, what ConsistentHash keys on; see HashKey
+var hashKey = "ip"
+
+// ring points per unit of backend weight
+const hashReplicas = 100
+
+// hashLoadFactor bounds consistent-hash loads (-hash-load-factor, 0 off):
+// a backend already handling more than this times its share of the pool's
+// requests in flight is passed over for the next one clockwise, so a hot
+// key spills over instead of piling onto one backend. 1.25 keeps every
+// backend within 25% of its share
+var hashLoadFactor float64
+
+// ConsistentHash places backends on a hash ring with virtual nodes and sends
+// each key to the first live backend clockwise from it, so a client keeps
+// its backend and only the keys of a backend that joins or leaves move.
+// routes, tenants and the mirror share the strategy, so each pool keeps its
+// own ring
+type ConsistentHash struct {
+	Key *HashKey // nil for -hash-key
+}
+
+type hashRing struct {
+	src    *[]*Backend // the backend list the ring was built from
+	points []uint64
+	owners []*Backend
+}
+
+// hash64 is FNV-1a with a splitmix64 finalizer; FNV alone clusters similar
+// keys such as "a#1", "a#2". it is stable across processes, so every
+// balancer instance agrees on the ring
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+func (ch *ConsistentHash) ringFor(s *ServerPool) *hashRing {
+	src := s.backends.Load()
+	if r := s.hashRing.Load(); r != nil && r.src == src {
+		return r
+	}
+	r := &hashRing{src: src}
+	type point struct {
+		hash uint64
+		b    *Backend
+	}
+	var pts []point
+	for _, b := range s.Backends() {
+		for i := 0; i < hashReplicas*max(b.Weight, 1); i++ {
+			pts = append(pts, point{hash64(fmt.Sprintf("%s#%d", b.Name(), i)), b})
+		}
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i].hash < pts[j].hash })
+	for _, p := range pts {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.b)
+	}
+	s.hashRing.Store(r)
+	return r
+}
+
+// Next has no key to hash and falls back to round robin
+func (ch *ConsistentHash) Next(s *ServerPool) *Backend {
+	return RoundRobin{}.Next(s)
+}
+
+func (ch *ConsistentHash) NextFor(s *ServerPool, r *http.Request) *Backend {
+	ring := ch.ringFor(s)
+	if len(ring.points) == 0 {
+		return nil
+	}
+	key := ch.Key
+	if key == nil {
+		key = defaultHashKey
+	}
+	h := hash64(key.Of(r))
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	bound := loadBound(s)
+	var first *Backend
+	for i := 0; i < len(ring.points); i++ {
+		b := ring.owners[(start+i)%len(ring.points)]
+		if !b.IsAlive() {
+			continue
+		}
+		if bound == nil || float64(b.InFlight()) < bound(b) {
+			if first != nil {
+				s.hashSpilled.Add(1)
+			}
+			return b
+		}
+		if first == nil {
+			first = b
+		}
+	}
+	// all over their bound, which rounding makes rare
+	return first
+}
+
+// loadBound is how many requests a backend may have in flight before keys
+// pass it over: hashLoadFactor times its weighted share of the pool's
+// requests, counting the one being placed. nil if loads aren't bounded
+func loadBound(s *ServerPool) func(*Backend) float64 {
+	if hashLoadFactor <= 0 {
+		return nil
+	}
+	var inFlight int64
+	weight := 0
+	for _, b := range s.Backends() {
+		if b.IsAlive() {
+			inFlight += b.InFlight()
+			weight += max(b.Weight, 1)
+		}
+	}
+	if weight == 0 {
+		return nil
+	}
+	return func(b *Backend) float64 {
+		return math.Ceil(hashLoadFactor * float64(inFlight+1) * float64(max(b.Weight, 1)) / float64(weight))
+	}
+}
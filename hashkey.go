@@ -0,0 +1,164 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// HashKey builds the key consistent-hash places a request by, from a small
+// expression of request attributes: parts joined with + make up one key, and
+// alternatives separated by | are tried in turn, the first whose parts are
+// all present winning. with none present the client IP is used. the parts
+// are
+//
+//	ip                the client IP
+//	ip/24, ip/24/56   its IPv4 (and IPv6, by default /64) network
+//	host              the Host header
+//	method            the request method
+//	path              the URL path
+//	path:2            its first two segments, e.g. /api/v1
+//	header:<name>     a request header
+//	cookie:<name>     a cookie
+//	query:<name>      a query parameter
+//
+// e.g. -hash-key 'header:X-Tenant+path:1|ip/24' keeps a tenant's requests
+// for each top-level path on one backend, and clients without the header on
+// one backend per /24. a routed pool can set its own in hash_key
+type HashKey struct {
+	spec string
+	alts [][]keyPart
+}
+
+// keyPart extracts one attribute, "" when the request has none
+type keyPart func(r *http.Request) string
+
+// defaultHashKey is -hash-key, parsed
+var defaultHashKey = &HashKey{spec: "ip", alts: [][]keyPart{{clientIPPart}}}
+
+func ParseHashKey(spec string) (*HashKey, error) {
+	k := &HashKey{spec: spec}
+	for _, alt := range strings.Split(spec, "|") {
+		var parts []keyPart
+		for _, p := range strings.Split(alt, "+") {
+			part, err := parseKeyPart(strings.TrimSpace(p))
+			if err != nil {
+				return nil, fmt.Errorf("bad hash key %q: %w", spec, err)
+			}
+			parts = append(parts, part)
+		}
+		k.alts = append(k.alts, parts)
+	}
+	return k, nil
+}
+
+func parseKeyPart(p string) (keyPart, error) {
+	kind, arg, hasArg := strings.Cut(p, ":")
+	switch {
+	case p == "ip":
+		return clientIPPart, nil
+	case strings.HasPrefix(p, "ip/"):
+		return parseNetworkPart(strings.TrimPrefix(p, "ip/"))
+	case p == "host":
+		return func(r *http.Request) string { return r.Host }, nil
+	case p == "method":
+		return func(r *http.Request) string { return r.Method }, nil
+	case p == "path":
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	case !hasArg || arg == "":
+	case kind == "path":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("path:%s needs a number of segments", arg)
+		}
+		return func(r *http.Request) string { return pathSegments(r.URL.Path, n) }, nil
+	case kind == "header":
+		return func(r *http.Request) string { return r.Header.Get(arg) }, nil
+	case kind == "cookie":
+		return func(r *http.Request) string {
+			if c, err := r.Cookie(arg); err == nil {
+				return c.Value
+			}
+			return ""
+		}, nil
+	case kind == "query":
+		return func(r *http.Request) string { return r.URL.Query().Get(arg) }, nil
+	}
+	return nil, fmt.Errorf("unknown part %q (use ip, ip/N, host, method, path, path:N, header:<name>, cookie:<name> or query:<name>)", p)
+}
+
+// parseNetworkPart reads "24" or "24/56", the IPv4 and IPv6 prefix lengths
+func parseNetworkPart(bits string) (keyPart, error) {
+	v4s, v6s, _ := strings.Cut(bits, "/")
+	v4, err := strconv.Atoi(v4s)
+	if err != nil || v4 < 0 || v4 > 32 {
+		return nil, fmt.Errorf("ip/%s needs an IPv4 prefix length of 0 to 32", bits)
+	}
+	v6 := 64
+	if v6s != "" {
+		if v6, err = strconv.Atoi(v6s); err != nil || v6 < 0 || v6 > 128 {
+			return nil, fmt.Errorf("ip/%s needs an IPv6 prefix length of 0 to 128", bits)
+		}
+	}
+	return func(r *http.Request) string {
+		addr, err := netip.ParseAddr(clientIPPart(r))
+		if err != nil {
+			return ""
+		}
+		addr = addr.Unmap()
+		n := v4
+		if addr.Is6() {
+			n = v6
+		}
+		prefix, _ := addr.Prefix(n)
+		return prefix.String()
+	}, nil
+}
+
+func clientIPPart(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// pathSegments is the first n segments of path
+func pathSegments(path string, n int) string {
+	for i := 1; i < len(path); i++ {
+		if path[i] == '/' {
+			if n--; n == 0 {
+				return path[:i]
+			}
+		}
+	}
+	return path
+}
+
+// Of is r's key
+func (k *HashKey) Of(r *http.Request) string {
+	var b strings.Builder
+alts:
+	for _, parts := range k.alts {
+		b.Reset()
+		for i, part := range parts {
+			v := part(r)
+			if v == "" {
+				continue alts
+			}
+			if i > 0 {
+				b.WriteByte(0)
+			}
+			b.WriteString(v)
+		}
+		return b.String()
+	}
+	return clientIPPart(r)
+}
+
+func (k *HashKey) String() string {
+	return k.spec
+}
@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HeaderRule adds, sets or removes one header, or sets a cookie on the
+// response. values may reference {client_ip}, {backend}, {request_id},
+// {host}, {method} and {path}, the connection info fields, e.g.
+// {tls_version} (see connInfoFields), what is known of the backend, as
+// {rack}, {version}, {canary} and {tag.NAME} for its tags, and the balancer's
+// own {var.NAME} (see headerVars), e.g. a compliance banner per region:
+//
+//	{"action": "set", "name": "X-Region", "value": "{tag.region}"},
+//	{"action": "cookie", "name": "consent_banner", "value": "{var.banner}", "attributes": "Path=/; Secure"}
+//
+// a tag or var that isn't set comes out empty, and a rule whose value comes
+// out empty altogether is skipped rather than sending an empty header
+type HeaderRule struct {
+	Action     string `json:"action" yaml:"action"` // add, set, remove or cookie
+	Name       string `json:"name" yaml:"name"`
+	Value      string `json:"value,omitempty" yaml:"value"`
+	Attributes string `json:"attributes,omitempty" yaml:"attributes"` // a cookie's, e.g. Path=/; Max-Age=3600
+}
+
+// headerVars are the values -header-vars or the config file's header_vars
+// give header rules as {var.NAME}, e.g. the region or deployment the
+// balancer runs in
+var headerVars map[string]string
+
+// parseHeaderVars reads name=value pairs separated by commas
+func parseHeaderVars(spec string) (map[string]string, error) {
+	vars := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("header var %q: expected name=value", pair)
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// HeaderRuleSet groups the rules applied to requests under a path prefix
+type HeaderRuleSet struct {
+	PathPrefix string       `json:"path_prefix"`
+	Request    []HeaderRule `json:"request"`
+	Response   []HeaderRule `json:"response"`
+}
+
+// RouteHeaders are a route's own rules, e.g. in -routes
+//
+//	{"path_prefix": "/api/", "pool": "api",
+//	 "headers": {"request": [{"action": "set", "name": "Authorization", "value": "Bearer s3cret"}],
+//	             "response": [{"action": "remove", "name": "Server"},
+//	                          {"action": "set", "name": "Strict-Transport-Security", "value": "max-age=31536000"}]}}
+//
+// they apply after any -header-rules sets, so they have the last word
+type RouteHeaders struct {
+	Request  []HeaderRule `json:"request,omitempty" yaml:"request"`
+	Response []HeaderRule `json:"response,omitempty" yaml:"response"`
+}
+
+func (rh *RouteHeaders) validate() error {
+	return validateHeaderRules(rh.Request, rh.Response)
+}
+
+type headerRulesKey struct{}
+
+// LoadHeaderRules reads a JSON list of rule sets, e.g.
+//
+//	[{"path_prefix": "/api", "request": [{"action": "set", "name": "X-Client", "value": "{client_ip}"}],
+//	  "response": [{"action": "remove", "name": "Server"}]}]
+func LoadHeaderRules(path string) ([]HeaderRuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sets []HeaderRuleSet
+	if err := json.Unmarshal(data, &sets); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, set := range sets {
+		if err := validateHeaderRules(set.Request, set.Response); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return sets, nil
+}
+
+func validateHeaderRules(request, response []HeaderRule) error {
+	for _, rule := range request {
+		if rule.Action == "cookie" {
+			return fmt.Errorf("header rule %q: cookies are set on responses only", rule.Name)
+		}
+	}
+	for _, rule := range append(slices.Clip(request), response...) {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hr HeaderRule) validate() error {
+	switch hr.Action {
+	case "add", "set", "remove", "cookie":
+	default:
+		return fmt.Errorf("header rule %q: unknown action %q", hr.Name, hr.Action)
+	}
+	if hr.Name == "" {
+		return fmt.Errorf("header rule: missing name")
+	}
+	if hr.Action == "cookie" && (&http.Cookie{Name: hr.Name, Value: "v"}).Valid() != nil {
+		return fmt.Errorf("header rule: bad cookie name %q", hr.Name)
+	}
+	return nil
+}
+
+// WithHeaderRules picks the rule sets matching the client's path before the
+// proxy rewrites it; the backend's proxy applies them in both directions
+func WithHeaderRules(rules []HeaderRuleSet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var matched []HeaderRuleSet
+		for _, set := range rules {
+			if strings.HasPrefix(r.URL.Path, set.PathPrefix) {
+				matched = append(matched, set)
+			}
+		}
+		if len(matched) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), headerRulesKey{}, matched))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRouteHeaders adds a route's rules to those applied to r
+func withRouteHeaders(r *http.Request, rh *RouteHeaders) *http.Request {
+	sets := append(slices.Clip(matchedHeaderRules(r.Context())), HeaderRuleSet{Request: rh.Request, Response: rh.Response})
+	return r.WithContext(context.WithValue(r.Context(), headerRulesKey{}, sets))
+}
+
+func matchedHeaderRules(ctx context.Context) []HeaderRuleSet {
+	sets, _ := ctx.Value(headerRulesKey{}).([]HeaderRuleSet)
+	return sets
+}
+
+func headerTemplate(r *http.Request, b *Backend) *strings.Replacer {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	pairs := append([]string{
+		"{client_ip}", clientIP,
+		"{backend}", b.Name(),
+		"{request_id}", GetRequestID(r),
+		"{host}", r.Host,
+		"{method}", r.Method,
+		"{path}", r.URL.Path,
+		"{rack}", b.Rack,
+		"{version}", b.Version(),
+		"{canary}", strconv.FormatBool(b.Canary),
+	}, connInfoTemplate(r)...)
+	for name, value := range b.Tags {
+		pairs = append(pairs, "{tag."+name+"}", value)
+	}
+	for name, value := range headerVars {
+		pairs = append(pairs, "{var."+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// tagPlaceholder matches a tag or var reference, which the template may not
+// know, e.g. {tag.region} on a backend without that tag
+var tagPlaceholder = regexp.MustCompile(`\{(tag|var)\.[^{}]*\}`)
+
+// expandHeaderValue fills in a rule's value. unknown tag and var references
+// are dropped from the rule before the request's values go in, so text in
+// those that looks like a reference, say in {path}, is kept as sent
+func expandHeaderValue(value string, tmpl *strings.Replacer) string {
+	value = tagPlaceholder.ReplaceAllStringFunc(value, func(ref string) string {
+		if tmpl.Replace(ref) == ref {
+			return ""
+		}
+		return ref
+	})
+	return tmpl.Replace(value)
+}
+
+func applyHeaderRules(h http.Header, rules []HeaderRule, tmpl *strings.Replacer) {
+	for _, rule := range rules {
+		value := rule.Value
+		if rule.Action != "remove" {
+			value = expandHeaderValue(rule.Value, tmpl)
+			if value == "" && rule.Value != "" {
+				continue
+			}
+		}
+		switch rule.Action {
+		case "add":
+			h.Add(rule.Name, value)
+		case "set":
+			h.Set(rule.Name, value)
+		case "remove":
+			h.Del(rule.Name)
+		case "cookie":
+			cookie := (&http.Cookie{Name: rule.Name, Value: value}).String()
+			if rule.Attributes != "" {
+				cookie += "; " + rule.Attributes
+			}
+			h.Add("Set-Cookie", cookie)
+		}
+	}
+}
+
+// applyRequestHeaderRules runs on the outgoing request to the backend
+func applyRequestHeaderRules(r *http.Request, b *Backend) {
+	sets := matchedHeaderRules(r.Context())
+	if len(sets) == 0 {
+		return
+	}
+	tmpl := headerTemplate(r, b)
+	for _, set := range sets {
+		applyHeaderRules(r.Header, set.Request, tmpl)
+	}
+}
+
+// applyResponseHeaderRules runs on the backend's response before it is copied to the client
+func applyResponseHeaderRules(res *http.Response, b *Backend) {
+	sets := matchedHeaderRules(res.Request.Context())
+	if len(sets) == 0 {
+		return
+	}
+	tmpl := headerTemplate(res.Request, b)
+	for _, set := range sets {
+		applyHeaderRules(res.Header, set.Response, tmpl)
+	}
+}
@@ -0,0 +1,31 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	tmpl := strings.NewReplacer("{path}", "/a/{tag.region}/{var.env}", "{host}", "{var.x}.example.com", "{tag.zone}", "z1")
+	h := http.Header{}
+	applyHeaderRules(h, []HeaderRule{
+		{Name: "X-Path", Action: "set", Value: "{path}"},
+		{Name: "X-Host", Action: "set", Value: "{host}{tag.region}"},
+		{Name: "X-Zone", Action: "set", Value: "{tag.zone}/{tag.region}"},
+		{Name: "X-Region", Action: "set", Value: "{tag.region}"},
+	}, tmpl)
+	for name, want := range map[string]string{
+		"X-Path":   "/a/{tag.region}/{var.env}",
+		"X-Host":   "{var.x}.example.com",
+		"X-Zone":   "z1/",
+		"X-Region": "",
+	} {
+		if got := h.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, ok := h["X-Region"]; ok {
+		t.Error("a rule left empty by unknown references set its header")
+	}
+}
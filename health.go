@@ -0,0 +1,176 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusRanges is a set of HTTP statuses, written like 200-299,304
+type StatusRanges [][2]int
+
+func (sr *StatusRanges) String() string {
+	parts := make([]string, len(*sr))
+	for i, r := range *sr {
+		if r[0] == r[1] {
+			parts[i] = strconv.Itoa(r[0])
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r[0], r[1])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (sr *StatusRanges) Set(v string) error {
+	var ranges StatusRanges
+	for _, part := range strings.Split(v, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		from, err := strconv.Atoi(lo)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(hi)
+		}
+		if err != nil || from < 100 || to > 599 || from > to {
+			return fmt.Errorf("bad status range %q", part)
+		}
+		ranges = append(ranges, [2]int{from, to})
+	}
+	*sr = ranges
+	return nil
+}
+
+func (sr StatusRanges) Contains(status int) bool {
+	for _, r := range sr {
+		if status >= r[0] && status <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP health check settings, from flags or the config file
+var (
+	healthCheckStatus  = StatusRanges{{200, 399}}
+	healthyThreshold   = 1
+	unhealthyThreshold = 1
+)
+
+// HealthSettings are how a pool's backends are probed. pools without their
+// own use the global ones from flags or the config file
+type HealthSettings struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	Path      string // empty means a TCP connect check
+	Status    StatusRanges
+	Healthy   int
+	Unhealthy int
+	Version   string // expected in versionHeader, empty for any
+}
+
+func globalHealth() HealthSettings {
+	return HealthSettings{
+		Interval:  healthCheckInterval,
+		Timeout:   healthCheckTimeout,
+		Path:      healthCheckPath,
+		Status:    healthCheckStatus,
+		Healthy:   healthyThreshold,
+		Unhealthy: unhealthyThreshold,
+		Version:   expectedVersion,
+	}
+}
+
+func (s *ServerPool) healthSettings() HealthSettings {
+	if s.Health != nil {
+		return *s.Health
+	}
+	return globalHealth()
+}
+
+// over returns base with what hc sets replacing it
+func (hc *HealthCheckConfig) over(base HealthSettings) (HealthSettings, error) {
+	if hc.Interval.Duration > 0 {
+		base.Interval = hc.Interval.Duration
+	}
+	if hc.Timeout.Duration > 0 {
+		base.Timeout = hc.Timeout.Duration
+	}
+	if hc.Path != "" {
+		base.Path = hc.Path
+	}
+	if hc.ExpectedStatus != "" {
+		base.Status = nil
+		if err := base.Status.Set(hc.ExpectedStatus); err != nil {
+			return base, fmt.Errorf("expected_status: %w", err)
+		}
+	}
+	if hc.HealthyThreshold > 0 {
+		base.Healthy = hc.HealthyThreshold
+	}
+	if hc.UnhealthyThreshold > 0 {
+		base.Unhealthy = hc.UnhealthyThreshold
+	}
+	if hc.ExpectedVersion != "" {
+		base.Version = hc.ExpectedVersion
+	}
+	return base, nil
+}
+
+// fresh connections each probe, so the check (and its rtt) covers connecting
+var healthClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true, DialContext: healthDial}}
+
+// isBackendHealthy asks the backend's health endpoint and expects one of the
+// hs.Status statuses
+func isBackendHealthy(b *Backend, hs HealthSettings) bool {
+	u := b.URL()
+	ctx, cancel := context.WithTimeout(context.Background(), hs.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.JoinPath(hs.Path).String(), nil)
+	if err != nil {
+		b.unavailable("%v", err)
+		return false
+	}
+	res, err := healthClientFor(b).Do(req)
+	if err != nil {
+		b.unavailable("%v", err)
+		return false
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+	_ = res.Body.Close()
+	b.observeSignals(res.Header)
+	if !hs.Status.Contains(res.StatusCode) {
+		b.unavailable("%s answered %s", u.Host, res.Status)
+		return false
+	}
+	return b.observeVersion(res.Header, hs)
+}
+
+// isUp is the backend's health state alone, ignoring maintenance
+func (b *Backend) isUp() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Alive
+}
+
+// observeHealth counts a probe result and returns whether the backend should
+// be up: it only flips after enough consecutive probes agree, so one slow
+// answer doesn't take a backend out and one lucky one doesn't bring it back
+func (b *Backend) observeHealth(ok bool, hs HealthSettings) bool {
+	if ok {
+		b.passes, b.fails = b.passes+1, 0
+	} else {
+		b.passes, b.fails = 0, b.fails+1
+	}
+
+	alive := b.isUp()
+	if alive && b.fails >= hs.Unhealthy {
+		return false
+	}
+	if !alive && b.passes >= hs.Healthy {
+		return true
+	}
+	return alive
+}
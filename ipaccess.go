@@ -0,0 +1,356 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -ip-allow and -ip-deny apply address lists kept elsewhere, e.g. by a
+// firewall team, without a redeploy. each is a file, an http(s) url or
+// s3://bucket/key (credentials from the usual AWS_* variables, and
+// AWS_ENDPOINT_URL for an S3-compatible store) holding addresses and CIDRs,
+// one per line or separated by spaces, with # comments. they are fetched
+// again every -ip-list-interval; urls are asked with If-None-Match, so an
+// unchanged list costs a 304, and a fetch that fails keeps the last list.
+// either may instead be the addresses and CIDRs themselves, separated by
+// commas. a client in the deny list, or missing from the allow list, gets a
+// 403. the client is found as for -client-rate. routes can have lists of
+// their own, see RouteIPAccess
+var (
+	ipAllowSource  string
+	ipDenySource   string
+	ipListInterval = time.Minute
+	ipAccess       *IPAccess
+)
+
+// the most a list may hold, to stop a wrong url from eating memory
+const maxIPListBytes = 16 << 20
+
+// IPAccess checks clients against an allow list and a deny list, either
+// of which may be nil
+type IPAccess struct {
+	Allow, Deny *IPList
+
+	denied atomic.Uint64
+}
+
+// IPList is a synced list of networks
+type IPList struct {
+	Source string
+
+	nets   atomic.Pointer[[]*net.IPNet]
+	fetch  func(ctx context.Context, etag string) (body []byte, newETag string, err error)
+	etag   string // of the list held, only touched by sync
+	synced atomic.Int64
+
+	failures atomic.Uint64
+}
+
+// errNotModified is what fetch returns when the list is unchanged
+var errNotModified = errors.New("not modified")
+
+// NewIPList makes a list for a file, an http(s) url or an s3:// url and
+// does the first fetch, which has to work
+func NewIPList(source string) (*IPList, error) {
+	if l, err := staticIPList(source, strings.Split(source, ",")); err == nil {
+		return l, nil
+	}
+	l := &IPList{Source: source}
+	u, err := url.Parse(source)
+	switch {
+	case err != nil:
+		return nil, err
+	case u.Scheme == "http" || u.Scheme == "https":
+		l.fetch = func(ctx context.Context, etag string) ([]byte, string, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+			if err != nil {
+				return nil, "", err
+			}
+			return fetchIPList(http.DefaultClient, req, etag)
+		}
+	case u.Scheme == "s3":
+		s3, err := newS3Store(u, os.Getenv("AWS_ENDPOINT_URL"))
+		if err != nil {
+			return nil, fmt.Errorf("ip list %s: %w", source, err)
+		}
+		l.fetch = func(ctx context.Context, etag string) ([]byte, string, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, s3.objectURL(""), nil)
+			if err != nil {
+				return nil, "", err
+			}
+			s3.sign(req, nil, time.Now().UTC())
+			return fetchIPList(s3.client, req, etag)
+		}
+	case u.Scheme == "" || u.Scheme == "file":
+		path := strings.TrimPrefix(source, "file://")
+		l.fetch = func(ctx context.Context, etag string) ([]byte, string, error) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, "", err
+			}
+			// a file's etag is its size and modification time
+			tag := fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano())
+			if tag == etag {
+				return nil, "", errNotModified
+			}
+			body, err := os.ReadFile(path)
+			return body, tag, err
+		}
+	default:
+		return nil, fmt.Errorf("ip list %s: expected a file, an http(s) url or s3://bucket/key", source)
+	}
+	if err := l.sync(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// staticIPList is a list of the given addresses and CIDRs that is never
+// fetched again
+func staticIPList(source string, entries []string) (*IPList, error) {
+	nets, err := parseIPList([]byte(strings.Join(entries, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	if len(nets) == 0 {
+		return nil, errors.New("no addresses")
+	}
+	l := &IPList{Source: source}
+	l.nets.Store(&nets)
+	l.synced.Store(time.Now().UnixNano())
+	return l, nil
+}
+
+// fetchIPList sends req with the etag held and reads the answer
+func fetchIPList(client *http.Client, req *http.Request, etag string) ([]byte, string, error) {
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, "", errNotModified
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, "", fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxIPListBytes+1))
+	if err == nil && len(body) > maxIPListBytes {
+		err = fmt.Errorf("longer than %d bytes", maxIPListBytes)
+	}
+	return body, res.Header.Get("ETag"), err
+}
+
+// sync fetches the list and swaps it in if it changed
+func (l *IPList) sync() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	body, etag, err := l.fetch(ctx, l.etag)
+	if errors.Is(err, errNotModified) {
+		l.synced.Store(time.Now().UnixNano())
+		return nil
+	}
+	var nets []*net.IPNet
+	if err == nil {
+		nets, err = parseIPList(body)
+	}
+	if err != nil {
+		l.failures.Add(1)
+		return fmt.Errorf("ip list %s: %w", l.Source, err)
+	}
+	old := l.nets.Swap(&nets)
+	l.etag = etag
+	l.synced.Store(time.Now().UnixNano())
+	if old == nil || len(*old) != len(nets) {
+		log.Printf("IP list %s: %d entries\n", l.Source, len(nets))
+	}
+	return nil
+}
+
+// keepSynced syncs the list every interval until ctx is done
+func (l *IPList) keepSynced(ctx context.Context, interval time.Duration) {
+	if l.fetch == nil {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := l.sync(); err != nil {
+			log.Printf("%v, keeping the last list\n", err)
+		}
+	}
+}
+
+// parseIPList reads addresses and CIDRs, a bare address being a /32 or /128
+func parseIPList(body []byte) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for i, line := range strings.Split(string(body), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		for _, f := range strings.Fields(line) {
+			if !strings.Contains(f, "/") {
+				ip := net.ParseIP(f)
+				if ip == nil {
+					return nil, fmt.Errorf("line %d: bad address %q", i+1, f)
+				}
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			_, n, err := net.ParseCIDR(f)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+// Contains reports whether ip is in the list
+func (l *IPList) Contains(ip net.IP) bool {
+	for _, n := range *l.nets.Load() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len is the number of entries held
+func (l *IPList) Len() int {
+	return len(*l.nets.Load())
+}
+
+// allowed reports whether the client at addr may come in
+func (a *IPAccess) allowed(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return a.Allow == nil
+	}
+	if a.Deny != nil && a.Deny.Contains(ip) {
+		return false
+	}
+	return a.Allow == nil || a.Allow.Contains(ip)
+}
+
+// Middleware answers 403 to clients the lists keep out
+func (a *IPAccess) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowed(requestClientIP(r)) {
+			a.denied.Add(1)
+			writeError(w, r, http.StatusForbidden, "ip_denied", "Forbidden.", 0)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RouteIPAccess limits a route to some clients, checked before anything
+// else on the route and after -ip-allow and -ip-deny, e.g. in -routes
+//
+//	{"path_prefix": "/internal/", "pool": "ops",
+//	 "ip_access": {"allow": ["10.20.0.0/16", "192.0.2.10"], "deny": ["10.20.99.0/24"]}}
+type RouteIPAccess struct {
+	Allow []string `json:"allow,omitempty" yaml:"allow"`
+	Deny  []string `json:"deny,omitempty" yaml:"deny"`
+
+	lists IPAccess
+}
+
+func (ra *RouteIPAccess) init(route string) error {
+	var err error
+	if len(ra.Allow) > 0 {
+		if ra.lists.Allow, err = staticIPList(route+" allow", ra.Allow); err != nil {
+			return fmt.Errorf("route %s: ip_access.allow: %w", route, err)
+		}
+	}
+	if len(ra.Deny) > 0 {
+		if ra.lists.Deny, err = staticIPList(route+" deny", ra.Deny); err != nil {
+			return fmt.Errorf("route %s: ip_access.deny: %w", route, err)
+		}
+	}
+	if ra.lists.Allow == nil && ra.lists.Deny == nil {
+		return fmt.Errorf("route %s: ip_access needs allow or deny", route)
+	}
+	return nil
+}
+
+// allow answers 403 to clients the route's lists keep out
+func (ra *RouteIPAccess) allow(w http.ResponseWriter, r *http.Request) bool {
+	if ra.lists.allowed(requestClientIP(r)) {
+		return true
+	}
+	ra.lists.denied.Add(1)
+	writeError(w, r, http.StatusForbidden, "ip_denied", "Forbidden.", 0)
+	return false
+}
+
+// Start keeps the lists synced until ctx is done
+func (a *IPAccess) Start(ctx context.Context, interval time.Duration) {
+	for _, l := range a.named() {
+		go l.keepSynced(ctx, interval)
+	}
+}
+
+// named is the lists in use by name, allow first
+func (a *IPAccess) named() []namedIPList {
+	var lists []namedIPList
+	if a.Allow != nil {
+		lists = append(lists, namedIPList{"allow", a.Allow})
+	}
+	if a.Deny != nil {
+		lists = append(lists, namedIPList{"deny", a.Deny})
+	}
+	return lists
+}
+
+type namedIPList struct {
+	name string
+	*IPList
+}
+
+// IPListStatus is a list as the admin API shows it
+type IPListStatus struct {
+	List     string    `json:"list"` // allow or deny
+	Source   string    `json:"source"`
+	Entries  int       `json:"entries"`
+	Synced   time.Time `json:"synced"`
+	Failures uint64    `json:"failures"`
+}
+
+func getIPLists(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Lists  []IPListStatus `json:"lists"`
+		Denied uint64         `json:"denied"`
+	}{Lists: []IPListStatus{}}
+	if a := ipAccess; a != nil {
+		for _, l := range a.named() {
+			status.Lists = append(status.Lists, IPListStatus{l.name, l.Source, l.Len(), time.Unix(0, l.synced.Load()), l.failures.Load()})
+		}
+		status.Denied = a.denied.Load()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
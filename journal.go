@@ -0,0 +1,211 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// the failure journal keeps the details of every request that was answered
+// with a 5xx, as JSON lines, for going through after an incident: the
+// request's headers, credentials redacted, the start of its body, the error
+// code the balancer answered with, and each attempt at a backend with its
+// status or error. it is bounded: once -failure-journal reaches half of
+// -failure-journal-max-bytes it becomes <path>.1, replacing the one before
+type JournaledRequest struct {
+	Time      time.Time        `json:"time"`
+	RequestID string           `json:"request_id,omitempty"`
+	Client    string           `json:"client"`
+	Method    string           `json:"method"`
+	URI       string           `json:"uri"`
+	Host      string           `json:"host"`
+	Header    http.Header      `json:"header"`
+	Body      []byte           `json:"body,omitempty"`
+	Truncated bool             `json:"truncated,omitempty"` // the body went on
+	Status    int              `json:"status"`
+	Error     string           `json:"error,omitempty"` // the balancer's error code, if it answered itself
+	Duration  float64          `json:"duration_ms"`
+	Attempts  []JournalAttempt `json:"attempts"`
+}
+
+// JournalAttempt is how one try at a backend ended
+type JournalAttempt struct {
+	Backend string  `json:"backend"`
+	At      float64 `json:"at_ms"` // since the request came in
+	Status  int     `json:"status,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	Kind    string  `json:"kind,omitempty"` // dns, connect_refused, 5xx, ... see classifyUpstreamError
+}
+
+// redactedHeaders are kept out of the journal, which may be read by more
+// people than the credentials are meant for, as are -api-key-header and
+// the routes' api_key headers, see journalRedacted
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-API-Key", debugTokenHeader, maintenanceBypassHeader}
+
+// journalRedacted is redactedHeaders with the API key headers configured
+func journalRedacted() []string {
+	redact := append([]string(nil), redactedHeaders...)
+	if apiKeys != nil {
+		redact = append(redact, apiKeys.Header)
+	}
+	if router != nil {
+		for _, rt := range router.Routes {
+			if rt.Auth != nil && rt.Auth.APIKey != nil {
+				redact = append(redact, rt.Auth.APIKey.Header)
+			}
+		}
+	}
+	return redact
+}
+
+type FailureJournal struct {
+	Path     string
+	MaxBytes int64
+	MaxBody  int64
+
+	entries chan *JournaledRequest
+	dropped atomic.Uint64
+}
+
+func NewFailureJournal(path string, maxBytes, maxBody int64) (*FailureJournal, error) {
+	j := &FailureJournal{Path: path, MaxBytes: maxBytes, MaxBody: maxBody, entries: make(chan *JournaledRequest, 256)}
+	f, size, err := j.open()
+	if err != nil {
+		return nil, err
+	}
+	go j.write(f, size)
+	return j, nil
+}
+
+func (j *FailureJournal) open() (*os.File, int64, error) {
+	f, err := os.OpenFile(j.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, st.Size(), nil
+}
+
+// single writer, rotating once the file holds half the budget
+func (j *FailureJournal) write(f *os.File, size int64) {
+	for e := range j.entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Println("Failure journal could not encode an entry: ", err)
+			continue
+		}
+		data = append(data, '\n')
+		if size > 0 && size+int64(len(data)) > j.MaxBytes/2 {
+			f.Close()
+			if err := os.Rename(j.Path, j.Path+".1"); err != nil {
+				log.Println("Failure journal rotation failed: ", err)
+			}
+			if f, size, err = j.open(); err != nil {
+				log.Println("Failure journal stopped: ", err)
+				return
+			}
+		}
+		n, err := f.Write(data)
+		size += int64(n)
+		if err != nil {
+			log.Println("Failure journal write failed: ", err)
+		}
+	}
+}
+
+type journalKey struct{}
+
+func (j *FailureJournal) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &JournaledRequest{
+			Time:      start,
+			RequestID: GetRequestID(r),
+			Client:    r.RemoteAddr,
+			Method:    r.Method,
+			URI:       r.URL.RequestURI(),
+			Host:      r.Host,
+			Header:    r.Header.Clone(),
+			Attempts:  []JournalAttempt{},
+		}
+		var body *journalBody
+		if r.Body != nil && r.Body != http.NoBody {
+			// keeps what the backends were sent, not reading ahead of them
+			body = &journalBody{ReadCloser: r.Body, max: j.MaxBody}
+			r.Body = body
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), journalKey{}, e)))
+		if sw.status < 500 {
+			return
+		}
+
+		e.Status = sw.status
+		e.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		for _, h := range journalRedacted() {
+			if _, ok := e.Header[http.CanonicalHeaderKey(h)]; ok {
+				e.Header.Set(h, "[redacted]")
+			}
+		}
+		if body != nil {
+			e.Body, e.Truncated = body.kept, body.truncated
+		}
+		select {
+		case j.entries <- e:
+		default:
+			if j.dropped.Add(1)%100 == 1 {
+				log.Println("Failure journal falling behind, dropping entries")
+			}
+		}
+	})
+}
+
+// journalAttempt notes how an attempt at b ended, with a status or an error
+func journalAttempt(r *http.Request, b *Backend, status int, err error) {
+	e, _ := r.Context().Value(journalKey{}).(*JournaledRequest)
+	if e == nil {
+		return
+	}
+	a := JournalAttempt{Backend: b.Name(), At: float64(time.Since(e.Time)) / float64(time.Millisecond), Status: status}
+	if err != nil {
+		a.Error, a.Kind = err.Error(), classifyUpstreamError(err).String()
+	} else if status >= 500 {
+		a.Kind = upstream5xx.String()
+	}
+	e.Attempts = append(e.Attempts, a)
+}
+
+// journalError notes the error code the balancer answered r with
+func journalError(r *http.Request, code string) {
+	if e, _ := r.Context().Value(journalKey{}).(*JournaledRequest); e != nil {
+		e.Error = code
+	}
+}
+
+// journalBody keeps the first max bytes read from a request body
+type journalBody struct {
+	io.ReadCloser
+	max       int64
+	kept      []byte
+	truncated bool
+}
+
+func (jb *journalBody) Read(p []byte) (int, error) {
+	n, err := jb.ReadCloser.Read(p)
+	if room := jb.max - int64(len(jb.kept)); room < int64(n) {
+		jb.kept = append(jb.kept, p[:max(room, 0)]...)
+		jb.truncated = true
+	} else {
+		jb.kept = append(jb.kept, p[:n]...)
+	}
+	return n, err
+}
@@ -0,0 +1,39 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJournalRedactsCredentials(t *testing.T) {
+	defer func(keys *APIKeys, rt *Router) { apiKeys, router = keys, rt }(apiKeys, router)
+	apiKeys = &APIKeys{Header: "X-Fleet-Key"}
+	router = &Router{Routes: []*Route{{Name: "admin", Auth: &RouteAuth{APIKey: &APIKeyAuth{Header: "X-Admin-Key"}}}}}
+
+	j := &FailureJournal{MaxBody: 64, entries: make(chan *JournaledRequest, 1)}
+	h := j.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/x", nil)
+	secrets := []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", debugTokenHeader, maintenanceBypassHeader, "X-Fleet-Key", "X-Admin-Key"}
+	for _, name := range secrets {
+		r.Header.Set(name, "secret")
+	}
+	r.Header.Set("Accept", "text/plain")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	e := <-j.entries
+	for _, name := range secrets {
+		if got := e.Header.Get(name); got != "[redacted]" {
+			t.Errorf("%s journaled as %q", name, got)
+		}
+	}
+	if got := e.Header.Get("Accept"); got != "text/plain" {
+		t.Errorf("Accept journaled as %q", got)
+	}
+	// what the request goes on with is untouched
+	if got := r.Header.Get("Authorization"); got != "secret" {
+		t.Errorf("request's Authorization is now %q", got)
+	}
+}
@@ -0,0 +1,169 @@
+package loadbalancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a JWKS document is fetched again after jwksMaxAge, and when a token names
+// a key it doesn't have, which is how a provider's key rotation shows up,
+// though at most once per jwksMinRefresh so bad tokens can't hammer it
+const (
+	jwksMaxAge     = time.Hour
+	jwksMinRefresh = 30 * time.Second
+)
+
+var jwksClient = &http.Client{Timeout: 5 * time.Second}
+
+type jwks struct {
+	url  string
+	keys atomic.Pointer[map[string]jwksKey] // by kid, swapped whole by a fetch
+
+	mux      sync.Mutex
+	fetched  time.Time     // last successful fetch
+	tried    time.Time     // last attempt
+	fetching chan struct{} // closed once the fetch under way is done
+	err      error         // of the last fetch
+}
+
+type jwksKey struct {
+	alg string
+	key any // *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// lookup returns the key kid names, or the only key when the token names
+// none. the document is fetched without holding up lookups of keys already
+// known, and only one fetch runs at a time
+func (j *jwks) lookup(kid string) (jwksKey, bool) {
+	k, ok := j.find(kid)
+	j.mux.Lock()
+	due := time.Since(j.tried) >= jwksMinRefresh
+	wait := !ok && (due || j.fetching != nil)
+	stale := ok && due && time.Since(j.fetched) > jwksMaxAge
+	if stale {
+		j.tried = time.Now() // one refresh is enough
+	}
+	j.mux.Unlock()
+	switch {
+	case wait:
+		if err := j.refresh(); err != nil {
+			log.Printf("Could not fetch JWKS from %s: %v\n", j.url, err)
+		}
+		k, ok = j.find(kid)
+	case stale:
+		// the keys we have do meanwhile
+		go func() {
+			if err := j.refresh(); err != nil {
+				log.Printf("Could not refresh JWKS from %s: %v\n", j.url, err)
+			}
+		}()
+	}
+	return k, ok
+}
+
+func (j *jwks) find(kid string) (jwksKey, bool) {
+	keys := j.keys.Load()
+	if keys == nil {
+		return jwksKey{}, false
+	}
+	if kid == "" && len(*keys) == 1 {
+		for _, k := range *keys {
+			return k, true
+		}
+	}
+	k, ok := (*keys)[kid]
+	return k, ok
+}
+
+// refresh fetches the document, or waits for the fetch already under way,
+// and swaps the keys in if it succeeds
+func (j *jwks) refresh() error {
+	j.mux.Lock()
+	if fetching := j.fetching; fetching != nil {
+		j.mux.Unlock()
+		<-fetching
+		j.mux.Lock()
+		defer j.mux.Unlock()
+		return j.err
+	}
+	done := make(chan struct{})
+	j.fetching, j.tried = done, time.Now()
+	j.mux.Unlock()
+
+	keys, err := j.fetch()
+	j.mux.Lock()
+	if err == nil {
+		j.keys.Store(&keys)
+		j.fetched = time.Now()
+	}
+	j.fetching, j.err = nil, err
+	j.mux.Unlock()
+	close(done)
+	return err
+}
+
+func (j *jwks) fetch() (map[string]jwksKey, error) {
+	res, err := jwksClient.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", j.url, res.Status)
+	}
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", j.url, err)
+	}
+	keys := map[string]jwksKey{}
+	for _, k := range doc.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA" && (k.Alg == "" || k.Alg == "RS256"):
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			keys[k.Kid] = jwksKey{alg: "RS256", key: key}
+		case k.Kty == "EC" && k.Crv == "P-256" && (k.Alg == "" || k.Alg == "ES256"):
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			keys[k.Kid] = jwksKey{alg: "ES256", key: key}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no RS256 or ES256 signing keys", j.url)
+	}
+	return keys, nil
+}
@@ -0,0 +1,134 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lane is a request's priority under load. a pool with -pool-max-conns
+// admits low-lane requests only while it is below LaneSettings.LowShare of
+// its cap and normal ones below NormalShare, so the last slots are kept for
+// critical requests. requests get their lane from their class (see
+// -classes); unclassified ones are normal
+type Lane int
+
+const (
+	LaneLow Lane = iota
+	LaneNormal
+	LaneCritical
+	numLanes
+)
+
+var laneNames = [numLanes]string{"low", "normal", "critical"}
+
+func (l Lane) String() string {
+	return laneNames[l]
+}
+
+func parseLane(name string) (Lane, error) {
+	if name == "" {
+		return LaneNormal, nil
+	}
+	for l, n := range laneNames {
+		if strings.EqualFold(name, n) {
+			return Lane(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown lane %q (use low, normal or critical)", name)
+}
+
+// LaneSettings are the shares of a pool's cap open to each lane, and how
+// long a request that doesn't fit waits for a slot before it is shed
+type LaneSettings struct {
+	LowShare    float64
+	NormalShare float64
+	Queue       time.Duration // 0 sheds at once
+}
+
+var lanes = LaneSettings{LowShare: 0.5, NormalShare: 0.9}
+
+type laneKey struct{}
+
+func requestLane(r *http.Request) Lane {
+	if l, ok := r.Context().Value(laneKey{}).(Lane); ok {
+		return l
+	}
+	return LaneNormal
+}
+
+// laneCap is how many requests may be in flight when one of lane l is admitted
+func (s *ServerPool) laneCap(l Lane) int64 {
+	share := 1.0
+	switch l {
+	case LaneLow:
+		share = lanes.LowShare
+	case LaneNormal:
+		share = lanes.NormalShare
+	}
+	return max(int64(float64(s.MaxConns)*share), 1)
+}
+
+// slotSignal wakes every queued request to try again whenever a slot frees
+// up, by closing the channel they wait on
+type slotSignal struct {
+	mux   sync.Mutex
+	freed chan struct{}
+}
+
+func (sig *slotSignal) wait() <-chan struct{} {
+	sig.mux.Lock()
+	defer sig.mux.Unlock()
+	if sig.freed == nil {
+		sig.freed = make(chan struct{})
+	}
+	return sig.freed
+}
+
+func (sig *slotSignal) broadcast() {
+	sig.mux.Lock()
+	defer sig.mux.Unlock()
+	if sig.freed != nil {
+		close(sig.freed)
+		sig.freed = nil
+	}
+}
+
+// tryAcquire takes a slot if the lane still has room. the count only goes
+// up when it stays within the cap, so a lane that is refused never shows as
+// holding a slot to a concurrent request of another lane
+func (s *ServerPool) tryAcquire(l Lane) bool {
+	if s.MaxConns == 0 {
+		s.inflight.Add(1)
+		return true
+	}
+	limit := s.laneCap(l)
+	for {
+		n := s.inflight.Load()
+		if n >= limit {
+			return false
+		}
+		if s.inflight.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// LaneStats are a lane's shed requests in a pool
+type LaneStats struct {
+	Cap  int64  `json:"cap"`
+	Shed uint64 `json:"shed"`
+}
+
+func (s *ServerPool) laneStats() map[string]LaneStats {
+	if s.MaxConns == 0 {
+		return nil
+	}
+	stats := map[string]LaneStats{}
+	for l := Lane(0); l < numLanes; l++ {
+		stats[l.String()] = LaneStats{Cap: s.laneCap(l), Shed: s.shed[l].Load()}
+	}
+	return stats
+}
@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"math"
+	"time"
+)
+
+// probe round-trip times are smoothed so one slow dial doesn't swing traffic
+const probeRTTAlpha = 0.3
+
+// observeProbe folds a health probe's round-trip time into the backend's
+// moving average
+func (b *Backend) observeProbe(rtt time.Duration) {
+	for {
+		old := b.probeRTT.Load()
+		next := int64(rtt)
+		if old > 0 {
+			next = int64(probeRTTAlpha*float64(rtt) + (1-probeRTTAlpha)*float64(old))
+		}
+		if b.probeRTT.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// ProbeRTT is the smoothed health probe round-trip time, 0 until measured
+func (b *Backend) ProbeRTT() time.Duration {
+	return time.Duration(b.probeRTT.Load())
+}
+
+// LeastLatency spreads traffic in inverse proportion to probe round-trip
+// time, so a backend twice as far away gets half the share. backends not yet
+// probed count as average
+type LeastLatency struct {
+	rng *lockedRand
+}
+
+func (st *LeastLatency) Next(s *ServerPool) *Backend {
+	backends := s.Backends()
+	alive := make([]*Backend, 0, len(backends))
+	var sum float64
+	measured := 0
+	for _, b := range backends {
+		if !b.IsAlive() {
+			continue
+		}
+		alive = append(alive, b)
+		if rtt := b.ProbeRTT(); rtt > 0 {
+			sum += float64(rtt)
+			measured++
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+	avg := 1.0
+	if measured > 0 {
+		avg = sum / float64(measured)
+	}
+
+	weights := make([]float64, len(alive))
+	var total float64
+	for i, b := range alive {
+		rtt := float64(b.ProbeRTT())
+		if rtt == 0 {
+			rtt = avg
+		}
+		weights[i] = 1 / math.Max(rtt, 1)
+		total += weights[i]
+	}
+	n := st.rng.Float64() * total
+	for i, w := range weights {
+		if n -= w; n < 0 {
+			return alive[i]
+		}
+	}
+	return alive[len(alive)-1]
+}
@@ -0,0 +1,284 @@
+package loadbalancer
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnLimits caps concurrent client connections globally and per client IP.
+// beyond the global cap connections either wait in the accept queue or are
+// turned away with a 503; beyond the per-client cap they are always refused.
+// response bandwidth can be capped per connection and per client IP.
+type ConnLimits struct {
+	MaxConns           int   // 0 means unlimited
+	MaxPerClient       int   // 0 means unlimited
+	Queue              bool  // wait for a free slot instead of rejecting
+	BandwidthPerConn   int64 // bytes/sec, 0 means unlimited
+	BandwidthPerClient int64 // bytes/sec shared by a client's connections, 0 means unlimited
+}
+
+var connLimits ConnLimits
+
+type limitListener struct {
+	net.Listener
+	tenant    string
+	addr      string // the addresses bound, for metrics
+	limits    ConnLimits
+	slots     chan struct{}
+	encrypted bool // TLS is terminated above, so a plaintext reply can't be sent
+
+	mux       sync.Mutex
+	clients   map[string]int
+	bandwidth map[string]*byteBucket // per-client buckets while the client is connected
+
+	active   atomic.Int64
+	rejected atomic.Uint64
+	closed   atomic.Bool
+}
+
+var (
+	listenersMux    sync.Mutex
+	activeListeners []*limitListener
+)
+
+// LimitListener wraps l with the configured connection caps. encrypted says
+// a TLSListener sits on top of it
+func LimitListener(l net.Listener, limits ConnLimits, tenant string, encrypted bool) net.Listener {
+	ll := &limitListener{Listener: l, tenant: tenant, addr: boundAddrs(l), limits: limits, encrypted: encrypted, clients: map[string]int{}, bandwidth: map[string]*byteBucket{}}
+	if limits.MaxConns > 0 {
+		ll.slots = make(chan struct{}, limits.MaxConns)
+	}
+	listenersMux.Lock()
+	defer listenersMux.Unlock()
+	// HA opens a listener each time it wins the lock; the ones closed since
+	// go once their last connection has
+	activeListeners = slices.DeleteFunc(activeListeners, func(l *limitListener) bool {
+		return l.closed.Load() && l.active.Load() == 0
+	})
+	activeListeners = append(activeListeners, ll)
+	return ll
+}
+
+// listening is the listeners counted in stats, metrics and the graph
+func listening() []*limitListener {
+	listenersMux.Lock()
+	defer listenersMux.Unlock()
+	return slices.Clone(activeListeners)
+}
+
+func (l *limitListener) Close() error {
+	l.closed.Store(true)
+	return l.Listener.Close()
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		// queueing means not accepting: clients wait in the kernel backlog
+		if l.slots != nil && l.limits.Queue {
+			l.slots <- struct{}{}
+		}
+
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if l.slots != nil && l.limits.Queue {
+				<-l.slots
+			}
+			return nil, err
+		}
+
+		if l.slots != nil && !l.limits.Queue {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				l.reject(c, "connection limit reached")
+				continue
+			}
+		}
+
+		ip := clientIP(c.RemoteAddr())
+		if !l.addClient(ip) {
+			if l.slots != nil {
+				<-l.slots
+			}
+			l.reject(c, "per-client connection limit reached for "+ip)
+			continue
+		}
+
+		l.active.Add(1)
+		return &limitedConn{Conn: l.throttle(c, ip), release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *limitListener) addClient(ip string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.limits.MaxPerClient > 0 && l.clients[ip] >= l.limits.MaxPerClient {
+		return false
+	}
+	l.clients[ip]++
+	return true
+}
+
+func (l *limitListener) release(ip string) {
+	l.mux.Lock()
+	if l.clients[ip]--; l.clients[ip] <= 0 {
+		delete(l.clients, ip)
+		delete(l.bandwidth, ip)
+	}
+	l.mux.Unlock()
+	l.active.Add(-1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// reject answers with a bare 503 so clients get a reason instead of a reset.
+// in TCP mode, and under TLS where the client expects a handshake, they just
+// get closed. the write happens off the accept loop so a slow peer can't
+// stall it.
+func (l *limitListener) reject(c net.Conn, reason string) {
+	if l.rejected.Add(1)%100 == 1 {
+		log.Printf("Rejecting %s: %s\n", c.RemoteAddr(), reason)
+	}
+	if tcpMode || l.encrypted {
+		_ = c.Close()
+		return
+	}
+	go func() {
+		_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+		_, _ = c.Write([]byte("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		_ = c.Close()
+	}()
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func clientIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// ConnStats reports utilization of one listener against its limits
+type ConnStats struct {
+	Tenant       string `json:"tenant"`
+	Addr         string `json:"addr"`
+	Active       int64  `json:"active"`
+	MaxConns     int    `json:"max_conns"`
+	Clients      int    `json:"clients"`
+	MaxPerClient int    `json:"max_per_client"`
+	Rejected     uint64 `json:"rejected"`
+}
+
+func (l *limitListener) Stats() ConnStats {
+	l.mux.Lock()
+	clients := len(l.clients)
+	l.mux.Unlock()
+	return ConnStats{
+		Tenant:       l.tenant,
+		Addr:         l.Addr().String(),
+		Active:       l.active.Load(),
+		MaxConns:     l.limits.MaxConns,
+		Clients:      clients,
+		MaxPerClient: l.limits.MaxPerClient,
+		Rejected:     l.rejected.Load(),
+	}
+}
+
+// PoolStats reports in-flight requests of a pool against its cap
+type PoolStats struct {
+	Name     string `json:"name"`
+	InFlight int64  `json:"in_flight"`
+	MaxConns int    `json:"max_conns"`
+	Rejected uint64 `json:"rejected"`
+
+	Lanes map[string]LaneStats `json:"lanes,omitempty"`
+}
+
+func (s *ServerPool) Stats() PoolStats {
+	return PoolStats{
+		Name:     s.Name,
+		InFlight: s.inflight.Load(),
+		MaxConns: s.MaxConns,
+		Rejected: s.rejected.Load(),
+		Lanes:    s.laneStats(),
+	}
+}
+
+// acquire takes a pool slot for the request's lane, waiting up to
+// lanes.Queue for one, and returns false when the lane stays full
+func (s *ServerPool) acquire(r *http.Request) bool {
+	l := requestLane(r)
+	if s.tryAcquire(l) {
+		return true
+	}
+	if lanes.Queue > 0 {
+		timeout := time.NewTimer(lanes.Queue)
+		defer timeout.Stop()
+		s.queued.Add(1)
+		defer s.queued.Add(-1)
+		for {
+			freed := s.slotFreed.wait()
+			if s.tryAcquire(l) {
+				return true
+			}
+			select {
+			case <-freed:
+				continue
+			case <-timeout.C:
+			case <-r.Context().Done():
+			}
+			break
+		}
+	}
+	s.rejected.Add(1)
+	s.shed[l].Add(1)
+	return false
+}
+
+func (s *ServerPool) releaseSlot() {
+	s.inflight.Add(-1)
+	s.slotFreed.broadcast()
+}
+
+func getLimits(w http.ResponseWriter, r *http.Request) {
+	active := listening()
+	listeners := make([]ConnStats, len(active))
+	for i, l := range active {
+		listeners[i] = l.Stats()
+	}
+	poolStats := make([]PoolStats, len(pools))
+	for i, p := range pools {
+		poolStats[i] = p.Stats()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"listeners":   listeners,
+		"pools":       poolStats,
+		"rate_limits": rateLimitStats(),
+	})
+}
@@ -0,0 +1,160 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bindAddrs are the addresses the default listener binds (-listen), all
+// sharing one set of connection limits. empty binds every interface on
+// -port. entries may leave out the port, so "::1,127.0.0.1" with -port 3000
+// serves both loopbacks
+var bindAddrs []string
+
+// listenAddrs turns the configured entries into host:port addresses
+func listenAddrs(entries []string, port int) ([]string, error) {
+	if len(entries) == 0 {
+		return []string{fmt.Sprintf(":%d", port)}, nil
+	}
+	var addrs []string
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(e); err != nil {
+			// a bare host, possibly an IPv6 literal with or without brackets
+			host := strings.TrimSuffix(strings.TrimPrefix(e, "["), "]")
+			if net.ParseIP(host) == nil && strings.Contains(host, ":") {
+				return nil, fmt.Errorf("listen address %q: bad IPv6 literal", e)
+			}
+			e = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		addrs = append(addrs, e)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen addresses")
+	}
+	return addrs, nil
+}
+
+// listenAll binds every address, or none of them
+func listenAll(addrs []string) (net.Listener, error) {
+	ls := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := listenTCP(addr)
+		if err != nil {
+			for _, bound := range ls {
+				_ = bound.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	if len(ls) == 1 {
+		return ls[0], nil
+	}
+	return newMultiListener(ls), nil
+}
+
+// multiListener accepts from several listeners as one, so the limits,
+// TLS and strict framing wrapped around it apply across all of them
+type multiListener struct {
+	ls    []net.Listener
+	conns chan net.Conn
+	errs  chan error
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newMultiListener(ls []net.Listener) *multiListener {
+	ml := &multiListener{ls: ls, conns: make(chan net.Conn), errs: make(chan error, len(ls)), closed: make(chan struct{})}
+	for _, l := range ls {
+		go ml.accept(l)
+	}
+	return ml
+}
+
+func (ml *multiListener) accept(l net.Listener) {
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			// e.g. out of file descriptors: back off and retry, as http.Server does
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			log.Printf("Accept error on %s: %v; retrying in %s\n", l.Addr(), err, delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ml.closed:
+				return
+			}
+		}
+		if err != nil {
+			ml.errs <- err
+			return
+		}
+		delay = 0
+		select {
+		case ml.conns <- c:
+		case <-ml.closed:
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ml.conns:
+		return c, nil
+	case err := <-ml.errs:
+		// one listener failing takes the rest down with it, as one listener would
+		_ = ml.Close()
+		return nil, err
+	case <-ml.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *multiListener) Close() error {
+	var errs []error
+	ml.once.Do(func() {
+		close(ml.closed)
+		for _, l := range ml.ls {
+			errs = append(errs, l.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (ml *multiListener) Addr() net.Addr {
+	return ml.ls[0].Addr()
+}
+
+// boundAddrs lists the addresses actually bound, ports chosen by the kernel
+// included
+func boundAddrs(l net.Listener) string {
+	switch wl := l.(type) {
+	case *proxyListener:
+		return boundAddrs(wl.Listener)
+	case tunedListener:
+		return boundAddrs(wl.Listener)
+	}
+	ml, ok := l.(*multiListener)
+	if !ok {
+		return l.Addr().String()
+	}
+	addrs := make([]string, len(ml.ls))
+	for i, l := range ml.ls {
+		addrs[i] = l.Addr().String()
+	}
+	return strings.Join(addrs, ", ")
+}
@@ -0,0 +1,188 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"load-balancer/sigv4"
+)
+
+// LogSink stores a compressed access log segment under name
+type LogSink interface {
+	Put(name string, body []byte) error
+}
+
+// NewLogSink returns an S3 sink for s3://bucket/prefix or a generic sink that
+// PUTs each segment to an http(s) base url. endpoint points the S3 sink at
+// an S3-compatible service instead, e.g. https://storage.googleapis.com for
+// GCS with HMAC keys. S3 credentials come from the usual AWS_* variables
+func NewLogSink(spec, endpoint string) (LogSink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &httpLogSink{base: strings.TrimSuffix(spec, "/") + "/", client: &http.Client{Timeout: time.Minute}}, nil
+	case "s3":
+		s, err := newS3Store(u, endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("log sink %q: %w", spec, err)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("log sink %q: expected s3://bucket/prefix or an http(s) url", spec)
+}
+
+// shipLogSegment gzips a rotated segment, uploads it and removes the local
+// copies once the sink has it
+func shipLogSegment(sink LogSink, segment string) error {
+	gz := segment
+	if !strings.HasSuffix(segment, ".gz") {
+		gz = segment + ".gz"
+		if err := gzipFile(segment, gz); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // shipped by an earlier attempt
+			}
+			return err
+		}
+		_ = os.Remove(segment)
+	}
+
+	data, err := os.ReadFile(gz)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	host, _ := os.Hostname()
+	// partitioned by day so buckets stay listable
+	name := fmt.Sprintf("%s/%s/%s", time.Now().UTC().Format("2006/01/02"), host, filepath.Base(gz))
+	if err := sink.Put(name, data); err != nil {
+		return err
+	}
+	return os.Remove(gz)
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+type httpLogSink struct {
+	base   string
+	client *http.Client
+}
+
+// Put sends the segment to <base><name>; credentials in the url become basic auth
+func (s *httpLogSink) Put(name string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.base+name, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	return checkSinkResponse(s.client.Do(req))
+}
+
+func checkSinkResponse(res *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("sink answered %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// s3Store puts and gets objects under s3://bucket/prefix with SigV4-signed
+// requests, which also covers S3-compatible stores
+type s3Store struct {
+	bucket, prefix string
+	endpoint       string
+	region         string
+	accessKey      string
+	secretKey      string
+	token          string
+	client         *http.Client
+}
+
+func newS3Store(u *url.URL, endpoint string) (*s3Store, error) {
+	s := &s3Store{
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{Timeout: time.Minute},
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("needs a bucket and AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+// objectURL is where the object name lives under the prefix
+func (s *s3Store) objectURL(name string) string {
+	key := name
+	if s.prefix != "" {
+		key = strings.TrimSuffix(s.prefix+"/"+name, "/")
+	}
+	if s.endpoint != "" {
+		return s.endpoint + "/" + s.bucket + "/" + sigv4.EscapePath(key)
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, sigv4.EscapePath(key))
+}
+
+func (s *s3Store) Put(name string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	s.sign(req, body, time.Now().UTC())
+	return checkSinkResponse(s.client.Do(req))
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+func (s *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	creds := sigv4.Credentials{AccessKey: s.accessKey, SecretKey: s.secretKey, Token: s.token}
+	sigv4.Sign(req, creds, s.region, "s3", hex.EncodeToString(payload[:]), now)
+}
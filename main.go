@@ -1,14 +1,18 @@
-package main
+package loadbalancer
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,78 +26,375 @@ type ContextKeys int
 const (
 	Attempts ContextKeys = iota
 	Retry
+	FailedBackend
 )
 
 const MAX_RETRIES = 3
 
 type Backend struct {
-	URL          *url.URL
-	Alive        bool
-	mux          sync.RWMutex
-	ReverseProxy *httputil.ReverseProxy
+	name     string
+	Rack     string // failure domain metadata, see -backends
+	Host     string
+	Weight   int               // share of traffic relative to the pool's other backends
+	MaxConns int               // concurrent requests, 0 is unlimited; see claim
+	H2C      bool              // speaks HTTP/2 without TLS, e.g. a gRPC server
+	Canary   bool              // in the pool's canary group, see canaryPercent
+	Cost     float64           // relative cost of serving from it, see LeastCost
+	Tags     map[string]string // free-form labels for bulk admin operations, see Selector
+	SigV4    string            // service[/region] to sign requests for, see sigV4
+
+	DialTimeout     time.Duration // overrides -upstream-dial-timeout, see requestTimeout
+	ResponseTimeout time.Duration // overrides -upstream-response-timeout
+	wrr             int           // current weight in smooth weighted round robin
+	Alive           bool
+	mux             sync.RWMutex
+	target          atomic.Pointer[backendTarget]
+
+	requests       atomic.Uint64
+	failures       atomic.Uint64                        // 5xx responses and transport errors
+	upstreamErrors [numUpstreamErrorKinds]atomic.Uint64 // the same, by cause
+	errorDecay     errorDecay                           // recent error rate, see weightDecayHalfLife
+
+	recentRequests minuteCounter // as above, over the last minute, for the status page
+	recentFailures minuteCounter
+	probeRTT       atomic.Int64  // smoothed health probe round trip, ns
+	passes         int           // consecutive health probe results, only
+	fails          int           // touched by the health check loop
+	retries        atomic.Uint64 // same-backend retries after transport errors
+	active         atomic.Int64  // requests in flight, across URL swaps
+	reserved       atomic.Int64  // slots held against MaxConns
+	latency        histogram
+	outlier        outlierState
+	bandit         banditArm
+
+	maintenance  atomic.Bool                 // manually out of rotation, see SetMaintenance
+	drain        atomic.Pointer[manualDrain] // out of rotation until its requests finish, see StartDrain
+	signal       backendSignal               // drain or degraded as the backend reports, see observeSignals
+	backoffUntil atomic.Int64                // unix ns, see observeBackpressure
+	upSince      atomic.Int64                // unix ns the backend last came back up, see slowStart
+	batch        atomic.Pointer[healthBatch] // collects transitions while the pool settles, see reloadSettle
+	version      atomic.Pointer[string]      // as last reported, see -version-header
+
+	tls       BackendTLS  // as configured, see setTLS
+	tlsConfig *tls.Config // loaded from tls, nil for the transport default
+	signer    *sigV4      // parsed from SigV4, nil to send requests unsigned
+
+	discovery *Discovery // what found the backend, nil if it was configured
+}
+
+// backendTarget is the upstream a backend currently proxies to. it is swapped
+// as a whole so the URL can change while requests are in flight
+type backendTarget struct {
+	url       *url.URL
+	proxy     *httputil.ReverseProxy
+	transport *backendTransport
+	inflight  atomic.Int64
 }
 
 type ServerPool struct {
-	backends []*Backend
+	Name     string
+	backends atomic.Pointer[[]*Backend] // copy on write, see Backends
+	editMux  sync.Mutex                 // serializes changes to backends
 	current  uint64
+	Strategy Strategy
+	wrrMux   sync.Mutex // guards the backends' smooth round robin weights
+	hashRing atomic.Pointer[hashRing]
+
+	hashSpilled atomic.Uint64 // keys sent past their backend by hashLoadFactor
+
+	MaxConns     int // concurrent requests across the pool, 0 is unlimited
+	inflight     atomic.Int64
+	rejected     atomic.Uint64
+	shed         [numLanes]atomic.Uint64 // rejections by lane
+	slotFreed    slotSignal
+	backendFreed slotSignal // a backend with MaxConns has room again
+	failovers    atomic.Uint64
+	requests     atomic.Uint64 // requests taken on, retries not counted
+	queued       atomic.Int64  // requests waiting for a slot
+
+	requestWindow minuteCounter // for the status page and the retry budget
+	retryWindow   minuteCounter
+	retriesDenied atomic.Uint64 // retries not made for the pool's budget, see RetryPolicy
+
+	Health      *HealthSettings // overrides the global health check settings
+	shift       atomic.Pointer[Shift]
+	canary      Canary
+	RateLimit   *RateLimit // optional cap on the requests the pool takes
+	maintenance poolMaintenance
+	Affinity    *Affinity       // optional session pinning
+	Sticky      *StickyCookie   // optional pinning by a balancer cookie
+	ReadWrites  *ReadYourWrites // optional pinning of reads after a write
+	Fallback    *ServerPool     // serves when no backend is live, see SetFallback
+
+	discoveryMux    sync.Mutex
+	discoveries     []*Discovery // dns+, srv+, consul+ and etcd+ backends, see Discover
+	discoveryPaused atomic.Bool  // lookups go on but change nothing, see PauseDiscovery
 }
 
 // method to get next index atomically (preventing issues with concurrency)
 // could also lock and unlock the mux but this is better
 func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
+	n := len(s.Backends())
+	if n == 0 {
+		return 0
+	}
+	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(n))
 }
 
-// returns next active backend to take a connection
+// returns next active backend to take a connection, as chosen by the pool's
+// strategy (round robin unless set)
 func (s *ServerPool) GetNext() *Backend {
-	next := s.NextIndex()
-	end := next + len(s.backends)
-	for i := next; i < end; i++ {
-		index := i % len(s.backends)
-		if s.backends[index].IsAlive() {
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(index))
-			}
-			return s.backends[index]
-		}
+	if len(s.Backends()) == 0 {
+		return nil
+	}
+	if s.Strategy == nil {
+		return RoundRobin{}.Next(s)
 	}
-	return nil
+	return s.Strategy.Next(s)
 }
 
-func (s *ServerPool) AddBackend(b *Backend) {
-	s.backends = append(s.backends, b)
+// nextFor is GetNext for strategies that look at the request
+func (s *ServerPool) nextFor(r *http.Request) *Backend {
+	if rs, ok := s.Strategy.(RequestStrategy); ok && len(s.Backends()) > 0 {
+		return rs.NextFor(s, r)
+	}
+	return s.GetNext()
 }
 
 // backend methods (must be serializable to avoid race conditions)
 // to learn how mux works (https://medium.com/bootdotdev/golang-mutexes-what-is-rwmutex-for-5360ab082626)
 func (b *Backend) SetAlive(alive bool) {
+	b.setAliveFor(alive, "")
+}
+
+// setAliveFor is SetAlive giving the reason for a change, which -webhook
+// receivers are sent
+func (b *Backend) setAliveFor(alive bool, reason string) {
 	b.mux.Lock()
+	changed := b.Alive != alive
 	b.Alive = alive
 	b.mux.Unlock()
+
+	// connections pooled before a state change likely point at a dead process
+	if changed {
+		// while the pool settles after a reload, only the summary is logged
+		// and sent to the webhooks
+		batched := b.batch.Load().record(b, alive)
+		if !batched {
+			notifyHealth(b, alive, reason)
+		}
+		if alive && slowStart > 0 {
+			b.upSince.Store(time.Now().UnixNano())
+			if !batched {
+				log.Printf("Backend %s: recovered, ramping up over %s\n", b.Name(), slowStart)
+			}
+		}
+		switch {
+		case batched:
+			b.closeIdle()
+		case alive:
+			b.flushIdle("backend recovered")
+		default:
+			b.flushIdle("backend down")
+		}
+	}
+}
+
+// Name identifies the backend in logs, header templates and the admin API.
+// it is fixed at creation and survives URL swaps
+func (b *Backend) Name() string {
+	return b.name
+}
+
+func (b *Backend) URL() *url.URL {
+	return b.target.Load().url
+}
+
+func (b *Backend) recordResult(failed bool) {
+	b.requests.Add(1)
+	b.recentRequests.Add(1)
+	b.bandit.observeResult(failed)
+	b.observeErrorRate(failed)
+	if failed {
+		b.failures.Add(1)
+		b.recentFailures.Add(1)
+	}
+}
+
+// Counts returns the total requests and failures seen by the backend
+func (b *Backend) Counts() (requests, failures uint64) {
+	return b.requests.Load(), b.failures.Load()
+}
+
+// InFlight is the number of requests the backend is currently serving,
+// including ones still finishing on a target it was swapped away from
+func (b *Backend) InFlight() int64 {
+	return b.active.Load()
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e := accessLogEntry(r); e != nil {
+		e.Backend = b.Name()
+	}
+	if transparentProxy {
+		r = withClientIP(r)
+	}
+	t := b.target.Load()
+	b.active.Add(1)
+	t.inflight.Add(1)
+	defer func() {
+		t.inflight.Add(-1)
+		b.active.Add(-1)
+	}()
+	start := time.Now()
+	t.proxy.ServeHTTP(w, r)
+	b.latency.Observe(time.Since(start))
+	b.bandit.observeLatency(time.Since(start))
 }
 
+// IsAlive reports whether the backend can take requests: healthy, not in
+// maintenance, not draining (by the admin API or its own signal) and not
+// ejected as an outlier
 func (b *Backend) IsAlive() bool {
 	b.mux.RLock()
 	alive := b.Alive
 	b.mux.RUnlock()
-	return alive
+	return alive && !b.InMaintenance() && b.drain.Load() == nil && !b.Draining() && !b.Ejected()
 }
 
-func LoadBalance(w http.ResponseWriter, r *http.Request) {
+// ServeHTTP balances a request over the pool's live backends
+func (s *ServerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	attempts := GetAttemptsFromContext(r)
 	if attempts > MAX_RETRIES {
 		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
-		http.Error(w, "Server unavailable.", http.StatusServiceUnavailable)
+		if s.serveFallback(w, r) || writeTimeout(w, r) {
+			return
+		}
+		writeError(w, r, http.StatusServiceUnavailable, "backend_unavailable", "Server unavailable.", 5*time.Second)
+		return
+	}
+
+	// retries re-enter here and already hold a slot
+	if attempts == 0 {
+		if sh := s.shift.Load(); sh != nil && !shifted(r) {
+			// a decision trace names the pool it moved to
+			if to := sh.redirectPool(); to != nil {
+				to.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), shiftedKey{}, true)))
+				return
+			}
+		}
+		if a := admitted(r); (a == nil || a.pool != s) && !s.admit(w, r) {
+			return
+		}
+		if !s.acquire(r) {
+			writeError(w, r, http.StatusServiceUnavailable, "pool_busy", "Server busy.", time.Second)
+			return
+		}
+		defer s.releaseSlot()
+		s.requests.Add(1)
+		s.requestWindow.Add(1)
+		r = prepareRetries(r)
+	}
+
+	if name := r.Header.Get(debugBackendHeader); name != "" && debugToken != "" {
+		b, ok := s.debugBackend(w, r, name)
+		if ok {
+			log.Printf("%s(%s) Forced to %s by %s\n", r.RemoteAddr, r.URL.Path, b.URL(), debugBackendHeader)
+			if traceDecisions {
+				s.traceDecision(w, r, b, "debug")
+			}
+			b.ServeHTTP(w, r)
+		}
+		return
+	}
+
+	if wait := s.backpressure(); wait > 0 && attempts == 0 {
+		backpressureShed.Add(1)
+		writeError(w, r, http.StatusServiceUnavailable, "backends_backing_off", "Server busy, backends asked to back off.", wait)
+		return
+	}
+
+	if nextServer, via := s.pick(r); nextServer != nil {
+		if nextServer = s.claim(r, nextServer); nextServer == nil {
+			writeError(w, r, http.StatusServiceUnavailable, "backends_busy", "All backends are at capacity.", time.Second)
+			return
+		}
+		defer s.releaseBackend(nextServer)
+		if traceDecisions {
+			s.traceDecision(w, r, nextServer, via)
+		}
+		// the access log, if any, has the structured version of this
+		if accessLogEntry(r) == nil {
+			if class := GetRequestClass(r); class != "" {
+				log.Printf("Routing %s request to %s\n", class, nextServer.URL())
+			} else {
+				log.Println("Routing to ", nextServer.URL())
+			}
+		}
+		s.serveGuarded(w, r, nextServer)
 		return
 	}
 
-	if nextServer := serverPool.GetNext(); nextServer != nil {
-		log.Println("Routing to ", nextServer.URL)
-		nextServer.ReverseProxy.ServeHTTP(w, r)
+	if s.serveFallback(w, r) {
+		return
+	}
+	if len(s.Backends()) == 0 {
+		writeError(w, r, http.StatusServiceUnavailable, "no_backends", emptyPoolMessage, emptyPoolRetryAfter)
 		return
 	}
+	if writeTimeout(w, r) {
+		return // the backends failed over from timed out
+	}
+	writeError(w, r, http.StatusServiceUnavailable, "no_healthy_backend", "Server unavailable.", 5*time.Second)
+}
+
+// pick chooses the backend for a request: a pinned session wins, otherwise
+// the next backend in rotation, possibly redirected by a traffic shift. it
+// also says which of those decided, for decision tracing
+func (s *ServerPool) pick(r *http.Request) (*Backend, string) {
+	if s.Affinity != nil && GetAttemptsFromContext(r) == 0 {
+		if b := s.Affinity.lookup(s, r); b != nil {
+			return b, "affinity"
+		}
+	}
+	if s.Sticky != nil && GetAttemptsFromContext(r) == 0 {
+		if b := s.Sticky.lookup(s, r); b != nil {
+			return b, "sticky"
+		}
+	}
+	if s.ReadWrites != nil && GetAttemptsFromContext(r) == 0 {
+		if b := s.ReadWrites.lookup(s, r); b != nil {
+			return b, "read-your-writes"
+		}
+	}
 
-	http.Error(w, "Server unavailable.", http.StatusServiceUnavailable)
+	var next *Backend
+	via := "strategy"
+	if failed, ok := r.Context().Value(FailedBackend).(*Backend); ok {
+		next, via = s.awayFrom(failed), "failover"
+	} else {
+		canary, split := s.drawGroup()
+		next = s.nextFor(r)
+		// backends back from an ejection take only part of their share at
+		// first, and the strategy is asked again for one in the drawn group
+		for tries := len(s.Backends()); next != nil && tries > 0 && (!next.admit(s) || split && next.Canary != canary); tries-- {
+			next = s.nextFor(r)
+		}
+		if split && next != nil && next.Canary != canary {
+			if b := s.nextInGroup(canary); b != nil {
+				next, via = b, "canary"
+			}
+		}
+	}
+	if next == nil {
+		return nil, via
+	}
+	if sh := s.shift.Load(); sh != nil {
+		if shifted := sh.redirect(next); shifted != next {
+			next, via = shifted, "shift"
+		}
+	}
+	return next, via
 }
 
 func GetRetryFromContext(r *http.Request) int {
@@ -112,21 +413,44 @@ func GetAttemptsFromContext(r *http.Request) int {
 	return 0
 }
 
-func isBackendAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+// health check settings, from flags or the config file
+var (
+	healthCheckInterval = 20 * time.Second
+	healthCheckTimeout  = 2 * time.Second
+	healthCheckPath     = "" // empty means a TCP connect check
+)
+
+func isBackendAlive(b *Backend, hs HealthSettings) bool {
+	u := b.URL()
+	if err := chaos.Inject(context.Background()); err != nil {
+		b.unavailable("%v", err)
+		return false
+	}
+	if hs.Path != "" {
+		return isBackendHealthy(b, hs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hs.Timeout)
+	defer cancel()
+	conn, err := healthDial(ctx, "tcp", hostPort(u))
 	if err != nil {
-		log.Println("Backend unavailable: ", err)
+		b.unavailable("%v", err)
 		return false
 	}
+	if u.Scheme == "https" {
+		if err := b.probeTLS(ctx, conn); err != nil {
+			_ = conn.Close()
+			b.unavailable("%v", err)
+			return false
+		}
+	}
 
 	_ = conn.Close()
 	return true
 }
 
 func (s *ServerPool) MarkBackendStatus(u *url.URL, alive bool) {
-	for _, b := range s.backends {
-		if b.URL.String() == u.String() {
+	for _, b := range s.Backends() {
+		if b.URL().String() == u.String() {
 			b.SetAlive(alive)
 			break
 		}
@@ -134,107 +458,1257 @@ func (s *ServerPool) MarkBackendStatus(u *url.URL, alive bool) {
 }
 
 func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends {
+	hs := s.healthSettings()
+	for _, b := range s.Backends() {
+		start := time.Now()
+		ok := isBackendAlive(b, hs)
+		if ok {
+			b.observeProbe(time.Since(start))
+		}
+		alive := b.observeHealth(ok, hs)
+		reason := fmt.Sprintf("health check passed (%d in a row)", b.passes)
+		if !alive {
+			reason = fmt.Sprintf("health check failed (%d in a row)", b.fails)
+		}
+		if alive && warmupPath != "" && !b.isUp() && !b.warmUp() {
+			alive, reason = false, "warm-up failed"
+		}
 		status := "up"
-		alive := isBackendAlive(b.URL)
-		b.SetAlive(alive)
+		if alive {
+			status = fmt.Sprintf("up, rtt %s", b.ProbeRTT().Round(time.Microsecond))
+		}
+		if cluster != nil {
+			cluster.Observe(s.Name, b.Name(), alive)
+			if decided := cluster.Decide(s.Name, b.Name(), alive); decided != alive {
+				alive, reason = decided, "cluster peers disagree with this node's health checks"
+			}
+		}
+		b.setAliveFor(alive, reason)
 		if !alive {
 			status = "down"
 		}
-		log.Printf("%s [%s]\n", b.URL, status)
+		if b.InMaintenance() {
+			status += ", maintenance"
+		}
+		if st := b.DrainStatus(); st != nil {
+			status += ", " + st.State
+		}
+		if !b.settling() {
+			log.Printf("%s [%s]\n", b.URL(), status)
+		}
+	}
+}
+
+// HealthCheck probes every pool each interval until ctx is done. pools with
+// an interval of their own are probed on their own schedule
+func HealthCheck(ctx context.Context) {
+	var shared []*ServerPool
+	for _, p := range pools {
+		if p.Health != nil && p.Health.Interval != healthCheckInterval {
+			go healthLoop(ctx, p.Health.Interval, []*ServerPool{p})
+		} else {
+			shared = append(shared, p)
+		}
 	}
+	healthLoop(ctx, healthCheckInterval, shared)
+	log.Println("Health checks stopped")
+}
+
+// RunHealthChecks probes the pool's backends on its interval until ctx is
+// done. HealthCheck covers the pools Main sets up; a pool made by a program
+// embedding the balancer runs its own
+func (s *ServerPool) RunHealthChecks(ctx context.Context) {
+	healthLoop(ctx, s.healthSettings().Interval, []*ServerPool{s})
 }
 
-func HealthCheck() {
-	t := time.NewTicker(time.Second * 20)
-	for range t.C {
+func healthLoop(ctx context.Context, interval time.Duration, pools []*ServerPool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
 		log.Println("Starting health check...")
-		serverPool.HealthCheck()
+		for _, p := range pools {
+			p.HealthCheck()
+		}
 		log.Println("Finished health check.")
 	}
 }
 
-var serverPool ServerPool
+var serverPool = ServerPool{Name: "default"}
 
-func initializeBackends(tokens []string) {
-	for _, tok := range tokens {
-		serverUrl, err := url.Parse(tok)
-		if err != nil {
-			log.Fatal(err)
-		}
+// with -allow-empty the balancer may start without backends, e.g. when they
+// are added later through the admin API or a config reload, and answers
+// with this until some appear
+var (
+	allowEmptyPool      bool
+	emptyPoolMessage    = "No backends available yet."
+	emptyPoolRetryAfter = 10 * time.Second
+)
 
-		// reverse proxy directs client request to respective backend server
-		proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+// every pool in the process, so health checks and stats cover all tenants
+var pools = []*ServerPool{&serverPool}
 
-		// proxy takes a callback error function
-		// we can use this to retry a connection
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-			log.Printf("[%s] %s\n", serverUrl.Host, e.Error())
-			retries := GetRetryFromContext(request)
-			if retries < MAX_RETRIES {
-				time.Sleep(10 * time.Millisecond)
-				ctx := context.WithValue(request.Context(), Retry, retries+1)
-				proxy.ServeHTTP(writer, request.WithContext((ctx)))
-				return
+// BackendOptions are the ;key=value attributes that may follow a backend url,
+// e.g. http://10.0.0.5:8080;rack=r1;host=h7
+type BackendOptions struct {
+	Rack   string `json:"rack,omitempty" yaml:"rack"`
+	Host   string `json:"host,omitempty" yaml:"host"`     // defaults to the url's hostname
+	Weight int    `json:"weight,omitempty" yaml:"weight"` // defaults to 1
+
+	MaxConns int     `json:"max_conns,omitempty" yaml:"max_conns"` // concurrent requests, 0 is unlimited
+	H2C      bool    `json:"h2c,omitempty" yaml:"h2c"`             // HTTP/2 without TLS, for gRPC over http
+	Canary   bool    `json:"canary,omitempty" yaml:"canary"`       // see canaryPercent
+	Cost     float64 `json:"cost,omitempty" yaml:"cost"`           // see LeastCost
+
+	DialTimeout     Duration `json:"dial_timeout,omitempty" yaml:"dial_timeout"` // see requestTimeout
+	ResponseTimeout Duration `json:"response_timeout,omitempty" yaml:"response_timeout"`
+
+	Tags map[string]string `json:"tags,omitempty" yaml:"tags"` // see Selector
+
+	SigV4 string `json:"sigv4,omitempty" yaml:"sigv4"` // e.g. s3 or execute-api/eu-west-1, see sigV4
+
+	TLS BackendTLS `json:"tls,omitempty" yaml:"tls"`
+}
+
+// parseBackendSpec splits a backend token into its url and options
+func parseBackendSpec(tok string) (*url.URL, BackendOptions, error) {
+	var opts BackendOptions
+	parts := strings.Split(tok, ";")
+
+	// url=N is shorthand for ;weight=N
+	if i := strings.LastIndex(parts[0], "="); i > 0 {
+		if w, err := strconv.Atoi(strings.TrimSpace(parts[0][i+1:])); err == nil {
+			if w < 1 {
+				return nil, opts, fmt.Errorf("backend %q: weight must be a positive integer", tok)
+			}
+			parts[0], opts.Weight = parts[0][:i], w
+		}
+	}
+	u, err := parseBackendURL(parts[0])
+	if err != nil {
+		return nil, opts, err
+	}
+	for _, attr := range parts[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(attr), "=")
+		if !ok || value == "" {
+			return nil, opts, fmt.Errorf("backend %q: bad attribute %q, expected key=value", tok, attr)
+		}
+		switch key {
+		case "rack":
+			opts.Rack = value
+		case "host":
+			opts.Host = value
+		case "weight":
+			w, err := strconv.Atoi(value)
+			if err != nil || w < 1 {
+				return nil, opts, fmt.Errorf("backend %q: weight must be a positive integer", tok)
+			}
+			opts.Weight = w
+		case "max_conns":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, opts, fmt.Errorf("backend %q: max_conns must be a non-negative integer", tok)
+			}
+			opts.MaxConns = n
+		case "h2c":
+			on, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, opts, fmt.Errorf("backend %q: h2c must be true or false", tok)
+			}
+			opts.H2C = on
+		case "canary":
+			on, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, opts, fmt.Errorf("backend %q: canary must be true or false", tok)
+			}
+			opts.Canary = on
+		case "cost":
+			c, err := strconv.ParseFloat(value, 64)
+			if err != nil || c < 0 {
+				return nil, opts, fmt.Errorf("backend %q: cost must be a non-negative number", tok)
+			}
+			opts.Cost = c
+		case "dial_timeout", "response_timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, opts, fmt.Errorf("backend %q: %s must be a duration like 2s", tok, key)
 			}
+			if key == "dial_timeout" {
+				opts.DialTimeout.Duration = d
+			} else {
+				opts.ResponseTimeout.Duration = d
+			}
+		case "sigv4":
+			opts.SigV4 = value
+		case "ca":
+			opts.TLS.CA = value
+		case "cert":
+			opts.TLS.Cert = value
+		case "key":
+			opts.TLS.Key = value
+		case "sni":
+			opts.TLS.ServerName = value
+		case "alpn":
+			opts.TLS.ALPN = strings.Split(value, "+")
+		case "insecure":
+			insecure, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, opts, fmt.Errorf("backend %q: insecure must be true or false", tok)
+			}
+			opts.TLS.Insecure = insecure
+		default:
+			if name, ok := strings.CutPrefix(key, "tag."); ok {
+				if err := checkTagKey(name); err != nil {
+					return nil, opts, fmt.Errorf("backend %q: %w", tok, err)
+				}
+				if opts.Tags == nil {
+					opts.Tags = map[string]string{}
+				}
+				opts.Tags[name] = value
+				continue
+			}
+			return nil, opts, fmt.Errorf("backend %q: unknown attribute %q", tok, key)
+		}
+	}
+	return u, opts, nil
+}
+
+// apply sets the options on a new backend
+func (o BackendOptions) apply(b *Backend) error {
+	if o.Rack != "" {
+		b.Rack = o.Rack
+	}
+	if o.Host != "" {
+		b.Host = o.Host
+	}
+	if o.Weight > 0 {
+		b.Weight = o.Weight
+	}
+	b.MaxConns = o.MaxConns
+	b.H2C = o.H2C
+	b.Canary = o.Canary
+	b.Cost = o.Cost
+	b.DialTimeout = o.DialTimeout.Duration
+	b.ResponseTimeout = o.ResponseTimeout.Duration
+	for name := range o.Tags {
+		if err := checkTagKey(name); err != nil {
+			return fmt.Errorf("backend %s: %w", b.URL(), err)
+		}
+	}
+	b.Tags = maps.Clone(o.Tags)
+	signer, err := parseSigV4(o.SigV4)
+	if err != nil {
+		return fmt.Errorf("backend %s: %w", b.URL(), err)
+	}
+	b.SigV4, b.signer = o.SigV4, signer
+	return b.setTLS(o.TLS)
+}
+
+// parses one entry of the backend list, rejecting anything the proxy can't dial
+func parseBackendURL(tok string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(tok))
+	if err != nil {
+		return nil, err
+	}
+	kind, scheme := discoveryScheme(u.Scheme)
+	if scheme != "http" && scheme != "https" && scheme != "tcp" {
+		return nil, fmt.Errorf("backend %q: scheme must be http, https or tcp, optionally after dns+, srv+, consul+ or etcd+", tok)
+	}
+	if kind == "srv" && u.Port() != "" {
+		return nil, fmt.Errorf("backend %q: srv+ takes the port from the SRV records", tok)
+	}
+	if scheme == "tcp" && (kind == "" || kind == "dns") && u.Port() == "" {
+		return nil, fmt.Errorf("backend %q: tcp needs a port", tok)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("backend %q: missing host", tok)
+	}
+	return u, nil
+}
+
+// AddBackendSpec parses a backend token, options included, and adds it to the pool
+func (s *ServerPool) AddBackendSpec(tok string) (*Backend, error) {
+	bc, err := backendConfigFromSpec(tok)
+	if err != nil {
+		return nil, err
+	}
+	return s.AddBackendConfig(bc)
+}
+
+// NewBackend creates a backend whose proxy retries failed requests on the
+// same server and then hands them back to this pool
+func (s *ServerPool) NewBackend(serverUrl *url.URL) *Backend {
+	b := &Backend{
+		name:   serverUrl.Host,
+		Host:   serverUrl.Hostname(),
+		Weight: 1,
+		Alive:  true,
+	}
+	b.target.Store(s.newTarget(b, serverUrl))
+	return b
+}
 
-			serverPool.MarkBackendStatus(serverUrl, false)
+func (s *ServerPool) newTarget(b *Backend, serverUrl *url.URL) *backendTarget {
+	// reverse proxy directs client request to respective backend server
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.IdleConnTimeout = upstreamIdleTimeout
+	b.configureTransport(transport)
+	if dial := upstreamDial(); dial != nil {
+		transport.DialContext = b.dialWithin(tunedDial(dial))
+	} else {
+		transport.DialContext = b.dialWithin(tunedDial((&net.Dialer{KeepAlive: 30 * time.Second}).DialContext))
+	}
+	// a connection bound to one client's address can't be reused for another
+	transport.DisableKeepAlives = transparentProxy
+	bt := &backendTransport{b: b, h1: transport, h2c: newH2CTransport(transport.DialContext)}
+	proxy.Transport = &chaosTransport{base: bt}
+
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		setForwardedHeaders(r)
+		setConnInfoHeaders(r)
+		addVia(r.Header, r.ProtoMajor, r.ProtoMinor)
+		applyRequestHeaderRules(r, b)
+		prepareRewrite(r)
+		prepareTransforms(r)
+		stripDebugHeaders(r)
+		stripMaintenanceBypass(r)
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		if isWarmup(res.Request) {
+			return nil
+		}
+		b.recordResult(res.StatusCode >= 500)
+		s.canary.record(b, res.StatusCode >= 500)
+		journalAttempt(res.Request, b, res.StatusCode, nil)
+		if res.StatusCode >= 500 {
+			countUpstreamError(res.Request, b, upstream5xx)
+		}
+		backingOff := b.observeBackpressure(res)
+		s.observeOutcome(b, res.StatusCode >= 500 && !backingOff)
+		if err := s.retryStatus(b, res); err != nil {
+			return err
+		}
+		b.observeSignals(res.Header)
+		addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
+		applyResponseHeaderRules(res, b)
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			watchUpgrade(res, b)
+		} else {
+			rewriteBody(res)
+			transformResponse(res)
+			watchStream(res)
+		}
+		if s.Affinity != nil {
+			s.Affinity.remember(s, b, res)
+		}
+		if s.Sticky != nil {
+			s.Sticky.pin(s, b, res)
+		}
+		if s.ReadWrites != nil {
+			s.ReadWrites.remember(s, b, res)
+		}
+		return nil
+	}
 
-			attempts := GetAttemptsFromContext(request)
-			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
-			ctx := context.WithValue(request.Context(), Attempts, attempts+1)
-			LoadBalance(writer, request.WithContext(ctx))
+	// proxy takes a callback error function
+	// we can use this to retry a connection
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
+		kind := classifyUpstreamError(e)
+		log.Printf("[%s] %s: %s\n", serverUrl.Host, kind, e.Error())
+		if w, ok := request.Context().Value(warmupKey{}).(*discardWriter); ok {
+			w.err = e
+			return
+		}
+		journalAttempt(request, b, 0, e)
+		if killed(request) {
+			writeError(writer, request, http.StatusServiceUnavailable, "request_cancelled", "The request was cancelled by an operator.", 0)
+			return
+		}
+		if bodyTooLarge(writer, request, e) {
+			return // the client's fault, not the backend's
+		}
+		var statusErr *retryStatusError
+		if !errors.As(e, &statusErr) {
+			countUpstreamError(request, b, kind)
+			b.recordResult(true)
+			s.canary.record(b, true)
+			s.observeOutcome(b, true)
+		}
+		if st := getRetryState(request); st != nil && isTimeout(e) {
+			st.timedOut = true
+		}
+		if requestTimedOut(request) {
+			writeTimeout(writer, request)
+			return
+		}
+		if !canRetry(request, e) || !s.retryBudgetLeft() {
+			if !writeTimeout(writer, request) {
+				writeError(writer, request, http.StatusBadGateway, "backend_error", "Bad gateway.", 0)
+			}
+			return
+		}
+		if !retryWait(request) {
+			return // the client is gone
+		}
+		if e := accessLogEntry(request); e != nil {
+			e.Retries++
+		}
+		s.retryWindow.Add(1)
+		retries := GetRetryFromContext(request)
+		if statusErr == nil && retries < retryPolicy.Attempts {
+			b.retries.Add(1)
+			ctx := context.WithValue(request.Context(), Retry, retries+1)
+			proxy.ServeHTTP(writer, request.WithContext((ctx)))
+			return
 		}
 
-		backend := Backend{
-			URL:          serverUrl,
-			Alive:        true,
-			ReverseProxy: proxy,
+		// a backend that answered is up, just not for this request
+		if statusErr == nil {
+			b.setAliveFor(false, "request failed: "+e.Error())
 		}
-		serverPool.AddBackend(&backend)
-		log.Printf("Configured backend: %s\n", serverUrl)
+		s.failovers.Add(1)
+
+		attempts := GetAttemptsFromContext(request)
+		log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
+		ctx := context.WithValue(request.Context(), Attempts, attempts+1)
+		ctx = context.WithValue(ctx, FailedBackend, b)
+		ctx = context.WithValue(ctx, Retry, 0)
+		s.ServeHTTP(writer, request.WithContext(ctx))
 	}
+
+	return &backendTarget{url: serverUrl, proxy: proxy, transport: bt}
 }
 
-func main() {
+func initializeBackends(backends []BackendConfig) {
+	for _, bc := range backends {
+		if isDiscoveryURL(bc.URL) {
+			if _, err := serverPool.Discover(bc); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Discovering backends from %s\n", bc.URL)
+			continue
+		}
+		b, err := serverPool.AddBackendConfig(bc)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Configured backend: %s\n", b.URL())
+	}
+}
+
+// Main runs the balancer as the lb command, from os.Args
+func Main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "smoke":
+			runSmoke(os.Args[2:])
+			return
+		case "simulate":
+			runSimulate(os.Args[2:])
+			return
+		case "config":
+			runConfig(os.Args[2:])
+			return
+		}
+	}
+
 	var serverList string
 	var port int
+	var startInMaintenance bool
 	var testMode bool
+	var testCount, testBasePort int
+	testBehaviors := TestBehaviors{}
+	var adminPort int
+	var chaosSettings ChaosSettings
+	var recordFile string
+	var recordSample float64
+	var recordBodies, recordCredentials bool
+	var recordMaxBody int64
+	var headerRulesFile, headerVarsSpec string
+	var tenantsFile string
+	var affinityCookie, affinityStore string
+	var affinityTTL time.Duration
+	var stickyCookie string
+	var stickyTTL time.Duration
+	var readYourWrites time.Duration
+	var readYourWritesKey string
+	var clusterBind, clusterPeers, clusterNode, clusterKey string
+	var clusterInterval time.Duration
+	var haConsul, haConsulToken, haKey, haNode, haOnLeader, haOnStandby string
+	var haTTL time.Duration
+	var dnsAddr, dnsName string
+	var dnsTTL time.Duration
+	var dnsWeighted bool
+	var rewriteTypes string
+	var classesFile string
+	var coalesce bool
+	var routesFile string
+	var strategyName string
+	var strategySeed uint64
+	var configFile string
+	var acmeHosts string
+	var listenList string
+	var trustedProxies string
+	var apiKeysSpec, apiKeyHeader string
+	var rateLimitStore string
+	var rateLimitLease time.Duration
+	var allocAuditAtStart bool
+	var allocAuditRate int
+	var errorPagesFile, fallbackBackend string
+	var journalFile string
+	var journalMaxBytes, journalMaxBody int64
+	var resolverServers string
+	var resolverTimeout, resolverTTL, resolverNegativeTTL time.Duration
+	var upstreamSweep time.Duration
+	var coalesceMaxBody int64
+	var coalesceWindow time.Duration
+	var coalesceWindowBytes int64
+	var coalesceHeaders string
+	var coalesceVary bool
+	var cacheSize, cacheMaxBody int64
+	var cacheTTL time.Duration
+	var compress bool
+	var compressMinSize int64
+	var compressTypes string
+	var cachePaths string
+	var mode string
+	var connInfoSpec string
+	var accessLogFile, accessLogFormat, accessLogShip, accessLogEndpoint string
+	var webhookList, webhookFormat string
+	var accessLogRotateSize int64
+	var accessLogRotateEvery time.Duration
 
 	// command line args
-	flag.StringVar(&serverList, "backends", "", "Backends (use commas to separate)")
+	flag.BoolVar(&allowEmptyPool, "allow-empty", false, "Start without backends and answer 503 until some are added")
+	flag.StringVar(&emptyPoolMessage, "empty-message", emptyPoolMessage, "Error message while there are no backends")
+	flag.StringVar(&errorPagesFile, "error-pages", "", "JSON file of pages replacing the balancer's error responses, by status or error code")
+	flag.StringVar(&fallbackBackend, "fallback-backend", "", "Backend, with ;options, to serve from while no backend in the default pool is live")
+	flag.DurationVar(&emptyPoolRetryAfter, "empty-retry-after", emptyPoolRetryAfter, "Retry-After while there are no backends")
+	flag.StringVar(&configFile, "config", "", "YAML or JSON config file; flags given explicitly override it. SIGHUP or POST /admin/reload reloads its backends")
+	flag.DurationVar(&reloadSettle, "reload-settle", reloadSettle, "After a reload, log the pool's health transitions as one summary at the end of this window instead of one by one (0 logs each)")
+	flag.StringVar(&serverList, "backends", "", "Backends (use commas to separate), optionally weighted and with attributes: url=5;rack=r1;host=h1;max_conns=50;h2c=true;canary=true (https also takes ca=, cert=, key=, sni=, alpn=h2+http/1.1, insecure=); dns+http://name:port and srv+http://_svc._tcp.name discover them from DNS, consul+http://consul:8500/service and etcd+http://etcd:2379/prefix/ from a registry")
 	flag.IntVar(&port, "port", 3000, "Port to serve")
+	flag.StringVar(&listenList, "listen", "", "Addresses to bind, e.g. 127.0.0.1:3000,[::1]:3000; entries without a port use -port (default all interfaces)")
+	flag.DurationVar(&drainTimeout, "drain-timeout", drainTimeout, "On SIGINT/SIGTERM, how long in-flight requests get to finish before exiting")
+	flag.StringVar(&shutdownReportFile, "shutdown-report", "", "Also write the final shutdown report to this file as JSON")
+	flag.StringVar(&frontTLS.Cert, "tls-cert", "", "PEM certificate (chain) to serve HTTPS with")
+	flag.StringVar(&frontTLS.Key, "tls-key", "", "PEM private key of -tls-cert")
+	flag.StringVar(&frontTLS.ClientCA, "tls-client-ca", "", "PEM CA bundle to verify client certificates against; clients may then present one (see -conn-info-headers)")
+	flag.StringVar(&connInfoSpec, "conn-info-headers", "", "Connection details sent to backends: all, or a list of client_port, tls_version, tls_cipher, tls_alpn, tls_sni, client_cert_sha256, client_cert_subject, each optionally =Header-Name")
+	flag.IntVar(&frontTLS.RedirectPort, "tls-redirect-port", 0, "Port answering plain HTTP with a redirect to HTTPS (0 disables)")
+	flag.StringVar(&acmeHosts, "acme-hosts", "", "Hostnames to get certificates for automatically via ACME (use commas to separate)")
+	flag.StringVar(&frontTLS.ACME.Cache, "acme-cache", frontTLS.ACME.Cache, "Directory caching ACME account and certificates")
+	flag.StringVar(&frontTLS.ACME.Email, "acme-email", "", "Contact email for the ACME account")
+	flag.StringVar(&frontTLS.ACME.Directory, "acme-directory", "", "ACME directory url (default Let's Encrypt production)")
 	flag.BoolVar(&testMode, "test", false, "Use test servers")
+	flag.IntVar(&testCount, "test-count", 4, "Number of test servers")
+	flag.IntVar(&testBasePort, "test-base-port", 3031, "Port of the first test server")
+	flag.Var(testBehaviors, "test-behavior", "Test server behavior as port=delay:<d>|jitter:<d>|status:<code>|error-rate:<0-1>|error-status:<code>|slow-body:<d>|flap:<d>|down, or *= for every server (repeatable, join with +)")
+	flag.StringVar(&strategyName, "strategy", "round-robin", "Load balancing strategy: round-robin, least-conn, random, weighted-random, least-latency, consistent-hash, least-cost or bandit (experimental)")
+	flag.StringVar(&hashKey, "hash-key", "ip", "What consistent-hash keys on, e.g. ip, header:X-User|ip or cookie:session+path:1 (see HashKey)")
+	flag.DurationVar(&costMaxLatency, "cost-max-latency", 0, "With least-cost, pass over backends whose probe round trip is above this while others are within it (0 for no bound)")
+	flag.Float64Var(&hashLoadFactor, "hash-load-factor", 0, "With consistent-hash, pass over a backend with more than this times its share of requests in flight, e.g. 1.25 (0 for no bound)")
+	flag.Uint64Var(&strategySeed, "seed", 0, "Seed for randomized strategies, for reproducible runs (0 picks one)")
+	flag.DurationVar(&healthCheckInterval, "health-interval", 20*time.Second, "Time between health checks")
+	flag.DurationVar(&healthCheckTimeout, "health-timeout", 2*time.Second, "Health probe timeout")
+	flag.StringVar(&healthCheckPath, "health-path", "", "HTTP path to probe for health (empty checks TCP connect only)")
+	flag.StringVar(&mode, "mode", "http", "Proxy HTTP requests (http) or raw TCP connections (tcp)")
+	flag.DurationVar(&tcpIdleTimeout, "tcp-idle-timeout", 0, "In TCP mode, close connections with no traffic either way for this long (0 never)")
+	flag.BoolVar(&frontH2C, "h2c", false, "Accept HTTP/2 without TLS from clients, e.g. for gRPC")
+	flag.BoolVar(&strictHTTP, "strict-http", true, "Refuse requests with ambiguous framing (Content-Length with Transfer-Encoding, bare LF, header folding)")
+	flag.StringVar(&upstreamSourceIP, "upstream-source-ip", "", "Local address to connect to backends from")
+	flag.StringVar(&resolverServers, "resolver-servers", "", "DNS servers for backend hostnames, ip[:port] (use commas to separate; empty uses the system's)")
+	flag.DurationVar(&resolverTimeout, "resolver-timeout", 2*time.Second, "Timeout of a backend hostname lookup")
+	flag.DurationVar(&resolverTTL, "resolver-cache-ttl", 0, "Cache resolved backend hostnames this long (0 disables)")
+	flag.DurationVar(&resolverNegativeTTL, "resolver-negative-ttl", 0, "Cache hostnames that don't exist this long (0 disables)")
+	flag.BoolVar(&spreadUpstreamIPs, "upstream-spread-ips", false, "Spread connections to a backend hostname across all its addresses, skipping ones that fail to connect")
+	flag.StringVar(&consulToken, "consul-token", os.Getenv("CONSUL_HTTP_TOKEN"), "ACL token for consul+ backends (defaults to $CONSUL_HTTP_TOKEN)")
+	flag.StringVar(&etcdUser, "etcd-user", os.Getenv("ETCDCTL_USER"), "User, or user:password, etcd+ backends log in as when etcd has auth enabled (defaults to $ETCDCTL_USER)")
+	flag.StringVar(&etcdPassword, "etcd-password", os.Getenv("ETCDCTL_PASSWORD"), "Password of -etcd-user (defaults to $ETCDCTL_PASSWORD)")
+	flag.DurationVar(&discoveryInterval, "discovery-interval", discoveryInterval, "Look discovered backends (dns+, srv+, etcd+) up again this often")
+	flag.StringVar(&backendTLSDefaults.CA, "backend-ca", "", "PEM CA bundle to verify https backends against (default system roots)")
+	flag.StringVar(&backendTLSDefaults.Cert, "backend-cert", "", "PEM client certificate presented to https backends (mTLS)")
+	flag.StringVar(&backendTLSDefaults.Key, "backend-key", "", "PEM private key of -backend-cert")
+	flag.BoolVar(&backendTLSDefaults.Insecure, "backend-insecure", false, "Skip verifying https backends' certificates")
+	flag.BoolVar(&transparentProxy, "transparent", false, "Connect to backends from the client's address (IP_TRANSPARENT, Linux, needs CAP_NET_ADMIN)")
+	flag.BoolVar(&holdTraffic, "hold", false, "Warm up, report ready on /readyz and only open the front port after POST /admin/go (for blue/green)")
+	flag.Float64Var(&clientRateLimit.Rate, "client-rate", 0, "Requests per second allowed per client IP (0 disables)")
+	flag.IntVar(&clientRateLimit.Burst, "client-burst", clientRateLimit.Burst, "Requests a client IP may burst above -client-rate")
+	flag.StringVar(&ipAllowSource, "ip-allow", "", "Only let in clients on this list of addresses and CIDRs: a file, an http(s) url or s3://bucket/key")
+	flag.StringVar(&ipDenySource, "ip-deny", "", "Refuse clients on this list of addresses and CIDRs: a file, an http(s) url or s3://bucket/key")
+	flag.DurationVar(&ipListInterval, "ip-list-interval", ipListInterval, "How often -ip-allow and -ip-deny are fetched again")
+	flag.IntVar(&clientRateLimit.MaxClients, "client-rate-max-clients", clientRateLimit.MaxClients, "Most client IPs tracked by -client-rate before the least recent are forgotten")
+	flag.StringVar(&rateLimitStore, "rate-limit-store", "", "redis://host:port[/db] to enforce -client-rate and pool and route rate limits across every balancer sharing it (empty limits per instance)")
+	flag.DurationVar(&rateLimitLease, "rate-limit-lease", 50*time.Millisecond, "With -rate-limit-store, how long each instance spends tokens it leased locally; a lease holds at most this much of a rate")
+	flag.IntVar(&retryPolicy.Attempts, "retry-attempts", retryPolicy.Attempts, "Retries on the same backend after a transport error before failing over")
+	flag.DurationVar(&retryPolicy.Backoff, "retry-backoff", retryPolicy.Backoff, "Wait before the first retry, doubled for each one after it (with jitter)")
+	flag.DurationVar(&retryPolicy.MaxBackoff, "retry-backoff-max", retryPolicy.MaxBackoff, "Longest wait between retries")
+	flag.IntVar(&retryPolicy.Budget, "retry-budget", retryPolicy.Budget, "Most retries for one request, across backends")
+	flag.Float64Var(&retryPolicy.Ratio, "retry-ratio", retryPolicy.Ratio, "Most retries a pool makes over a minute, as a fraction of its requests (0 for no limit)")
+	flag.Uint64Var(&retryPolicy.MinRetries, "retry-ratio-min", retryPolicy.MinRetries, "Retries per minute a pool may make whatever -retry-ratio allows")
+	flag.Var(&retryPolicy.Statuses, "retry-status", "Backend response statuses retried on another backend, e.g. 502-504 (none by default)")
+	flag.Int64Var(&retryPolicy.BufferBody, "retry-buffer-body", retryPolicy.BufferBody, "Largest request body kept so the request can be retried (0 keeps none)")
+	flag.Int64Var(&maxRequestBody, "max-request-body", 0, "Answer 413 to request bodies over this many bytes (0 is unlimited)")
+	flag.BoolVar(&backendBackpressure, "backend-backpressure", false, "Treat 429/503 with Retry-After as a request to back off: lower the backend's share until then, and answer 503 while every backend is backing off")
+	flag.DurationVar(&backpressureMax, "backpressure-max", backpressureMax, "Longest backoff a backend's Retry-After can ask for")
+	flag.BoolVar(&backendSignals, "backend-signals", false, "Let backends drain themselves (X-Drain: true) or lower their share (X-Healthy: degraded) through response headers")
+	flag.IntVar(&degradedWeightPercent, "signal-degraded-weight", degradedWeightPercent, "Percent of its weight a backend reporting X-Healthy: degraded keeps")
+	flag.DurationVar(&weightDecayHalfLife, "weight-decay", 0, "Cut backends' weight by their recent error rate, the rate halving this often as errors stop (0 disables)")
+	flag.IntVar(&weightDecayFloor, "weight-decay-floor", weightDecayFloor, "Percent of its weight a failing backend keeps with -weight-decay")
+	flag.IntVar(&outliers.Consecutive, "outlier-consecutive", 0, "Eject a backend after this many consecutive 5xx or transport errors (0 disables)")
+	flag.DurationVar(&outliers.Window, "outlier-window", outliers.Window, "Window the consecutive failures must fall in")
+	flag.DurationVar(&outliers.Ejection, "outlier-ejection", outliers.Ejection, "How long an ejected backend sits out")
+	flag.DurationVar(&outliers.RampUp, "outlier-ramp-up", outliers.RampUp, "Time for a re-admitted backend to get back to its full share")
+	flag.DurationVar(&slowStart, "slow-start", 0, "Time for a backend that comes back up to get back to its full share (0 gives it at once)")
+	flag.Float64Var(&canaryPercent, "canary-percent", 0, "Percent of requests sent to backends marked canary=true (change it per pool with PUT /admin/canary)")
+	flag.BoolVar(&startInMaintenance, "maintenance", false, "Start with the default pool in maintenance, answering 503 to all but -maintenance-bypass-token requests")
+	flag.StringVar(&maintenanceBypassToken, "maintenance-bypass-token", "", "Secret that lets requests through a pool in maintenance, in an "+maintenanceBypassHeader+" header or "+maintenanceBypassCookie+" cookie")
+	flag.StringVar(&warmupPath, "health-warmup", "", "Path requested through the proxy before a recovered backend is marked up (empty skips it)")
+	flag.Var(&healthCheckStatus, "health-status", "Statuses that pass an HTTP health check, e.g. 200-299,304")
+	flag.IntVar(&healthyThreshold, "health-healthy-threshold", 1, "Consecutive passing probes before a down backend is marked up")
+	flag.IntVar(&unhealthyThreshold, "health-unhealthy-threshold", 1, "Consecutive failing probes before an up backend is marked down")
+	flag.StringVar(&versionHeader, "version-header", "", "Header backends report their version in on HTTP health checks, e.g. X-App-Version")
+	flag.StringVar(&expectedVersion, "expected-version", "", "Keep backends reporting another version (see -version-header) out of rotation")
+	flag.DurationVar(&clientIdleTimeout, "client-idle-timeout", clientIdleTimeout, "Close client keep-alive connections idle for longer than this")
+	flag.DurationVar(&clientMaxAge, "client-max-age", 0, "Close client connections after a response once they are this old, so clients rebalance (0 disables)")
+	flag.DurationVar(&upstreamResponseHeaderTimeout, "upstream-response-timeout", 0, "Give up on a backend that hasn't sent response headers by then (0 waits forever)")
+	flag.BoolVar(&traceDecisions, "trace-decisions", false, "Report each balancing decision in an "+decisionHeader+" response header and the logs")
+	flag.IntVar(&adminPort, "admin-port", 0, "Port to serve the admin API on (0 disables it)")
+	flag.BoolVar(&chaosSettings.Enabled, "chaos", false, "Randomly delay or drop a share of upstream requests and health probes")
+	flag.Float64Var(&chaosSettings.DropRate, "chaos-drop", 0.01, "Fraction of upstream calls dropped in chaos mode")
+	flag.Float64Var(&chaosSettings.DelayRate, "chaos-delay", 0.05, "Fraction of upstream calls delayed in chaos mode")
+	flag.DurationVar(&chaosSettings.MaxDelay.Duration, "chaos-max-delay", 500*time.Millisecond, "Upper bound of injected chaos delays")
+	flag.StringVar(&recordFile, "record", "", "Append sampled requests to this file for later replay")
+	flag.Float64Var(&recordSample, "record-sample", 0.01, "Fraction of requests to record")
+	flag.BoolVar(&recordBodies, "record-bodies", false, "Include request bodies in the recording")
+	flag.BoolVar(&recordCredentials, "record-credentials", false, "Record Authorization, Cookie, API key and token headers as sent instead of redacted, for a replay that needs them")
+	flag.Int64Var(&recordMaxBody, "record-max-body", 64<<10, "Maximum recorded body size in bytes")
+	flag.StringVar(&journalFile, "failure-journal", "", "Append the details of requests answered with a 5xx (headers, body start, attempts, backend errors) to this file")
+	flag.Int64Var(&journalMaxBytes, "failure-journal-max-bytes", 64<<20, "Disk the failure journal may use, across the file and the one rotated before it")
+	flag.Int64Var(&journalMaxBody, "failure-journal-max-body", 8<<10, "Bytes of each failed request's body to keep in the failure journal")
+	flag.BoolVar(&forwardedOptions.Trust, "trust-forwarded", false, "Keep and append to incoming X-Forwarded-*, X-Real-IP and Forwarded headers instead of stripping them")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "With -trust-forwarded, only trust peers in these CIDRs or IPs (use commas to separate; empty trusts all)")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "Read a PROXY protocol v1 or v2 header at the start of each client connection and take the client address from it")
+	flag.StringVar(&proxyProtocolFrom, "proxy-protocol-from", "", "The peers -proxy-protocol expects headers from, as CIDRs or IPs (use commas to separate; 0.0.0.0/0,::/0 for any)")
+	flag.StringVar(&proxyProtocolBackends, "proxy-protocol-backends", "", "In TCP mode, send backends a PROXY protocol header naming the client: v1 or v2 (empty sends none)")
+	flag.StringVar(&webhookList, "webhook", "", "POST an event to these urls when a backend goes down or comes back up (use commas to separate)")
+	flag.StringVar(&webhookFormat, "webhook-format", "json", "Webhook payload: json (the event) or slack (a Slack-compatible text message)")
+	flag.BoolVar(&forwardedOptions.RFC7239, "forwarded-header", false, "Also send the RFC 7239 Forwarded header to backends")
+	flag.StringVar(&viaPseudonym, "via", viaPseudonym, "Pseudonym added to Via headers in both directions, unique per instance (empty disables)")
+	flag.IntVar(&connLimits.MaxConns, "max-conns", 0, "Maximum concurrent client connections (0 is unlimited)")
+	flag.IntVar(&connLimits.MaxPerClient, "max-conns-per-client", 0, "Maximum concurrent connections per client IP (0 is unlimited)")
+	flag.BoolVar(&connLimits.Queue, "queue-conns", false, "Queue connections beyond -max-conns instead of rejecting them")
+	flag.Int64Var(&connLimits.BandwidthPerConn, "bandwidth-per-conn", 0, "Maximum response bytes/sec per client connection (0 is unlimited)")
+	flag.Int64Var(&connLimits.BandwidthPerClient, "bandwidth-per-client", 0, "Maximum response bytes/sec per client IP across its connections (0 is unlimited)")
+	flag.DurationVar(&backendQueue, "backend-queue", 0, "How long a request waits when every backend is at its max_conns (0 answers 503 at once)")
+	flag.IntVar(&serverPool.MaxConns, "pool-max-conns", 0, "Maximum concurrent requests to the pool (0 is unlimited)")
+	flag.Int64Var(&maxInFlight, "max-in-flight", 0, "Maximum concurrent requests across all pools, past which requests are shed with a 503 (0 is unlimited)")
+	flag.BoolVar(&reusePort, "reuse-port", false, "Bind listeners with SO_REUSEPORT, so a new process can bind the same ports before this one exits (SIGUSR2 hands them over instead)")
+	flag.DurationVar(&upgradeTimeout, "upgrade-timeout", upgradeTimeout, "How long a process started by SIGUSR2 has to start listening before it is killed and this one carries on")
+	flag.DurationVar(&maxInFlightRetryAfter, "max-in-flight-retry-after", maxInFlightRetryAfter, "Retry-After sent with requests shed by -max-in-flight")
+	flag.Float64Var(&lanes.LowShare, "lane-low-share", lanes.LowShare, "Share of -pool-max-conns open to low-priority requests")
+	flag.Float64Var(&lanes.NormalShare, "lane-normal-share", lanes.NormalShare, "Share of -pool-max-conns open to normal-priority requests (the rest is kept for critical ones)")
+	flag.DurationVar(&lanes.Queue, "lane-queue", 0, "How long a request waits for a free pool slot before being shed (0 sheds at once)")
+	flag.StringVar(&affinityCookie, "affinity-cookie", "", "Pin sessions identified by this application cookie to one backend")
+	flag.StringVar(&affinityStore, "affinity-store", "memory", "Session affinity store: memory or redis://host:port[/db]")
+	flag.DurationVar(&affinityTTL, "affinity-ttl", 30*time.Minute, "How long an idle session stays pinned")
+	flag.StringVar(&stickyCookie, "sticky-cookie", "", "Pin clients to a backend with a cookie of this name set by the balancer")
+	flag.DurationVar(&stickyTTL, "sticky-ttl", 0, "Lifetime of the sticky cookie (0 lasts the browser session)")
+	flag.DurationVar(&readYourWrites, "read-your-writes", 0, "After a write, send the client's reads to the backend that took it for this long (0 disables)")
+	flag.StringVar(&readYourWritesKey, "read-your-writes-key", "ip", "What tells clients apart for -read-your-writes, in -hash-key syntax, e.g. header:Authorization|ip")
+	flag.StringVar(&clusterBind, "cluster-bind", "", "UDP address to gossip backend health with other balancer instances on (empty disables cluster mode); rate limits are shared through -rate-limit-store, which it requires when any are set")
+	flag.StringVar(&clusterPeers, "cluster-peers", "", "Gossip addresses of other instances (use commas to separate)")
+	flag.StringVar(&clusterNode, "cluster-node", "", "Name of this instance in the cluster (defaults to the gossip address)")
+	flag.StringVar(&clusterKey, "cluster-key", os.Getenv("LB_CLUSTER_KEY"), "Secret every cluster member shares to sign its gossip with (defaults to $LB_CLUSTER_KEY)")
+	flag.DurationVar(&clusterInterval, "cluster-interval", time.Second, "How often state is gossiped")
+	flag.StringVar(&haConsul, "ha-consul", "", "Consul address for active-passive HA; only the lock holder serves traffic (empty disables)")
+	flag.StringVar(&haConsulToken, "ha-consul-token", "", "ACL token for -ha-consul (defaults to -consul-token)")
+	flag.StringVar(&haKey, "ha-key", "service/load-balancer/leader", "Consul key used as the leader lock")
+	flag.StringVar(&haNode, "ha-node", "", "Name of this instance in leader election (defaults to the hostname)")
+	flag.DurationVar(&haTTL, "ha-ttl", 10*time.Second, "Session TTL; a dead leader is replaced after roughly this long")
+	flag.StringVar(&haOnLeader, "ha-on-leader", "", "Shell command run on becoming leader, e.g. to bind the virtual IP")
+	flag.StringVar(&haOnStandby, "ha-on-standby", "", "Shell command run on losing leadership, e.g. to release the virtual IP")
+	flag.StringVar(&dnsAddr, "dns-addr", "", "UDP address to answer DNS queries for -dns-name on (empty disables)")
+	flag.StringVar(&dnsName, "dns-name", "backends.lb.internal", "Name resolving to the healthy backends; <pool>.<name> resolves a named pool")
+	flag.DurationVar(&dnsTTL, "dns-ttl", 5*time.Second, "TTL of DNS answers")
+	flag.BoolVar(&dnsWeighted, "dns-weighted", false, "Weigh DNS answers by the backends' weights and health: SRV weights, and A/AAAA records in weighted random order")
+	flag.Var(&bodyRewrite.Rules, "rewrite", "Rewrite response bodies with s|find|replace| (repeatable)")
+	flag.StringVar(&rewriteTypes, "rewrite-types", "text/html,text/css,text/plain,application/javascript,application/json,application/xml", "Content types -rewrite applies to (use commas to separate)")
+	flag.StringVar(&apiKeysSpec, "api-keys", "", "Require API keys from this JSON file or redis://host:port[/db] store (empty disables)")
+	flag.StringVar(&apiKeyHeader, "api-key-header", "X-API-Key", "Header carrying the API key (Authorization: Bearer also works)")
+	flag.StringVar(&classesFile, "classes", "", "JSON file naming request classes for per-endpoint stats, logs and rate limits")
+	flag.BoolVar(&allocAuditAtStart, "alloc-audit", false, "Turn the allocation audit on, see /admin/alloc-audit")
+	flag.IntVar(&allocAuditRate, "alloc-audit-rate", defaultAllocAuditRate, "With -alloc-audit, sample an allocation every this many bytes on average")
+	flag.StringVar(&debugToken, "debug-token", "", "Token that lets X-Debug-Backend force a request onto a named backend (empty disables)")
+	flag.StringVar(&accessLogFile, "access-log", "", "Write an access log to this file (- for stdout)")
+	flag.StringVar(&accessLogFormat, "access-log-format", "json", "Access log format: json or logfmt")
+	flag.Int64Var(&accessLogRotateSize, "access-log-rotate-size", 100<<20, "Rotate the access log at this many bytes (0 disables)")
+	flag.DurationVar(&accessLogRotateEvery, "access-log-rotate-every", time.Hour, "Rotate the access log this often (0 disables)")
+	flag.StringVar(&accessLogShip, "access-log-ship", "", "Upload rotated, gzipped segments to s3://bucket/prefix or an http(s) url")
+	flag.StringVar(&accessLogEndpoint, "access-log-ship-endpoint", "", "S3-compatible endpoint for s3:// shipping, e.g. https://storage.googleapis.com")
+	flag.DurationVar(&dedupe.Window, "dedupe-window", 0, "Treat a POST repeating one from the same client within this long as a double submit (0 disables)")
+	flag.StringVar(&dedupe.Mode, "dedupe-mode", dedupe.Mode, "What to do with a double submit: reject (409) or serialize (run after the first)")
+	flag.Int64Var(&dedupe.MaxBody, "dedupe-max-body", dedupe.MaxBody, "Largest POST body checked for double submits")
+	flag.Int64Var(&responseBuffer, "response-buffer", 0, "Bytes of each response to buffer for slow clients, freeing the backend sooner (0 disables)")
+	flag.BoolVar(&coalesce, "coalesce", false, "Collapse concurrent identical anonymous GETs into one upstream request")
+	flag.Int64Var(&coalesceMaxBody, "coalesce-max-body", 1<<20, "Largest response shared between coalesced requests")
+	flag.DurationVar(&coalesceWindow, "coalesce-window", 0, "Also share a coalesced response with identical requests arriving this long after it completes (0 shares only while in flight)")
+	flag.Int64Var(&coalesceWindowBytes, "coalesce-window-bytes", defaultCoalesceWindowBytes, "Most bytes of responses kept for -coalesce-window at a time")
+	flag.StringVar(&coalesceHeaders, "coalesce-key-headers", strings.Join(coalesceKeyHeaders, ","), "Request headers that must match for requests to be coalesced (use commas to separate)")
+	flag.BoolVar(&coalesceVary, "coalesce-vary", true, "Only share a coalesced response with requests matching the first one on the headers it varies on")
+	flag.Int64Var(&cacheSize, "cache-size", 0, "Bytes of cacheable responses to keep in memory (0 disables the cache)")
+	flag.Int64Var(&cacheMaxBody, "cache-max-body", 1<<20, "Largest response body the cache keeps")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "Longest the cache keeps a response before asking the backend again (0 for as long as it allows)")
+	flag.StringVar(&cachePaths, "cache-paths", "", "Comma-separated path prefixes to cache, !prefix to skip one (empty caches every path)")
+	flag.BoolVar(&compress, "compress", false, "Compress responses with br or gzip for clients that accept them")
+	flag.Int64Var(&compressMinSize, "compress-min-size", 1024, "Smallest response body -compress compresses")
+	flag.StringVar(&compressTypes, "compress-types", "text/*,application/javascript,application/json,application/xml,image/svg+xml", "Content types -compress applies to, type/* for all of a type (use commas to separate)")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0, "Answer 504, or cut the response off, once a request has taken this long in all, retries included (0 for no limit)")
+	flag.DurationVar(&clientTCP.KeepAlive, "tcp-keepalive", 0, "Idle time before keepalive probes on client connections (0 for the default of 15s, negative turns them off)")
+	flag.DurationVar(&clientTCP.KeepAliveInterval, "tcp-keepalive-interval", 0, "Time between keepalive probes on client connections (0 for the system default; Linux and Windows only)")
+	flag.IntVar(&clientTCP.KeepAliveCount, "tcp-keepalive-count", 0, "Unanswered keepalive probes before a client is given up on (0 for the system default; Linux and Windows only)")
+	flag.DurationVar(&clientTCP.UserTimeout, "tcp-user-timeout", 0, "Give up on a client that hasn't acknowledged sent data for this long (0 for the system default; Linux and Windows only)")
+	flag.IntVar(&clientTCP.Linger, "tcp-linger", -1, "Seconds closing a client connection waits to send unsent data, 0 resetting it (negative for the system default)")
+	flag.DurationVar(&upstreamTCP.KeepAlive, "upstream-tcp-keepalive", upstreamTCP.KeepAlive, "Idle time before keepalive probes on backend connections (negative turns them off)")
+	flag.DurationVar(&upstreamTCP.KeepAliveInterval, "upstream-tcp-keepalive-interval", 0, "Time between keepalive probes on backend connections (0 for the system default; Linux and Windows only)")
+	flag.IntVar(&upstreamTCP.KeepAliveCount, "upstream-tcp-keepalive-count", 0, "Unanswered keepalive probes before a backend connection is given up on (0 for the system default; Linux and Windows only)")
+	flag.DurationVar(&upstreamTCP.UserTimeout, "upstream-tcp-user-timeout", 0, "Give up on a backend connection with data unacknowledged for this long (0 for the system default; Linux and Windows only)")
+	flag.IntVar(&upstreamTCP.Linger, "upstream-tcp-linger", -1, "Seconds closing a backend connection waits to send unsent data, 0 resetting it (negative for the system default)")
+	flag.DurationVar(&upstreamDialTimeout, "upstream-dial-timeout", upstreamDialTimeout, "Give up connecting to a backend after this long")
+	flag.DurationVar(&websocketIdleTimeout, "websocket-idle-timeout", websocketIdleTimeout, "Close upgraded (WebSocket) connections with no traffic either way for this long (0 never)")
+	flag.DurationVar(&upstreamIdleTimeout, "upstream-idle-timeout", 90*time.Second, "Close pooled upstream connections idle for longer than this")
+	flag.DurationVar(&upstreamSweep, "upstream-sweep-interval", 0, "Close all idle upstream connections this often, capping their reuse age (0 disables)")
+	flag.StringVar(&routesFile, "routes", "", "JSON file with extra pools and path/Accept/Content-Type routes into them")
+	flag.StringVar(&mirrorBackends, "mirror-backends", "", "Shadow backends to copy requests to, responses discarded, in -backends syntax (they form the pool \"shadow\")")
+	flag.Float64Var(&mirrorPercent, "mirror-percent", mirrorPercent, "Percent of requests copied to -mirror-backends")
+	flag.StringVar(&tenantsFile, "tenants", "", "JSON file defining additional named listener groups")
+	flag.StringVar(&headerRulesFile, "header-rules", "", "JSON file with request/response header rules per path prefix")
+	flag.StringVar(&headerVarsSpec, "header-vars", "", "Values header rules can reference as {var.NAME}, e.g. region=eu-west-1,deployment=d42")
 	flag.Parse()
+	inheritListeners()
+	if allocAuditAtStart {
+		if allocAuditRate < 1 {
+			log.Fatal("-alloc-audit-rate must be a positive number of bytes")
+		}
+		enableAllocAudit(allocAuditRate)
+	}
+
+	switch mode {
+	case "http":
+	case "tcp":
+		tcpMode = true
+	default:
+		log.Fatalf("unknown -mode %q (use http or tcp)", mode)
+	}
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	forwardedOptions.TrustedProxies = proxies
+	if connInfoHeaders, err = parseConnInfoHeaders(connInfoSpec); err != nil {
+		log.Fatal(err)
+	}
+	if degradedWeightPercent < 1 || degradedWeightPercent > 100 {
+		log.Fatal("-signal-degraded-weight must be between 1 and 100")
+	}
+	if weightDecayHalfLife < 0 || weightDecayFloor < 1 || weightDecayFloor > 100 {
+		log.Fatal("-weight-decay must not be negative and -weight-decay-floor must be between 1 and 100")
+	}
+	if canaryPercent < 0 || canaryPercent > 100 {
+		log.Fatal("-canary-percent must be between 0 and 100")
+	}
+	if listenList != "" {
+		bindAddrs = strings.Split(listenList, ",")
+	}
+	if acmeHosts != "" {
+		frontTLS.ACME.Hosts = strings.Split(acmeHosts, ",")
+	}
+	if headerVarsSpec != "" {
+		if headerVars, err = parseHeaderVars(headerVarsSpec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg := &Config{}
+	if configFile != "" {
+		var err error
+		if cfg, err = LoadConfig(configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := cfg.overlayFlags(port, strategyName, strategySeed); err != nil {
+		log.Fatal(err)
+	}
+	if serverList != "" {
+		cfg.Backends = nil
+		for _, tok := range strings.Split(serverList, ",") {
+			bc, err := backendConfigFromSpec(tok)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.Backends = append(cfg.Backends, bc)
+		}
+	}
+	port = cfg.Port
+
+	if defaultHashKey, err = ParseHashKey(hashKey); err != nil {
+		log.Fatal(err)
+	}
+	if proxyProtocolBackends != "" && proxyProtocolBackends != "v1" && proxyProtocolBackends != "v2" {
+		log.Fatalf("-proxy-protocol-backends must be v1 or v2, got %q", proxyProtocolBackends)
+	}
+	if webhookList != "" {
+		wh, err := newWebhooks(strings.Split(webhookList, ","), webhookFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		healthWebhooks = wh
+		go wh.run()
+	}
+	if retryPolicy.Ratio < 0 {
+		log.Fatalf("-retry-ratio must not be negative, got %g", retryPolicy.Ratio)
+	}
+	if maxInFlight < 0 {
+		log.Fatalf("-max-in-flight must not be negative, got %d", maxInFlight)
+	}
+	if hashLoadFactor != 0 && hashLoadFactor <= 1 {
+		log.Fatalf("-hash-load-factor must be above 1, got %g", hashLoadFactor)
+	}
+	if err := checkUpstreamSource(); err != nil {
+		log.Fatal(err)
+	}
+	if resolverServers != "" || resolverTTL > 0 || resolverNegativeTTL > 0 {
+		r, err := NewResolver(strings.Split(resolverServers, ","), resolverTimeout, resolverTTL, resolverNegativeTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		upstreamResolver = r
+	}
+	var tlsConfig *tls.Config
+	if frontTLS.Enabled() {
+		var err error
+		if tlsConfig, err = frontTLS.serverConfig(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	chaos.Update(chaosSettings)
+	strategy, err := NewStrategy(cfg.Strategy, cfg.Seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverPool.Strategy = strategy
+	bodyRewrite.ContentTypes = strings.Split(rewriteTypes, ",")
+	if chaosSettings.Enabled {
+		log.Println("Chaos mode enabled")
+	}
 
 	if testMode {
 		// Use test servers
 		log.Println("Running in test mode with test servers")
-		ready := make(chan bool)
-		go StartServers(ready)
-		<-ready // wait for signal to continue
-		tokens := make([]string, len(Ports))
-		for i, p := range Ports {
-			tokens[i] = "http://localhost:" + strconv.Itoa(p)
-		}
-		initializeBackends(tokens)
+		testServers, err := StartServers(testCount, testBasePort, testBehaviors)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runningTestServers = testServers
+		var backends []BackendConfig
+		for _, u := range testServers.URLs {
+			backends = append(backends, BackendConfig{URL: u})
+		}
+		initializeBackends(backends)
+
+		// stop the test servers cleanly instead of leaving them to die with the process
+		onShutdown(func(ctx context.Context) error {
+			defer log.Println("Test servers stopped")
+			return testServers.Shutdown(ctx)
+		})
 	} else {
-		if len(serverList) == 0 {
-			log.Fatal("Must have some backends")
+		if len(cfg.Backends) == 0 {
+			if !allowEmptyPool {
+				log.Fatal("Must have some backends (or -allow-empty)")
+			}
+			log.Println("Starting without backends")
+		}
+		initializeBackends(cfg.Backends)
+		// backends given with -backends win over the file, so there is nothing to reload
+		if configFile != "" && serverList == "" {
+			reloadPath = configFile
+			go reloadOnHangup(configFile)
+		}
+	}
+	if fallbackBackend != "" {
+		bc, err := backendConfigFromSpec(fallbackBackend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := serverPool.SetFallback(bc); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if errorPagesFile != "" {
+		if errorPages, err = LoadErrorPages(errorPagesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if startInMaintenance {
+		serverPool.SetMaintenance(true)
+	}
+	if affinityCookie != "" {
+		store, err := NewAffinityStore(affinityStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverPool.Affinity = &Affinity{Cookie: affinityCookie, TTL: affinityTTL, Store: store}
+		log.Printf("Session affinity on cookie %s (%s store)\n", affinityCookie, affinityStore)
+	}
+	if stickyCookie != "" {
+		serverPool.Sticky = &StickyCookie{Name: stickyCookie, TTL: stickyTTL}
+		log.Printf("Sticky sessions on balancer cookie %s\n", stickyCookie)
+	}
+	if readYourWrites > 0 {
+		key, err := ParseHashKey(readYourWritesKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store, err := NewAffinityStore(affinityStore)
+		if err != nil {
+			log.Fatal(err)
 		}
-		tokens := strings.Split(serverList, ",")
-		initializeBackends(tokens)
+		serverPool.ReadWrites = &ReadYourWrites{Window: readYourWrites, Key: key, Store: store}
+		log.Printf("Reads pinned for %s after a write, by %s (%s store)\n", readYourWrites, key, affinityStore)
+	}
+
+	if mirrorBackends != "" {
+		if trafficMirror, err = newTrafficMirror(mirrorBackends, mirrorPercent); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Mirroring %g%% of requests to the shadow pool\n", mirrorPercent)
+	}
+
+	if rateLimitStore != "" {
+		if rateLimitLease <= 0 {
+			log.Fatal("-rate-limit-lease must be positive")
+		}
+		if sharedRateLimits, err = NewSharedRateLimits(rateLimitStore, rateLimitLease); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Rate limits shared through redis at %s, leasing %s of a rate at a time\n", sharedRateLimits.c.Addr(), rateLimitLease)
+	}
+
+	var handler http.Handler = &serverPool
+	if routesFile != "" || len(cfg.Routes) > 0 || len(cfg.Pools) > 0 {
+		rc := &RoutesConfig{Pools: cfg.Pools, Routes: cfg.Routes}
+		if routesFile != "" {
+			if rc, err = LoadRoutes(routesFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		router, err = NewRouter(rc, handler)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = router
+	}
+	if trafficMirror != nil {
+		handler = WithMirror(trafficMirror, handler)
+		useMiddleware("mirror", explainMirror(trafficMirror))
+	}
+	if responseBuffer > 0 {
+		handler = WithWriteBehind(responseBuffer, handler)
+		useMiddleware("write-behind", nil)
+	}
+	if headerRulesFile != "" {
+		rules, err := LoadHeaderRules(headerRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = WithHeaderRules(rules, handler)
+		useMiddleware("header-rules", explainHeaderRules(rules))
+	}
+	if coalesce {
+		coalescer = NewCoalescer(coalesceMaxBody)
+		coalescer.Window, coalescer.WindowBytes, coalescer.Vary = coalesceWindow, coalesceWindowBytes, coalesceVary
+		coalescer.KeyHeaders = nil
+		for _, h := range strings.Split(coalesceHeaders, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				coalescer.KeyHeaders = append(coalescer.KeyHeaders, http.CanonicalHeaderKey(h))
+			}
+		}
+		handler = coalescer.Middleware(handler)
+		useMiddleware("coalesce", explainCoalesce)
+	}
+	if cacheSize > 0 {
+		responseCache = NewResponseCache(cacheSize, cacheMaxBody)
+		responseCache.MaxTTL = cacheTTL
+		if cachePaths != "" {
+			responseCache.Paths = strings.Split(cachePaths, ",")
+		}
+		handler = responseCache.Middleware(handler)
+		useMiddleware("cache", explainCache)
+	}
+	handler = WithAdmission(handler)
+	useMiddleware("admission", nil)
+	if compress {
+		compression = &Compression{MinSize: compressMinSize, ContentTypes: strings.Split(compressTypes, ",")}
+		handler = compression.Middleware(handler)
+		useMiddleware("compress", nil)
+	}
+	if dedupe.Window > 0 {
+		if dedupe.Mode != "reject" && dedupe.Mode != "serialize" {
+			log.Fatalf("unknown -dedupe-mode %q (use reject or serialize)", dedupe.Mode)
+		}
+		handler = dedupe.Middleware(handler)
+		useMiddleware("dedupe", nil)
+	}
+	if recordFile != "" {
+		recorder, err := NewRecorder(recordFile, recordSample, recordBodies, recordCredentials, recordMaxBody)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = recorder.Middleware(handler)
+		useMiddleware("record", func(*http.Request) string { return fmt.Sprintf("sampled at %.1f%%", recordSample*100) })
+		log.Printf("Recording %.1f%% of requests to %s\n", recordSample*100, recordFile)
+	}
+	if journalFile != "" {
+		journal, err := NewFailureJournal(journalFile, journalMaxBytes, journalMaxBody)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = journal.Middleware(handler)
+		useMiddleware("failure-journal", nil)
+		log.Printf("Journaling failed requests to %s\n", journalFile)
+	}
+	if classesFile != "" {
+		classes, err := LoadRequestClasses(classesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		requestClasses = classes
+		handler = WithRequestClasses(classes, handler)
+		useMiddleware("classes", explainClasses(classes))
+	}
+	if requestTimeout > 0 {
+		handler = WithRequestTimeout(handler)
+		useMiddleware("request-timeout", func(*http.Request) string { return fmt.Sprintf("%s in all", requestTimeout) })
+	}
+	handler = WithVia(handler)
+	useMiddleware("via", explainVia)
+	if apiKeysSpec != "" {
+		store, err := NewAPIKeyStore(apiKeysSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiKeys = NewAPIKeys(apiKeyHeader, store)
+		handler = apiKeys.Middleware(handler)
+		useMiddleware("api-keys", nil)
+	}
+	if clientRateLimit.Rate > 0 {
+		handler = clientRateLimit.Middleware(handler)
+		useMiddleware("client-rate-limit", nil)
+	}
+	if ipAllowSource != "" || ipDenySource != "" {
+		ipAccess = &IPAccess{}
+		if ipAllowSource != "" {
+			if ipAccess.Allow, err = NewIPList(ipAllowSource); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if ipDenySource != "" {
+			if ipAccess.Deny, err = NewIPList(ipDenySource); err != nil {
+				log.Fatal(err)
+			}
+		}
+		ipAccess.Start(context.Background(), ipListInterval)
+		handler = ipAccess.Middleware(handler)
+		useMiddleware("ip-access", nil)
+	}
+	if maxRequestBody > 0 {
+		handler = WithMaxRequestBody(handler)
+		useMiddleware("max-request-body", nil)
+	}
+	if maxInFlight > 0 {
+		handler = WithMaxInFlight(handler)
+		useMiddleware("max-in-flight", func(*http.Request) string {
+			return fmt.Sprintf("%d of %d in flight", inFlight.Load(), maxInFlight)
+		})
+	}
+	if accessLogFile != "" {
+		var sink LogSink
+		if accessLogShip != "" {
+			var err error
+			if sink, err = NewLogSink(accessLogShip, accessLogEndpoint); err != nil {
+				log.Fatal(err)
+			}
+		}
+		accessLog, err := NewAccessLog(accessLogFile, accessLogFormat, accessLogRotateSize, accessLogRotateEvery, sink)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = accessLog.Middleware(handler)
+		useMiddleware("access-log", nil)
+		onShutdown(accessLog.Close)
+	}
+	handler = WithStrictHTTP(handler)
+	useMiddleware("strict-http", nil)
+	handler = WithRequestID(handler)
+	useMiddleware("request-id", nil)
+	if clientMaxAge > 0 {
+		handler = WithConnMaxAge(handler)
+		useMiddleware("conn-max-age", nil)
 	}
 
 	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(LoadBalance),
+		Handler:     withH2C(handler),
+		ConnContext: clientConnContext,
+		IdleTimeout: clientIdleTimeout,
+	}
+
+	var tenants []*Tenant
+	if tenantsFile != "" {
+		if tenants, err = LoadTenants(tenantsFile); err != nil {
+			log.Fatal(err)
+		}
+		for _, t := range tenants {
+			if err := t.Start(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if clusterBind != "" {
+		if rateLimitStore == "" && (clientRateLimit.Rate > 0 || len(rateLimitStats()) > 0) {
+			log.Fatal("-cluster-bind shares health, not rate limits: add -rate-limit-store so members enforce -client-rate and pool and route rate limits together")
+		}
+		c, err := NewCluster(clusterBind, strings.Split(clusterPeers, ","), clusterNode, clusterKey, clusterInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cluster = c
 	}
 
-	go HealthCheck()
+	if tcpMode && healthCheckPath != "" {
+		log.Fatal("-health-path doesn't apply with -mode tcp, whose health checks are TCP connects")
+	}
+	// the process this one upgrades serves until it is listening, and gives
+	// up on it after -upgrade-timeout, so that one isn't held
+	hold := holdTraffic && !upgrading()
+	if hold && adminPort <= 0 {
+		log.Fatal("-hold needs -admin-port for POST /admin/go")
+	}
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	drainOnShutdown(&server)
+	go shutdownOnSignal(stopHealth)
+	go upgradeOnSignal()
+	if upstreamSweep > 0 {
+		go sweepIdleConns(upstreamSweep)
+	}
+	if dnsAddr != "" {
+		dns := &DNSResponder{Name: strings.ToLower(strings.TrimSuffix(dnsName, ".")) + ".", TTL: dnsTTL, Weighted: dnsWeighted}
+		go func() {
+			if err := dns.Serve(dnsAddr); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if adminPort > 0 {
+		startAdmin(adminPort)
+	}
+	// /readyz answers while preload warms up, which it does before the
+	// health loop starts so the two don't probe at once
+	if hold {
+		preload()
+	}
+	go HealthCheck(healthCtx)
 
-	log.Printf("Load balancer at :%d\n", port)
-	if err := server.ListenAndServe(); err != nil {
+	addrs, err := listenAddrs(bindAddrs, port)
+	if err != nil {
 		log.Fatal(err)
 	}
+	listen := func() net.Listener {
+		l, err := listenAll(addrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if l, err = withProxyProtocol(withClientTCP(l)); err != nil {
+			log.Fatal(err)
+		}
+		if tcpMode {
+			log.Printf("Load balancer at %s (TCP)\n", boundAddrs(l))
+			accepting.Store(true)
+			upgradeReady()
+			return TLSListener(LimitListener(l, connLimits, "default", tlsConfig != nil), tlsConfig)
+		}
+		if tlsConfig != nil {
+			log.Printf("Load balancer at %s (HTTPS)\n", boundAddrs(l))
+		} else {
+			log.Printf("Load balancer at %s\n", boundAddrs(l))
+		}
+		accepting.Store(true)
+		upgradeReady()
+		return StrictListener(TLSListener(LimitListener(l, connLimits, "default", tlsConfig != nil), tlsConfig))
+	}
+
+	if hold {
+		holdUntilGo()
+	} else if holdTraffic {
+		log.Println("Taking over from an upgrade, not holding traffic")
+	}
+	for _, t := range tenants {
+		if err := t.Serve(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if tlsConfig != nil && frontTLS.RedirectPort > 0 {
+		serveRedirect(frontTLS.RedirectPort, port)
+	}
+
+	serve := server.Serve
+	if tcpMode {
+		serve = tcpProxy.Serve
+		onShutdown(tcpProxy.Shutdown)
+	}
+	if haConsul == "" {
+		if err := serve(listen()); serveErr(err) {
+			log.Fatal(err)
+		}
+		<-shutdownDone
+		return
+	}
+
+	// in HA mode the port is only open while we hold the lock
+	var l net.Listener
+	if haConsulToken == "" {
+		haConsulToken = consulToken
+	}
+	elector = &Elector{Consul: haConsul, Key: haKey, Token: haConsulToken, Node: haNode, TTL: haTTL}
+	elector.OnLeader = func() {
+		runHook("leader", haOnLeader)
+		l = listen()
+		go serve(l)
+	}
+	elector.OnStandby = func() {
+		if l != nil {
+			_ = l.Close()
+			l = nil
+		}
+		accepting.Store(false)
+		runHook("standby", haOnStandby)
+	}
+	// an upgrade is done once this process is leader, or settled as standby
+	elector.Ready = upgradeReady
+	onShutdown(func(context.Context) error { return elector.release() })
+	go elector.Run()
+	<-shutdownDone
 }
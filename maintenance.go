@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// a pool in maintenance (PUT /admin/maintenance, or -maintenance for the
+// default pool from the start) answers 503 to everyone but requests carrying
+// -maintenance-bypass-token in an X-Maintenance-Bypass header or an
+// lb_maintenance_bypass cookie, so engineers can check a deploy through the
+// balancer before traffic is let back in. the token is stripped before the
+// request reaches a backend, and bypass requests are neither served from
+// nor kept in the cache, nor coalesced
+const (
+	maintenanceBypassHeader = "X-Maintenance-Bypass"
+	maintenanceBypassCookie = "lb_maintenance_bypass"
+)
+
+var maintenanceBypassToken string
+
+// what clients are told to wait before trying again
+const maintenanceRetryAfter = time.Minute
+
+// poolMaintenance is whether a pool is closed, with what went through anyway
+type poolMaintenance struct {
+	on       atomic.Bool
+	bypassed atomic.Uint64
+	refused  atomic.Uint64
+}
+
+// admit reports whether r may go on, counting it either way while the pool
+// is in maintenance
+func (m *poolMaintenance) admit(r *http.Request) bool {
+	if !m.on.Load() {
+		return true
+	}
+	if maintenanceBypass(r) {
+		m.bypassed.Add(1)
+		return true
+	}
+	m.refused.Add(1)
+	return false
+}
+
+// admit answers r if the pool is in maintenance and r can't bypass it, or
+// the pool's rate limit is used up, and reports whether r may go on
+func (s *ServerPool) admit(w http.ResponseWriter, r *http.Request) bool {
+	if !s.maintenance.admit(r) {
+		writeError(w, r, http.StatusServiceUnavailable, "maintenance", "Down for maintenance.", maintenanceRetryAfter)
+		return false
+	}
+	if s.RateLimit != nil && !featureOff(r, "rate_limit") && !s.RateLimit.allow(w, r) {
+		return false
+	}
+	return true
+}
+
+// maintenanceBypass reports whether r carries the bypass token
+func maintenanceBypass(r *http.Request) bool {
+	if maintenanceBypassToken == "" {
+		return false
+	}
+	token := r.Header.Get(maintenanceBypassHeader)
+	if token == "" {
+		if c, err := r.Cookie(maintenanceBypassCookie); err == nil {
+			token = c.Value
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(maintenanceBypassToken)) == 1
+}
+
+// stripMaintenanceBypass keeps the token from reaching backends
+func stripMaintenanceBypass(r *http.Request) {
+	r.Header.Del(maintenanceBypassHeader)
+	cookies := r.Header.Values("Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	var kept []string
+	for _, c := range r.Cookies() {
+		if c.Name != maintenanceBypassCookie {
+			kept = append(kept, c.String())
+		}
+	}
+	if len(kept) == len(r.Cookies()) {
+		return
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// MaintenanceStatus is a pool's maintenance state as the admin API shows it
+type MaintenanceStatus struct {
+	Pool        string `json:"pool"`
+	Maintenance bool   `json:"maintenance"`
+	Bypassed    uint64 `json:"bypassed"`
+	Refused     uint64 `json:"refused"`
+}
+
+func (s *ServerPool) MaintenanceStatus() MaintenanceStatus {
+	return MaintenanceStatus{s.Name, s.maintenance.on.Load(), s.maintenance.bypassed.Load(), s.maintenance.refused.Load()}
+}
+
+// SetMaintenance closes the pool to all but bypass requests, or opens it
+func (s *ServerPool) SetMaintenance(on bool) {
+	if s.maintenance.on.Swap(on) != on {
+		log.Printf("[%s] Pool maintenance: %t\n", s.Name, on)
+	}
+}
+
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	list := []MaintenanceStatus{}
+	for _, p := range pools {
+		list = append(list, p.MaintenanceStatus())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// puts a pool in maintenance or takes it out, e.g. {"pool": "api", "maintenance": true}
+func putMaintenancePool(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pool        string `json:"pool"`
+		Maintenance bool   `json:"maintenance"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pool := findPool(req.Pool)
+	if pool == nil {
+		http.Error(w, fmt.Sprintf("unknown pool %q", req.Pool), http.StatusNotFound)
+		return
+	}
+	pool.SetMaintenance(req.Maintenance)
+	writeJSON(w, http.StatusOK, pool.MaintenanceStatus())
+}
@@ -0,0 +1,395 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds, in seconds, of the request latency histogram buckets
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a lock-free Prometheus style histogram over latencyBuckets.
+// counts are per bucket and summed when written out
+type histogram struct {
+	counts [len(latencyBuckets) + 1]atomic.Uint64 // the last one is +Inf
+	sum    atomic.Int64                           // ns
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d.Seconds() > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, cumulative)
+	}
+	cumulative += h.counts[len(latencyBuckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, cumulative)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name/value pairs as Prometheus labels
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	return b.String()
+}
+
+func metricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func boolGauge(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// getMetrics serves every pool's and listener's counters in the Prometheus
+// text format
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	type poolBackend struct {
+		pool string
+		b    *Backend
+	}
+	var all []poolBackend
+	for _, p := range pools {
+		for _, b := range p.Backends() {
+			all = append(all, poolBackend{p.Name, b})
+		}
+	}
+	each := func(name, typ, help string, value func(b *Backend) any) {
+		metricHeader(w, name, typ, help)
+		for _, pb := range all {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, labels("pool", pb.pool, "backend", pb.b.Name()), value(pb.b))
+		}
+	}
+
+	each("lb_backend_requests_total", "counter", "Responses and transport errors per backend.",
+		func(b *Backend) any { req, _ := b.Counts(); return req })
+	each("lb_backend_failures_total", "counter", "5xx responses and transport errors per backend.",
+		func(b *Backend) any { _, fail := b.Counts(); return fail })
+	metricHeader(w, "lb_upstream_errors_total", "counter", "5xx responses and transport errors per backend, by cause.")
+	for _, pb := range all {
+		for k := range pb.b.upstreamErrors {
+			kind := upstreamErrorKind(k)
+			fmt.Fprintf(w, "lb_upstream_errors_total{%s} %d\n", labels("pool", pb.pool, "backend", pb.b.Name(), "kind", kind.String()), pb.b.upstreamErrors[kind].Load())
+		}
+	}
+	each("lb_backend_retries_total", "counter", "Requests retried against the same backend after a transport error.",
+		func(b *Backend) any { return b.retries.Load() })
+	each("lb_backend_up", "gauge", "Whether the backend is healthy and in rotation.",
+		func(b *Backend) any { return boolGauge(b.IsAlive()) })
+	each("lb_backend_in_flight", "gauge", "Requests the backend is serving.",
+		func(b *Backend) any { return b.InFlight() })
+	if weightDecayHalfLife > 0 {
+		each("lb_backend_error_rate", "gauge", "Smoothed recent error rate that -weight-decay cuts the weight by.",
+			func(b *Backend) any { return b.ErrorRate() })
+	}
+	each("lb_backend_probe_rtt_seconds", "gauge", "Smoothed health probe round trip.",
+		func(b *Backend) any { return b.ProbeRTT().Seconds() })
+
+	metricHeader(w, "lb_backend_request_duration_seconds", "histogram", "Time from handing a request to the backend to its response being written.")
+	for _, pb := range all {
+		pb.b.latency.write(w, "lb_backend_request_duration_seconds", labels("pool", pb.pool, "backend", pb.b.Name()))
+	}
+
+	metricHeader(w, "lb_pool_failovers_total", "counter", "Requests moved to another backend after one failed.")
+	for _, p := range pools {
+		fmt.Fprintf(w, "lb_pool_failovers_total{%s} %d\n", labels("pool", p.Name), p.failovers.Load())
+	}
+	if hashLoadFactor > 0 {
+		metricHeader(w, "lb_hash_spillovers_total", "counter", "Consistent-hash keys sent past a backend over its load bound.")
+		for _, p := range pools {
+			if _, ok := p.Strategy.(*ConsistentHash); ok {
+				fmt.Fprintf(w, "lb_hash_spillovers_total{%s} %d\n", labels("pool", p.Name), p.hashSpilled.Load())
+			}
+		}
+	}
+	metricHeader(w, "lb_pool_retries_denied_total", "counter", "Retries not made because the pool was past -retry-ratio.")
+	for _, p := range pools {
+		fmt.Fprintf(w, "lb_pool_retries_denied_total{%s} %d\n", labels("pool", p.Name), p.retriesDenied.Load())
+	}
+	if maxInFlight > 0 {
+		metricHeader(w, "lb_in_flight", "gauge", "Requests in flight across all pools, as -max-in-flight counts them.")
+		fmt.Fprintf(w, "lb_in_flight %d\n", inFlight.Load())
+		metricHeader(w, "lb_overload_shed_total", "counter", "Requests shed with a 503 past -max-in-flight.")
+		fmt.Fprintf(w, "lb_overload_shed_total %d\n", overloadShed.Load())
+	}
+	metricHeader(w, "lb_pool_in_flight", "gauge", "Requests being served by the pool.")
+	for _, p := range pools {
+		fmt.Fprintf(w, "lb_pool_in_flight{%s} %d\n", labels("pool", p.Name), p.inflight.Load())
+	}
+	metricHeader(w, "lb_pool_rejected_total", "counter", "Requests turned away because the pool was at its limit.")
+	for _, p := range pools {
+		fmt.Fprintf(w, "lb_pool_rejected_total{%s} %d\n", labels("pool", p.Name), p.rejected.Load())
+	}
+
+	metricHeader(w, "lb_pool_maintenance", "gauge", "Whether the pool is in maintenance, refusing all but bypass requests.")
+	for _, p := range pools {
+		fmt.Fprintf(w, "lb_pool_maintenance{%s} %d\n", labels("pool", p.Name), boolGauge(p.maintenance.on.Load()))
+	}
+	metricHeader(w, "lb_pool_maintenance_refused_total", "counter", "Requests answered 503 while the pool was in maintenance.")
+	for _, p := range pools {
+		fmt.Fprintf(w, "lb_pool_maintenance_refused_total{%s} %d\n", labels("pool", p.Name), p.maintenance.refused.Load())
+	}
+
+	metricHeader(w, "lb_group_requests_total", "counter", "Responses and transport errors per pool for its stable and canary backends.")
+	for _, p := range pools {
+		for i := range p.canary.groups {
+			fmt.Fprintf(w, "lb_group_requests_total{%s} %d\n", labels("pool", p.Name, "group", groupName(i == 1)), p.canary.groups[i].requests.Load())
+		}
+	}
+	metricHeader(w, "lb_group_failures_total", "counter", "5xx responses and transport errors per pool for its stable and canary backends.")
+	for _, p := range pools {
+		for i := range p.canary.groups {
+			fmt.Fprintf(w, "lb_group_failures_total{%s} %d\n", labels("pool", p.Name, "group", groupName(i == 1)), p.canary.groups[i].failures.Load())
+		}
+	}
+	metricHeader(w, "lb_canary_percent", "gauge", "Percent of the pool's requests sent to its canary backends.")
+	for _, p := range pools {
+		fmt.Fprintf(w, "lb_canary_percent{%s} %g\n", labels("pool", p.Name), p.canary.Percent())
+	}
+
+	metricHeader(w, "lb_discovery_backends", "gauge", "Backends found under each discovery url.")
+	for _, p := range pools {
+		for _, d := range p.Discoveries() {
+			fmt.Fprintf(w, "lb_discovery_backends{%s} %d\n", labels("pool", p.Name, "name", d.String()), d.Backends())
+		}
+	}
+	metricHeader(w, "lb_discovery_failures_total", "counter", "Discovery lookups that failed, keeping the last backends.")
+	for _, p := range pools {
+		for _, d := range p.Discoveries() {
+			fmt.Fprintf(w, "lb_discovery_failures_total{%s} %d\n", labels("pool", p.Name, "name", d.String()), d.failures.Load())
+		}
+	}
+
+	if backendBackpressure {
+		metricHeader(w, "lb_backpressure_shed_total", "counter", "Requests answered 503 because every backend was backing off.")
+		fmt.Fprintf(w, "lb_backpressure_shed_total %d\n", backpressureShed.Load())
+	}
+
+	if spreadUpstreamIPs {
+		metricHeader(w, "lb_upstream_address_failures_total", "counter", "Connections to one of a backend hostname's addresses that failed, moving on to the next.")
+		fmt.Fprintf(w, "lb_upstream_address_failures_total %d\n", upstreamSpread.dialFailures.Load())
+	}
+
+	metricHeader(w, "lb_requests_cancelled_total", "counter", "Requests cancelled through the admin API.")
+	fmt.Fprintf(w, "lb_requests_cancelled_total %d\n", activeRequests.killed.Load())
+
+	metricHeader(w, "lb_midstream_failures_total", "counter", "Backends failing after the response headers were sent.")
+	fmt.Fprintf(w, "lb_midstream_failures_total %d\n", midstreamFailures.Load())
+	metricHeader(w, "lb_midstream_resumed_total", "counter", "Of those, responses completed from another backend.")
+	fmt.Fprintf(w, "lb_midstream_resumed_total %d\n", midstreamResumed.Load())
+
+	if apiKeys != nil {
+		stats := apiKeys.Stats()
+		metricHeader(w, "lb_api_key_requests_total", "counter", "Requests per API key, rejected ones included.")
+		for _, k := range stats {
+			fmt.Fprintf(w, "lb_api_key_requests_total{%s} %d\n", labels("key", k.Name), k.Requests)
+		}
+		metricHeader(w, "lb_api_key_rejected_total", "counter", "Requests per API key refused by its rate limit or quota.")
+		for _, k := range stats {
+			fmt.Fprintf(w, "lb_api_key_rejected_total{%s} %d\n", labels("key", k.Name, "reason", "rate_limited"), k.RateLimited)
+			fmt.Fprintf(w, "lb_api_key_rejected_total{%s} %d\n", labels("key", k.Name, "reason", "quota_exceeded"), k.OverQuota)
+		}
+		metricHeader(w, "lb_api_key_quota_used", "gauge", "Requests counted in the API key's current quota window.")
+		for _, k := range stats {
+			if k.Quota > 0 {
+				fmt.Fprintf(w, "lb_api_key_quota_used{%s} %d\n", labels("key", k.Name), k.QuotaUsed)
+			}
+		}
+	}
+
+	if responseCache != nil {
+		st := responseCache.Stats()
+		metricHeader(w, "lb_cache_requests_total", "counter", "Cacheable requests, by whether the cache answered.")
+		fmt.Fprintf(w, "lb_cache_requests_total{%s} %d\n", labels("result", "hit"), st.Hits)
+		fmt.Fprintf(w, "lb_cache_requests_total{%s} %d\n", labels("result", "miss"), st.Misses)
+		metricHeader(w, "lb_cache_revalidated_total", "counter", "Stale cached responses the backend confirmed unchanged.")
+		fmt.Fprintf(w, "lb_cache_revalidated_total %d\n", st.Revalidated)
+		metricHeader(w, "lb_cache_bytes", "gauge", "Bytes of responses held by the cache.")
+		fmt.Fprintf(w, "lb_cache_bytes %d\n", st.Bytes)
+		metricHeader(w, "lb_cache_purged_total", "counter", "Cached responses dropped through the purge API.")
+		fmt.Fprintf(w, "lb_cache_purged_total %d\n", st.Purged)
+	}
+
+	if c := compression; c != nil {
+		metricHeader(w, "lb_compressed_responses_total", "counter", "Responses compressed, by encoding.")
+		for i, enc := range compressEncodings {
+			fmt.Fprintf(w, "lb_compressed_responses_total{%s} %d\n", labels("encoding", enc), c.responses[i].Load())
+		}
+		metricHeader(w, "lb_compression_bytes_total", "counter", "Bytes of compressed responses, before and after.")
+		fmt.Fprintf(w, "lb_compression_bytes_total{%s} %d\n", labels("stage", "in"), c.bytesIn.Load())
+		fmt.Fprintf(w, "lb_compression_bytes_total{%s} %d\n", labels("stage", "out"), c.bytesOut.Load())
+	}
+
+	if dedupe.Window > 0 {
+		metricHeader(w, "lb_dedupe_duplicates_total", "counter", "Double submits caught, by what was done with them.")
+		fmt.Fprintf(w, "lb_dedupe_duplicates_total{%s} %d\n", labels("action", "rejected"), dedupe.rejected.Load())
+		fmt.Fprintf(w, "lb_dedupe_duplicates_total{%s} %d\n", labels("action", "serialized"), dedupe.serialized.Load())
+	}
+
+	if a := ipAccess; a != nil {
+		metricHeader(w, "lb_ip_denied_total", "counter", "Requests refused by -ip-allow or -ip-deny.")
+		fmt.Fprintf(w, "lb_ip_denied_total %d\n", a.denied.Load())
+		metricHeader(w, "lb_ip_list_entries", "gauge", "Addresses and CIDRs held per IP list.")
+		for _, l := range a.named() {
+			fmt.Fprintf(w, "lb_ip_list_entries{%s} %d\n", labels("list", l.name), l.Len())
+		}
+		metricHeader(w, "lb_ip_list_sync_failures_total", "counter", "IP list fetches that failed, keeping the last list.")
+		for _, l := range a.named() {
+			fmt.Fprintf(w, "lb_ip_list_sync_failures_total{%s} %d\n", labels("list", l.name), l.failures.Load())
+		}
+	}
+
+	if clientRateLimit.Rate > 0 {
+		metricHeader(w, "lb_client_rate_limited_total", "counter", "Requests refused by the per-client-IP rate limit.")
+		fmt.Fprintf(w, "lb_client_rate_limited_total %d\n", clientRateLimit.limited.Load())
+		metricHeader(w, "lb_client_rate_buckets", "gauge", "Client IPs currently tracked by the rate limit.")
+		fmt.Fprintf(w, "lb_client_rate_buckets %d\n", clientRateLimit.Clients())
+		metricHeader(w, "lb_client_rate_evicted_total", "counter", "Client buckets forgotten while still active to stay within -client-rate-max-clients.")
+		fmt.Fprintf(w, "lb_client_rate_evicted_total %d\n", clientRateLimit.evicted.Load())
+	}
+
+	if sharedRateLimits != nil {
+		metricHeader(w, "lb_rate_limit_store_requests_total", "counter", "Token leases asked of -rate-limit-store.")
+		fmt.Fprintf(w, "lb_rate_limit_store_requests_total %d\n", sharedRateLimits.leased.Load())
+		metricHeader(w, "lb_rate_limit_store_errors_total", "counter", "Token leases -rate-limit-store failed to give, the instance limiting on its own meanwhile.")
+		fmt.Fprintf(w, "lb_rate_limit_store_errors_total %d\n", sharedRateLimits.errors.Load())
+	}
+	if limits := rateLimitStats(); len(limits) > 0 {
+		metricHeader(w, "lb_rate_limited_total", "counter", "Requests refused by a pool's or route's rate limit.")
+		for _, l := range limits {
+			fmt.Fprintf(w, "lb_rate_limited_total{%s} %d\n", labels("scope", l.Scope, "name", l.Name), l.Limited)
+		}
+	}
+
+	if router != nil {
+		metricHeader(w, "lb_route_request_bytes", "histogram", "Request body sizes, by route.")
+		for _, rt := range router.Routes {
+			rt.sizes.requests.write(w, "lb_route_request_bytes", labels("route", rt.Name))
+		}
+		metricHeader(w, "lb_route_response_bytes", "histogram", "Response body sizes from backends, by route.")
+		for _, rt := range router.Routes {
+			rt.sizes.responses.write(w, "lb_route_response_bytes", labels("route", rt.Name))
+		}
+		metricHeader(w, "lb_route_responses_too_large_total", "counter", "Responses refused or cut off for going over the route's max_response_bytes.")
+		for _, rt := range router.Routes {
+			fmt.Fprintf(w, "lb_route_responses_too_large_total{%s} %d\n", labels("route", rt.Name), rt.sizes.tooLarge.Load())
+		}
+		metricHeader(w, "lb_route_ip_denied_total", "counter", "Requests refused by a route's ip_access lists.")
+		for _, rt := range router.Routes {
+			if rt.IPAccess != nil {
+				fmt.Fprintf(w, "lb_route_ip_denied_total{%s} %d\n", labels("route", rt.Name), rt.IPAccess.lists.denied.Load())
+			}
+		}
+		metricHeader(w, "lb_route_auth_refused_total", "counter", "Requests a route's auth requirements turned away, by the method that failed.")
+		for _, rt := range router.Routes {
+			if rt.Auth == nil {
+				continue
+			}
+			for _, m := range authMethods {
+				if n, ok := rt.Auth.Refused()[m]; ok {
+					fmt.Fprintf(w, "lb_route_auth_refused_total{%s} %d\n", labels("route", rt.Name, "method", m), n)
+				}
+			}
+		}
+		metricHeader(w, "lb_openapi_validation_failures_total", "counter", "Requests that didn't match their route's OpenAPI spec.")
+		for _, rt := range router.Routes {
+			if rt.OpenAPI == nil {
+				continue
+			}
+			failures := rt.OpenAPI.Failures()
+			for _, reason := range []string{"unknown_path", "method_not_allowed", "invalid_parameter", "invalid_body"} {
+				fmt.Fprintf(w, "lb_openapi_validation_failures_total{%s} %d\n", labels("route", rt.Name, "reason", reason), failures[reason])
+			}
+		}
+	}
+
+	if tcpMode {
+		metricHeader(w, "lb_tcp_idle_closed_total", "counter", "TCP proxied connections closed by -tcp-idle-timeout.")
+		fmt.Fprintf(w, "lb_tcp_idle_closed_total %d\n", tcpProxy.idleClosed.Load())
+	}
+
+	if responseBuffer > 0 {
+		metricHeader(w, "lb_response_buffer_bytes", "gauge", "Response bytes held for slow clients.")
+		fmt.Fprintf(w, "lb_response_buffer_bytes %d\n", writeBehindBytes.Load())
+		metricHeader(w, "lb_response_buffer_full_total", "counter", "Responses that filled -response-buffer, so the backend waited on the client.")
+		fmt.Fprintf(w, "lb_response_buffer_full_total %d\n", writeBehindFull.Load())
+	}
+
+	metricHeader(w, "lb_websocket_connections", "gauge", "Upgraded (WebSocket) connections being tunnelled.")
+	fmt.Fprintf(w, "lb_websocket_connections %d\n", websocketsOpen.Load())
+	metricHeader(w, "lb_websocket_idle_closed_total", "counter", "Upgraded connections closed by -websocket-idle-timeout.")
+	fmt.Fprintf(w, "lb_websocket_idle_closed_total %d\n", websocketsIdleClosed.Load())
+
+	// a listener HA closed may still be draining next to its replacement on
+	// the same addresses; they are summed as one series
+	var conns []string
+	active, rejected := map[string]int64{}, map[string]uint64{}
+	for _, l := range listening() {
+		key := labels("tenant", l.tenant, "addr", l.addr)
+		if _, ok := active[key]; !ok {
+			conns = append(conns, key)
+		}
+		active[key] += l.active.Load()
+		rejected[key] += l.rejected.Load()
+	}
+	metricHeader(w, "lb_active_connections", "gauge", "Open client connections per listener.")
+	for _, key := range conns {
+		fmt.Fprintf(w, "lb_active_connections{%s} %d\n", key, active[key])
+	}
+	metricHeader(w, "lb_rejected_connections_total", "counter", "Client connections refused by connection limits.")
+	for _, key := range conns {
+		fmt.Fprintf(w, "lb_rejected_connections_total{%s} %d\n", key, rejected[key])
+	}
+	if coalescer != nil {
+		metricHeader(w, "lb_coalesce_requests_total", "counter", "Coalescable requests: sent upstream, shared while in flight or within -coalesce-window (both saving an upstream call), or unshared after waiting.")
+		for _, c := range []struct {
+			result string
+			n      uint64
+		}{{"upstream", coalescer.upstream.Load()}, {"shared", coalescer.shared.Load()}, {"window", coalescer.windowed.Load()}, {"unshared", coalescer.unshared.Load()}} {
+			fmt.Fprintf(w, "lb_coalesce_requests_total{%s} %d\n", labels("result", c.result), c.n)
+		}
+	}
+	if maxRequestBody > 0 || router != nil {
+		metricHeader(w, "lb_request_bodies_too_large_total", "counter", "Requests answered 413 for a body over -max-request-body or the route's max_request_bytes.")
+		fmt.Fprintf(w, "lb_request_bodies_too_large_total %d\n", bodiesTooLarge.Load())
+	}
+	if proxyProtocol {
+		metricHeader(w, "lb_proxy_protocol_errors_total", "counter", "Client connections closed for a missing or malformed PROXY protocol header.")
+		fmt.Fprintf(w, "lb_proxy_protocol_errors_total %d\n", proxyHeaderFailures.Load())
+	}
+	if wh := healthWebhooks; wh != nil {
+		metricHeader(w, "lb_webhook_events_total", "counter", "Backend health events for -webhook by outcome: sent (per url), failed after retries (per url) or dropped on a full queue.")
+		for _, c := range []struct {
+			result string
+			n      uint64
+		}{{"sent", wh.sent.Load()}, {"failed", wh.failed.Load()}, {"dropped", wh.dropped.Load()}} {
+			fmt.Fprintf(w, "lb_webhook_events_total{%s} %d\n", labels("result", c.result), c.n)
+		}
+	}
+}
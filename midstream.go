@@ -0,0 +1,243 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// once a backend has sent headers, a failure can't be retried the usual way.
+// ReverseProxy then aborts the connection, which clients of a response with
+// a Content-Length may take for a complete body. instead, a GET of a
+// resumable response, such as a large download, is completed from other
+// backends with Range requests starting at the last delivered byte;
+// otherwise a chunked response ends with a streamErrorTrailer
+// saying it is incomplete, and a fixed length one is aborted and logged
+const streamErrorTrailer = "X-Stream-Error"
+
+var midstreamFailures, midstreamResumed atomic.Uint64
+
+type streamGuardKey struct{}
+
+// streamGuard sits between the proxy and the client and remembers enough of
+// the response to tell how far it got
+type streamGuard struct {
+	http.ResponseWriter
+	written int64
+	body    *watchedBody
+
+	status  int
+	trailer bool // streamErrorTrailer announced
+
+	// what resuming needs: the body's first and last byte within the
+	// representation, the total as the backend wrote it in Content-Range,
+	// and a validator so the rest is known to come from the same version
+	resumable  bool
+	first      int64
+	last       int64
+	total      string
+	validator  string
+	validateBy string // header holding validator in a response
+}
+
+func (g *streamGuard) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *streamGuard) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	n, err := g.ResponseWriter.Write(p)
+	g.written += int64(n)
+	return n, err
+}
+
+func (g *streamGuard) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// watchedBody keeps the upstream's read error, so a failing backend can be
+// told apart from a client that went away
+type watchedBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (wb *watchedBody) Read(p []byte) (int, error) {
+	n, err := wb.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		wb.err = err
+	}
+	return n, err
+}
+
+// watchStream is called from ModifyResponse to keep an eye on the body
+func watchStream(res *http.Response) {
+	g, ok := res.Request.Context().Value(streamGuardKey{}).(*streamGuard)
+	if !ok {
+		return
+	}
+	g.body = &watchedBody{ReadCloser: res.Body}
+	res.Body = g.body
+	if res.Request.Method == http.MethodGet {
+		g.watchRange(res)
+	}
+	// gRPC reports a broken stream in its own trailers
+	if res.ContentLength < 0 && res.Request.ProtoAtLeast(1, 1) && !isGRPC(res.Request) {
+		if res.Trailer == nil {
+			res.Trailer = http.Header{}
+		}
+		res.Trailer[streamErrorTrailer] = nil
+		g.trailer = true
+	}
+}
+
+// watchRange works out whether the response could be completed with a Range
+// request if its backend fails
+func (g *streamGuard) watchRange(res *http.Response) {
+	switch {
+	case res.StatusCode == http.StatusOK && res.ContentLength > 0 && res.Header.Get("Accept-Ranges") == "bytes":
+		g.first, g.last, g.total = 0, res.ContentLength-1, strconv.FormatInt(res.ContentLength, 10)
+	case res.StatusCode == http.StatusPartialContent:
+		// a single range; multipart/byteranges bodies don't carry Content-Range
+		var ok bool
+		if g.first, g.last, g.total, ok = parseContentRange(res.Header.Get("Content-Range")); !ok {
+			return
+		}
+	default:
+		return
+	}
+	// a weak ETag doesn't promise identical bytes, so fall back to the date
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		g.validator, g.validateBy = etag, "ETag"
+	} else if lm := res.Header.Get("Last-Modified"); lm != "" {
+		g.validator, g.validateBy = lm, "Last-Modified"
+	} else {
+		return
+	}
+	g.resumable = true
+}
+
+// parseContentRange reads "bytes first-last/total", total possibly "*"
+func parseContentRange(v string) (first, last int64, total string, ok bool) {
+	spec, found := strings.CutPrefix(v, "bytes ")
+	if !found {
+		return 0, 0, "", false
+	}
+	span, total, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, "", false
+	}
+	from, to, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, "", false
+	}
+	first, err1 := strconv.ParseInt(from, 10, 64)
+	last, err2 := strconv.ParseInt(to, 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < first {
+		return 0, 0, "", false
+	}
+	return first, last, total, true
+}
+
+// serveGuarded proxies to b and takes over if b fails mid-response
+func (s *ServerPool) serveGuarded(w http.ResponseWriter, r *http.Request, b *Backend) {
+	r, done := activeRequests.track(r, s.Name, b)
+	defer done()
+	g := &streamGuard{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), streamGuardKey{}, g))
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		// a read error after the client left is the client's doing
+		if v != http.ErrAbortHandler || g.body == nil || g.body.err == nil || r.Context().Err() != nil {
+			panic(v)
+		}
+		s.recoverStream(g, r, b)
+	}()
+	b.ServeHTTP(g, r)
+}
+
+func (s *ServerPool) recoverStream(g *streamGuard, r *http.Request, failed *Backend) {
+	midstreamFailures.Add(1)
+	log.Printf("%s(%s) %s failed after %d bytes: %v\n", r.RemoteAddr, r.URL.Path, failed.Name(), g.written, g.body.err)
+
+	// each attempt picks up where the previous one stopped
+	for attempt := 0; g.resumable && attempt < MAX_RETRIES; attempt++ {
+		next, err := s.resume(g, r, failed)
+		if err == nil {
+			midstreamResumed.Add(1)
+			return
+		}
+		log.Printf("%s(%s) Could not resume at byte %d: %v\n", r.RemoteAddr, r.URL.Path, g.first+g.written, err)
+		if next == nil || errors.Is(err, errClientGone) {
+			break
+		}
+		failed = next
+	}
+	if g.trailer {
+		// ending the chunked body normally, with the trailer saying it is cut short
+		g.Header().Set(streamErrorTrailer, fmt.Sprintf("upstream failed after %d bytes", g.written))
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+var (
+	errResumeMismatch = errors.New("backend did not return the requested range of the same content")
+	errClientGone     = errors.New("client went away")
+)
+
+// resume asks another backend for the rest of the body and copies it to the
+// client, returning the backend it asked
+func (s *ServerPool) resume(g *streamGuard, r *http.Request, failed *Backend) (*Backend, error) {
+	next := s.awayFrom(failed)
+	if next == nil {
+		return nil, errors.New("no other live backend")
+	}
+	from := g.first + g.written
+	out := r.Clone(r.Context())
+	out.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, g.last))
+	out.Header.Set("If-Range", g.validator)
+	for _, h := range []string{"Connection", "Keep-Alive", "Upgrade", "Te", "Proxy-Connection"} {
+		out.Header.Del(h)
+	}
+	t := next.target.Load()
+	t.proxy.Director(out)
+	out.RequestURI = ""
+
+	res, err := t.transport.RoundTrip(out)
+	if err != nil {
+		return next, err
+	}
+	defer res.Body.Close()
+	want := fmt.Sprintf("bytes %d-%d/%s", from, g.last, g.total)
+	if res.StatusCode != http.StatusPartialContent || res.Header.Get("Content-Range") != want ||
+		res.Header.Get(g.validateBy) != g.validator {
+		return next, errResumeMismatch
+	}
+	log.Printf("%s(%s) Resuming at byte %d from %s\n", r.RemoteAddr, r.URL.Path, from, next.Name())
+	body := &watchedBody{ReadCloser: res.Body}
+	if _, err := io.Copy(g, body); err != nil {
+		if body.err == nil {
+			return next, errClientGone
+		}
+		return next, err
+	}
+	if g.first+g.written != g.last+1 {
+		return next, io.ErrUnexpectedEOF
+	}
+	return next, nil
+}
@@ -0,0 +1,193 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Mirror copies a sample of a route's requests to a shadow pool and throws
+// the shadow responses away. a request is mirrored when its method is listed
+// (any if none are), it carries the opt-in Header if one is set, and it wins
+// the Percent draw. at most MaxConcurrent mirrored requests run at once;
+// beyond that, and for bodies over MaxBody, requests aren't mirrored, so the
+// shadow pool can never hold up production traffic
+type Mirror struct {
+	Pool          string   `json:"pool" yaml:"pool"`
+	Percent       float64  `json:"percent" yaml:"percent"`
+	Methods       []string `json:"methods,omitempty" yaml:"methods"`
+	Header        string   `json:"header,omitempty" yaml:"header"`
+	MaxConcurrent int      `json:"max_concurrent,omitempty" yaml:"max_concurrent"`
+	MaxBody       int64    `json:"max_body,omitempty" yaml:"max_body"`
+
+	pool     *ServerPool
+	slots    chan struct{}
+	mirrored atomic.Uint64
+	skipped  atomic.Uint64
+}
+
+const mirrorTimeout = 30 * time.Second
+
+// -mirror-backends shadows all traffic, not only a route's: the backends
+// make up a pool named "shadow" (health checked like any other, and usable
+// as a route's mirror pool too) and -mirror-percent of requests are copied
+// to it, on the same terms as a route's mirror
+var (
+	mirrorBackends string
+	mirrorPercent  = 100.0
+	trafficMirror  *Mirror
+)
+
+// newTrafficMirror builds the shadow pool from a -backends style list
+func newTrafficMirror(list string, percent float64) (*Mirror, error) {
+	if percent <= 0 || percent > 100 {
+		return nil, fmt.Errorf("-mirror-percent must be in (0, 100]")
+	}
+	if findPool("shadow") != nil {
+		return nil, fmt.Errorf("-mirror-backends: pool name shadow already in use")
+	}
+	p := &ServerPool{Name: "shadow", Strategy: serverPool.Strategy}
+	for _, tok := range strings.Split(list, ",") {
+		bc, err := backendConfigFromSpec(tok)
+		if err != nil {
+			return nil, err
+		}
+		if isDiscoveryURL(bc.URL) {
+			if _, err := p.Discover(bc); err != nil {
+				return nil, err
+			}
+			log.Printf("[shadow] Discovering backends from %s\n", bc.URL)
+			continue
+		}
+		b, err := p.AddBackendConfig(bc)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[shadow] Configured backend: %s\n", b.URL())
+	}
+	pools = append(pools, p)
+	m := &Mirror{Pool: p.Name, Percent: percent}
+	if err := m.init("-mirror-backends"); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WithMirror copies a sample of every request to m's pool before passing it
+// on. it sits inside WithAdmission, so only requests their route and pool
+// let in are copied
+func WithMirror(m *Mirror, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !featureOff(r, "mirror") {
+			m.send(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *Mirror) init(route string) error {
+	if m.pool = findPool(m.Pool); m.pool == nil {
+		return fmt.Errorf("route %s: unknown mirror pool %q", route, m.Pool)
+	}
+	if m.Percent <= 0 || m.Percent > 100 {
+		return fmt.Errorf("route %s: mirror percent must be in (0, 100]", route)
+	}
+	if m.MaxConcurrent <= 0 {
+		m.MaxConcurrent = 16
+	}
+	if m.MaxBody <= 0 {
+		m.MaxBody = 1 << 20
+	}
+	for i, method := range m.Methods {
+		m.Methods[i] = strings.ToUpper(method)
+	}
+	m.slots = make(chan struct{}, m.MaxConcurrent)
+	return nil
+}
+
+func (m *Mirror) wants(r *http.Request) bool {
+	if len(m.Methods) > 0 && !contains(m.Methods, r.Method) {
+		return false
+	}
+	if m.Header != "" && r.Header.Get(m.Header) == "" {
+		return false
+	}
+	return rand.Float64()*100 < m.Percent
+}
+
+// send mirrors r if it is sampled, leaving r's body intact for the real
+// backend
+func (m *Mirror) send(r *http.Request) {
+	if !m.wants(r) {
+		return
+	}
+	if r.ContentLength > m.MaxBody {
+		m.skipped.Add(1)
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.skipped.Add(1)
+		return
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, m.MaxBody+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || int64(len(body)) > m.MaxBody {
+			<-m.slots
+			m.skipped.Add(1)
+			return
+		}
+	}
+
+	// a fresh context: the shadow must outlive the client's request and stay
+	// out of its access log entry and retry state
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	shadow := r.Clone(ctx)
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.Header.Set("X-Mirrored", "1")
+	m.mirrored.Add(1)
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+		w := &discardWriter{header: http.Header{}}
+		m.pool.ServeHTTP(w, shadow)
+		if w.status >= 500 {
+			log.Printf("Mirror %s(%s) answered %d\n", m.Pool, shadow.URL.Path, w.status)
+		}
+	}()
+}
+
+// lists every route's mirror counters. the -mirror-backends one has no route
+func getMirrors(w http.ResponseWriter, r *http.Request) {
+	type mirrorStats struct {
+		Route    string `json:"route,omitempty"`
+		Pool     string `json:"pool"`
+		Mirrored uint64 `json:"mirrored"`
+		Skipped  uint64 `json:"skipped"`
+		InFlight int    `json:"in_flight"`
+	}
+	stats := []mirrorStats{}
+	if m := trafficMirror; m != nil {
+		stats = append(stats, mirrorStats{"", m.Pool, m.mirrored.Load(), m.skipped.Load(), len(m.slots)})
+	}
+	if router != nil {
+		for _, rt := range router.Routes {
+			if m := rt.Mirror; m != nil {
+				stats = append(stats, mirrorStats{rt.Name, m.Pool, m.mirrored.Load(), m.skipped.Load(), len(m.slots)})
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,597 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OpenAPIValidation checks a route's requests against an OpenAPI 3 spec
+// (YAML or JSON) before they reach a backend: the path and method must be
+// in the spec, parameters must be present when required and fit their
+// schema, and the body must have an allowed content type and, with
+// ValidateBody, match its JSON schema. the supported schema keywords are
+// type, enum, minimum, maximum, minLength, maxLength, pattern, items,
+// properties and required, with local $refs. e.g. in -routes
+//
+//	{"path_prefix": "/api/", "pool": "default",
+//	 "openapi": {"spec": "api.yaml", "base_path": "/api", "validate_body": true}}
+type OpenAPIValidation struct {
+	Spec         string `json:"spec" yaml:"spec"`
+	BasePath     string `json:"base_path,omitempty" yaml:"base_path"` // defaults to the path of the spec's first server
+	ValidateBody bool   `json:"validate_body,omitempty" yaml:"validate_body"`
+	MaxBody      int64  `json:"max_body,omitempty" yaml:"max_body"`       // largest body validated, 1MB by default
+	ReportOnly   bool   `json:"report_only,omitempty" yaml:"report_only"` // log and count failures but let requests through
+
+	route string
+	doc   *apiDocument
+	paths []*apiPath
+
+	mux      sync.Mutex
+	failures map[string]uint64 // by reason
+}
+
+type apiDocument struct {
+	Servers []struct {
+		URL string `yaml:"url"`
+	} `yaml:"servers"`
+	Paths      map[string]*apiPathItem `yaml:"paths"`
+	Components struct {
+		Schemas       map[string]*apiSchema      `yaml:"schemas"`
+		Parameters    map[string]*apiParameter   `yaml:"parameters"`
+		RequestBodies map[string]*apiRequestBody `yaml:"requestBodies"`
+	} `yaml:"components"`
+}
+
+type apiPathItem struct {
+	Parameters []*apiParameter `yaml:"parameters"`
+	Get        *apiOperation   `yaml:"get"`
+	Put        *apiOperation   `yaml:"put"`
+	Post       *apiOperation   `yaml:"post"`
+	Delete     *apiOperation   `yaml:"delete"`
+	Options    *apiOperation   `yaml:"options"`
+	Head       *apiOperation   `yaml:"head"`
+	Patch      *apiOperation   `yaml:"patch"`
+	Trace      *apiOperation   `yaml:"trace"`
+}
+
+func (pi *apiPathItem) operation(method string) *apiOperation {
+	switch method {
+	case http.MethodGet:
+		return pi.Get
+	case http.MethodPut:
+		return pi.Put
+	case http.MethodPost:
+		return pi.Post
+	case http.MethodDelete:
+		return pi.Delete
+	case http.MethodOptions:
+		return pi.Options
+	case http.MethodHead:
+		if pi.Head == nil {
+			return pi.Get
+		}
+		return pi.Head
+	case http.MethodPatch:
+		return pi.Patch
+	case http.MethodTrace:
+		return pi.Trace
+	}
+	return nil
+}
+
+type apiOperation struct {
+	Parameters  []*apiParameter `yaml:"parameters"`
+	RequestBody *apiRequestBody `yaml:"requestBody"`
+}
+
+type apiParameter struct {
+	Ref      string     `yaml:"$ref"`
+	Name     string     `yaml:"name"`
+	In       string     `yaml:"in"`
+	Required bool       `yaml:"required"`
+	Schema   *apiSchema `yaml:"schema"`
+}
+
+type apiRequestBody struct {
+	Ref      string `yaml:"$ref"`
+	Required bool   `yaml:"required"`
+	Content  map[string]struct {
+		Schema *apiSchema `yaml:"schema"`
+	} `yaml:"content"`
+}
+
+type apiSchema struct {
+	Ref        string                `yaml:"$ref"`
+	Type       string                `yaml:"type"`
+	Nullable   bool                  `yaml:"nullable"`
+	Enum       []any                 `yaml:"enum"`
+	Minimum    *float64              `yaml:"minimum"`
+	Maximum    *float64              `yaml:"maximum"`
+	MinLength  *int                  `yaml:"minLength"`
+	MaxLength  *int                  `yaml:"maxLength"`
+	Pattern    string                `yaml:"pattern"`
+	Items      *apiSchema            `yaml:"items"`
+	Properties map[string]*apiSchema `yaml:"properties"`
+	Required   []string              `yaml:"required"`
+
+	re *regexp.Regexp
+}
+
+// apiPath is a path template split into segments, "{id}" ones matching any
+// value
+type apiPath struct {
+	template string
+	segments []string
+	literals int
+	item     *apiPathItem
+}
+
+func (p *apiPath) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(p.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, seg := range p.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[seg[1:len(seg)-1]] = segments[i]
+			continue
+		}
+		if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// init loads the spec for route
+func (v *OpenAPIValidation) init(route string) error {
+	data, err := os.ReadFile(v.Spec)
+	if err != nil {
+		return fmt.Errorf("route %s: %w", route, err)
+	}
+	var doc apiDocument
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("route %s: %s: %w", route, v.Spec, err)
+	}
+	if len(doc.Paths) == 0 {
+		return fmt.Errorf("route %s: %s has no paths", route, v.Spec)
+	}
+	v.route, v.doc, v.failures = route, &doc, map[string]uint64{}
+	if v.MaxBody == 0 {
+		v.MaxBody = 1 << 20
+	}
+	if v.BasePath == "" && len(doc.Servers) > 0 {
+		if u, err := url.Parse(doc.Servers[0].URL); err == nil {
+			v.BasePath = u.Path
+		}
+	}
+	v.BasePath = strings.TrimSuffix(v.BasePath, "/")
+
+	for template, item := range doc.Paths {
+		if item == nil {
+			continue
+		}
+		p := &apiPath{template: template, segments: strings.Split(strings.Trim(template, "/"), "/"), item: item}
+		for _, seg := range p.segments {
+			if !strings.HasPrefix(seg, "{") {
+				p.literals++
+			}
+		}
+		v.paths = append(v.paths, p)
+	}
+	// concrete paths win over templated ones, e.g. /users/me over /users/{id}
+	sort.Slice(v.paths, func(i, j int) bool {
+		if v.paths[i].literals != v.paths[j].literals {
+			return v.paths[i].literals > v.paths[j].literals
+		}
+		return v.paths[i].template < v.paths[j].template
+	})
+	return v.compilePatterns()
+}
+
+func (v *OpenAPIValidation) compilePatterns() error {
+	var walk func(s *apiSchema, depth int) error
+	walk = func(s *apiSchema, depth int) error {
+		if s == nil || depth > 32 {
+			return nil
+		}
+		if s.Pattern != "" && s.re == nil {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return fmt.Errorf("route %s: %s: pattern %q: %w", v.route, v.Spec, s.Pattern, err)
+			}
+			s.re = re
+		}
+		if err := walk(s.Items, depth+1); err != nil {
+			return err
+		}
+		for _, p := range s.Properties {
+			if err := walk(p, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, s := range v.doc.Components.Schemas {
+		if err := walk(s, 0); err != nil {
+			return err
+		}
+	}
+	for _, p := range v.doc.Components.Parameters {
+		if err := walk(p.Schema, 0); err != nil {
+			return err
+		}
+	}
+	for _, item := range v.doc.Paths {
+		if item == nil {
+			continue
+		}
+		params := item.Parameters
+		var bodies []*apiRequestBody
+		for _, op := range []*apiOperation{item.Get, item.Put, item.Post, item.Delete, item.Options, item.Head, item.Patch, item.Trace} {
+			if op != nil {
+				params = append(params, op.Parameters...)
+				bodies = append(bodies, op.RequestBody)
+			}
+		}
+		for _, p := range params {
+			if err := walk(p.Schema, 0); err != nil {
+				return err
+			}
+		}
+		for _, body := range append(bodies, mapValues(v.doc.Components.RequestBodies)...) {
+			if body == nil {
+				continue
+			}
+			for _, c := range body.Content {
+				if err := walk(c.Schema, 0); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func mapValues[K comparable, V any](m map[K]V) []V {
+	values := make([]V, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// local refs only, e.g. #/components/schemas/User
+func (v *OpenAPIValidation) schema(s *apiSchema) *apiSchema {
+	for i := 0; s != nil && s.Ref != "" && i < 8; i++ {
+		s = v.doc.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+func (v *OpenAPIValidation) parameter(p *apiParameter) *apiParameter {
+	if p != nil && p.Ref != "" {
+		return v.doc.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	}
+	return p
+}
+
+func (v *OpenAPIValidation) requestBody(b *apiRequestBody) *apiRequestBody {
+	if b != nil && b.Ref != "" {
+		return v.doc.Components.RequestBodies[strings.TrimPrefix(b.Ref, "#/components/requestBodies/")]
+	}
+	return b
+}
+
+// apiViolation is why a request doesn't match the spec
+type apiViolation struct {
+	status int
+	reason string // for metrics: unknown_path, method_not_allowed, invalid_parameter, invalid_body
+	msg    string
+}
+
+func (e *apiViolation) Error() string {
+	return e.msg
+}
+
+func violation(status int, reason, format string, args ...any) *apiViolation {
+	return &apiViolation{status: status, reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+// Check validates r, buffering its body if that needs checking
+func (v *OpenAPIValidation) Check(r *http.Request) *apiViolation {
+	p := r.URL.Path
+	if v.BasePath != "" {
+		rest, ok := strings.CutPrefix(p, v.BasePath)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			return violation(http.StatusNotFound, "unknown_path", "Path %s is not part of the API.", p)
+		}
+		p = rest
+	}
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+
+	var path *apiPath
+	var pathParams map[string]string
+	for _, candidate := range v.paths {
+		if params, ok := candidate.match(segments); ok {
+			path, pathParams = candidate, params
+			break
+		}
+	}
+	if path == nil {
+		return violation(http.StatusNotFound, "unknown_path", "Path %s is not part of the API.", p)
+	}
+	op := path.item.operation(r.Method)
+	if op == nil {
+		return violation(http.StatusMethodNotAllowed, "method_not_allowed", "%s is not allowed on %s.", r.Method, path.template)
+	}
+
+	// operation parameters override path-level ones of the same name and location
+	params := map[string]*apiParameter{}
+	for _, list := range [][]*apiParameter{path.item.Parameters, op.Parameters} {
+		for _, p := range list {
+			if p = v.parameter(p); p != nil {
+				params[p.In+":"+p.Name] = p
+			}
+		}
+	}
+	query := r.URL.Query()
+	for _, param := range params {
+		var values []string
+		switch param.In {
+		case "path":
+			if pv, ok := pathParams[param.Name]; ok {
+				values = []string{pv}
+			}
+		case "query":
+			values = query[param.Name]
+		case "header":
+			values = r.Header.Values(param.Name)
+		case "cookie":
+			if c, err := r.Cookie(param.Name); err == nil {
+				values = []string{c.Value}
+			}
+		}
+		if len(values) == 0 {
+			if param.Required || param.In == "path" {
+				return violation(http.StatusBadRequest, "invalid_parameter", "Missing %s parameter %s.", param.In, param.Name)
+			}
+			continue
+		}
+		if err := v.checkParam(param, values); err != nil {
+			return violation(http.StatusBadRequest, "invalid_parameter", "Invalid %s parameter %s: %v.", param.In, param.Name, err)
+		}
+	}
+	return v.checkBody(r, v.requestBody(op.RequestBody))
+}
+
+// checkParam converts the raw values to the schema's type and checks them
+func (v *OpenAPIValidation) checkParam(param *apiParameter, values []string) error {
+	s := v.schema(param.Schema)
+	if s == nil {
+		return nil
+	}
+	if s.Type == "array" {
+		if param.In != "query" && len(values) == 1 {
+			values = strings.Split(values[0], ",")
+		}
+		items := make([]any, len(values))
+		for i, raw := range values {
+			items[i] = v.convert(v.schema(s.Items), raw)
+		}
+		return v.checkValue(s, items, 0)
+	}
+	return v.checkValue(s, v.convert(s, values[0]), 0)
+}
+
+// convert reads a raw parameter as the schema's type, leaving it a string
+// when it doesn't parse so the type check reports it
+func (v *OpenAPIValidation) convert(s *apiSchema, raw string) any {
+	if s == nil {
+		return raw
+	}
+	switch s.Type {
+	case "integer", "number":
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+	return raw
+}
+
+func (v *OpenAPIValidation) checkBody(r *http.Request, body *apiRequestBody) *apiViolation {
+	empty := r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody
+	if body == nil {
+		return nil
+	}
+	if empty {
+		if body.Required {
+			return violation(http.StatusBadRequest, "invalid_body", "A request body is required.")
+		}
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return violation(http.StatusUnsupportedMediaType, "invalid_body", "Missing or malformed Content-Type.")
+	}
+	var schema *apiSchema
+	found := false
+	for ct, c := range body.Content {
+		if ct == mediaType || ct == "*/*" || (strings.HasSuffix(ct, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(ct, "*"))) {
+			schema, found = v.schema(c.Schema), true
+			if ct == mediaType {
+				break
+			}
+		}
+	}
+	if !found {
+		return violation(http.StatusUnsupportedMediaType, "invalid_body", "Content-Type %s is not accepted here.", mediaType)
+	}
+	if !v.ValidateBody || schema == nil || !(mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, v.MaxBody+1))
+	if err != nil {
+		return violation(http.StatusBadRequest, "invalid_body", "Could not read the request body.")
+	}
+	// whatever was read still has to reach the backend
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	if int64(len(data)) > v.MaxBody {
+		return nil // too big to check here
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return violation(http.StatusBadRequest, "invalid_body", "Body is not valid JSON: %v.", err)
+	}
+	if err := v.checkValue(schema, doc, 0); err != nil {
+		return violation(http.StatusBadRequest, "invalid_body", "Invalid body: %v.", err)
+	}
+	return nil
+}
+
+var errTooDeep = errors.New("nested too deeply")
+
+// checkValue validates a decoded JSON (or converted parameter) value
+func (v *OpenAPIValidation) checkValue(s *apiSchema, value any, depth int) error {
+	if s = v.schema(s); s == nil {
+		return nil
+	}
+	if depth > 32 {
+		return errTooDeep
+	}
+	if value == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return fmt.Errorf("must not be null")
+	}
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, e := range s.Enum {
+			ok = ok || fmt.Sprint(e) == fmt.Sprint(value)
+		}
+		if !ok {
+			return fmt.Errorf("%v is not one of %v", value, s.Enum)
+		}
+	}
+
+	switch x := value.(type) {
+	case string:
+		if s.Type != "" && s.Type != "string" {
+			return fmt.Errorf("%q is not %s", x, article(s.Type))
+		}
+		n := len([]rune(x))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("shorter than %d", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("longer than %d", *s.MaxLength)
+		}
+		if s.re != nil && !s.re.MatchString(x) {
+			return fmt.Errorf("%q doesn't match %s", x, s.Pattern)
+		}
+	case float64:
+		if s.Type != "" && s.Type != "number" && s.Type != "integer" {
+			return fmt.Errorf("%v is not %s", x, article(s.Type))
+		}
+		if s.Type == "integer" && x != math.Trunc(x) {
+			return fmt.Errorf("%v is not an integer", x)
+		}
+		if s.Minimum != nil && x < *s.Minimum {
+			return fmt.Errorf("%v is below %v", x, *s.Minimum)
+		}
+		if s.Maximum != nil && x > *s.Maximum {
+			return fmt.Errorf("%v is above %v", x, *s.Maximum)
+		}
+	case bool:
+		if s.Type != "" && s.Type != "boolean" {
+			return fmt.Errorf("%v is not %s", x, article(s.Type))
+		}
+	case []any:
+		if s.Type != "" && s.Type != "array" {
+			return fmt.Errorf("an array is not %s", article(s.Type))
+		}
+		for i, item := range x {
+			if err := v.checkValue(s.Items, item, depth+1); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+	case map[string]any:
+		if s.Type != "" && s.Type != "object" {
+			return fmt.Errorf("an object is not %s", article(s.Type))
+		}
+		for _, name := range s.Required {
+			if _, ok := x[name]; !ok {
+				return fmt.Errorf("missing property %s", name)
+			}
+		}
+		for name, ps := range s.Properties {
+			if pv, ok := x[name]; ok {
+				if err := v.checkValue(ps, pv, depth+1); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func article(typ string) string {
+	if strings.ContainsRune("aeiou", rune(typ[0])) {
+		return "an " + typ
+	}
+	return "a " + typ
+}
+
+// validate answers the request itself when it fails the check, returning
+// false; in report-only mode failures are only logged and counted
+func (v *OpenAPIValidation) validate(w http.ResponseWriter, r *http.Request) bool {
+	bad := v.Check(r)
+	if bad == nil {
+		return true
+	}
+	v.mux.Lock()
+	v.failures[bad.reason]++
+	v.mux.Unlock()
+	if v.ReportOnly {
+		log.Printf("%s(%s) Would reject for route %s: %s\n", r.RemoteAddr, r.URL.Path, v.route, bad.msg)
+		return true
+	}
+	writeError(w, r, bad.status, bad.reason, bad.msg, 0)
+	return false
+}
+
+// Failures counts rejected requests by reason
+func (v *OpenAPIValidation) Failures() map[string]uint64 {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	counts := make(map[string]uint64, len(v.failures))
+	for reason, n := range v.failures {
+		counts[reason] = n
+	}
+	return counts
+}
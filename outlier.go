@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierDetection ejects backends on live traffic: Consecutive 5xx
+// responses or transport errors within Window take a backend out of
+// rotation for Ejection, after which its share of traffic ramps back up
+// over RampUp. it reacts within requests rather than health check intervals
+type OutlierDetection struct {
+	Consecutive int // 0 disables detection
+	Window      time.Duration
+	Ejection    time.Duration
+	RampUp      time.Duration
+}
+
+var outliers = OutlierDetection{Window: 10 * time.Second, Ejection: 30 * time.Second, RampUp: 30 * time.Second}
+
+// outlierState is a backend's run of failures and its ejection
+type outlierState struct {
+	mux          sync.Mutex
+	failures     int
+	firstFailure time.Time
+	ejectedUntil atomic.Int64 // unix ns, read on every pick
+}
+
+// observeOutcome counts a response (or transport error) from b and ejects b
+// once it has failed too often. the last live backend is never ejected
+func (s *ServerPool) observeOutcome(b *Backend, failed bool) {
+	if outliers.Consecutive <= 0 {
+		return
+	}
+	o := &b.outlier
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if !failed {
+		o.failures = 0
+		return
+	}
+
+	now := time.Now()
+	if o.failures == 0 || now.Sub(o.firstFailure) > outliers.Window {
+		o.failures, o.firstFailure = 0, now
+	}
+	o.failures++
+	if o.failures < outliers.Consecutive || b.Ejected() {
+		return
+	}
+	o.failures = 0
+	if !s.othersAlive(b) {
+		log.Printf("[%s] Backend %s is an outlier but the only live backend, keeping it\n", s.Name, b.Name())
+		return
+	}
+	o.ejectedUntil.Store(now.Add(outliers.Ejection).UnixNano())
+	log.Printf("[%s] Backend %s ejected for %s after %d consecutive failures\n",
+		s.Name, b.Name(), outliers.Ejection, outliers.Consecutive)
+}
+
+func (s *ServerPool) othersAlive(b *Backend) bool {
+	for _, o := range s.Backends() {
+		if o != b && o.IsAlive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Ejected reports whether the backend is sitting out an ejection
+func (b *Backend) Ejected() bool {
+	until := b.outlier.ejectedUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// slowStart ramps up the share of a backend that health checks bring back
+// up over this long, as for one back from ejection, so a cold backend (e.g.
+// a JVM still compiling) isn't handed its full share at once (-slow-start,
+// 0 off)
+var slowStart time.Duration
+
+// admit decides whether a backend just back from ejection or recovering
+// from being down takes this request: the chance grows linearly over the
+// ramp-up, drawn from the pool's generator
+func (b *Backend) admit(s *ServerPool) bool {
+	share := b.rampShare()
+	return share >= 1 || s.random() < share
+}
+
+// rampShare is the part of its traffic a backend takes now, 1 once it is
+// past any ramp-up
+func (b *Backend) rampShare() float64 {
+	return min(ramp(b.outlier.ejectedUntil.Load(), outliers.RampUp), ramp(b.upSince.Load(), slowStart))
+}
+
+// ramp is how far along a ramp-up started at unix ns from is
+func ramp(from int64, over time.Duration) float64 {
+	if from == 0 || over <= 0 {
+		return 1
+	}
+	since := time.Since(time.Unix(0, from))
+	if since >= over {
+		return 1
+	}
+	return max(float64(since)/float64(over), 0)
+}
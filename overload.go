@@ -0,0 +1,42 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// -max-in-flight caps the requests being served across every pool and
+// listener. past it a request is shed at once with a 503 and a Retry-After
+// of -max-in-flight-retry-after, before any middleware or backend spends
+// time on it, which keeps a surge from queueing up until everything times
+// out. -pool-max-conns caps one pool's requests, and can queue them by lane.
+// upgraded connections, e.g. websockets, aren't counted, as they hold on for
+// as long as they stay open
+var (
+	maxInFlight           int64
+	maxInFlightRetryAfter = time.Second
+)
+
+var (
+	inFlight     atomic.Int64
+	overloadShed atomic.Uint64
+)
+
+// WithMaxInFlight sheds requests past -max-in-flight
+func WithMaxInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if inFlight.Add(1) > maxInFlight {
+			inFlight.Add(-1)
+			overloadShed.Add(1)
+			writeError(w, r, http.StatusServiceUnavailable, "overloaded", "Server busy.", maxInFlightRetryAfter)
+			return
+		}
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package loadbalancer
+
+// a pool's backend list is copy on write: readers take a snapshot with
+// Backends and never lock, while changes build a new list and swap it in.
+// balancing, health checks and the admin API can then run while backends
+// are added, removed or replaced by reloads, discovery or the admin API
+
+// Backends is a snapshot of the pool's backends. it is never modified in
+// place, so it stays valid and consistent however the pool changes
+func (s *ServerPool) Backends() []*Backend {
+	if p := s.backends.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// update replaces the backend list with what change makes of the current
+// one. change must not modify the list it is given; changes are serialized
+func (s *ServerPool) update(change func(old []*Backend) []*Backend) {
+	s.editMux.Lock()
+	defer s.editMux.Unlock()
+	next := change(s.Backends())
+	s.backends.Store(&next)
+}
+
+func (s *ServerPool) AddBackend(b *Backend) {
+	s.update(func(old []*Backend) []*Backend {
+		next := make([]*Backend, 0, len(old)+1)
+		return append(append(next, old...), b)
+	})
+}
+
+// RemoveBackend takes b out of rotation and drains it. it reports whether b
+// was in the pool
+func (s *ServerPool) RemoveBackend(b *Backend) bool {
+	return s.ReplaceBackend(b, nil)
+}
+
+// ReplaceBackend puts b in old's place in the rotation, or just removes old
+// when b is nil, and drains old. it reports whether old was in the pool
+func (s *ServerPool) ReplaceBackend(old, b *Backend) bool {
+	found := false
+	s.update(func(backends []*Backend) []*Backend {
+		next := make([]*Backend, 0, len(backends))
+		for _, o := range backends {
+			switch {
+			case o != old:
+				next = append(next, o)
+			case b != nil:
+				next = append(next, b)
+				found = true
+			default:
+				found = true
+			}
+		}
+		return next
+	})
+	if found {
+		go old.target.Load().drain(old.Name())
+	}
+	return found
+}
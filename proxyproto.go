@@ -0,0 +1,328 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// behind an L4 balancer such as a cloud NLB or HAProxy, every connection
+// comes from the balancer. with -proxy-protocol each starts with a PROXY
+// protocol header, v1 (text) or v2 (binary), naming the client, and the
+// client is what connection limits, -client-rate, the logs and
+// X-Forwarded-For see. -proxy-protocol-from, which it needs, lists the
+// addresses and CIDRs of the peers that send one (0.0.0.0/0,::/0 for any);
+// other peers are taken as they are, so clients that reach the port directly
+// can't claim another address. a trusted peer's connection without a
+// header is closed, and a LOCAL header, as health checks send, keeps the
+// peer's address. with -mode tcp, -proxy-protocol-backends v1 or v2 sends
+// backends a header in turn
+var (
+	proxyProtocol         bool
+	proxyProtocolFrom     string
+	proxyProtocolBackends string
+)
+
+// how long a peer has to send its header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyMaxPending is how many connections may be accepted ahead of the
+// server taking them. the rest wait in the kernel's backlog, as they do
+// without -proxy-protocol, so connection limits that queue still hold them
+// there
+const proxyMaxPending = 64
+
+var proxyHeaderFailures atomic.Uint64
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener reads the header of each connection before handing it out.
+// headers are read off the accept path, so a slow peer holds up only its own
+// pending slot
+type proxyListener struct {
+	net.Listener
+	from *IPList // peers that send headers
+
+	conns   chan net.Conn
+	errs    chan error
+	pending chan struct{} // a slot per connection accepted and not handed out yet
+	once    sync.Once
+	closed  chan struct{}
+}
+
+// withProxyProtocol wraps l if -proxy-protocol is set
+func withProxyProtocol(l net.Listener) (net.Listener, error) {
+	if !proxyProtocol {
+		return l, nil
+	}
+	if proxyProtocolFrom == "" {
+		return nil, errors.New("-proxy-protocol needs -proxy-protocol-from, the peers that send headers (0.0.0.0/0,::/0 for any)")
+	}
+	from, err := staticIPList("-proxy-protocol-from", strings.Split(proxyProtocolFrom, ","))
+	if err != nil {
+		return nil, fmt.Errorf("-proxy-protocol-from: %w", err)
+	}
+	pl := &proxyListener{
+		Listener: l,
+		from:     from,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		pending:  make(chan struct{}, proxyMaxPending),
+		closed:   make(chan struct{}),
+	}
+	go pl.accept()
+	return pl, nil
+}
+
+func (pl *proxyListener) accept() {
+	for {
+		select {
+		case pl.pending <- struct{}{}:
+		case <-pl.closed:
+			return
+		}
+		c, err := pl.Listener.Accept()
+		if err != nil {
+			<-pl.pending
+			select {
+			case pl.errs <- err:
+			case <-pl.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go pl.handshake(c)
+	}
+}
+
+func (pl *proxyListener) handshake(c net.Conn) {
+	if ap, err := netip.ParseAddrPort(c.RemoteAddr().String()); err != nil || !pl.from.Contains(net.IP(ap.Addr().Unmap().AsSlice())) {
+		pl.hand(c)
+		return
+	}
+	_ = c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	br := bufio.NewReader(c)
+	src, dst, err := readProxyHeader(br)
+	if err != nil {
+		proxyHeaderFailures.Add(1)
+		log.Printf("PROXY protocol from %s: %v, closing\n", c.RemoteAddr(), err)
+		_ = c.Close()
+		<-pl.pending
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	pl.hand(&proxiedConn{Conn: c, br: br, remote: src, local: dst})
+}
+
+func (pl *proxyListener) hand(c net.Conn) {
+	select {
+	case pl.conns <- c:
+	case <-pl.closed:
+		_ = c.Close()
+	}
+	<-pl.pending
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-pl.conns:
+		return c, nil
+	case err := <-pl.errs:
+		return nil, err
+	case <-pl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *proxyListener) Close() error {
+	err := net.ErrClosed
+	pl.once.Do(func() {
+		close(pl.closed)
+		err = pl.Listener.Close()
+	})
+	return err
+}
+
+// proxiedConn is a connection with the addresses from its header
+type proxiedConn struct {
+	net.Conn
+	br            *bufio.Reader // holds what came after the header, until drained
+	remote, local net.Addr      // nil keeps the connection's own
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(p)
+		}
+		c.br = nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// readProxyHeader reads a v1 or v2 header and returns the addresses it
+// names, nil for LOCAL, UNKNOWN and families other than TCP over IPv4/6
+func readProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	start, err := br.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(br)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(br)
+	case err != nil:
+		return nil, nil, err
+	}
+	return nil, nil, errors.New("no PROXY protocol header")
+}
+
+// v1 is one line of at most 107 bytes:
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("bad v1 header")
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, nil, fmt.Errorf("bad v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, err1 := parseProxyAddr(f[2], f[4])
+	dst, err2 := parseProxyAddr(f[3], f[5])
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, nil, fmt.Errorf("bad v1 header: %w", err)
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// v2 is the signature, version and command, family, length and addresses,
+// maybe followed by TLVs, which are skipped
+func readProxyV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unknown v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+	switch cmd := hdr[12] & 0xf; {
+	case cmd == 0: // LOCAL
+		return nil, nil, nil
+	case cmd != 1:
+		return nil, nil, fmt.Errorf("unknown v2 command %d", cmd)
+	}
+	var size int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		size = 4
+	case 0x21: // TCP over IPv6
+		size = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("short v2 address block")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	ports := body[2*size:]
+	src := net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(ports)))
+	dst := net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(ports[2:])))
+	return src, dst, nil
+}
+
+// writeProxyHeader sends src and dst to w in the given version ahead of
+// anything else. addresses of different families, or not IP at all, go as
+// UNKNOWN
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	s, err1 := netip.ParseAddrPort(src.String())
+	d, err2 := netip.ParseAddrPort(dst.String())
+	s = netip.AddrPortFrom(s.Addr().Unmap(), s.Port())
+	d = netip.AddrPortFrom(d.Addr().Unmap(), d.Port())
+	known := err1 == nil && err2 == nil && s.Addr().Is4() == d.Addr().Is4()
+
+	if version == "v1" {
+		line := "PROXY UNKNOWN\r\n"
+		if known {
+			proto := "TCP4"
+			if s.Addr().Is6() {
+				proto = "TCP6"
+			}
+			line = fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, s.Addr(), d.Addr(), s.Port(), d.Port())
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	}
+
+	buf := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		// PROXY with an unspecified family: the receiver keeps our address
+		buf = append(buf, 0x21, 0x00, 0, 0)
+		_, err := w.Write(buf)
+		return err
+	}
+	fam := byte(0x11)
+	if s.Addr().Is6() {
+		fam = 0x21
+	}
+	sa, da := s.Addr().AsSlice(), d.Addr().AsSlice()
+	buf = append(buf, 0x21, fam)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(2*len(sa)+4))
+	buf = append(buf, sa...)
+	buf = append(buf, da...)
+	buf = binary.BigEndian.AppendUint16(buf, s.Port())
+	buf = binary.BigEndian.AppendUint16(buf, d.Port())
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,239 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientRateLimit gives every client IP a token bucket of Rate requests per
+// second with bursts of Burst, and answers 429 once it runs dry. behind
+// trusted proxies (-trust-forwarded) the client is taken from
+// X-Forwarded-For, walking back past the -trusted-proxies, or one hop
+// without them; IPv6 clients share a bucket per /64, which is what one
+// host can usually pick addresses from.
+//
+// a bucket left idle long enough to fill up is no different from a new one,
+// so idle buckets are dropped; beyond MaxClients the least recently seen
+// client's bucket goes, which keeps memory bounded under scans from many
+// addresses
+type ClientRateLimit struct {
+	Rate       float64
+	Burst      int
+	MaxClients int
+
+	scope   string // the buckets' prefix in -rate-limit-store
+	mux     sync.Mutex
+	clients map[string]*list.Element
+	lru     *list.List // of *clientBucket, most recently seen first
+	limited atomic.Uint64
+	evicted atomic.Uint64
+}
+
+type clientBucket struct {
+	key    string
+	bucket *tokenBucket
+	seen   time.Time
+}
+
+var clientRateLimit = &ClientRateLimit{Burst: 20, MaxClients: 100000, scope: "client"}
+
+func (cl *ClientRateLimit) init() {
+	cl.clients = map[string]*list.Element{}
+	cl.lru = list.New()
+}
+
+// idleAfter is how long a bucket takes to fill up again
+func (cl *ClientRateLimit) idleAfter() time.Duration {
+	burst := max(float64(cl.Burst), cl.Rate)
+	return time.Duration(burst / cl.Rate * float64(time.Second))
+}
+
+// take spends one of key's tokens, or returns how long until there is one
+func (cl *ClientRateLimit) take(key string) time.Duration {
+	if sharedRateLimits != nil {
+		return sharedRateLimits.take(cl.scope+":"+key, cl.Rate, cl.Burst, func() time.Duration { return cl.takeOwn(key) })
+	}
+	return cl.takeOwn(key)
+}
+
+// takeOwn is take on the instance's own buckets
+func (cl *ClientRateLimit) takeOwn(key string) time.Duration {
+	now := time.Now()
+	cl.mux.Lock()
+	var cb *clientBucket
+	if e, ok := cl.clients[key]; ok {
+		cb = e.Value.(*clientBucket)
+		cl.lru.MoveToFront(e)
+	} else {
+		cl.evict(now)
+		cb = &clientBucket{key: key, bucket: newTokenBucket(cl.Rate, cl.Burst)}
+		cl.clients[key] = cl.lru.PushFront(cb)
+	}
+	cb.seen = now
+	cl.mux.Unlock()
+	return cb.bucket.take()
+}
+
+// evict drops idle buckets from the back of the list and, if still full,
+// the least recently seen one. called with mux held
+func (cl *ClientRateLimit) evict(now time.Time) {
+	idle := cl.idleAfter()
+	for e := cl.lru.Back(); e != nil; e = cl.lru.Back() {
+		cb := e.Value.(*clientBucket)
+		if now.Sub(cb.seen) < idle && cl.lru.Len() < cl.MaxClients {
+			return
+		}
+		if now.Sub(cb.seen) < idle {
+			cl.evicted.Add(1)
+		}
+		cl.lru.Remove(e)
+		delete(cl.clients, cb.key)
+	}
+}
+
+// Clients is the number of buckets held
+func (cl *ClientRateLimit) Clients() int {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	return cl.lru.Len()
+}
+
+// Middleware refuses requests from clients over their rate
+func (cl *ClientRateLimit) Middleware(next http.Handler) http.Handler {
+	cl.init()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if featureOff(r, "rate_limit") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait := cl.take(rateLimitKey(requestClientIP(r))); wait > 0 {
+			cl.limited.Add(1)
+			writeError(w, r, http.StatusTooManyRequests, "rate_limited", "Too many requests.", wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func rateLimitKey(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip
+}
+
+// requestClientIP is the address of the client behind any trusted proxies:
+// the peer itself, or the last X-Forwarded-For entry not from a trusted
+// proxy, the last entry of all when every peer is trusted
+func requestClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !forwardedOptions.trustsPeer(r.RemoteAddr) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		// without -trusted-proxies only the peer is known to be a proxy,
+		// and anything left of its hop may be the client's own invention
+		if len(forwardedOptions.TrustedProxies) == 0 || !forwardedOptions.trustsPeer(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// RateLimit caps the requests a pool or a route takes at Rate per second,
+// with bursts of Burst (default Rate), so e.g. an expensive report endpoint
+// can be held tighter than the rest of the API. the cap is shared by every
+// client unless PerClient gives each client IP its own, as -client-rate
+// does. it is written as rate_limit on a pool or route:
+//
+//	"routes": [{"path_prefix": "/reports/", "pool": "default",
+//	            "rate_limit": {"rate": 2, "burst": 5, "per_client": true}}]
+type RateLimit struct {
+	Rate      float64 `json:"rate" yaml:"rate"`
+	Burst     int     `json:"burst,omitempty" yaml:"burst"`
+	PerClient bool    `json:"per_client,omitempty" yaml:"per_client"`
+
+	scope   string // pool:<name> or route:<name>, see SharedRateLimits
+	bucket  *tokenBucket
+	clients *ClientRateLimit
+	limited atomic.Uint64
+}
+
+func (rl *RateLimit) init(scope string) error {
+	if rl.Rate <= 0 {
+		return errors.New("rate_limit.rate must be positive")
+	}
+	if rl.Burst < 0 {
+		return errors.New("rate_limit.burst must not be negative")
+	}
+	rl.scope = scope
+	if rl.PerClient {
+		rl.clients = &ClientRateLimit{Rate: rl.Rate, Burst: rl.Burst, MaxClients: clientRateLimit.MaxClients, scope: scope}
+		rl.clients.init()
+		return nil
+	}
+	rl.bucket = newTokenBucket(rl.Rate, rl.Burst)
+	return nil
+}
+
+// allow takes a token for r, or answers 429 and returns false
+func (rl *RateLimit) allow(w http.ResponseWriter, r *http.Request) bool {
+	var wait time.Duration
+	if rl.clients != nil {
+		wait = rl.clients.take(rateLimitKey(requestClientIP(r)))
+	} else if sharedRateLimits != nil {
+		wait = sharedRateLimits.take(rl.scope, rl.Rate, rl.Burst, rl.bucket.take)
+	} else {
+		wait = rl.bucket.take()
+	}
+	if wait <= 0 {
+		return true
+	}
+	rl.limited.Add(1)
+	writeError(w, r, http.StatusTooManyRequests, "rate_limited", "Too many requests.", wait)
+	return false
+}
+
+// RateLimitStats is a pool's or route's rate limit as the admin API shows it
+type RateLimitStats struct {
+	Scope     string  `json:"scope"` // pool or route
+	Name      string  `json:"name"`
+	Rate      float64 `json:"rate"`
+	Burst     int     `json:"burst,omitempty"`
+	PerClient bool    `json:"per_client,omitempty"`
+	Limited   uint64  `json:"limited"`
+}
+
+// rateLimitStats lists the pools' and routes' rate limits
+func rateLimitStats() []RateLimitStats {
+	stats := []RateLimitStats{}
+	add := func(scope, name string, rl *RateLimit) {
+		if rl != nil {
+			stats = append(stats, RateLimitStats{scope, name, rl.Rate, rl.Burst, rl.PerClient, rl.limited.Load()})
+		}
+	}
+	for _, p := range pools {
+		add("pool", p.Name, p.RateLimit)
+	}
+	if router != nil {
+		for _, rt := range router.Routes {
+			add("route", rt.Name, rt.RateLimit)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,36 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestRequestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, tc := range []struct {
+		name string
+		opts ForwardedOptions
+		peer string
+		xff  []string
+		want string
+	}{
+		{"forwarded headers off", ForwardedOptions{}, "203.0.113.9:5000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"no header", ForwardedOptions{Trust: true}, "10.0.0.1:5000", nil, "10.0.0.1"},
+		// the client writes what it likes left of the peer's own hop
+		{"spoofed leftmost", ForwardedOptions{Trust: true}, "10.0.0.1:5000", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"spoofed in a second header", ForwardedOptions{Trust: true}, "10.0.0.1:5000", []string{"1.2.3.4", "198.51.100.7"}, "198.51.100.7"},
+		{"through trusted proxies", ForwardedOptions{Trust: true, TrustedProxies: []*net.IPNet{proxies}}, "10.0.0.1:5000", []string{"1.2.3.4, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"untrusted peer", ForwardedOptions{Trust: true, TrustedProxies: []*net.IPNet{proxies}}, "203.0.113.9:5000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"garbage hop", ForwardedOptions{Trust: true}, "10.0.0.1:5000", []string{"1.2.3.4, not-an-ip"}, "10.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func(was ForwardedOptions) { forwardedOptions = was }(forwardedOptions)
+			forwardedOptions = tc.opts
+			r := &http.Request{RemoteAddr: tc.peer, Header: http.Header{"X-Forwarded-For": tc.xff}}
+			if got := requestClientIP(r); got != tc.want {
+				t.Errorf("client %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
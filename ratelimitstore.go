@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"load-balancer/redis"
+)
+
+// SharedRateLimits enforces the rate limits, -client-rate and the pools'
+// and routes' rate_limit, across every balancer sharing a redis store
+// (-rate-limit-store) instead of per instance. the token buckets live in
+// redis; each instance leases tokens for -rate-limit-lease at a time and
+// spends them locally, so most requests don't wait on redis. a lease is
+// sized by how fast the instance spent the last one, starting from a single
+// token and never above -rate-limit-lease worth of the rate, so what goes
+// unspent when it runs out stays small. one lease per key is fetched at a
+// time, the requests meanwhile waiting for it. a refusal is remembered
+// locally until redis said a token would be due. while redis can't be
+// reached each instance goes back to its own buckets
+type SharedRateLimits struct {
+	c     *redis.Client
+	lease time.Duration
+
+	mux       sync.Mutex
+	leases    map[string]*rateLease
+	downUntil time.Time // redis failed, own buckets until then
+
+	leased atomic.Uint64 // round trips to redis
+	errors atomic.Uint64
+}
+
+type rateLease struct {
+	tokens      int
+	expires     time.Time // tokens not spent by then are dropped
+	deniedUntil time.Time
+	fetching    chan struct{} // closed once the lease being fetched is in
+
+	spent int       // tokens spent since the last fetch
+	since time.Time // of the last fetch
+}
+
+// size is how many tokens to ask for next: as many as were spent since the
+// last fetch, scaled to a lease's length, between one and most
+func (l *rateLease) size(lease time.Duration, most int, now time.Time) int {
+	elapsed := now.Sub(l.since)
+	if l.spent == 0 || elapsed <= 0 {
+		return 1
+	}
+	want := math.Ceil(float64(l.spent) * float64(lease) / float64(elapsed))
+	return int(min(max(want, 1), float64(most)))
+}
+
+// sharedRateLimits is nil unless -rate-limit-store is set
+var sharedRateLimits *SharedRateLimits
+
+// rateLimitStoreRetry is how long a failing store is left alone
+const rateLimitStoreRetry = time.Second
+
+// rateLimitScript is a token bucket in a hash, refilled by the time passed
+// since the last call on redis's own clock, so instances' clocks don't
+// matter. it grants up to ARGV[3] tokens, or none and the ms until one
+var rateLimitScript = `
+redis.replicate_commands()
+local rate, burst, want = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens, at = tonumber(b[1]) or burst, tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(now - at, 0) * rate)
+local got = math.min(want, math.floor(tokens))
+tokens = tokens - got
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+local wait = 0
+if got == 0 then wait = math.ceil((1 - tokens) / rate * 1000) end
+return {got, wait}
+`
+
+// rateLimitScriptSHA names the script for EVALSHA, so it is only sent
+// when redis doesn't have it yet
+var rateLimitScriptSHA = func() string {
+	sum := sha1.Sum([]byte(rateLimitScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+func NewSharedRateLimits(rawURL string, lease time.Duration) (*SharedRateLimits, error) {
+	c, err := redis.NewClient(rawURL, 200*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	s := &SharedRateLimits{c: c, lease: lease, leases: map[string]*rateLease{}}
+	go s.sweep()
+	return s, nil
+}
+
+// sweep drops leases that ran out, which would otherwise pile up with
+// per-client limits
+func (s *SharedRateLimits) sweep() {
+	for range time.Tick(10 * time.Second) {
+		now := time.Now()
+		s.mux.Lock()
+		for key, l := range s.leases {
+			if now.After(l.expires) && now.After(l.deniedUntil) && l.fetching == nil {
+				delete(s.leases, key)
+			}
+		}
+		s.mux.Unlock()
+	}
+}
+
+// take spends one of key's tokens from the fleet-wide bucket of rate and
+// burst, or returns how long until there is one. own is the instance's own
+// bucket, used while redis is down
+func (s *SharedRateLimits) take(key string, rate float64, burst int, own func() time.Duration) time.Duration {
+	capacity := math.Max(float64(burst), math.Ceil(rate))
+	most := int(min(max(math.Ceil(rate*s.lease.Seconds()), 1), capacity))
+	for {
+		now := time.Now()
+		s.mux.Lock()
+		if now.Before(s.downUntil) {
+			s.mux.Unlock()
+			return own()
+		}
+		l := s.leases[key]
+		if l == nil {
+			l = &rateLease{since: now}
+			s.leases[key] = l
+		}
+		switch {
+		case l.tokens > 0 && now.Before(l.expires):
+			l.tokens--
+			l.spent++
+			s.mux.Unlock()
+			return 0
+		case now.Before(l.deniedUntil):
+			s.mux.Unlock()
+			return l.deniedUntil.Sub(now)
+		case l.fetching != nil:
+			fetching := l.fetching
+			s.mux.Unlock()
+			<-fetching
+			continue
+		}
+		want := l.size(s.lease, most, now)
+		fetched := make(chan struct{})
+		l.fetching = fetched
+		s.mux.Unlock()
+
+		got, wait, err := s.acquire(key, rate, capacity, want)
+		s.mux.Lock()
+		l.fetching = nil
+		close(fetched)
+		if err != nil {
+			if s.errors.Add(1); !now.Before(s.downUntil) {
+				log.Printf("Rate limit store failed, limiting per instance for %s: %v\n", rateLimitStoreRetry, err)
+			}
+			s.downUntil = time.Now().Add(rateLimitStoreRetry)
+			s.mux.Unlock()
+			return own()
+		}
+		if got == 0 {
+			l.deniedUntil = now.Add(wait)
+			s.mux.Unlock()
+			return wait
+		}
+		if !now.Before(l.expires) {
+			l.tokens = 0 // what is left of the last lease has run out
+		}
+		l.tokens += got - 1
+		l.expires = now.Add(s.lease)
+		l.spent, l.since = 1, now
+		s.mux.Unlock()
+		return 0
+	}
+}
+
+// acquire leases up to want tokens from redis
+func (s *SharedRateLimits) acquire(key string, rate, burst float64, want int) (int, time.Duration, error) {
+	s.leased.Add(1)
+	args := []string{"1", "lb:ratelimit:" + key,
+		strconv.FormatFloat(rate, 'g', -1, 64), strconv.FormatFloat(burst, 'g', -1, 64), strconv.Itoa(want)}
+	reply, err := s.c.Do(append([]string{"EVALSHA", rateLimitScriptSHA}, args...)...)
+	var serverErr redis.Error
+	if errors.As(err, &serverErr) && strings.HasPrefix(string(serverErr), "NOSCRIPT") {
+		// EVAL loads it for the next time
+		reply, err = s.c.Do(append([]string{"EVAL", rateLimitScript}, args...)...)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	items, _ := reply.([]any)
+	if len(items) != 2 {
+		return 0, 0, fmt.Errorf("rate limit store: unexpected reply %v", reply)
+	}
+	got, _ := items[0].(int64)
+	wait, _ := items[1].(int64)
+	return int(got), time.Duration(wait) * time.Millisecond, nil
+}
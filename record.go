@@ -0,0 +1,216 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RecordedRequest is one line of a traffic recording (JSON lines)
+type RecordedRequest struct {
+	Time      time.Time   `json:"time"`
+	Method    string      `json:"method"`
+	URI       string      `json:"uri"`
+	Host      string      `json:"host"`
+	Header    http.Header `json:"header"`
+	Class     string      `json:"class,omitempty"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// Recorder samples incoming requests and appends them to a file so they can
+// be replayed later against a pool. credentials (the headers the failure
+// journal redacts) are recorded as "[redacted]" unless Credentials is set.
+type Recorder struct {
+	Sample      float64
+	Bodies      bool
+	MaxBody     int64
+	Credentials bool
+
+	entries chan RecordedRequest
+	dropped atomic.Uint64
+}
+
+func NewRecorder(path string, sample float64, bodies, credentials bool, maxBody int64) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &Recorder{
+		Sample:      sample,
+		Bodies:      bodies,
+		MaxBody:     maxBody,
+		Credentials: credentials,
+		entries:     make(chan RecordedRequest, 1024),
+	}
+	go rec.write(f)
+	return rec, nil
+}
+
+// single writer so request goroutines never block on disk
+func (rec *Recorder) write(f *os.File) {
+	enc := json.NewEncoder(f)
+	for e := range rec.entries {
+		if err := enc.Encode(e); err != nil {
+			log.Println("Recorder write failed: ", err)
+		}
+	}
+}
+
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() < rec.Sample {
+			rec.record(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rec *Recorder) record(r *http.Request) {
+	e := RecordedRequest{
+		Time:   time.Now(),
+		Method: r.Method,
+		URI:    r.URL.RequestURI(),
+		Host:   r.Host,
+		Header: r.Header.Clone(),
+		Class:  GetRequestClass(r),
+	}
+	if !rec.Credentials {
+		for _, h := range journalRedacted() {
+			if _, ok := e.Header[http.CanonicalHeaderKey(h)]; ok {
+				e.Header.Set(h, "[redacted]")
+			}
+		}
+	}
+
+	if rec.Bodies && r.Body != nil && r.Body != http.NoBody {
+		// read at most MaxBody+1 bytes and stitch them back in front of the rest
+		buf, err := io.ReadAll(io.LimitReader(r.Body, rec.MaxBody+1))
+		if err != nil {
+			log.Println("Recorder could not read body: ", err)
+		}
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		if int64(len(buf)) > rec.MaxBody {
+			buf = buf[:rec.MaxBody]
+			e.Truncated = true
+		}
+		e.Body = buf
+	}
+
+	select {
+	case rec.entries <- e:
+	default:
+		if rec.dropped.Add(1)%100 == 1 {
+			log.Println("Recorder falling behind, dropping samples")
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// runReplay implements `loadbalancer replay`: it sends a recording to a target
+// at a fixed rate and reports the resulting status codes
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "Recording to replay")
+	target := fs.String("target", "", "Base URL to send requests to (e.g. http://localhost:3000)")
+	rate := fs.Float64("rate", 10, "Requests per second")
+	concurrency := fs.Int("concurrency", 16, "Maximum requests in flight")
+	keepHost := fs.Bool("keep-host", false, "Send the recorded Host header instead of the target's")
+	_ = fs.Parse(args)
+
+	if *file == "" || *target == "" || *rate <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var (
+		wg       sync.WaitGroup
+		mux      sync.Mutex
+		statuses = map[string]int{}
+		sem      = make(chan struct{}, *concurrency)
+		tick     = time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		start    = time.Now()
+		sent     int
+	)
+	defer tick.Stop()
+
+	dec := json.NewDecoder(f)
+	for {
+		var e RecordedRequest
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("Bad recording entry %d: %v", sent+1, err)
+		}
+
+		<-tick.C
+		sem <- struct{}{}
+		wg.Add(1)
+		sent++
+		go func(e RecordedRequest) {
+			defer func() { <-sem; wg.Done() }()
+			status := replayOne(*target, e, *keepHost)
+			mux.Lock()
+			statuses[status]++
+			mux.Unlock()
+		}(e)
+	}
+	wg.Wait()
+
+	keys := make([]string, 0, len(statuses))
+	for k := range statuses {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Printf("replayed %d requests in %s\n", sent, time.Since(start).Round(time.Millisecond))
+	for _, k := range keys {
+		fmt.Printf("  %-8s %d\n", k, statuses[k])
+	}
+}
+
+func replayOne(target string, e RecordedRequest, keepHost bool) string {
+	req, err := http.NewRequest(e.Method, strings.TrimSuffix(target, "/")+e.URI, bytes.NewReader(e.Body))
+	if err != nil {
+		return "invalid"
+	}
+	req.Header = e.Header.Clone()
+	for h, v := range req.Header {
+		// a redacted credential is left out rather than sent as is
+		if len(v) == 1 && v[0] == "[redacted]" {
+			req.Header.Del(h)
+		}
+	}
+	if keepHost {
+		req.Host = e.Host
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "error"
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	return fmt.Sprint(res.StatusCode)
+}
@@ -0,0 +1,195 @@
+// Package redis is a deliberately small RESP2 client: enough for state
+// shared between balancer instances, such as rate limits and sticky
+// sessions, without pulling in a driver dependency
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one server. connections are pooled and every command runs
+// with a deadline.
+type Client struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// ErrNil is returned for missing keys
+var ErrNil = errors.New("redis: nil")
+
+// NewClient parses redis://[:password@]host:port[/db]
+func NewClient(rawURL string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("redis url %q: expected redis://host:port", rawURL)
+	}
+
+	c := &Client{addr: u.Host, timeout: timeout, idle: make(chan *redisConn, 16)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if pw, ok := u.User.Password(); ok {
+		c.password = pw
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis url %q: bad db %q", rawURL, db)
+		}
+	}
+	return c, nil
+}
+
+// Addr is the server's host:port
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+func (c *Client) conn() (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := rc.do(c.timeout, "AUTH", c.password); err != nil {
+			_ = nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			_ = nc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Do sends one command and returns its reply: string, int64, nil-able []any
+// or ErrNil
+func (c *Client) Do(args ...string) (any, error) {
+	rc, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := rc.do(c.timeout, args...)
+
+	// server errors leave the connection usable, network errors don't
+	var serverErr Error
+	if err != nil && !errors.As(err, &serverErr) && err != ErrNil {
+		_ = rc.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		_ = rc.Close()
+	}
+	return reply, err
+}
+
+func (c *Client) Get(key string) (string, error) {
+	reply, err := c.Do("GET", key)
+	if err != nil {
+		return "", err
+	}
+	s, _ := reply.(string)
+	return s, nil
+}
+
+func (c *Client) Set(key, value string, ttl time.Duration) error {
+	_, err := c.Do("SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Error is an error reply from the server, which leaves the connection usable
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+func (rc *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	_ = rc.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(rc, b.String()); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = rc.read(); err != nil && err != ErrNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
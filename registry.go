@@ -0,0 +1,298 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backends registered in Consul or etcd, e.g. by autoscaled instances, are
+// given as a discovery url whose host is the registry:
+//
+//	consul+http://consul:8500/web?dc=dc1&tag=v2
+//
+// follows the Consul service web: a backend per instance whose health checks
+// pass, at the service address (the node's if none) and port. the weight is
+// the instance's "weight" meta key, else its Consul passing weight. changes
+// are seen as they happen through blocking queries. the query goes on to
+// Consul's health API as is, so dc, tag, ns and filter work
+//
+//	etcd+http://etcd:2379/services/web/
+//
+// reads the keys under the prefix through etcd's v3 JSON API every
+// -discovery-interval. each value is an instance, "host:port" or
+// {"address": "host:port", "weight": 3} ("host" and "port" work too, as does
+// a weight in "metadata"). instances that register with a lease drop out
+// when they stop renewing it. with auth enabled in etcd it logs in as
+// -etcd-user
+//
+// the +scheme is how to reach the backends; the registry itself is asked
+// over plain http
+
+// consulToken is sent as X-Consul-Token (-consul-token)
+var consulToken string
+
+// etcdUser and etcdPassword log in to an etcd with auth enabled (-etcd-user,
+// which may also be user:password, and -etcd-password)
+var etcdUser, etcdPassword string
+
+// how long a Consul blocking query waits for a change
+const consulWait = 5 * time.Minute
+
+type consulSource struct {
+	api   url.URL
+	index uint64 // X-Consul-Index of the last answer
+}
+
+func newConsulSource(u *url.URL) (*consulSource, error) {
+	service := strings.Trim(u.Path, "/")
+	if service == "" || strings.Contains(service, "/") {
+		return nil, errors.New("give the Consul service as the path, e.g. consul+http://consul:8500/web")
+	}
+	return &consulSource{api: url.URL{
+		Scheme:   "http",
+		Host:     registryHost(u, "8500"),
+		Path:     "/v1/health/service/" + service,
+		RawQuery: u.RawQuery,
+	}}, nil
+}
+
+func (*consulSource) watches() bool { return true }
+
+// consulEntry is the part of a /v1/health/service answer used here
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func (cs *consulSource) lookup(ctx context.Context) (map[discoveredAddr]discoveredTarget, error) {
+	api := cs.api
+	q := api.Query()
+	q.Set("passing", "true")
+	if cs.index > 0 {
+		q.Set("index", strconv.FormatUint(cs.index, 10))
+		q.Set("wait", fmt.Sprintf("%ds", int(consulWait.Seconds())))
+	}
+	api.RawQuery = q.Encode()
+	// Consul adds up to wait/16 to spread out the answers
+	ctx, cancel := context.WithTimeout(ctx, consulWait+consulWait/16+discoveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if consulToken != "" {
+		req.Header.Set("X-Consul-Token", consulToken)
+	}
+	var entries []consulEntry
+	res, err := registryCall(req, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("consul: %w", err)
+	}
+
+	// per Consul's docs, start over if the index goes back and never block on 0
+	index, _ := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	switch {
+	case index < cs.index:
+		index = 0
+	case index == 0:
+		index = 1
+	}
+	cs.index = index
+
+	found := map[discoveredAddr]discoveredTarget{}
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		weight, _ := strconv.Atoi(e.Service.Meta["weight"])
+		if weight < 1 {
+			weight = e.Service.Weights.Passing
+		}
+		found[discoveredAddr{host, strconv.Itoa(e.Service.Port)}] = discoveredTarget{name: hostName(host), weight: weight}
+	}
+	return found, nil
+}
+
+type etcdSource struct {
+	api    string // the v3 API, e.g. http://etcd:2379/v3
+	prefix string
+	token  string // from logging in, while etcd takes it
+}
+
+func newEtcdSource(u *url.URL) (*etcdSource, error) {
+	if strings.Trim(u.Path, "/") == "" {
+		return nil, errors.New("give the etcd key prefix as the path, e.g. etcd+http://etcd:2379/services/web/")
+	}
+	return &etcdSource{api: "http://" + registryHost(u, "2379") + "/v3", prefix: u.Path}, nil
+}
+
+func (*etcdSource) watches() bool { return false }
+
+func (es *etcdSource) lookup(ctx context.Context) (map[discoveredAddr]discoveredTarget, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	var answer struct {
+		KVs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	// []byte fields go over the JSON API in base64
+	rng := map[string][]byte{"key": []byte(es.prefix), "range_end": prefixEnd(es.prefix)}
+	err := es.call(ctx, "/kv/range", rng, &answer)
+	// tokens expire, so log in again once when etcd stops taking ours
+	var status *registryStatusError
+	if errors.As(err, &status) && status.code == http.StatusUnauthorized && es.token != "" {
+		es.token = ""
+		err = es.call(ctx, "/kv/range", rng, &answer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+
+	found := map[discoveredAddr]discoveredTarget{}
+	for _, kv := range answer.KVs {
+		addr, t, err := parseRegisteredInstance(kv.Value)
+		if err != nil {
+			log.Printf("Skipping etcd key %s: %v\n", kv.Key, err)
+			continue
+		}
+		found[addr] = t
+	}
+	return found, nil
+}
+
+// call posts a request to the v3 API, logging in first if there is a user
+// and no token yet
+func (es *etcdSource) call(ctx context.Context, path string, body, v any) error {
+	if user := etcdUser; user != "" && es.token == "" {
+		password := etcdPassword
+		if name, pw, ok := strings.Cut(user, ":"); ok {
+			user, password = name, pw
+		}
+		var login struct {
+			Token string `json:"token"`
+		}
+		if err := es.post(ctx, "/auth/authenticate", map[string]string{"name": user, "password": password}, &login); err != nil {
+			return fmt.Errorf("logging in as %s: %w", user, err)
+		}
+		es.token = login.Token
+	}
+	return es.post(ctx, path, body, v)
+}
+
+func (es *etcdSource) post(ctx context.Context, path string, body, v any) error {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, es.api+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if es.token != "" {
+		req.Header.Set("Authorization", es.token)
+	}
+	_, err = registryCall(req, v)
+	return err
+}
+
+// prefixEnd is the end of etcd's range of keys starting with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// all 0xff, so every key from prefix on
+	return []byte{0}
+}
+
+// parseRegisteredInstance reads an instance written to etcd
+func parseRegisteredInstance(v []byte) (discoveredAddr, discoveredTarget, error) {
+	var inst struct {
+		Address  string            `json:"address"`
+		Host     string            `json:"host"`
+		Port     int               `json:"port"`
+		Weight   int               `json:"weight"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(v, &inst); err != nil {
+		inst.Address = strings.TrimSpace(string(v))
+	}
+	if inst.Host != "" {
+		inst.Address = net.JoinHostPort(inst.Host, strconv.Itoa(inst.Port))
+	}
+	host, port, err := net.SplitHostPort(inst.Address)
+	if err != nil || host == "" {
+		return discoveredAddr{}, discoveredTarget{}, fmt.Errorf("instance %q: want host:port", v)
+	}
+	if inst.Weight < 1 {
+		inst.Weight, _ = strconv.Atoi(inst.Metadata["weight"])
+	}
+	return discoveredAddr{host, port}, discoveredTarget{name: hostName(host), weight: max(inst.Weight, 0)}, nil
+}
+
+// registryHost is the registry's host:port from a discovery url
+func registryHost(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// hostName is host if it is a name, for TLS, and empty for an address
+func hostName(host string) string {
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// registryCall sends req and decodes a 200 answer into v
+func registryCall(req *http.Request, v any) (*http.Response, error) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, &registryStatusError{code: res.StatusCode, status: res.Status, msg: strings.TrimSpace(string(msg))}
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// registryStatusError is a registry's answer other than 200
+type registryStatusError struct {
+	code        int
+	status, msg string
+}
+
+func (e *registryStatusError) Error() string {
+	return e.status + ": " + e.msg
+}
@@ -0,0 +1,139 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// sameBackend reports whether two backends proxy to the same place with the
+// same options, i.e. a reload can keep the running one
+func sameBackend(a, b *Backend) bool {
+	return a.URL().String() == b.URL().String() && a.Weight == b.Weight &&
+		a.Rack == b.Rack && a.Host == b.Host && a.MaxConns == b.MaxConns && a.H2C == b.H2C &&
+		a.Canary == b.Canary && a.Cost == b.Cost &&
+		a.DialTimeout == b.DialTimeout && a.ResponseTimeout == b.ResponseTimeout && a.tls.equal(b.tls) &&
+		maps.Equal(a.Tags, b.Tags) && a.SigV4 == b.SigV4
+}
+
+// SetBackends brings the pool's backends in line with want. backends that
+// are unchanged keep running, with their health and counters; new ones are
+// added and removed ones stop getting new requests and are drained like a
+// swapped target
+func (s *ServerPool) SetBackends(want []BackendConfig) (added, removed []*Backend, err error) {
+	next := make([]*Backend, 0, len(want))
+	var discover []BackendConfig
+	for _, bc := range want {
+		if isDiscoveryURL(bc.URL) {
+			discover = append(discover, bc)
+			continue
+		}
+		u, err := parseBackendURL(bc.URL)
+		if err != nil {
+			return nil, nil, err
+		}
+		b := s.NewBackend(u)
+		if err := bc.BackendOptions.apply(b); err != nil {
+			return nil, nil, err
+		}
+		next = append(next, b)
+	}
+	if err := s.setDiscoveries(discover); err != nil {
+		return nil, nil, err
+	}
+
+	s.update(func(old []*Backend) []*Backend {
+		kept := map[*Backend]bool{}
+		for i, b := range next {
+			for _, o := range old {
+				if !kept[o] && sameBackend(o, b) {
+					next[i], kept[o] = o, true
+					break
+				}
+			}
+			if next[i] == b {
+				added = append(added, b)
+			}
+		}
+		for _, o := range old {
+			switch {
+			case o.discovery != nil:
+				// its discovery adds and removes it
+				next = append(next, o)
+			case !kept[o]:
+				removed = append(removed, o)
+			}
+		}
+		return next
+	})
+
+	for _, b := range removed {
+		go b.target.Load().drain(b.Name())
+	}
+	return added, removed, nil
+}
+
+// reloadBackends re-reads the config file into the default pool. only the
+// backend list is reloaded; other settings still need a restart
+func reloadBackends(path string) error {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Backends) == 0 && !allowEmptyPool {
+		return fmt.Errorf("%s: no backends, keeping the current ones", path)
+	}
+	added, removed, err := serverPool.SetBackends(cfg.Backends)
+	if err != nil {
+		return err
+	}
+	for _, b := range added {
+		log.Printf("Added backend: %s\n", b.URL())
+	}
+	for _, b := range removed {
+		log.Printf("Removed backend: %s, draining\n", b.URL())
+	}
+	log.Printf("Reloaded %s: %d added, %d removed\n", path, len(added), len(removed))
+	if reloadSettle > 0 && len(added)+len(removed) > 0 {
+		serverPool.settle(reloadSettle)
+	}
+	return nil
+}
+
+// reloadPath is the config file SIGHUP and POST /admin/reload reload, ""
+// when there is nothing to reload
+var reloadPath string
+
+// reloadOnHangup reloads the backends from path on every SIGHUP. Windows has
+// no SIGHUP; POST /admin/reload does the same there and everywhere else
+func reloadOnHangup(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloadBackends(path); err != nil {
+			log.Println("Reload failed: ", err)
+		}
+	}
+}
+
+// reloads the config file's backends, like SIGHUP
+func postReload(w http.ResponseWriter, r *http.Request) {
+	if reloadPath == "" {
+		http.Error(w, "nothing to reload: there is no -config, or -backends overrides it", http.StatusNotFound)
+		return
+	}
+	if err := reloadBackends(reloadPath); err != nil {
+		log.Println("Reload failed: ", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	status := []BackendStatus{}
+	for _, b := range serverPool.Backends() {
+		status = append(status, backendStatus(serverPool.Name, b))
+	}
+	writeJSON(w, http.StatusOK, status)
+}
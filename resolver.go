@@ -0,0 +1,156 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver looks up backend hostnames for upstream connections and health
+// checks, optionally against its own DNS servers instead of the system's,
+// and caches answers: found names for TTL, names that don't exist for
+// NegativeTTL. when a lookup fails outright the last answer keeps being used
+type Resolver struct {
+	Servers     []string // host:port, tried in turn; empty uses the system's
+	Timeout     time.Duration
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	resolver *net.Resolver
+	next     atomic.Uint32
+
+	mux   sync.Mutex
+	cache map[string]resolved
+}
+
+type resolved struct {
+	ips     []net.IP
+	err     error // not found
+	expires time.Time
+}
+
+// upstreamResolver is nil unless one of the -resolver flags asks for it
+var upstreamResolver *Resolver
+
+// NewResolver checks the server addresses, adding port 53 where missing
+func NewResolver(servers []string, timeout, ttl, negativeTTL time.Duration) (*Resolver, error) {
+	r := &Resolver{Timeout: timeout, TTL: ttl, NegativeTTL: negativeTTL, cache: map[string]resolved{}}
+	for _, s := range servers {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, _ := net.SplitHostPort(s)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("resolver %q: must be an IP address", s)
+		}
+		r.Servers = append(r.Servers, s)
+	}
+	r.resolver = net.DefaultResolver
+	if len(r.Servers) > 0 {
+		r.resolver = &net.Resolver{PreferGo: true, Dial: r.dialServer}
+	}
+	return r, nil
+}
+
+// dialServer sends each query to the next configured server
+func (r *Resolver) dialServer(ctx context.Context, network, _ string) (net.Conn, error) {
+	server := r.Servers[int(r.next.Add(1)-1)%len(r.Servers)]
+	d := net.Dialer{Timeout: r.Timeout}
+	return d.DialContext(ctx, network, server)
+}
+
+// LookupIP returns host's addresses, from the cache while it is fresh
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	r.mux.Lock()
+	cached, ok := r.cache[host]
+	r.mux.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.ips, cached.err
+	}
+
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	ips, err := r.resolver.LookupIP(ctx, "ip", host)
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		r.store(host, resolved{ips: ips, expires: time.Now().Add(r.TTL)})
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		r.store(host, resolved{err: err, expires: time.Now().Add(r.NegativeTTL)})
+	case ok && cached.err == nil:
+		log.Printf("Resolving %s failed, using the last answer: %v\n", host, err)
+		return cached.ips, nil
+	}
+	return ips, err
+}
+
+func (r *Resolver) store(host string, entry resolved) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.cache[host] = entry
+}
+
+// wrapDial resolves the host of addr itself and dials its addresses in turn
+func (r *Resolver) wrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := r.LookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: no addresses", host)
+		}
+		return nil, firstErr
+	}
+}
+
+// lookupBackendIP resolves a backend hostname the way upstream connections do
+func lookupBackendIP(ctx context.Context, host string) ([]net.IP, error) {
+	if upstreamResolver != nil {
+		return upstreamResolver.LookupIP(ctx, host)
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// healthDial connects health probes, through upstreamResolver if set. with
+// -upstream-spread-ips a probe passes if any address answers
+func healthDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: healthCheckTimeout}
+	if spreadUpstreamIPs {
+		return upstreamSpread.wrapDial(d.DialContext)(ctx, network, addr)
+	}
+	if upstreamResolver != nil {
+		return upstreamResolver.wrapDial(d.DialContext)(ctx, network, addr)
+	}
+	return d.DialContext(ctx, network, addr)
+}
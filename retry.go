@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy says when a failed request is tried again. a transport error
+// is retried on the same backend up to Attempts times before the request
+// fails over to another one; a response with one of Statuses goes straight
+// to another backend, leaving the one that answered in rotation. each retry
+// waits Backoff doubled per retry so far, capped at MaxBackoff, with full
+// jitter, and no request is retried more than Budget times in all.
+//
+// across requests, a pool's retries over the last minute are held to Ratio
+// of its requests, plus MinRetries so a quiet pool can still retry: when
+// backends are failing, retrying every request would multiply the load on
+// the ones left standing. a request past the pool's budget fails with the
+// error it got
+//
+// only requests that are safe to send twice are retried: idempotent methods
+// and requests carrying an Idempotency-Key, or any request that never reached
+// the backend. a request body must also be replayable, so bodies up to
+// BufferBody bytes are kept for the purpose
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Budget     int
+	Ratio      float64 // 0 lifts the cap
+	MinRetries uint64  // per minute
+	Statuses   StatusRanges
+	BufferBody int64
+}
+
+var retryPolicy = RetryPolicy{
+	Attempts:   MAX_RETRIES,
+	Backoff:    10 * time.Millisecond,
+	MaxBackoff: time.Second,
+	Budget:     10,
+	Ratio:      0.2,
+	MinRetries: 10,
+	BufferBody: 64 << 10,
+}
+
+// retryState is a request's retries so far, across backends
+type retryState struct {
+	used     int
+	timedOut bool // an attempt timed out, see writeTimeout
+}
+
+type retryStateKey struct{}
+
+func getRetryState(r *http.Request) *retryState {
+	st, _ := r.Context().Value(retryStateKey{}).(*retryState)
+	return st
+}
+
+// prepareRetries is called on a request's first attempt: it starts the
+// retry count and buffers a small body so the request can be sent again
+func prepareRetries(r *http.Request) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), retryStateKey{}, &retryState{}))
+	// a body of unknown length may be a stream, which mustn't be held up
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength <= 0 || retryPolicy.BufferBody <= 0 || isGRPC(r) {
+		return r
+	}
+	if r.ContentLength > retryPolicy.BufferBody {
+		return r
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, retryPolicy.BufferBody+1))
+	if err != nil || int64(len(buf)) > retryPolicy.BufferBody {
+		// left unreplayable; whatever was read still goes to the backend
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return r
+	}
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return r
+}
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true,
+	http.MethodTrace: true, http.MethodPut: true, http.MethodDelete: true,
+}
+
+// canRetry reports whether r may be sent again after err, nil meaning the
+// backend answered with a retryable status
+func canRetry(r *http.Request, err error) bool {
+	st := getRetryState(r)
+	if st == nil || st.used >= retryPolicy.Budget {
+		return false
+	}
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 && r.GetBody == nil {
+		return false
+	}
+	return idempotentMethods[r.Method] || r.Header.Get("Idempotency-Key") != "" || neverSent(err)
+}
+
+// retryBudgetLeft reports whether the pool's retries are within
+// retryPolicy.Ratio of its requests, counting one up against the budget if not
+func (s *ServerPool) retryBudgetLeft() bool {
+	if retryPolicy.Ratio <= 0 {
+		return true
+	}
+	allowed := uint64(retryPolicy.Ratio*float64(s.requestWindow.Sum())) + retryPolicy.MinRetries
+	if s.retryWindow.Sum() < allowed {
+		return true
+	}
+	s.retriesDenied.Add(1)
+	return false
+}
+
+// neverSent reports whether err means the backend never got the request
+func neverSent(err error) bool {
+	var op *net.OpError
+	return err != nil && errors.As(err, &op) && op.Op == "dial"
+}
+
+// retryWait sleeps before the next retry and rewinds the body. it returns
+// false if the client went away meanwhile
+func retryWait(r *http.Request) bool {
+	st := getRetryState(r)
+	st.used++
+	wait := retryPolicy.Backoff << min(st.used-1, 30)
+	if wait > retryPolicy.MaxBackoff || wait <= 0 {
+		wait = retryPolicy.MaxBackoff
+	}
+	if wait > 0 {
+		t := time.NewTimer(rand.N(wait) + 1)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	if r.GetBody != nil {
+		r.Body, _ = r.GetBody()
+	}
+	return true
+}
+
+// retryStatusError turns a response with a retryable status into a proxy
+// error, so it takes the same path as a failed connection
+type retryStatusError struct {
+	status int
+}
+
+func (e *retryStatusError) Error() string {
+	return fmt.Sprintf("backend answered %d, retrying elsewhere", e.status)
+}
+
+// retryStatus decides whether a response is thrown away for a retry on
+// another backend. the last attempt's response is passed on whatever it is
+func (s *ServerPool) retryStatus(b *Backend, res *http.Response) error {
+	if !retryPolicy.Statuses.Contains(res.StatusCode) || GetAttemptsFromContext(res.Request) >= MAX_RETRIES ||
+		!canRetry(res.Request, nil) || !s.othersAlive(b) || !s.retryBudgetLeft() {
+		return nil
+	}
+	return &retryStatusError{status: res.StatusCode}
+}
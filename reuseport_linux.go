@@ -0,0 +1,14 @@
+package loadbalancer
+
+import (
+	"runtime"
+	"strings"
+)
+
+// SO_REUSEPORT, missing from package syscall on amd64, 386 and arm
+var soReusePort = func() int {
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 0x200
+	}
+	return 0xf
+}()
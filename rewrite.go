@@ -0,0 +1,137 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// RewriteRule replaces every occurrence of Find in a response body with Replace
+type RewriteRule struct {
+	Find, Replace string
+}
+
+// RewriteRules is a repeatable flag of sed-like rules, e.g.
+// -rewrite 's|http://app.internal:8080|https://example.com|'. the first
+// character after s is the delimiter
+type RewriteRules []RewriteRule
+
+func (rr *RewriteRules) String() string {
+	parts := make([]string, len(*rr))
+	for i, r := range *rr {
+		parts[i] = fmt.Sprintf("s|%s|%s|", r.Find, r.Replace)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (rr *RewriteRules) Set(value string) error {
+	if len(value) < 4 || value[0] != 's' {
+		return fmt.Errorf("rewrite %q: expected s<d>find<d>replace<d>", value)
+	}
+	d := value[1:2]
+	parts := strings.Split(value[2:], d)
+	if len(parts) != 3 || parts[2] != "" || parts[0] == "" {
+		return fmt.Errorf("rewrite %q: expected s%sfind%sreplace%s", value, d, d, d)
+	}
+	*rr = append(*rr, RewriteRule{Find: parts[0], Replace: parts[1]})
+	return nil
+}
+
+// BodyRewrite applies its rules to responses whose media type is listed
+type BodyRewrite struct {
+	Rules        RewriteRules
+	ContentTypes []string
+}
+
+var bodyRewrite BodyRewrite
+
+// prepareRewrite asks the backend for an uncompressed body, since rules
+// match plain text
+func prepareRewrite(r *http.Request) {
+	if len(bodyRewrite.Rules) > 0 {
+		r.Header.Del("Accept-Encoding")
+	}
+}
+
+// rewriteBody wraps the response body in streaming replacers when the
+// response is one we rewrite
+func rewriteBody(res *http.Response) {
+	if len(bodyRewrite.Rules) == 0 || res.Body == nil || res.Body == http.NoBody {
+		return
+	}
+	if ce := res.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	matched := false
+	for _, ct := range bodyRewrite.ContentTypes {
+		if strings.EqualFold(strings.TrimSpace(ct), mediaType) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return
+	}
+
+	var body io.Reader = res.Body
+	for _, rule := range bodyRewrite.Rules {
+		body = newReplaceReader(body, []byte(rule.Find), []byte(rule.Replace))
+	}
+	res.Body = readCloser{Reader: body, Closer: res.Body}
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+}
+
+// replaceReader rewrites a stream without buffering it: only the last
+// len(old)-1 bytes, which could be the start of a match, are held back
+type replaceReader struct {
+	src      io.Reader
+	old, new []byte
+	buf      []byte
+	in       []byte // read but not yet scanned to completion
+	out      []byte // rewritten, waiting to be read
+	err      error
+}
+
+func newReplaceReader(src io.Reader, old, new []byte) *replaceReader {
+	return &replaceReader{src: src, old: old, new: new, buf: make([]byte, 32<<10)}
+}
+
+func (r *replaceReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.src.Read(r.buf)
+		r.in = append(r.in, r.buf[:n]...)
+		r.err = err
+		r.scan(err != nil)
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *replaceReader) scan(final bool) {
+	r.out = r.out[:0]
+	for {
+		i := bytes.Index(r.in, r.old)
+		if i < 0 {
+			break
+		}
+		r.out = append(r.out, r.in[:i]...)
+		r.out = append(r.out, r.new...)
+		r.in = r.in[i+len(r.old):]
+	}
+
+	keep := min(len(r.old)-1, len(r.in))
+	if final {
+		keep = 0
+	}
+	r.out = append(r.out, r.in[:len(r.in)-keep]...)
+	r.in = append(r.in[:0], r.in[len(r.in)-keep:]...)
+}
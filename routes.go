@@ -0,0 +1,575 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Route sends matching requests to a named pool instead of the default one.
+// a route can match on the Host header, on the path (one of Path exactly,
+// PathPrefix or PathRegex) and on media types, where any listed Accept type
+// is acceptable to the client or the request body's Content-Type is (or
+// specializes) any listed type, e.g. application/grpc also matches
+// application/grpc+proto. whatever is given must all match. Hosts are names
+// like api.example.com or wildcards like *.example.com, which match any
+// subdomain. with OpenAPI set, matching requests are checked against a spec
+// before they are mirrored or proxied.
+//
+// routes are tried by Priority (higher first), then routes for exact hosts,
+// then for wildcard hosts, most specific first, then for any host; among
+// those exact paths come first, then longer prefixes before shorter ones,
+// then regexes, then media-only and host-only routes, and finally the order
+// they were written
+type Route struct {
+	Name        string   `json:"name,omitempty" yaml:"name"`
+	Hosts       []string `json:"hosts,omitempty" yaml:"hosts"`
+	Path        string   `json:"path,omitempty" yaml:"path"`
+	PathPrefix  string   `json:"path_prefix,omitempty" yaml:"path_prefix"`
+	PathRegex   string   `json:"path_regex,omitempty" yaml:"path_regex"`
+	Accept      []string `json:"accept,omitempty" yaml:"accept"`
+	ContentType []string `json:"content_type,omitempty" yaml:"content_type"`
+	Priority    int      `json:"priority,omitempty" yaml:"priority"`
+	Pool        string   `json:"pool" yaml:"pool"`
+	Mirror      *Mirror  `json:"mirror,omitempty" yaml:"mirror"`
+
+	RateLimit *RateLimit `json:"rate_limit,omitempty" yaml:"rate_limit"`
+
+	IPAccess *RouteIPAccess `json:"ip_access,omitempty" yaml:"ip_access"`
+
+	Auth *RouteAuth `json:"auth,omitempty" yaml:"auth"`
+
+	Headers *RouteHeaders `json:"headers,omitempty" yaml:"headers"`
+
+	MaxRequestBytes  int64 `json:"max_request_bytes,omitempty" yaml:"max_request_bytes"`   // see maxRequestBody
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty" yaml:"max_response_bytes"` // see routeSizes
+
+	OpenAPI *OpenAPIValidation `json:"openapi,omitempty" yaml:"openapi"`
+
+	ErrorPages ErrorPages `json:"error_pages,omitempty" yaml:"error_pages"` // over -error-pages, see ErrorPages
+
+	TimeoutFallback *TimeoutFallback `json:"timeout_fallback,omitempty" yaml:"timeout_fallback"`
+
+	RequestTransforms  []string `json:"request_transforms,omitempty" yaml:"request_transforms"`   // see BodyTransformer
+	ResponseTransforms []string `json:"response_transforms,omitempty" yaml:"response_transforms"` // see BodyTransformer
+
+	pool  *ServerPool
+	re    *regexp.Regexp
+	order int
+	sizes routeSizes
+
+	requestTransforms, responseTransforms []BodyTransformer
+}
+
+// route kinds, in precedence order
+const (
+	routeExact = iota
+	routePrefix
+	routeRegex
+	routeMedia
+	routeHost
+)
+
+var routeKindNames = []string{"exact", "prefix", "regex", "media", "host"}
+
+func (rt *Route) kind() int {
+	switch {
+	case rt.Path != "":
+		return routeExact
+	case rt.PathPrefix != "":
+		return routePrefix
+	case rt.PathRegex != "":
+		return routeRegex
+	case len(rt.Accept) == 0 && len(rt.ContentType) == 0:
+		return routeHost
+	}
+	return routeMedia
+}
+
+// hostRank orders routes by how specific their hosts are: highest for exact
+// names only, then with wildcards the number of labels their least specific
+// wildcard fixes, so *.api.example.com ranks above *.example.com, and 0 for
+// any host
+func (rt *Route) hostRank() int {
+	if len(rt.Hosts) == 0 {
+		return 0
+	}
+	rank := math.MaxInt
+	for _, h := range rt.Hosts {
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			rank = min(rank, strings.Count(suffix, "."))
+		}
+	}
+	return rank
+}
+
+// matchesHost reports whether host, as sent in the Host header, is one of
+// the route's hosts
+func (rt *Route) matchesHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, want := range rt.Hosts {
+		if suffix, ok := strings.CutPrefix(want, "*"); ok {
+			if len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == want {
+			return true
+		}
+	}
+	return false
+}
+
+// before reports whether rt takes precedence over other
+func (rt *Route) before(other *Route) bool {
+	if rt.Priority != other.Priority {
+		return rt.Priority > other.Priority
+	}
+	if h, oh := rt.hostRank(), other.hostRank(); h != oh {
+		return h > oh
+	}
+	if k, ok := rt.kind(), other.kind(); k != ok {
+		return k < ok
+	}
+	if len(rt.PathPrefix) != len(other.PathPrefix) {
+		return len(rt.PathPrefix) > len(other.PathPrefix)
+	}
+	return rt.order < other.order
+}
+
+// RoutesConfig defines the extra pools and the routes into them, either in a
+// -routes file or under pools and routes in the config file, e.g.
+//
+//	{"pools": {"grpc": ["http://10.0.0.7:50051"], "stream": ["http://10.0.0.8:8080"],
+//	           "static": {"backends": ["http://10.0.0.9:8080"], "strategy": "least-conn",
+//	                      "health_check": {"path": "/ping", "interval": "5s"},
+//	                      "rate_limit": {"rate": 50, "per_client": true}}},
+//	 "routes": [{"content_type": ["application/grpc"], "pool": "grpc"},
+//	            {"hosts": ["static.example.com", "*.cdn.example.com"], "pool": "static"},
+//	            {"path_prefix": "/events/", "accept": ["text/event-stream"], "pool": "stream"},
+//	            {"path_prefix": "/api/", "pool": "default",
+//	             "mirror": {"pool": "canary", "percent": 5, "methods": ["GET"], "max_concurrent": 8},
+//	             "rate_limit": {"rate": 100, "burst": 200},
+//	             "openapi": {"spec": "api.yaml", "validate_body": true}}]}
+type RoutesConfig struct {
+	Pools  map[string]PoolConfig `json:"pools"`
+	Routes []*Route              `json:"routes"`
+}
+
+// PoolConfig is a routed pool's backends with, optionally, its own strategy
+// and health check settings; those left out are the default pool's. it can
+// also be written as just the list of backends
+type PoolConfig struct {
+	Backends    []BackendConfig    `json:"backends" yaml:"backends"`
+	Strategy    string             `json:"strategy,omitempty" yaml:"strategy"`
+	HashKey     string             `json:"hash_key,omitempty" yaml:"hash_key"` // for consistent-hash, see HashKey
+	Seed        uint64             `json:"seed,omitempty" yaml:"seed"`
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty" yaml:"health_check"`
+	RateLimit   *RateLimit         `json:"rate_limit,omitempty" yaml:"rate_limit"`
+	Fallback    *BackendConfig     `json:"fallback,omitempty" yaml:"fallback"` // see ServerPool.Fallback
+}
+
+func (pc *PoolConfig) UnmarshalJSON(data []byte) error {
+	if json.Unmarshal(data, &pc.Backends) == nil {
+		return nil
+	}
+	type plain PoolConfig
+	return json.Unmarshal(data, (*plain)(pc))
+}
+
+func (pc *PoolConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&pc.Backends)
+	}
+	type plain PoolConfig
+	return node.Decode((*plain)(pc))
+}
+
+// Router tries routes in precedence order and falls back to Default
+type Router struct {
+	Routes  []*Route
+	Default http.Handler
+}
+
+// router is set when -routes is given, for the admin explain endpoint
+var router *Router
+
+func LoadRoutes(path string) (*RoutesConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rc RoutesConfig
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &rc, nil
+}
+
+// NewRouter builds the configured pools, registers them for health checks
+// and resolves each route's pool
+func NewRouter(rc *RoutesConfig, fallback http.Handler) (*Router, error) {
+	built := map[string]*ServerPool{}
+	for name, pc := range rc.Pools {
+		if findPool(name) != nil {
+			return nil, fmt.Errorf("route pool %q: name already in use", name)
+		}
+		if len(pc.Backends) == 0 {
+			return nil, fmt.Errorf("route pool %q: no backends", name)
+		}
+		p := &ServerPool{Name: name, Strategy: serverPool.Strategy, ReadWrites: serverPool.ReadWrites}
+		if pc.Strategy != "" {
+			strategy, err := NewStrategy(pc.Strategy, pc.Seed)
+			if err != nil {
+				return nil, fmt.Errorf("route pool %q: %w", name, err)
+			}
+			p.Strategy = strategy
+		}
+		if pc.HashKey != "" {
+			if _, ok := p.Strategy.(*ConsistentHash); !ok {
+				return nil, fmt.Errorf("route pool %q: hash_key needs the consistent-hash strategy", name)
+			}
+			key, err := ParseHashKey(pc.HashKey)
+			if err != nil {
+				return nil, fmt.Errorf("route pool %q: %w", name, err)
+			}
+			// its own, so the default pool keeps its key
+			p.Strategy = &ConsistentHash{Key: key}
+		}
+		if pc.HealthCheck != nil {
+			hs, err := pc.HealthCheck.over(globalHealth())
+			if err != nil {
+				return nil, fmt.Errorf("route pool %q: health_check.%w", name, err)
+			}
+			p.Health = &hs
+		}
+		if pc.RateLimit != nil {
+			if err := pc.RateLimit.init("pool:" + name); err != nil {
+				return nil, fmt.Errorf("route pool %q: %w", name, err)
+			}
+			p.RateLimit = pc.RateLimit
+		}
+		for _, bc := range pc.Backends {
+			if isDiscoveryURL(bc.URL) {
+				if _, err := p.Discover(bc); err != nil {
+					return nil, fmt.Errorf("route pool %q: %w", name, err)
+				}
+				log.Printf("[%s] Discovering backends from %s\n", name, bc.URL)
+				continue
+			}
+			b, err := p.AddBackendConfig(bc)
+			if err != nil {
+				return nil, fmt.Errorf("route pool %q: %w", name, err)
+			}
+			log.Printf("[%s] Configured backend: %s\n", name, b.URL())
+		}
+		pools = append(pools, p)
+		built[name] = p
+		if pc.Fallback != nil {
+			if err := p.SetFallback(*pc.Fallback); err != nil {
+				return nil, fmt.Errorf("route pool %q: fallback: %w", name, err)
+			}
+		}
+	}
+
+	for i, rt := range rc.Routes {
+		if rt.Name == "" {
+			rt.Name = fmt.Sprintf("route-%d", i)
+		}
+		if rt.pool = built[rt.Pool]; rt.pool == nil {
+			if rt.pool = findPool(rt.Pool); rt.pool == nil {
+				return nil, fmt.Errorf("route %s: unknown pool %q", rt.Name, rt.Pool)
+			}
+		}
+		paths := 0
+		for _, p := range []string{rt.Path, rt.PathPrefix, rt.PathRegex} {
+			if p != "" {
+				paths++
+			}
+		}
+		if paths > 1 {
+			return nil, fmt.Errorf("route %s: use only one of path, path_prefix and path_regex", rt.Name)
+		}
+		if paths == 0 && len(rt.Accept) == 0 && len(rt.ContentType) == 0 && len(rt.Hosts) == 0 {
+			return nil, fmt.Errorf("route %s: needs hosts, a path, accept or content_type", rt.Name)
+		}
+		for i, h := range rt.Hosts {
+			h = strings.TrimSuffix(strings.ToLower(h), ".")
+			if h == "" || strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+				return nil, fmt.Errorf("route %s: bad host %q (use a name or *.domain)", rt.Name, rt.Hosts[i])
+			}
+			rt.Hosts[i] = h
+		}
+		if rt.PathRegex != "" {
+			re, err := regexp.Compile(rt.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+			}
+			rt.re = re
+		}
+		if rt.Mirror != nil {
+			if err := rt.Mirror.init(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.RateLimit != nil {
+			if err := rt.RateLimit.init("route:" + rt.Name); err != nil {
+				return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+			}
+		}
+		if rt.IPAccess != nil {
+			if err := rt.IPAccess.init(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.Auth != nil {
+			if err := rt.Auth.init(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if rt.MaxResponseBytes < 0 {
+			return nil, fmt.Errorf("route %s: max_response_bytes must not be negative", rt.Name)
+		}
+		if rt.MaxRequestBytes < 0 {
+			return nil, fmt.Errorf("route %s: max_request_bytes must not be negative", rt.Name)
+		}
+		if rt.Headers != nil {
+			if err := rt.Headers.validate(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+			}
+		}
+		if rt.OpenAPI != nil {
+			if err := rt.OpenAPI.init(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		if err := rt.ErrorPages.init(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+		}
+		if rt.TimeoutFallback != nil {
+			if err := rt.TimeoutFallback.init(rt.Name); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if rt.requestTransforms, err = lookupBodyTransformers(rt.Name, rt.RequestTransforms); err != nil {
+			return nil, err
+		}
+		if rt.responseTransforms, err = lookupBodyTransformers(rt.Name, rt.ResponseTransforms); err != nil {
+			return nil, err
+		}
+		rt.order = i
+	}
+
+	routes := append([]*Route(nil), rc.Routes...)
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].before(routes[j]) })
+	return &Router{Routes: routes, Default: fallback}, nil
+}
+
+// matches reports whether r matches the route and, if not, why
+func (rt *Route) matches(r *http.Request) (bool, string) {
+	if len(rt.Hosts) > 0 && !rt.matchesHost(r.Host) {
+		return false, fmt.Sprintf("host %s is not one of %s", r.Host, strings.Join(rt.Hosts, ", "))
+	}
+	p := r.URL.Path
+	switch rt.kind() {
+	case routeExact:
+		if p != rt.Path {
+			return false, fmt.Sprintf("path %s is not %s", p, rt.Path)
+		}
+	case routePrefix:
+		if !strings.HasPrefix(p, rt.PathPrefix) {
+			return false, fmt.Sprintf("path %s doesn't start with %s", p, rt.PathPrefix)
+		}
+	case routeRegex:
+		if !rt.re.MatchString(p) {
+			return false, fmt.Sprintf("path %s doesn't match %s", p, rt.PathRegex)
+		}
+	}
+	if len(rt.Accept) == 0 && len(rt.ContentType) == 0 {
+		return true, ""
+	}
+
+	if len(rt.ContentType) > 0 {
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+			for _, want := range rt.ContentType {
+				if mediaType == want || strings.HasPrefix(mediaType, want+"+") {
+					return true, ""
+				}
+			}
+		}
+	}
+	for _, want := range rt.Accept {
+		if accepts(r.Header.Values("Accept"), want) {
+			return true, ""
+		}
+	}
+	return false, "neither Accept nor Content-Type match"
+}
+
+// accepts reports whether the Accept header names mediaType explicitly with
+// a non-zero quality. wildcards don't count, or every browser request would
+// match every route
+func accepts(accept []string, mediaType string) bool {
+	for _, line := range accept {
+		for _, part := range strings.Split(line, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || mt != mediaType {
+				continue
+			}
+			if q, ok := params["q"]; ok {
+				if v, err := strconv.ParseFloat(q, 64); err != nil || v == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// match is the route r takes, nil for the default pool
+func (router *Router) match(r *http.Request) *Route {
+	for _, rt := range router.Routes {
+		if ok, _ := rt.matches(r); ok {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt := router.match(r)
+	if rt == nil {
+		router.Default.ServeHTTP(w, r)
+		return
+	}
+	// header rules may have moved the request to another route since
+	// WithAdmission checked it
+	if a := admitted(r); a == nil || a.route != rt {
+		if r = rt.admit(w, r); r == nil {
+			return
+		}
+	}
+	if rt.Headers != nil {
+		r = withRouteHeaders(r, rt.Headers)
+	}
+	if rt.Mirror != nil && !featureDisabled(rt.Name, "mirror") {
+		rt.Mirror.send(r)
+	}
+	if rt.requestTransforms != nil {
+		transformRequest(r, rt.requestTransforms)
+	}
+	if rt.responseTransforms != nil {
+		r = withResponseTransforms(r, rt.responseTransforms)
+	}
+	if rt.TimeoutFallback != nil {
+		rt.TimeoutFallback.serve(w, r, rt.serveSized)
+		return
+	}
+	rt.serveSized(w, r)
+}
+
+// admit checks r against what the route requires of its requests,
+// answering and returning nil if it falls short
+func (rt *Route) admit(w http.ResponseWriter, r *http.Request) *http.Request {
+	if rt.ErrorPages != nil {
+		r = withErrorPages(r, rt.ErrorPages)
+	}
+	if rt.IPAccess != nil && !rt.IPAccess.allow(w, r) {
+		return nil
+	}
+	if rt.Auth != nil && !rt.Auth.allow(w, r) {
+		return nil
+	}
+	if rt.MaxRequestBytes > 0 && !limitBody(w, r, rt.MaxRequestBytes) {
+		return nil
+	}
+	if rt.OpenAPI != nil && !rt.OpenAPI.validate(w, r) {
+		return nil
+	}
+	if rt.RateLimit != nil && !featureDisabled(rt.Name, "rate_limit") && !rt.RateLimit.allow(w, r) {
+		return nil
+	}
+	return r
+}
+
+// RouteExplanation says which route a request would take and why the routes
+// ahead of it didn't match
+type RouteExplanation struct {
+	Route      string           `json:"route,omitempty"` // empty means the default pool
+	Pool       string           `json:"pool"`
+	Considered []RouteCandidate `json:"considered"`
+}
+
+type RouteCandidate struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Priority int    `json:"priority"`
+	Matched  bool   `json:"matched"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func (router *Router) Explain(r *http.Request) RouteExplanation {
+	ex := RouteExplanation{Pool: serverPool.Name, Considered: []RouteCandidate{}}
+	for _, rt := range router.Routes {
+		ok, reason := rt.matches(r)
+		ex.Considered = append(ex.Considered, RouteCandidate{
+			Name:     rt.Name,
+			Kind:     routeKindNames[rt.kind()],
+			Priority: rt.Priority,
+			Matched:  ok,
+			Reason:   reason,
+		})
+		if ok {
+			ex.Route, ex.Pool = rt.Name, rt.pool.Name
+			break
+		}
+	}
+	return ex
+}
+
+// explains a sample request given as query parameters, e.g.
+// /admin/routes/explain?host=api.example.com&path=/api/v1/users&method=POST&content_type=application/json
+func getRouteExplain(w http.ResponseWriter, r *http.Request) {
+	if router == nil {
+		http.Error(w, "no routes configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	method, target := q.Get("method"), q.Get("path")
+	if method == "" {
+		method = http.MethodGet
+	}
+	if target == "" {
+		target = "/"
+	}
+	sample, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("host"); v != "" {
+		sample.Host = v
+	}
+	if v := q.Get("accept"); v != "" {
+		sample.Header.Set("Accept", v)
+	}
+	if v := q.Get("content_type"); v != "" {
+		sample.Header.Set("Content-Type", v)
+	}
+	writeJSON(w, http.StatusOK, router.Explain(sample))
+}
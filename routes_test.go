@@ -0,0 +1,33 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRouteHostOrder(t *testing.T) {
+	rc := &RoutesConfig{Routes: []*Route{
+		{Name: "any", PathPrefix: "/"},
+		{Name: "example", Hosts: []string{"*.example.com"}},
+		{Name: "api", Hosts: []string{"*.api.example.com"}},
+		{Name: "mixed", Hosts: []string{"www.example.org", "*.example.org"}},
+		{Name: "exact", Hosts: []string{"v1.api.example.com"}},
+	}}
+	router, err := NewRouter(rc, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"v1.api.example.com": "exact",
+		"v2.api.example.com": "api",
+		"www.example.com":    "example",
+		"www.example.org":    "mixed",
+		"example.com":        "any",
+	} {
+		r := &http.Request{Method: http.MethodGet, Host: host, URL: &url.URL{Path: "/"}, Header: http.Header{}}
+		if rt := router.match(r); rt == nil || rt.Name != want {
+			t.Errorf("%s took %v, want %s", host, rt, want)
+		}
+	}
+}
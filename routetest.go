@@ -0,0 +1,182 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// middlewareStep is one layer of the main handler chain. explain says what
+// the layer would do with a request, for POST /admin/route-test
+type middlewareStep struct {
+	Name    string
+	explain func(r *http.Request) string
+}
+
+// handlerChain lists the main listener's middleware, innermost first
+var handlerChain []middlewareStep
+
+// useMiddleware records a layer as main wraps the handler in it
+func useMiddleware(name string, explain func(r *http.Request) string) {
+	handlerChain = append(handlerChain, middlewareStep{Name: name, explain: explain})
+}
+
+func explainHeaderRules(rules []HeaderRuleSet) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		var prefixes []string
+		for _, set := range rules {
+			if strings.HasPrefix(r.URL.Path, set.PathPrefix) {
+				prefixes = append(prefixes, set.PathPrefix)
+			}
+		}
+		if len(prefixes) == 0 {
+			return "no rule sets match"
+		}
+		return "rule sets for " + strings.Join(prefixes, ", ")
+	}
+}
+
+func explainCoalesce(r *http.Request) string {
+	if _, ok := coalescer.key(r); ok {
+		if coalescer.Window > 0 {
+			return fmt.Sprintf("may share an identical request's response, in flight or up to %s old", coalescer.Window)
+		}
+		return "may share a concurrent identical request's response"
+	}
+	return "not shareable, passes through"
+}
+
+func explainCache(r *http.Request) string {
+	if _, ok := coalesceKey(r); !ok {
+		return "not cacheable, passes through"
+	}
+	if !responseCache.cachesPath(r.URL.Path) {
+		return "path not cached, passes through"
+	}
+	key, _ := coalesceKey(r)
+	switch cr, fresh := responseCache.get(key); {
+	case fresh:
+		return "served from the cache"
+	case cr != nil:
+		return "stale in the cache, revalidated with the backend"
+	}
+	return "may be cached"
+}
+
+func explainClasses(classes []*RequestClass) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		for _, c := range classes {
+			if c.matches(r) {
+				return fmt.Sprintf("class %s, %s lane", c.Name, c.lane)
+			}
+		}
+		return ""
+	}
+}
+
+func explainMirror(m *Mirror) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return fmt.Sprintf("copied to pool %s %g%% of the time", m.Pool, m.Percent)
+	}
+}
+
+func explainVia(r *http.Request) string {
+	if viaPseudonym != "" && viaContains(r.Header.Values("Via"), viaPseudonym) {
+		return "rejected as a forwarding loop"
+	}
+	return ""
+}
+
+// RouteTest is a sample request for POST /admin/route-test
+type RouteTest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Host    string            `json:"host,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// RouteTestResult is where a sample request would go: the middleware it
+// passes, outermost first, then the route, pool and backend
+type RouteTestResult struct {
+	Middleware []string `json:"middleware"`
+	Route      string   `json:"route,omitempty"`
+	Pool       string   `json:"pool"`
+	Backend    string   `json:"backend,omitempty"`
+	Via        string   `json:"via,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// planRoute works out where r would be sent without sending it. the backend
+// comes from the pool's strategy, so the test counts as a pick, e.g. it
+// advances round robin like a real request would
+func planRoute(r *http.Request) RouteTestResult {
+	res := RouteTestResult{Middleware: []string{}, Pool: serverPool.Name}
+	for i := len(handlerChain) - 1; i >= 0; i-- {
+		step := handlerChain[i]
+		note := step.Name
+		if step.explain != nil {
+			if detail := step.explain(r); detail != "" {
+				note += ": " + detail
+			}
+		}
+		res.Middleware = append(res.Middleware, note)
+	}
+
+	pool := &serverPool
+	if router != nil {
+		ex := router.Explain(r)
+		res.Route = ex.Route
+		if ex.Route != "" {
+			pool = findPool(ex.Pool)
+		}
+	}
+	res.Pool = pool.Name
+
+	if name := r.Header.Get(debugBackendHeader); name != "" && debugToken != "" {
+		res.Via = "debug"
+		token := r.Header.Get(debugTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(debugToken)) != 1 {
+			res.Error = "invalid debug token"
+		} else if b := pool.FindBackend(name); b == nil {
+			res.Error = fmt.Sprintf("no backend named %q", name)
+		} else {
+			res.Backend = b.Name()
+		}
+		return res
+	}
+	b, via := pool.pick(r)
+	if b == nil {
+		res.Error = "no healthy backend"
+		return res
+	}
+	res.Backend, res.Via = b.Name(), via
+	return res
+}
+
+// e.g. {"method": "POST", "path": "/api/orders", "headers": {"Content-Type": "application/json"}}
+func postRouteTest(w http.ResponseWriter, r *http.Request) {
+	var req RouteTest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	if req.Path == "" {
+		req.Path = "/"
+	}
+	sample, err := http.NewRequest(req.Method, req.Path, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sample.Host = req.Host
+	for k, v := range req.Headers {
+		sample.Header.Set(k, v)
+	}
+	sample.RemoteAddr = r.RemoteAddr
+	writeJSON(w, http.StatusOK, planRoute(sample))
+}
@@ -0,0 +1,71 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"load-balancer/redis"
+)
+
+// ReadYourWrites sends a client's reads to the backend that took its last
+// write for Window afterwards, for pools of replicas that apply writes
+// asynchronously: without it a client can write to one replica and read the
+// old value back from another that hasn't caught up. writes are any method
+// other than GET, HEAD, OPTIONS and TRACE that a backend answered below 500;
+// clients are told apart by Key, the client IP by default. every pool pins
+// its own clients. pins are kept in the -affinity-store under a hash of the
+// key, so a redis store shares them between balancers without holding the
+// credentials a key may be made of. a pinned backend that is down is
+// skipped and the read balanced as usual. a pinned client's reads are
+// neither served from the cache nor coalesced, which could hand it a
+// response from before its write
+type ReadYourWrites struct {
+	Window time.Duration
+	Key    *HashKey
+	Store  AffinityStore
+}
+
+func isRead(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func (ryw *ReadYourWrites) key(pool string, r *http.Request) string {
+	sum := sha256.Sum256([]byte(ryw.Key.Of(r)))
+	return "lb:ryw:" + pool + ":" + hex.EncodeToString(sum[:16])
+}
+
+// lookup returns the live backend the client last wrote to, for a read
+// within the window
+func (ryw *ReadYourWrites) lookup(s *ServerPool, r *http.Request) *Backend {
+	if !isRead(r.Method) {
+		return nil
+	}
+	name, err := ryw.Store.Get(ryw.key(s.Name, r))
+	if err != nil {
+		if err != redis.ErrNil {
+			log.Println("Read-your-writes lookup failed: ", err)
+		}
+		return nil
+	}
+	if b := s.FindBackend(name); b != nil && b.IsAlive() {
+		return b
+	}
+	return nil
+}
+
+// remember pins the client to b after a write it answered
+func (ryw *ReadYourWrites) remember(s *ServerPool, b *Backend, res *http.Response) {
+	if isRead(res.Request.Method) || res.StatusCode >= 500 {
+		return
+	}
+	if err := ryw.Store.Set(ryw.key(s.Name, res.Request), b.Name(), ryw.Window); err != nil {
+		log.Println("Read-your-writes store failed: ", err)
+	}
+}
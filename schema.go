@@ -0,0 +1,140 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// lb config schema prints a JSON Schema of the -config file, made from the
+// Config struct by reflection so it can't drift from what the balancer
+// reads. editors validate and complete configs with it, YAML ones too,
+// e.g. with "# yaml-language-server: $schema=lb.schema.json" on top, and CI
+// can check them with any JSON Schema validator. unknown keys are flagged,
+// though the balancer itself ignores them
+func runConfig(args []string) {
+	if len(args) != 1 || args[0] != "schema" {
+		fmt.Fprintln(os.Stderr, "usage: lb config schema > lb.schema.json")
+		os.Exit(2)
+	}
+	data, err := json.MarshalIndent(ConfigSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+}
+
+// ConfigSchema is the JSON Schema (draft 2020-12) of Config
+func ConfigSchema() map[string]any {
+	g := schemaGen{defs: map[string]any{}}
+	root := g.schema(reflect.TypeOf(Config{}))
+	schema := map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "load balancer config",
+		"$ref":    root["$ref"],
+		"$defs":   g.defs,
+	}
+	return schema
+}
+
+type schemaGen struct {
+	defs map[string]any
+}
+
+var durationSchema = map[string]any{
+	"type":        "string",
+	"pattern":     `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|^0$`,
+	"description": "a duration like 300ms, 10s or 1h30m",
+}
+
+// schema describes t, named structs by reference to $defs
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(Duration{}):
+		return durationSchema
+	case reflect.TypeOf(time.Duration(0)):
+		return map[string]any{"type": "integer", "description": "nanoseconds"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.ref(t)
+	}
+	// interfaces and the like take anything
+	return map[string]any{}
+}
+
+// ref defines a struct once in $defs and refers to it
+func (g *schemaGen) ref(t reflect.Type) map[string]any {
+	ref := map[string]any{"$ref": "#/$defs/" + t.Name()}
+	if _, ok := g.defs[t.Name()]; ok {
+		return ref
+	}
+	g.defs[t.Name()] = true // placeholder, for types that refer to themselves
+	def := g.object(t)
+	switch t {
+	case reflect.TypeOf(BackendConfig{}):
+		// or a -backends entry, e.g. http://10.0.0.5:8080;weight=2
+		def = map[string]any{"oneOf": []any{
+			map[string]any{"type": "string", "description": "a backend url with ;key=value options, as in -backends"},
+			def,
+		}}
+	case reflect.TypeOf(PoolConfig{}):
+		// or just its backends
+		def = map[string]any{"oneOf": []any{
+			g.schema(reflect.TypeOf([]BackendConfig{})),
+			def,
+		}}
+	}
+	g.defs[t.Name()] = def
+	return ref
+}
+
+// object lists a struct's fields as encoding/json sees them, embedded
+// structs' fields included
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+		}
+	}
+	walk(t)
+	return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+}
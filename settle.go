@@ -0,0 +1,114 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a reload that swaps many backends sets off a burst of up and down
+// transitions as the new ones are probed and the old ones drain, each
+// logged on its own. for -reload-settle after a reload, the pool's
+// transitions are collected instead, and when the window closes a single
+// line, and a single webhook event, says which backends ended up down or
+// up and which went both ways. health checks, routing and connection
+// flushing carry on as usual, only their per-backend lines aren't logged.
+// off by default
+var reloadSettle time.Duration
+
+// healthBatch collects a pool's transitions while it settles
+type healthBatch struct {
+	pool    string
+	started time.Time
+
+	mux     sync.Mutex
+	changes map[string]*batchedChange // by backend name
+	order   []string
+}
+
+type batchedChange struct {
+	from, to bool // alive before the first transition, and after the last
+	n        int
+}
+
+// settle batches the transitions of s's backends for d
+func (s *ServerPool) settle(d time.Duration) {
+	hb := &healthBatch{pool: s.Name, started: time.Now(), changes: map[string]*batchedChange{}}
+	backends := s.Backends()
+	for _, b := range backends {
+		b.batch.Store(hb)
+	}
+	time.AfterFunc(d, func() {
+		for _, b := range backends {
+			// a later reload's batch stays
+			b.batch.CompareAndSwap(hb, nil)
+		}
+		hb.summarize()
+	})
+}
+
+// settling reports whether b's transitions are being batched
+func (b *Backend) settling() bool {
+	return b.batch.Load() != nil
+}
+
+// unavailable logs why a probe of b failed, unless its pool is settling
+func (b *Backend) unavailable(format string, args ...any) {
+	if !b.settling() {
+		log.Printf("Backend unavailable: "+format+"\n", args...)
+	}
+}
+
+// record notes b's transition and reports whether it was batched, in which
+// case it isn't logged on its own. hb may be nil
+func (hb *healthBatch) record(b *Backend, alive bool) bool {
+	if hb == nil {
+		return false
+	}
+	hb.mux.Lock()
+	defer hb.mux.Unlock()
+	c, ok := hb.changes[b.Name()]
+	if !ok {
+		c = &batchedChange{from: !alive}
+		hb.changes[b.Name()] = c
+		hb.order = append(hb.order, b.Name())
+	}
+	c.to = alive
+	c.n++
+	return true
+}
+
+// summarize logs the batch as one line, and sends it to the webhooks as one
+// event, if anything changed
+func (hb *healthBatch) summarize() {
+	hb.mux.Lock()
+	defer hb.mux.Unlock()
+	if len(hb.order) == 0 {
+		return
+	}
+	var down, up, flapped []string
+	for _, name := range hb.order {
+		switch c := hb.changes[name]; {
+		case c.from == c.to:
+			flapped = append(flapped, fmt.Sprintf("%s (%d changes)", name, c.n))
+		case c.to:
+			up = append(up, name)
+		default:
+			down = append(down, name)
+		}
+	}
+	var parts []string
+	for _, group := range []struct {
+		what  string
+		names []string
+	}{{"down", down}, {"up", up}, {"back where they were", flapped}} {
+		if len(group.names) > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s: %s", len(group.names), group.what, strings.Join(group.names, ", ")))
+		}
+	}
+	summary := fmt.Sprintf("over %s: %s", time.Since(hb.started).Round(time.Second), strings.Join(parts, "; "))
+	log.Printf("[%s] Health after reload, %s\n", hb.pool, summary)
+	healthWebhooks.notify(HealthEvent{Pool: hb.pool, Summary: "health after reload, " + summary, Time: time.Now()})
+}
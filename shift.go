@@ -0,0 +1,282 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// minimum requests to the new backend in one step before its error rate is trusted
+const shiftMinSamples = 20
+
+// Shift ramps traffic from one backend to another in equal steps, or with
+// ToPool set from the whole pool it runs in to another pool. after each step
+// the target's error rate is checked and the shift rolls back to zero if it
+// exceeds MaxErrorRate.
+type Shift struct {
+	From         *Backend
+	To           *Backend
+	ToPool       *ServerPool
+	Duration     time.Duration
+	Steps        int
+	MaxErrorRate float64
+
+	pool     *ServerPool // the pool it runs in
+	mux      sync.RWMutex
+	fraction float64
+	state    string // running, completed, rolled_back, aborted
+	reason   string
+	stop     chan struct{}
+}
+
+type ShiftStatus struct {
+	Pool     string  `json:"pool"`
+	From     string  `json:"from,omitempty"`
+	To       string  `json:"to,omitempty"`
+	ToPool   string  `json:"to_pool,omitempty"`
+	Fraction float64 `json:"fraction"`
+	State    string  `json:"state"`
+	Reason   string  `json:"reason,omitempty"`
+}
+
+func (sh *Shift) Status() ShiftStatus {
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+	st := ShiftStatus{Pool: sh.pool.Name, Fraction: sh.fraction, State: sh.state, Reason: sh.reason}
+	if sh.ToPool != nil {
+		st.ToPool = sh.ToPool.Name
+	} else {
+		st.From, st.To = sh.From.Name(), sh.To.Name()
+	}
+	return st
+}
+
+// String names the shift for logs, e.g. "a:80 -> b:80" or "pool blue -> green"
+func (sh *Shift) String() string {
+	if sh.ToPool != nil {
+		return "pool " + sh.pool.Name + " -> " + sh.ToPool.Name
+	}
+	return sh.From.Name() + " -> " + sh.To.Name()
+}
+
+// redirect decides whether a request the strategy sent to b moves to the
+// shift target instead
+func (sh *Shift) redirect(b *Backend) *Backend {
+	if b != sh.From || !sh.To.IsAlive() {
+		return b
+	}
+	if sh.draw() {
+		return sh.To
+	}
+	return b
+}
+
+// redirectPool returns the pool a request to the shift's pool moves to,
+// nil if it stays
+func (sh *Shift) redirectPool() *ServerPool {
+	if sh.ToPool == nil || !sh.ToPool.hasAlive() || !sh.draw() {
+		return nil
+	}
+	return sh.ToPool
+}
+
+// draw says whether a request falls in the shifted fraction
+func (sh *Shift) draw() bool {
+	sh.mux.RLock()
+	fraction := sh.fraction
+	sh.mux.RUnlock()
+	return fraction > 0 && rand.Float64() < fraction
+}
+
+// counts are the target's requests and failures so far
+func (sh *Shift) counts() (requests, failures uint64) {
+	if sh.ToPool == nil {
+		return sh.To.Counts()
+	}
+	for _, b := range sh.ToPool.Backends() {
+		r, f := b.Counts()
+		requests, failures = requests+r, failures+f
+	}
+	return requests, failures
+}
+
+func (s *ServerPool) hasAlive() bool {
+	for _, b := range s.Backends() {
+		if b.IsAlive() {
+			return true
+		}
+	}
+	return false
+}
+
+func (sh *Shift) run() {
+	step := sh.Duration / time.Duration(sh.Steps)
+	t := time.NewTicker(step)
+	defer t.Stop()
+
+	reqs, fails := sh.counts()
+	for i := 1; i <= sh.Steps; i++ {
+		sh.set(float64(i)/float64(sh.Steps), "running", "")
+		log.Printf("Shift %s at %.0f%%\n", sh, 100*float64(i)/float64(sh.Steps))
+
+		select {
+		case <-t.C:
+		case <-sh.stop:
+			return
+		}
+
+		r, f := sh.counts()
+		dr, df := r-reqs, f-fails
+		reqs, fails = r, f
+		if dr >= shiftMinSamples && float64(df)/float64(dr) > sh.MaxErrorRate {
+			reason := fmt.Sprintf("error rate %.1f%% over %d requests exceeded %.1f%%", 100*float64(df)/float64(dr), dr, 100*sh.MaxErrorRate)
+			sh.set(0, "rolled_back", reason)
+			log.Printf("Shift %s rolled back: %s\n", sh, reason)
+			return
+		}
+	}
+	sh.set(1, "completed", "")
+	log.Printf("Shift %s completed\n", sh)
+}
+
+func (sh *Shift) set(fraction float64, state, reason string) {
+	sh.mux.Lock()
+	sh.fraction, sh.state, sh.reason = fraction, state, reason
+	sh.mux.Unlock()
+}
+
+// shiftsBackTo reports whether from's pool shifts, directly or along a
+// chain of them, lead to pool. a completed shift keeps sending its pool's
+// traffic on, so it counts until deleted; a rolled back one does not.
+func shiftsBackTo(from, pool *ServerPool) bool {
+	seen := map[*ServerPool]bool{}
+	for p := from; p != nil && !seen[p]; {
+		if p == pool {
+			return true
+		}
+		seen[p] = true
+		sh := p.shift.Load()
+		if sh == nil || sh.Status().Fraction == 0 {
+			return false
+		}
+		p = sh.ToPool
+	}
+	return false
+}
+
+// shiftedKey marks a request a pool shift moved, which no other pool's
+// shift moves again
+type shiftedKey struct{}
+
+func shifted(r *http.Request) bool {
+	return r.Context().Value(shiftedKey{}) != nil
+}
+
+// StartShift replaces any existing shift in the pool
+func (s *ServerPool) StartShift(sh *Shift) {
+	sh.pool = s
+	sh.state = "running"
+	sh.stop = make(chan struct{})
+	if old := s.shift.Swap(sh); old != nil {
+		close(old.stop)
+	}
+	go sh.run()
+}
+
+// StopShift aborts the current shift and sends all traffic back to the strategy
+func (s *ServerPool) StopShift() *Shift {
+	sh := s.shift.Swap(nil)
+	if sh != nil {
+		close(sh.stop)
+		sh.set(0, "aborted", "stopped via admin api")
+	}
+	return sh
+}
+
+// starts a shift, e.g. {"from": "a:80", "to": "b:80", "duration": "10m", "steps": 10, "max_error_rate": 0.05},
+// or one of the whole pool to another with {"pool": "blue", "to_pool": "green", ...}
+func postShift(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pool         string  `json:"pool"`
+		From         string  `json:"from"`
+		To           string  `json:"to"`
+		ToPool       string  `json:"to_pool"`
+		Duration     string  `json:"duration"`
+		Steps        int     `json:"steps"`
+		MaxErrorRate float64 `json:"max_error_rate"`
+	}
+	req.Steps = 10
+	req.MaxErrorRate = 0.05
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pool := findPool(req.Pool)
+	if pool == nil {
+		http.Error(w, fmt.Sprintf("unknown pool %q", req.Pool), http.StatusNotFound)
+		return
+	}
+	sh := &Shift{}
+	if req.ToPool != "" {
+		if req.From != "" || req.To != "" {
+			http.Error(w, "a shift is either between backends or to another pool", http.StatusBadRequest)
+			return
+		}
+		if sh.ToPool = findPool(req.ToPool); sh.ToPool == nil || sh.ToPool == pool {
+			http.Error(w, "to_pool must be another pool", http.StatusBadRequest)
+			return
+		}
+		if shiftsBackTo(sh.ToPool, pool) {
+			http.Error(w, fmt.Sprintf("pool %q already shifts traffic back to %q; delete that shift first", req.ToPool, pool.Name), http.StatusConflict)
+			return
+		}
+	} else {
+		sh.From, sh.To = pool.FindBackend(req.From), pool.FindBackend(req.To)
+		if sh.From == nil || sh.To == nil || sh.From == sh.To {
+			http.Error(w, "from and to must be two different backends of the pool", http.StatusBadRequest)
+			return
+		}
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 || req.Steps <= 0 {
+		http.Error(w, "duration and steps must be positive", http.StatusBadRequest)
+		return
+	}
+
+	sh.Duration, sh.Steps, sh.MaxErrorRate = d, req.Steps, req.MaxErrorRate
+	pool.StartShift(sh)
+	writeJSON(w, http.StatusAccepted, sh.Status())
+}
+
+func getShift(w http.ResponseWriter, r *http.Request) {
+	pool := findPool(r.URL.Query().Get("pool"))
+	if pool == nil {
+		http.Error(w, "unknown pool", http.StatusNotFound)
+		return
+	}
+	sh := pool.shift.Load()
+	if sh == nil {
+		http.Error(w, "no shift in progress", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, sh.Status())
+}
+
+func deleteShift(w http.ResponseWriter, r *http.Request) {
+	pool := findPool(r.URL.Query().Get("pool"))
+	if pool == nil {
+		http.Error(w, "unknown pool", http.StatusNotFound)
+		return
+	}
+	sh := pool.StopShift()
+	if sh == nil {
+		http.Error(w, "no shift in progress", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, sh.Status())
+}
@@ -0,0 +1,47 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"testing"
+)
+
+// two pools whose finished shifts point at each other, e.g. blue -> green
+// and then green -> blue for a rollback, serve a request once instead of
+// bouncing it between them
+func TestPoolShiftsDoNotLoop(t *testing.T) {
+	blue, err := NewHarness(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blue.Close()
+	green, err := NewHarness(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer green.Close()
+	blue.Pool.Name, green.Pool.Name = "blue", "green"
+
+	toGreen := &Shift{ToPool: green.Pool, pool: blue.Pool}
+	toGreen.set(1, "completed", "")
+	blue.Pool.shift.Store(toGreen)
+	if !shiftsBackTo(blue.Pool, green.Pool) {
+		t.Fatal("a green -> blue shift should be refused while blue shifts to green")
+	}
+
+	toBlue := &Shift{ToPool: blue.Pool, pool: green.Pool}
+	toBlue.set(1, "completed", "")
+	green.Pool.shift.Store(toBlue)
+
+	echo, status, err := blue.Get("/")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("got %d, %v", status, err)
+	}
+	if echo.BackendPort != green.Port(0) {
+		t.Fatalf("served by port %d, want green's %d", echo.BackendPort, green.Port(0))
+	}
+
+	toGreen.set(0, "rolled_back", "")
+	if shiftsBackTo(blue.Pool, green.Pool) {
+		t.Fatal("a rolled back shift should not block the reverse one")
+	}
+}
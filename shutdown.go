@@ -0,0 +1,287 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// on SIGINT or SIGTERM the balancer stops accepting connections and gives
+// requests in flight up to drainTimeout (-drain-timeout) to finish before
+// it exits. a second signal exits at once. on Windows, Ctrl+C and
+// Ctrl+Break in the console drain the same way, see drainLimit
+var drainTimeout = 30 * time.Second
+
+// once drained the balancer logs a ShutdownReport and, with
+// -shutdown-report, also writes it to that file as JSON. hooks registered
+// with onShutdown, such as writing out the -access-log queue and releasing
+// the -ha-consul session, run before it exits
+var (
+	shutdownReportFile string
+	startedAt          = time.Now()
+)
+
+// ShutdownReport sums up the process's life
+type ShutdownReport struct {
+	Started     time.Time            `json:"started"`
+	Stopped     time.Time            `json:"stopped"`
+	Uptime      string               `json:"uptime"`
+	Requests    uint64               `json:"requests"`
+	Errors      ShutdownErrors       `json:"errors"`
+	Connections ShutdownConnections  `json:"connections"`
+	Backends    []ShutdownBackendRow `json:"backends"`
+}
+
+type ShutdownErrors struct {
+	BackendFailures uint64 `json:"backend_failures"` // 5xx responses and transport errors
+	Retries         uint64 `json:"retries"`
+	Failovers       uint64 `json:"failovers"`
+	Rejected        uint64 `json:"rejected"` // turned away at pool limits
+}
+
+type ShutdownConnections struct {
+	Open      int64 `json:"open"`      // when the signal came
+	Drained   int64 `json:"drained"`   // of those, closed within the drain timeout
+	Abandoned int64 `json:"abandoned"` // still open when it ran out
+}
+
+type ShutdownBackendRow struct {
+	Pool     string `json:"pool"`
+	Name     string `json:"name"`
+	Requests uint64 `json:"requests"`
+	Failures uint64 `json:"failures"`
+	Retries  uint64 `json:"retries"`
+}
+
+func openConnections() int64 {
+	var n int64
+	for _, l := range listening() {
+		n += l.active.Load()
+	}
+	return n
+}
+
+func shutdownReport(openAtSignal int64) ShutdownReport {
+	now := time.Now()
+	rep := ShutdownReport{
+		Started:  startedAt,
+		Stopped:  now,
+		Uptime:   now.Sub(startedAt).Round(time.Second).String(),
+		Backends: []ShutdownBackendRow{},
+	}
+	left := openConnections()
+	rep.Connections = ShutdownConnections{Open: openAtSignal, Drained: max(openAtSignal-left, 0), Abandoned: left}
+	for _, p := range pools {
+		rep.Requests += p.requests.Load()
+		rep.Errors.Failovers += p.failovers.Load()
+		rep.Errors.Rejected += p.rejected.Load()
+		for _, b := range p.Backends() {
+			requests, failures := b.Counts()
+			retries := b.retries.Load()
+			rep.Errors.BackendFailures += failures
+			rep.Errors.Retries += retries
+			rep.Backends = append(rep.Backends, ShutdownBackendRow{
+				Pool: p.Name, Name: b.Name(), Requests: requests, Failures: failures, Retries: retries,
+			})
+		}
+	}
+	return rep
+}
+
+func writeShutdownReport(rep ShutdownReport) {
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return
+	}
+	log.Printf("Shutdown report: %s\n", data)
+	if shutdownReportFile == "" {
+		return
+	}
+	if err := os.WriteFile(shutdownReportFile, append(data, '\n'), 0o644); err != nil {
+		log.Println("Shutdown report not written: ", err)
+	}
+}
+
+var (
+	shutdownMux   sync.Mutex
+	drainServers  []*http.Server
+	shutdownHooks []func(ctx context.Context) error
+	shutdownDone  = make(chan struct{})
+)
+
+// drainOnShutdown registers a server to be drained on shutdown
+func drainOnShutdown(srv *http.Server) {
+	shutdownMux.Lock()
+	defer shutdownMux.Unlock()
+	drainServers = append(drainServers, srv)
+}
+
+// onShutdown runs hook once the servers are drained
+func onShutdown(hook func(ctx context.Context) error) {
+	shutdownMux.Lock()
+	defer shutdownMux.Unlock()
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// shutdownState is how far the drain on shutdown is, for GET /admin/shutdown
+var shutdownState struct {
+	mux      sync.Mutex
+	signal   string
+	started  time.Time // zero until a signal comes
+	deadline time.Time
+	done     time.Time
+	atSignal int64 // requests in flight when it came
+}
+
+// ShutdownStatus is GET /admin/shutdown: whether the balancer is draining
+// to exit and what it is still waiting for, so an operator can tell when
+// it is safe to go on, e.g. to stop the machine
+type ShutdownStatus struct {
+	State       string                `json:"state"` // running, draining or done
+	Signal      string                `json:"signal,omitempty"`
+	Started     *time.Time            `json:"started,omitempty"`
+	Deadline    *time.Time            `json:"deadline,omitempty"` // when what is left is cut off
+	Connections int64                 `json:"connections"`        // client connections open
+	InFlight    int64                 `json:"in_flight"`          // requests being proxied
+	Finished    int64                 `json:"finished"`           // of those in flight at the signal
+	Oldest      float64               `json:"oldest_age_seconds,omitempty"`
+	ETA         float64               `json:"eta_seconds,omitempty"` // until drained, within the deadline
+	Backends    []ShutdownDrainStatus `json:"backends,omitempty"`    // those still serving requests
+}
+
+type ShutdownDrainStatus struct {
+	Pool     string  `json:"pool"`
+	Backend  string  `json:"backend"`
+	InFlight int64   `json:"in_flight"`
+	Oldest   float64 `json:"oldest_age_seconds,omitempty"`
+}
+
+func requestsInFlight() int64 {
+	var n int64
+	for _, p := range pools {
+		for _, b := range p.Backends() {
+			n += b.InFlight()
+		}
+	}
+	return n
+}
+
+func shutdownStatus() ShutdownStatus {
+	shutdownState.mux.Lock()
+	signal, started, deadline, done, atSignal := shutdownState.signal, shutdownState.started, shutdownState.deadline, shutdownState.done, shutdownState.atSignal
+	shutdownState.mux.Unlock()
+
+	st := ShutdownStatus{State: "running", Connections: openConnections(), InFlight: requestsInFlight()}
+	if started.IsZero() {
+		return st
+	}
+	st.State, st.Signal, st.Started, st.Deadline = "draining", signal, &started, &deadline
+	if !done.IsZero() {
+		st.State = "done"
+	}
+	st.Finished = max(atSignal-st.InFlight, 0)
+	if oldest, ok := activeRequests.oldest(nil); ok {
+		st.Oldest = time.Since(oldest).Seconds()
+	}
+	if eta := drainETA(atSignal, st.InFlight, time.Since(started)); eta > 0 {
+		st.ETA = min(eta, time.Until(deadline)).Seconds()
+	}
+	for _, p := range pools {
+		for _, b := range p.Backends() {
+			n := b.InFlight()
+			if n == 0 {
+				continue
+			}
+			bs := ShutdownDrainStatus{Pool: p.Name, Backend: b.Name(), InFlight: n}
+			if oldest, ok := activeRequests.oldest(b); ok {
+				bs.Oldest = time.Since(oldest).Seconds()
+			}
+			st.Backends = append(st.Backends, bs)
+		}
+	}
+	return st
+}
+
+func getShutdown(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, shutdownStatus())
+}
+
+// serveErr is a Serve error worth dying over, i.e. anything but a shutdown
+func serveErr(err error) bool {
+	return err != nil && !errors.Is(err, http.ErrServerClosed)
+}
+
+// shutdownOnSignal waits for a signal and drains; stopHealth stops the
+// health checks so none flips a backend mid-drain. shutdownDone is closed
+// once it is safe to exit
+func shutdownOnSignal(stopHealth context.CancelFunc) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	received := <-sig
+	limit := drainLimit(received)
+	log.Printf("Received %s, draining connections for up to %s\n", received, limit)
+	go func() {
+		log.Printf("Received %s again, exiting\n", <-sig)
+		os.Exit(1)
+	}()
+	stopHealth()
+	openAtSignal := openConnections()
+	shutdownState.mux.Lock()
+	shutdownState.signal = received.String()
+	shutdownState.started = time.Now()
+	shutdownState.deadline = shutdownState.started.Add(limit)
+	shutdownState.atSignal = requestsInFlight()
+	shutdownState.mux.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+	shutdownMux.Lock()
+	servers, hooks := drainServers, shutdownHooks
+	shutdownMux.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(5 * time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-drained:
+				return
+			case <-tick.C:
+			}
+			st := shutdownStatus()
+			log.Printf("Draining: %d connections open, %d requests in flight, the oldest for %.1fs\n", st.Connections, st.InFlight, st.Oldest)
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println("Drain incomplete: ", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(drained)
+	rep := shutdownReport(openAtSignal)
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			log.Println("Shutdown: ", err)
+		}
+	}
+	writeShutdownReport(rep)
+	shutdownState.mux.Lock()
+	shutdownState.done = time.Now()
+	shutdownState.mux.Unlock()
+	log.Println("Shutdown complete")
+	close(shutdownDone)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package loadbalancer
+
+import (
+	"os"
+	"time"
+)
+
+func drainLimit(sig os.Signal) time.Duration {
+	return drainTimeout
+}
@@ -0,0 +1,20 @@
+package loadbalancer
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Go delivers Ctrl+C and Ctrl+Break in a console as os.Interrupt, and a
+// closed console window, logoff and system shutdown as SIGTERM. Windows ends
+// the process about five seconds after the latter whatever it is doing, so
+// the drain is cut short to leave time for the shutdown report
+const consoleCloseDrain = 4 * time.Second
+
+func drainLimit(sig os.Signal) time.Duration {
+	if sig == syscall.SIGTERM {
+		return min(drainTimeout, consoleCloseDrain)
+	}
+	return drainTimeout
+}
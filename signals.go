@@ -0,0 +1,88 @@
+package loadbalancer
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// with -backend-signals a backend can report on itself in response headers,
+// on proxied responses and health probes alike: "X-Drain: true" takes it out
+// of rotation, "X-Healthy: degraded" cuts its share to degradedWeightPercent
+// of its weight. every response that carries neither clears the state, so a
+// drained backend comes back once its health probes stop asking to drain.
+// the headers are not passed on to clients
+const (
+	drainHeader   = "X-Drain"
+	healthyHeader = "X-Healthy"
+)
+
+var (
+	backendSignals        bool
+	degradedWeightPercent = 50
+)
+
+// backend signal states
+const (
+	signalNone int32 = iota
+	signalDegraded
+	signalDraining
+)
+
+var signalNames = []string{"", "degraded", "draining"}
+
+// backendSignal is what a backend last said about itself
+type backendSignal struct {
+	state atomic.Int32
+}
+
+// observeSignals reads the backend's signal headers from a response
+func (b *Backend) observeSignals(h http.Header) {
+	if !backendSignals {
+		return
+	}
+	state := signalNone
+	if strings.EqualFold(strings.TrimSpace(h.Get(drainHeader)), "true") {
+		state = signalDraining
+	} else if strings.EqualFold(strings.TrimSpace(h.Get(healthyHeader)), "degraded") {
+		state = signalDegraded
+	}
+	h.Del(drainHeader)
+	h.Del(healthyHeader)
+	if old := b.signal.state.Swap(state); old != state {
+		switch state {
+		case signalNone:
+			log.Printf("Backend %s: no longer %s\n", b.Name(), signalNames[old])
+		default:
+			log.Printf("Backend %s: reports %s\n", b.Name(), signalNames[state])
+		}
+	}
+}
+
+// Signal is the backend's self-reported state, "" when it has none
+func (b *Backend) Signal() string {
+	if state := b.signal.state.Load(); state != signalNone || !b.BackingOff() {
+		return signalNames[state]
+	}
+	return "backing-off"
+}
+
+// Draining reports whether the backend asked to be taken out of rotation
+func (b *Backend) Draining() bool {
+	return b.signal.state.Load() == signalDraining
+}
+
+// effectiveWeight is the weight strategies balance by, in hundredths so a
+// degraded backend of weight 1 still gets less than its peers. it is cut
+// further for recent errors with -weight-decay
+func (b *Backend) effectiveWeight() int {
+	w := b.Weight * 100
+	if b.signal.state.Load() == signalDegraded || b.BackingOff() {
+		w = max(1, b.Weight*degradedWeightPercent)
+	}
+	if share := b.decayShare(); share < 1 {
+		w = max(1, int(float64(w)*share))
+	}
+	return w
+}
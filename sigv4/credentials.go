@@ -0,0 +1,177 @@
+package sigv4
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials sign requests; role credentials expire
+type Credentials struct {
+	AccessKey string    `json:"AccessKeyId"`
+	SecretKey string    `json:"SecretAccessKey"`
+	Token     string    `json:"Token"`
+	Expires   time.Time `json:"Expiration"` // zero for long-lived keys
+}
+
+var ambient = &credentialChain{client: &http.Client{Timeout: 2 * time.Second}}
+
+// AmbientCredentials are the first of: AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN; the AWS_PROFILE (or default)
+// profile in the shared credentials file; the ECS task role; the EC2
+// instance role. role credentials are fetched again shortly before they
+// expire
+func AmbientCredentials() (Credentials, error) {
+	return ambient.get()
+}
+
+type credentialChain struct {
+	mux    sync.Mutex
+	creds  Credentials
+	client *http.Client
+}
+
+func (c *credentialChain) get() (Credentials, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.creds.AccessKey != "" && (c.creds.Expires.IsZero() || time.Until(c.creds.Expires) > 5*time.Minute) {
+		return c.creds, nil
+	}
+	creds, err := c.find()
+	if err != nil {
+		return Credentials{}, err
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+func (c *credentialChain) find() (Credentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return Credentials{AccessKey: id, SecretKey: secret, Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if creds, ok := sharedCredentials(); ok {
+		return creds, nil
+	}
+	if full, rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"), os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); full != "" || rel != "" {
+		if full == "" {
+			full = "http://169.254.170.2" + rel
+		}
+		req, err := http.NewRequest(http.MethodGet, full, nil)
+		if err != nil {
+			return Credentials{}, err
+		}
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		return c.fetch(req)
+	}
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") != "true" {
+		return c.instanceRole()
+	}
+	return Credentials{}, errors.New("no AWS credentials in the environment, shared credentials file, container or instance metadata")
+}
+
+// sharedCredentials reads the profile from ~/.aws/credentials, or
+// AWS_SHARED_CREDENTIALS_FILE
+func sharedCredentials() (Credentials, bool) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, false
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Credentials{}, false
+	}
+	defer f.Close()
+	profile := cmp.Or(os.Getenv("AWS_PROFILE"), "default")
+	var creds Credentials
+	in := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			in = strings.TrimSpace(strings.Trim(line, "[]")) == profile
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !in || !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKey = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.Token = strings.TrimSpace(value)
+		}
+	}
+	return creds, creds.AccessKey != "" && creds.SecretKey != ""
+}
+
+// instanceRole asks the EC2 instance metadata service, with an IMDSv2 token
+func (c *credentialChain) instanceRole() (Credentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, _ := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := c.read(req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("no AWS credentials found, and instance metadata: %w", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, imds+"/meta-data/iam/security-credentials/", nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	role, err := c.read(req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("instance role: %w", err)
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	req, _ = http.NewRequest(http.MethodGet, imds+"/meta-data/iam/security-credentials/"+name, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	return c.fetch(req)
+}
+
+// fetch reads role credentials in the JSON the container and instance
+// metadata services share
+func (c *credentialChain) fetch(req *http.Request) (Credentials, error) {
+	body, err := c.read(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	var creds Credentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return Credentials{}, err
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return Credentials{}, fmt.Errorf("%s returned no credentials", req.URL)
+	}
+	return creds, nil
+}
+
+func (c *credentialChain) read(req *http.Request) ([]byte, error) {
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", req.URL, res.Status)
+	}
+	return body, nil
+}
@@ -0,0 +1,251 @@
+package loadbalancer
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// the simulator is a discrete-event model of the pool: no sockets, no sleeping.
+// every strategy sees the exact same arrival trace so their load distribution
+// and tail latency can be compared offline.
+
+type simNode struct {
+	mean     time.Duration // mean service time
+	workers  int           // requests served concurrently, the rest queue
+	busy     int
+	queue    []simJob
+	inflight int
+	served   int
+	ewma     float64 // observed latency in ns, used by the ewma policy
+}
+
+type simJob struct {
+	arrival time.Duration
+	u       float64 // uniform draw turned into a service time by the chosen node
+}
+
+type simEvent struct {
+	at   time.Duration
+	node int
+	job  simJob
+}
+
+type simEvents []simEvent
+
+func (e simEvents) Len() int           { return len(e) }
+func (e simEvents) Less(i, j int) bool { return e[i].at < e[j].at }
+func (e simEvents) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e *simEvents) Push(x any)        { *e = append(*e, x.(simEvent)) }
+
+func (e *simEvents) Pop() any {
+	old := *e
+	x := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return x
+}
+
+func (e simEvents) peek() (simEvent, bool) {
+	if len(e) == 0 {
+		return simEvent{}, false
+	}
+	return e[0], true
+}
+
+type simPolicy interface {
+	pick(nodes []*simNode, rng *rand.Rand) int
+}
+
+type simRoundRobin struct{ next int }
+
+func (p *simRoundRobin) pick(nodes []*simNode, _ *rand.Rand) int {
+	p.next = (p.next + 1) % len(nodes)
+	return p.next
+}
+
+type simLeastConn struct{}
+
+func (simLeastConn) pick(nodes []*simNode, rng *rand.Rand) int {
+	best := rng.IntN(len(nodes))
+	for i, n := range nodes {
+		if n.inflight < nodes[best].inflight {
+			best = i
+		}
+	}
+	return best
+}
+
+// power of two choices: sample two nodes, keep the less loaded one
+type simP2C struct{}
+
+func (simP2C) pick(nodes []*simNode, rng *rand.Rand) int {
+	a, b := rng.IntN(len(nodes)), rng.IntN(len(nodes))
+	if nodes[b].inflight < nodes[a].inflight {
+		return b
+	}
+	return a
+}
+
+// ewma weighs observed latency by outstanding work (peak-ewma style)
+type simEWMA struct{}
+
+func (simEWMA) pick(nodes []*simNode, rng *rand.Rand) int {
+	best, bestCost := 0, math.Inf(1)
+	offset := rng.IntN(len(nodes))
+	for k := range nodes {
+		i := (k + offset) % len(nodes)
+		cost := nodes[i].ewma * float64(nodes[i].inflight+1)
+		if cost < bestCost {
+			best, bestCost = i, cost
+		}
+	}
+	return best
+}
+
+var simPolicies = map[string]func() simPolicy{
+	"round-robin": func() simPolicy { return &simRoundRobin{next: -1} },
+	"least-conn":  func() simPolicy { return simLeastConn{} },
+	"p2c":         func() simPolicy { return simP2C{} },
+	"ewma":        func() simPolicy { return simEWMA{} },
+}
+
+type simResult struct {
+	strategy  string
+	served    []int
+	latencies []time.Duration
+}
+
+func simulate(name string, trace []simJob, means []time.Duration, workers int, seed uint64) simResult {
+	policy := simPolicies[name]()
+	rng := rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15))
+	nodes := make([]*simNode, len(means))
+	for i, m := range means {
+		nodes[i] = &simNode{mean: m, workers: workers, ewma: float64(m)}
+	}
+
+	events := &simEvents{}
+	latencies := make([]time.Duration, 0, len(trace))
+
+	start := func(i int, job simJob, now time.Duration) {
+		n := nodes[i]
+		n.busy++
+		service := time.Duration(-float64(n.mean) * math.Log(1-job.u))
+		heap.Push(events, simEvent{at: now + service, node: i, job: job})
+	}
+
+	complete := func(ev simEvent) {
+		n := nodes[ev.node]
+		lat := ev.at - ev.job.arrival
+		latencies = append(latencies, lat)
+		n.inflight--
+		n.busy--
+		n.served++
+		n.ewma = 0.9*n.ewma + 0.1*float64(lat)
+		if len(n.queue) > 0 {
+			next := n.queue[0]
+			n.queue = n.queue[1:]
+			start(ev.node, next, ev.at)
+		}
+	}
+
+	for _, job := range trace {
+		for ev, ok := events.peek(); ok && ev.at <= job.arrival; ev, ok = events.peek() {
+			complete(heap.Pop(events).(simEvent))
+		}
+
+		i := policy.pick(nodes, rng)
+		nodes[i].inflight++
+		if nodes[i].busy < nodes[i].workers {
+			start(i, job, job.arrival)
+		} else {
+			nodes[i].queue = append(nodes[i].queue, job)
+		}
+	}
+	for events.Len() > 0 {
+		complete(heap.Pop(events).(simEvent))
+	}
+
+	res := simResult{strategy: name, latencies: latencies}
+	for _, n := range nodes {
+		res.served = append(res.served, n.served)
+	}
+	return res
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// runSimulate implements `loadbalancer simulate`
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	service := fs.String("service", "20ms,20ms,20ms,80ms", "Mean service time of each simulated backend")
+	workers := fs.Int("workers", 4, "Requests each backend serves concurrently")
+	requests := fs.Int("requests", 100000, "Number of requests in the trace")
+	rate := fs.Float64("rate", 400, "Mean arrival rate in requests per second (Poisson)")
+	strategies := fs.String("strategies", "round-robin,least-conn,p2c,ewma", "Strategies to compare")
+	seed := fs.Uint64("seed", 1, "Seed for the trace and for randomized strategies")
+	_ = fs.Parse(args)
+
+	var means []time.Duration
+	for _, tok := range strings.Split(*service, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(tok))
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid service time %q", tok)
+		}
+		means = append(means, d)
+	}
+	names := strings.Split(*strategies, ",")
+	for _, name := range names {
+		if _, ok := simPolicies[name]; !ok {
+			log.Fatalf("Unknown strategy %q", name)
+		}
+	}
+	if *requests <= 0 || *rate <= 0 || *workers <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// one shared trace: exponential inter-arrival gaps plus a service draw per request
+	rng := rand.New(rand.NewPCG(*seed, *seed))
+	trace := make([]simJob, *requests)
+	var now time.Duration
+	for i := range trace {
+		now += time.Duration(rng.ExpFloat64() / *rate * float64(time.Second))
+		trace[i] = simJob{arrival: now, u: rng.Float64()}
+	}
+
+	fmt.Printf("%d requests at %.0f rps over %d backends (%s), %d workers each\n\n",
+		*requests, *rate, len(means), *service, *workers)
+	fmt.Printf("%-12s %10s %10s %10s %10s  %s\n", "strategy", "mean", "p50", "p99", "p99.9", "share per backend")
+	for _, name := range names {
+		res := simulate(name, trace, means, *workers, *seed)
+		slices.Sort(res.latencies)
+
+		var total time.Duration
+		for _, l := range res.latencies {
+			total += l
+		}
+		shares := make([]string, len(res.served))
+		for i, n := range res.served {
+			shares[i] = fmt.Sprintf("%.1f%%", 100*float64(n)/float64(len(trace)))
+		}
+		fmt.Printf("%-12s %10s %10s %10s %10s  %s\n", name,
+			(total / time.Duration(len(res.latencies))).Round(time.Microsecond),
+			percentile(res.latencies, 50).Round(time.Microsecond),
+			percentile(res.latencies, 99).Round(time.Microsecond),
+			percentile(res.latencies, 99.9).Round(time.Microsecond),
+			strings.Join(shares, " "))
+	}
+}
@@ -0,0 +1,146 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// every route keeps histograms of its request and response body sizes, and
+// one with max_response_bytes refuses bigger replies from its backends: a
+// reply announcing a bigger Content-Length is answered with a 502, one that
+// grows past the cap as it streams is cut off there, and either is logged.
+// e.g. in -routes
+//
+//	{"path_prefix": "/export/", "pool": "reports", "max_response_bytes": 52428800}
+type routeSizes struct {
+	requests  sizeHistogram
+	responses sizeHistogram
+	tooLarge  atomic.Uint64
+}
+
+// upper bounds, in bytes, of the body size histogram buckets
+var sizeBuckets = [...]float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+// sizeHistogram is histogram over sizeBuckets
+type sizeHistogram struct {
+	counts [len(sizeBuckets) + 1]atomic.Uint64
+	sum    atomic.Int64
+}
+
+func (h *sizeHistogram) Observe(n int64) {
+	i := 0
+	for i < len(sizeBuckets) && float64(n) > sizeBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(n)
+}
+
+func (h *sizeHistogram) write(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, le := range sizeBuckets {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, cumulative)
+	}
+	cumulative += h.counts[len(sizeBuckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %d\n", name, labels, h.sum.Load())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, cumulative)
+}
+
+var errResponseTooLarge = errors.New("response over the route's max_response_bytes")
+
+// serveSized serves r through rt's pool, measuring both bodies and holding
+// the response to the route's cap
+func (rt *Route) serveSized(w http.ResponseWriter, r *http.Request) {
+	var body *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+	sw := &sizeWriter{ResponseWriter: w, route: rt, r: r}
+	defer func() {
+		if body != nil {
+			rt.sizes.requests.Observe(body.n)
+		} else {
+			rt.sizes.requests.Observe(0)
+		}
+		rt.sizes.responses.Observe(max(sw.written, sw.size))
+	}()
+	rt.pool.ServeHTTP(sw, r)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sizeWriter counts what the backend's response puts out and stops it at
+// the route's cap
+type sizeWriter struct {
+	http.ResponseWriter
+	route   *Route
+	r       *http.Request
+	wrote   bool
+	refused bool
+	written int64
+	size    int64 // of a refused response, as far as it is known
+}
+
+func (sw *sizeWriter) WriteHeader(status int) {
+	if sw.wrote {
+		return
+	}
+	if status >= 200 {
+		sw.wrote = true
+	}
+	// a HEAD or 304 response's Content-Length is that of a body it doesn't have
+	bodiless := sw.r.Method == http.MethodHead || status == http.StatusNotModified || status < 200
+	max := sw.route.MaxResponseBytes
+	if size, err := strconv.ParseInt(sw.Header().Get("Content-Length"), 10, 64); err == nil && max > 0 && size > max && !bodiless {
+		sw.refuse(size)
+		clear(sw.Header())
+		writeError(sw.ResponseWriter, sw.r, http.StatusBadGateway, "response_too_large", "The upstream response was too large.", 0)
+		// the proxy gives up on the first failed write, so it has to be out
+		_ = http.NewResponseController(sw.ResponseWriter).Flush()
+		return
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *sizeWriter) Write(p []byte) (int, error) {
+	if !sw.wrote {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.refused {
+		return 0, errResponseTooLarge
+	}
+	if max := sw.route.MaxResponseBytes; max > 0 && sw.written+int64(len(p)) > max {
+		sw.refuse(sw.written + int64(len(p)))
+		return 0, errResponseTooLarge
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.written += int64(n)
+	return n, err
+}
+
+func (sw *sizeWriter) refuse(size int64) {
+	sw.refused, sw.size = true, size
+	sw.route.sizes.tooLarge.Add(1)
+	log.Printf("%s(%s) Route %s: response of at least %d bytes is over max_response_bytes %d, cut off\n", sw.r.RemoteAddr, sw.r.URL.Path, sw.route.Name, size, sw.route.MaxResponseBytes)
+}
+
+func (sw *sizeWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,191 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// websocketGUID is the fixed key suffix from RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+type smokeCheck struct {
+	name string
+	run  func() error
+}
+
+// runSmoke implements `loadbalancer smoke`: a quick battery of requests against
+// a live deployment that exits non-zero when anything looks wrong
+func runSmoke(args []string) {
+	fs := flag.NewFlagSet("smoke", flag.ExitOnError)
+	target := fs.String("target", "", "Base URL of the balancer (e.g. http://lb:3000)")
+	idHeader := fs.String("id-header", "X-Served-By", "Response header identifying the backend")
+	requests := fs.Int("requests", 20, "Requests used to check the distribution")
+	minBackends := fs.Int("min-backends", 2, "Distinct backends the distribution check must reach")
+	bodySize := fs.Int("body-size", 8<<20, "Size of the large request body in bytes")
+	wsPath := fs.String("ws-path", "/ws", "Path used for the WebSocket upgrade check (empty skips it)")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout per request")
+	_ = fs.Parse(args)
+
+	base, err := url.Parse(strings.TrimSuffix(*target, "/"))
+	if *target == "" || err != nil || base.Host == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	client := &http.Client{Timeout: *timeout}
+
+	checks := []smokeCheck{
+		{"distribution", func() error {
+			seen := map[string]int{}
+			for range *requests {
+				res, err := client.Get(base.String() + "/")
+				if err != nil {
+					return err
+				}
+				_, _ = io.Copy(io.Discard, res.Body)
+				_ = res.Body.Close()
+				if res.StatusCode >= 400 {
+					return fmt.Errorf("status %d", res.StatusCode)
+				}
+				seen[res.Header.Get(*idHeader)]++
+			}
+
+			ids := make([]string, 0, len(seen))
+			for id, n := range seen {
+				ids = append(ids, fmt.Sprintf("%s=%d", id, n))
+			}
+			sort.Strings(ids)
+			fmt.Printf("    %s: %s\n", *idHeader, strings.Join(ids, " "))
+			if _, ok := seen[""]; ok {
+				return fmt.Errorf("some responses had no %s header", *idHeader)
+			}
+			if len(seen) < *minBackends {
+				return fmt.Errorf("reached %d backends, want at least %d", len(seen), *minBackends)
+			}
+			return nil
+		}},
+		{"large body", func() error {
+			body := make([]byte, *bodySize)
+			_, _ = rand.Read(body)
+			res, err := client.Post(base.String()+"/", "application/octet-stream", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.StatusCode >= 400 {
+				return fmt.Errorf("status %d", res.StatusCode)
+			}
+
+			// echo backends report what they received, so check the body arrived intact
+			var echo Echo
+			if json.NewDecoder(res.Body).Decode(&echo) == nil && echo.BodySHA256 != "" {
+				sum := sha256.Sum256(body)
+				if echo.BodySHA256 != hex.EncodeToString(sum[:]) {
+					return fmt.Errorf("backend received a different body (%d bytes)", echo.BodyBytes)
+				}
+			}
+			return nil
+		}},
+		{"streaming", func() error {
+			// chunked request body written over time, read back as it streams
+			pr, pw := io.Pipe()
+			go func() {
+				for i := range 5 {
+					fmt.Fprintf(pw, "chunk %d\n", i)
+					time.Sleep(50 * time.Millisecond)
+				}
+				_ = pw.Close()
+			}()
+			req, _ := http.NewRequest(http.MethodPost, base.String()+"/", pr)
+			res, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.StatusCode >= 400 {
+				return fmt.Errorf("status %d", res.StatusCode)
+			}
+			_, err = io.Copy(io.Discard, res.Body)
+			return err
+		}},
+		{"websocket upgrade", func() error {
+			if *wsPath == "" {
+				fmt.Println("    skipped")
+				return nil
+			}
+			return smokeWebsocket(base, *wsPath, *timeout)
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		start := time.Now()
+		err := c.run()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %-18s %v\n", c.name, err)
+			continue
+		}
+		fmt.Printf("ok   %-18s %s\n", c.name, time.Since(start).Round(time.Millisecond))
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		os.Exit(1)
+	}
+}
+
+// smokeWebsocket performs a raw upgrade handshake and checks the accept key
+func smokeWebsocket(base *url.URL, path string, timeout time.Duration) error {
+	if base.Scheme != "http" {
+		return fmt.Errorf("websocket check only supports http targets")
+	}
+	host := base.Host
+	if base.Port() == "" {
+		host = net.JoinHostPort(base.Hostname(), "80")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, base.Host, key)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("status %d, want 101", res.StatusCode)
+	}
+	if got := res.Header.Get("Sec-WebSocket-Accept"); got != websocketAccept(key) {
+		return fmt.Errorf("bad Sec-WebSocket-Accept %q", got)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"load-balancer/framing"
+)
+
+// with -strict-http (the default) every connection's bytes are checked as
+// they are read, see framing.Scanner, and requests on a connection with
+// ambiguous framing are refused. with -h2c a connection that turns to
+// HTTP/2, by its preface or an h2c upgrade, is no longer scanned: its binary
+// frames aren't HTTP/1 and can't be misframed this way
+var strictHTTP = true
+
+// strictConn scans what is read from the client
+type strictConn struct {
+	net.Conn
+
+	mux  sync.Mutex
+	scan framing.Scanner
+}
+
+func (c *strictConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mux.Lock()
+	c.scan.Feed(p[:n])
+	c.mux.Unlock()
+	return n, err
+}
+
+func (c *strictConn) violation() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.scan.Violation()
+}
+
+type strictListener struct {
+	net.Listener
+}
+
+// StrictListener checks the framing of every connection l accepts, but for
+// HTTP/2 over TLS
+func StrictListener(l net.Listener) net.Listener {
+	if !strictHTTP {
+		return l
+	}
+	return strictListener{l}
+}
+
+func (l strictListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*tls.Conn); ok && tc.ConnectionState().NegotiatedProtocol == "h2" {
+		return c, nil
+	}
+	return &strictConn{Conn: c, scan: framing.Scanner{H2C: frontH2C}}, nil
+}
+
+type strictConnKey struct{}
+
+// strictConnContext is the servers' ConnContext, so handlers can find the
+// scanner of the connection a request came in on
+func strictConnContext(ctx context.Context, c net.Conn) context.Context {
+	if sc, ok := c.(*strictConn); ok {
+		return context.WithValue(ctx, strictConnKey{}, sc)
+	}
+	return ctx
+}
+
+// WithStrictHTTP refuses requests from connections whose framing turned out
+// ambiguous, and closes those connections
+func WithStrictHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(strictConnKey{}).(*strictConn); ok {
+			if reason := c.violation(); reason != "" {
+				log.Printf("%s(%s) Refused ambiguous request: %s\n", r.RemoteAddr, r.URL.Path, reason)
+				w.Header().Set("Connection", "close")
+				writeError(w, r, http.StatusBadRequest, "ambiguous_request", "Ambiguous request framing: "+reason+".", 0)
+				return
+			}
+			r = withTLSState(r, c.Conn)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
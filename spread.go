@@ -0,0 +1,114 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a backend given by a hostname with several addresses is normally dialed
+// at the first one that answers, so one address takes all its connections.
+// with -upstream-spread-ips each new connection starts at the next address
+// in turn, and an address that fails to connect is tried last for
+// spreadHold, so a dead one is skipped until then. connections are kept
+// alive as usual, so requests spread as new connections are made. lookups
+// go through -resolver-servers and its cache if set
+var spreadUpstreamIPs bool
+
+// how long an address that refused a connection goes to the back of the line
+const spreadHold = 10 * time.Second
+
+// IPSpreader rotates connections across the addresses of a hostname
+type IPSpreader struct {
+	mux    sync.Mutex
+	next   map[string]uint64    // host:port -> connections started
+	failed map[string]time.Time // ip:port -> until when it is tried last
+
+	dialFailures atomic.Uint64
+}
+
+var upstreamSpread = &IPSpreader{next: map[string]uint64{}, failed: map[string]time.Time{}}
+
+// wrapDial resolves the host of addr and dials its addresses in turn,
+// starting at the next one for this host
+func (sp *IPSpreader) wrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := lookupBackendIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, target := range sp.order(addr, ips, port) {
+			conn, err := dial(ctx, network, target)
+			if err == nil {
+				sp.recovered(target)
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				// out of time, which says nothing about the address
+				return nil, err
+			}
+			sp.fail(host, target, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: no addresses", host)
+		}
+		return nil, firstErr
+	}
+}
+
+// order is ips as ip:port, rotated to start at addr's next address, with
+// those that recently failed at the end
+func (sp *IPSpreader) order(addr string, ips []net.IP, port string) []string {
+	now := time.Now()
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	var ok, held []string
+	for _, ip := range ips {
+		target := net.JoinHostPort(ip.String(), port)
+		if until, failed := sp.failed[target]; failed && now.Before(until) {
+			held = append(held, target)
+			continue
+		}
+		ok = append(ok, target)
+	}
+	// rotating only the good ones keeps their shares even
+	if len(ok) > 0 {
+		start := int(sp.next[addr] % uint64(len(ok)))
+		ok = slices.Concat(ok[start:], ok[:start])
+	}
+	sp.next[addr]++
+	return append(ok, held...)
+}
+
+func (sp *IPSpreader) fail(host, target string, err error) {
+	sp.dialFailures.Add(1)
+	sp.mux.Lock()
+	_, known := sp.failed[target]
+	sp.failed[target] = time.Now().Add(spreadHold)
+	sp.mux.Unlock()
+	if !known {
+		log.Printf("Upstream %s: %s failed, trying its other addresses first for %s: %v\n", host, target, spreadHold, err)
+	}
+}
+
+func (sp *IPSpreader) recovered(target string) {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	delete(sp.failed, target)
+}
@@ -0,0 +1,107 @@
+package loadbalancer
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// with -hold the balancer starts cold for a blue/green switch: it loads its
+// config, probes every pool once right away, opens connections to the live
+// backends and then reports ready on /readyz, but only binds its listeners,
+// tenants' included, once POST /admin/go says so. the old instance keeps
+// serving until then
+var holdTraffic bool
+
+var (
+	warmed    atomic.Bool // the startup probe pass is done
+	accepting atomic.Bool // the front listeners are open
+	goOnce    sync.Once
+	goSignal  = make(chan struct{})
+)
+
+// preload probes every pool and warms a connection to each live backend
+// through its proxy, on the warm-up path or else the health path
+func preload() {
+	log.Println("Warming up before taking traffic...")
+	for _, p := range pools {
+		p.HealthCheck()
+		path := warmupPath
+		if path == "" {
+			path = p.healthSettings().Path
+		}
+		if path == "" {
+			continue
+		}
+		for _, b := range p.Backends() {
+			if b.IsAlive() && !b.warmRequest(path) {
+				log.Printf("Backend %s: could not open a connection ahead of traffic\n", b.Name())
+			}
+		}
+	}
+	warmed.Store(true)
+}
+
+// holdUntilGo waits for the admin go signal once preload has warmed up
+func holdUntilGo() {
+	if servable() {
+		log.Println("Warm; holding traffic until POST /admin/go")
+	} else {
+		log.Println("Warm but some pools have no live backend; holding traffic until POST /admin/go")
+	}
+	<-goSignal
+	log.Println("Go received, taking traffic")
+}
+
+// servable reports whether every pool that has backends has a live one
+func servable() bool {
+	for _, p := range pools {
+		backends := p.Backends()
+		if len(backends) == 0 {
+			continue
+		}
+		live := false
+		for _, b := range backends {
+			live = live || b.IsAlive()
+		}
+		if !live {
+			return false
+		}
+	}
+	return true
+}
+
+type Readiness struct {
+	Ready     bool `json:"ready"`
+	Accepting bool `json:"accepting"`
+	Holding   bool `json:"holding"` // warm and waiting for POST /admin/go
+}
+
+// getReadyz is 200 once the instance could serve: warmed up (or past the
+// hold) and with a live backend in every pool
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	rd := Readiness{Accepting: accepting.Load()}
+	rd.Ready = (rd.Accepting || warmed.Load()) && servable()
+	rd.Holding = holdTraffic && !rd.Accepting && warmed.Load()
+	status := http.StatusOK
+	if !rd.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rd)
+}
+
+// postGo releases a held instance. it refuses while not ready unless
+// ?force=true
+func postGo(w http.ResponseWriter, r *http.Request) {
+	if !holdTraffic {
+		http.Error(w, "not holding traffic (start with -hold)", http.StatusConflict)
+		return
+	}
+	if !(warmed.Load() && servable()) && r.URL.Query().Get("force") != "true" {
+		http.Error(w, "not ready yet, see /readyz (or ?force=true)", http.StatusConflict)
+		return
+	}
+	goOnce.Do(func() { close(goSignal) })
+	w.WriteHeader(http.StatusAccepted)
+}
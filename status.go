@@ -0,0 +1,166 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// minuteCounter counts events over the last minute in one-second buckets
+type minuteCounter struct {
+	mux     sync.Mutex
+	buckets [60]uint64
+	seconds [60]int64 // the second each bucket counts
+}
+
+func (c *minuteCounter) Add(n uint64) {
+	now := time.Now().Unix()
+	i := now % 60
+	c.mux.Lock()
+	if c.seconds[i] != now {
+		c.seconds[i], c.buckets[i] = now, 0
+	}
+	c.buckets[i] += n
+	c.mux.Unlock()
+}
+
+// Sum is the count over the last 60 seconds
+func (c *minuteCounter) Sum() uint64 {
+	now := time.Now().Unix()
+	var sum uint64
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for i, s := range c.seconds {
+		if now-s < 60 {
+			sum += c.buckets[i]
+		}
+	}
+	return sum
+}
+
+// PoolStatus sums up a pool at a glance
+type PoolStatus struct {
+	Name      string  `json:"name"`
+	Healthy   int     `json:"healthy"`
+	Unhealthy int     `json:"unhealthy"` // down, draining, ejected or in maintenance
+	InFlight  int64   `json:"in_flight"`
+	MaxConns  int     `json:"max_conns,omitempty"`
+	Queued    int64   `json:"queued"` // waiting for a slot, see -lane-queue
+	Requests  uint64  `json:"requests_last_minute"`
+	Retries   uint64  `json:"retries_last_minute"` // same-backend retries and failovers
+	RetryRate float64 `json:"retry_rate"`          // retries per request over the last minute
+
+	Versions map[string]int `json:"versions,omitempty"` // backends by reported version, see -version-header
+
+	Backends []BackendHealth `json:"backends"`
+}
+
+// BackendHealth is a backend's line on the status page
+type BackendHealth struct {
+	Name      string  `json:"name"`
+	State     string  `json:"state"` // up, down, maintenance, draining, drained, ejected, degraded or backing-off
+	Weight    int     `json:"weight"`
+	InFlight  int64   `json:"in_flight"`
+	Requests  uint64  `json:"requests_last_minute"`
+	Errors    uint64  `json:"errors_last_minute"` // 5xx responses and transport errors
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// state is the first of what keeps b out of rotation, or up
+func (b *Backend) state() string {
+	switch {
+	case !b.isUp():
+		return "down"
+	case b.InMaintenance():
+		return "maintenance"
+	case b.drainState() != "":
+		return b.drainState()
+	case b.Ejected():
+		return "ejected"
+	case b.Signal() != "":
+		return b.Signal()
+	}
+	return "up"
+}
+
+func (b *Backend) health() BackendHealth {
+	bh := BackendHealth{
+		Name:     b.Name(),
+		State:    b.state(),
+		Weight:   b.Weight,
+		InFlight: b.InFlight(),
+		Requests: b.recentRequests.Sum(),
+		Errors:   b.recentFailures.Sum(),
+	}
+	if bh.Requests > 0 {
+		bh.ErrorRate = float64(bh.Errors) / float64(bh.Requests)
+	}
+	return bh
+}
+
+func (s *ServerPool) Status() PoolStatus {
+	ps := PoolStatus{
+		Name:     s.Name,
+		InFlight: s.inflight.Load(),
+		MaxConns: s.MaxConns,
+		Queued:   s.queued.Load(),
+		Requests: s.requestWindow.Sum(),
+		Retries:  s.retryWindow.Sum(),
+		Versions: s.versions(),
+		Backends: []BackendHealth{},
+	}
+	for _, b := range s.Backends() {
+		ps.Backends = append(ps.Backends, b.health())
+		if b.IsAlive() {
+			ps.Healthy++
+		} else {
+			ps.Unhealthy++
+		}
+	}
+	if ps.Requests > 0 {
+		ps.RetryRate = float64(ps.Retries) / float64(ps.Requests)
+	}
+	return ps
+}
+
+// getStatus shows every pool and its backends, as JSON or, with
+// ?format=text, as tables. /dashboard shows the same in a browser
+func getStatus(w http.ResponseWriter, r *http.Request) {
+	list := make([]PoolStatus, len(pools))
+	for i, p := range pools {
+		list[i] = p.Status()
+	}
+	uptime := time.Since(startedAt).Round(time.Second)
+	if r.URL.Query().Get("format") != "text" {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"started":        startedAt,
+			"uptime":         uptime.String(),
+			"uptime_seconds": int64(uptime.Seconds()),
+			"pools":          list,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tHEALTHY\tIN FLIGHT\tQUEUED\tREQ/MIN\tRETRIES/MIN\tRETRY RATE\tVERSIONS")
+	for _, ps := range list {
+		inflight := fmt.Sprint(ps.InFlight)
+		if ps.MaxConns > 0 {
+			inflight += fmt.Sprintf("/%d", ps.MaxConns)
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d\t%s\t%d\t%d\t%d\t%.1f%%\t%s\n", ps.Name, ps.Healthy, ps.Healthy+ps.Unhealthy,
+			inflight, ps.Queued, ps.Requests, ps.Retries, ps.RetryRate*100, formatVersions(ps.Versions))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "POOL\tBACKEND\tSTATE\tWEIGHT\tIN FLIGHT\tREQ/MIN\tERRORS/MIN\tERROR RATE")
+	for _, ps := range list {
+		for _, bh := range ps.Backends {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%.1f%%\n", ps.Name, bh.Name, bh.State, bh.Weight,
+				bh.InFlight, bh.Requests, bh.Errors, bh.ErrorRate*100)
+		}
+	}
+	fmt.Fprintf(tw, "\nup %s\n", uptime)
+	_ = tw.Flush()
+}
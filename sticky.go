@@ -0,0 +1,53 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// StickyCookie pins clients to a backend with a cookie the balancer sets
+// itself, for applications that keep session state in memory and have no
+// session cookie of their own to key Affinity on. the cookie holds a hash of
+// the backend's name, so backend addresses aren't exposed; when the pinned
+// backend is down the client is balanced as usual and re-pinned
+type StickyCookie struct {
+	Name string
+	TTL  time.Duration // 0 makes it a browser session cookie
+}
+
+func stickyValue(pool string, b *Backend) string {
+	sum := sha256.Sum256([]byte(pool + "\x00" + b.Name()))
+	return hex.EncodeToString(sum[:12])
+}
+
+// lookup returns the live backend the request's cookie points at, if any
+func (sc *StickyCookie) lookup(s *ServerPool, r *http.Request) *Backend {
+	c, err := r.Cookie(sc.Name)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	for _, b := range s.Backends() {
+		if stickyValue(s.Name, b) == c.Value {
+			if b.IsAlive() {
+				return b
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// pin sets the cookie on the response unless the client already has it
+func (sc *StickyCookie) pin(s *ServerPool, b *Backend, res *http.Response) {
+	value := stickyValue(s.Name, b)
+	if c, err := res.Request.Cookie(sc.Name); err == nil && c.Value == value {
+		return
+	}
+	cookie := &http.Cookie{Name: sc.Name, Value: value, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if sc.TTL > 0 {
+		cookie.MaxAge = int(sc.TTL / time.Second)
+	}
+	res.Header.Add("Set-Cookie", cookie.String())
+}
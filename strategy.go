@@ -0,0 +1,209 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy chooses which live backend of a pool takes the next request, or
+// nil when none is alive. implementations keep any state they need on the
+// pool or its backends so one value can serve every pool
+type Strategy interface {
+	Next(s *ServerPool) *Backend
+}
+
+var strategies = map[string]func(rng *lockedRand) Strategy{
+	"round-robin":     func(*lockedRand) Strategy { return RoundRobin{} },
+	"least-conn":      func(*lockedRand) Strategy { return LeastConn{} },
+	"random":          func(rng *lockedRand) Strategy { return &Random{rng: rng} },
+	"weighted-random": func(rng *lockedRand) Strategy { return &WeightedRandom{rng: rng} },
+	"least-latency":   func(rng *lockedRand) Strategy { return &LeastLatency{rng: rng} },
+	"consistent-hash": func(*lockedRand) Strategy { return &ConsistentHash{} },
+	"least-cost":      func(*lockedRand) Strategy { return LeastCost{} },
+	"bandit":          func(rng *lockedRand) Strategy { return &Bandit{rng: rng} },
+}
+
+// NewStrategy returns the named strategy. randomized strategies draw from a
+// generator seeded with seed, so runs are reproducible; 0 picks a random seed
+func NewStrategy(name string, seed uint64) (Strategy, error) {
+	if newStrategy, ok := strategies[name]; ok {
+		if seed == 0 {
+			seed = rand.Uint64()
+		}
+		return newStrategy(&lockedRand{r: rand.New(rand.NewPCG(seed, seed))}), nil
+	}
+	names := make([]string, 0, len(strategies))
+	for n := range strategies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown strategy %q (use %s)", name, strings.Join(names, ", "))
+}
+
+// RoundRobin cycles through the live backends in order. when weights differ
+// it runs smooth weighted round robin, which interleaves picks (a a b a c
+// rather than a a a b c) so heavy backends don't get bursts
+type RoundRobin struct{}
+
+func (rr RoundRobin) Next(s *ServerPool) *Backend {
+	backends := s.Backends()
+	for _, b := range backends {
+		if b.effectiveWeight() != 100 {
+			return rr.smooth(s)
+		}
+	}
+
+	next := s.NextIndex()
+	end := next + len(backends)
+	for i := next; i < end; i++ {
+		index := i % len(backends)
+		if backends[index].IsAlive() {
+			if i != next {
+				atomic.StoreUint64(&s.current, uint64(index))
+			}
+			return backends[index]
+		}
+	}
+	return nil
+}
+
+// smooth is nginx's smooth weighted round robin: every live backend gains
+// its weight, the highest current weight wins and pays back the total
+func (RoundRobin) smooth(s *ServerPool) *Backend {
+	s.wrrMux.Lock()
+	defer s.wrrMux.Unlock()
+	var best *Backend
+	total := 0
+	for _, b := range s.Backends() {
+		if !b.IsAlive() {
+			continue
+		}
+		w := b.effectiveWeight()
+		b.wrr += w
+		total += w
+		if best == nil || b.wrr > best.wrr {
+			best = b
+		}
+	}
+	if best != nil {
+		best.wrr -= total
+	}
+	return best
+}
+
+// LeastConn picks the live backend with the fewest requests in flight for
+// its weight, which keeps slow or expensive requests from piling up on one
+// server while a backend of weight 2 carries twice the load of one of
+// weight 1. ties are broken round-robin
+type LeastConn struct{}
+
+func (LeastConn) Next(s *ServerPool) *Backend {
+	backends := s.Backends()
+	start := s.NextIndex()
+	var best *Backend
+	var bestLoad, bestWeight int64
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		if !b.IsAlive() {
+			continue
+		}
+		// compare a/wa < b/wb as a*wb < b*wa to stay in integers; the
+		// request about to be sent counts, so idle heavy backends win
+		load := b.InFlight() + 1
+		if w := int64(b.effectiveWeight()); best == nil || load*bestWeight < bestLoad*w {
+			best, bestLoad, bestWeight = b, load, w
+		}
+	}
+	return best
+}
+
+// lockedRand shares one seeded generator between request goroutines
+type lockedRand struct {
+	mux sync.Mutex
+	r   *rand.Rand
+}
+
+func (l *lockedRand) IntN(n int) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.r.IntN(n)
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.r.Float64()
+}
+
+// seeded is a strategy that draws from a seeded generator. the pool's other
+// random choices draw from it too, so a run with -seed is reproducible
+type seeded interface {
+	source() *lockedRand
+}
+
+func (st *Random) source() *lockedRand         { return st.rng }
+func (st *WeightedRandom) source() *lockedRand { return st.rng }
+func (st *LeastLatency) source() *lockedRand   { return st.rng }
+func (st *Bandit) source() *lockedRand         { return st.rng }
+
+// random draws from the pool strategy's generator, or the global one for a
+// strategy that isn't randomized
+func (s *ServerPool) random() float64 {
+	if st, ok := s.Strategy.(seeded); ok {
+		return st.source().Float64()
+	}
+	return rand.Float64()
+}
+
+// Random picks a live backend uniformly at random
+type Random struct {
+	rng *lockedRand
+}
+
+func (st *Random) Next(s *ServerPool) *Backend {
+	backends := s.Backends()
+	alive := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.IsAlive() {
+			alive = append(alive, b)
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+	return alive[st.rng.IntN(len(alive))]
+}
+
+// WeightedRandom picks a live backend with probability proportional to its
+// weight. unlike smooth weighted round robin it keeps no per-backend state,
+// so a pick is one pass over the pool with no locking beyond the generator
+type WeightedRandom struct {
+	rng *lockedRand
+}
+
+func (st *WeightedRandom) Next(s *ServerPool) *Backend {
+	backends := s.Backends()
+	total := 0
+	for _, b := range backends {
+		if b.IsAlive() {
+			total += b.effectiveWeight()
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := st.rng.IntN(total)
+	for _, b := range backends {
+		if !b.IsAlive() {
+			continue
+		}
+		if n -= b.effectiveWeight(); n < 0 {
+			return b
+		}
+	}
+	return nil // the pool changed health mid-pick
+}
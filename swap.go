@@ -0,0 +1,92 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// how long a replaced target may keep serving in-flight requests before its
+// connections are closed regardless
+const swapDrainTimeout = 5 * time.Minute
+
+// SwapURL atomically points the backend at a new upstream. new requests go to
+// u immediately; requests already in flight finish against the old target,
+// whose idle connections are closed once it has drained
+func (s *ServerPool) SwapURL(b *Backend, u *url.URL) {
+	old := b.target.Swap(s.newTarget(b, u))
+	log.Printf("[%s] Backend %s now targets %s (was %s)\n", s.Name, b.Name(), u, old.url)
+	go old.drain(b.Name())
+}
+
+func (t *backendTarget) drain(name string) {
+	deadline := time.Now().Add(swapDrainTimeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for t.inflight.Load() > 0 && time.Now().Before(deadline) {
+		<-tick.C
+	}
+	if n := t.inflight.Load(); n > 0 {
+		log.Printf("Backend %s: closing old target %s with %d requests still in flight\n", name, t.url, n)
+	}
+	t.transport.CloseIdleConnections()
+	log.Printf("Backend %s: old target %s drained\n", name, t.url)
+}
+
+// FindBackend looks a backend up by name
+func (s *ServerPool) FindBackend(name string) *Backend {
+	for _, b := range s.Backends() {
+		if b.Name() == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// findPool returns the named pool, or the default one for an empty name
+func findPool(name string) *ServerPool {
+	if name == "" {
+		return &serverPool
+	}
+	for _, p := range pools {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// swaps a backend's target, e.g. {"backend": "10.0.0.5:8080", "url": "http://10.0.0.9:8080"}
+func postSwap(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Pool    string `json:"pool"`
+		Backend string `json:"backend"`
+		URL     string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pool := findPool(req.Pool)
+	if pool == nil {
+		http.Error(w, fmt.Sprintf("unknown pool %q", req.Pool), http.StatusNotFound)
+		return
+	}
+	b := pool.FindBackend(req.Backend)
+	if b == nil {
+		http.Error(w, fmt.Sprintf("unknown backend %q", req.Backend), http.StatusNotFound)
+		return
+	}
+	u, err := parseBackendURL(req.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pool.SwapURL(b, u)
+	writeJSON(w, http.StatusOK, map[string]string{"backend": b.Name(), "url": u.String()})
+}
@@ -0,0 +1,249 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// tags are free-form key=value labels on a backend, e.g.
+// http://10.0.0.5:8080;tag.build=2024-06;tag.zone=b or "tags": {"build":
+// "2024-06"} in a config file. a selector picks backends by them for the
+// bulk admin operations
+//
+//	POST   /admin/backends/drain?selector=build=2024-06
+//	DELETE /admin/backends/drain?selector=build=2024-06
+//	PUT    /admin/backends/weight?selector=rack=a1   {"weight": 2}
+//	DELETE /admin/backends?selector=rack=a1,build!=2024-07
+//
+// across every pool, or the ?pool= one. a selector is a comma-separated list
+// of key=value and key!=value terms that must all hold; rack and host also
+// match the backend's rack and host attributes when it has no tag of that
+// name
+
+// Selector is a parsed tag selector
+type Selector []selectorTerm
+
+type selectorTerm struct {
+	key, value string
+	not        bool
+}
+
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		key, value, ok := strings.Cut(term, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad selector term %q, expected key=value or key!=value", term)
+		}
+		t := selectorTerm{key: strings.TrimSpace(key), value: strings.TrimSpace(value)}
+		if k, isNot := strings.CutSuffix(t.key, "!"); isNot {
+			t.key, t.not = strings.TrimSpace(k), true
+		}
+		if err := checkTagKey(t.key); err != nil {
+			return nil, fmt.Errorf("bad selector term %q: %w", term, err)
+		}
+		sel = append(sel, t)
+	}
+	return sel, nil
+}
+
+func checkTagKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty tag name")
+	}
+	if strings.ContainsAny(key, "=!,; ") {
+		return fmt.Errorf("tag name %q may not contain =, !, commas, semicolons or spaces", key)
+	}
+	return nil
+}
+
+// Matches reports whether b has every tag the selector asks for
+func (sel Selector) Matches(b *Backend) bool {
+	for _, t := range sel {
+		if (b.tag(t.key) == t.value) == t.not {
+			return false
+		}
+	}
+	return true
+}
+
+func (sel Selector) String() string {
+	terms := make([]string, len(sel))
+	for i, t := range sel {
+		op := "="
+		if t.not {
+			op = "!="
+		}
+		terms[i] = t.key + op + t.value
+	}
+	return strings.Join(terms, ",")
+}
+
+// tag is b's tag key, "" if it has none
+func (b *Backend) tag(key string) string {
+	if v, ok := b.Tags[key]; ok {
+		return v
+	}
+	switch key {
+	case "rack":
+		return b.Rack
+	case "host":
+		return b.Host
+	}
+	return ""
+}
+
+// options are the options b was configured with
+func (b *Backend) options() BackendOptions {
+	return BackendOptions{
+		Rack:            b.Rack,
+		Host:            b.Host,
+		Weight:          b.Weight,
+		MaxConns:        b.MaxConns,
+		H2C:             b.H2C,
+		Canary:          b.Canary,
+		Cost:            b.Cost,
+		DialTimeout:     Duration{b.DialTimeout},
+		ResponseTimeout: Duration{b.ResponseTimeout},
+		Tags:            maps.Clone(b.Tags),
+		SigV4:           b.SigV4,
+		TLS:             b.tls,
+	}
+}
+
+// poolBackend is a backend and the pool it is in
+type poolBackend struct {
+	pool *ServerPool
+	b    *Backend
+}
+
+// selectBackends resolves ?selector= over the ?pool= pool, or all of them.
+// a selector is required, so a request missing one can't touch every backend
+func selectBackends(w http.ResponseWriter, r *http.Request) ([]poolBackend, bool) {
+	q := r.URL.Query()
+	if q.Get("selector") == "" {
+		http.Error(w, "missing ?selector=, e.g. ?selector=rack=a1", http.StatusBadRequest)
+		return nil, false
+	}
+	sel, err := ParseSelector(q.Get("selector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if name := q.Get("pool"); name != "" && findPool(name) == nil {
+		http.Error(w, fmt.Sprintf("unknown pool %q", name), http.StatusNotFound)
+		return nil, false
+	}
+	var list []poolBackend
+	for _, p := range pools {
+		if name := q.Get("pool"); name != "" && name != p.Name {
+			continue
+		}
+		for _, b := range p.Backends() {
+			if sel.Matches(b) {
+				list = append(list, poolBackend{p, b})
+			}
+		}
+	}
+	return list, true
+}
+
+// drains every selected backend
+func postDrainSelected(w http.ResponseWriter, r *http.Request) {
+	list, ok := selectBackends(w, r)
+	if !ok {
+		return
+	}
+	drains := []*DrainStatus{}
+	for _, pb := range list {
+		if pb.b.StartDrain() {
+			log.Printf("[%s] Draining backend %s through the admin API (%s), %d in flight\n", pb.pool.Name, pb.b.Name(), r.URL.Query().Get("selector"), pb.b.InFlight())
+		}
+		drains = append(drains, pb.b.DrainStatus())
+	}
+	writeJSON(w, http.StatusAccepted, drains)
+}
+
+// calls off the drains of every selected backend
+func deleteDrainSelected(w http.ResponseWriter, r *http.Request) {
+	list, ok := selectBackends(w, r)
+	if !ok {
+		return
+	}
+	status := []BackendStatus{}
+	for _, pb := range list {
+		if pb.b.StopDrain() {
+			log.Printf("[%s] Backend %s back in rotation through the admin API (%s)\n", pb.pool.Name, pb.b.Name(), r.URL.Query().Get("selector"))
+		}
+		status = append(status, backendStatus(pb.pool.Name, pb.b))
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// sets the weight of every selected backend: {"weight": 2}. like PUT
+// /admin/backends/{name}, each is replaced by a copy with the new weight,
+// which keeps its health, maintenance and drain state. discovered backends are
+// left alone, their discovery would undo the change
+func putWeightSelected(w http.ResponseWriter, r *http.Request) {
+	list, ok := selectBackends(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Weight int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Weight < 1 {
+		http.Error(w, "weight must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	status := []BackendStatus{}
+	for _, pb := range list {
+		old := pb.b
+		if old.discovery != nil || old.Weight == req.Weight {
+			continue
+		}
+		opts := old.options()
+		opts.Weight = req.Weight
+		b := pb.pool.NewBackend(old.URL())
+		if err := opts.apply(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b.Alive = old.isUp()
+		b.SetMaintenance(old.InMaintenance())
+		if old.drain.Load() != nil {
+			b.StartDrain()
+		}
+		if !pb.pool.ReplaceBackend(old, b) {
+			continue // removed meanwhile
+		}
+		log.Printf("[%s] Backend %s weight %d -> %d through the admin API\n", pb.pool.Name, b.Name(), old.Weight, b.Weight)
+		status = append(status, backendStatus(pb.pool.Name, b))
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// removes every selected backend, draining them
+func deleteBackendsSelected(w http.ResponseWriter, r *http.Request) {
+	list, ok := selectBackends(w, r)
+	if !ok {
+		return
+	}
+	removed := []BackendStatus{}
+	for _, pb := range list {
+		if pb.pool.RemoveBackend(pb.b) {
+			log.Printf("[%s] Removed backend %s through the admin API (%s), draining\n", pb.pool.Name, pb.b.URL(), r.URL.Query().Get("selector"))
+			removed = append(removed, backendStatus(pb.pool.Name, pb.b))
+		}
+	}
+	writeJSON(w, http.StatusOK, removed)
+}
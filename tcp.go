@@ -0,0 +1,212 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// with -mode tcp the balancer port takes raw TCP connections, e.g. for
+// databases or Redis, instead of HTTP. each connection goes to a backend
+// picked the same way as a request (strategy, affinity by client address,
+// shifts, max_conns and -pool-max-conns) and bytes are copied both ways
+// until either side closes. a backend that can't be dialed is marked down
+// and the connection fails over to another. backends are given as
+// tcp://host:port, and health checks are TCP connects
+var tcpMode bool
+
+// tcpIdleTimeout closes a proxied connection with no traffic either way for
+// this long (-tcp-idle-timeout, 0 never)
+var tcpIdleTimeout time.Duration
+
+// TCPProxy serves a pool over raw TCP
+type TCPProxy struct {
+	Pool *ServerPool
+
+	mux       sync.Mutex
+	listeners []net.Listener
+	conns     sync.WaitGroup
+	closing   atomic.Bool
+
+	idleClosed atomic.Uint64
+}
+
+var tcpProxy = &TCPProxy{Pool: &serverPool}
+
+// Serve accepts connections on l until it is closed
+func (p *TCPProxy) Serve(l net.Listener) error {
+	p.mux.Lock()
+	p.listeners = append(p.listeners, l)
+	p.mux.Unlock()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if p.closing.Load() || errors.Is(err, net.ErrClosed) {
+				return http.ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		p.conns.Add(1)
+		go func() {
+			defer p.conns.Done()
+			p.handle(c)
+		}()
+	}
+}
+
+// Shutdown stops accepting and waits for open connections to finish, until
+// ctx is done
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.closing.Store(true)
+	p.mux.Lock()
+	for _, l := range p.listeners {
+		_ = l.Close()
+	}
+	p.mux.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tcpRequest stands in for a request when a connection is routed, so it
+// goes through the same picking as HTTP
+func tcpRequest(c net.Conn) *http.Request {
+	r, _ := http.NewRequest(http.MethodConnect, "tcp://"+c.LocalAddr().String(), nil)
+	r.RemoteAddr = c.RemoteAddr().String()
+	if transparentProxy {
+		r = withClientIP(r)
+	}
+	return r
+}
+
+func dialBackend(ctx context.Context, b *Backend) (net.Conn, error) {
+	dial := upstreamDial()
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.dialTimeout())
+	defer cancel()
+	return tunedDial(dial)(ctx, "tcp", hostPort(b.URL()))
+}
+
+func (p *TCPProxy) handle(client net.Conn) {
+	defer client.Close()
+	s := p.Pool
+	r := tcpRequest(client)
+	if !s.acquire(r) {
+		log.Printf("TCP %s refused, pool busy\n", r.RemoteAddr)
+		return
+	}
+	defer s.releaseSlot()
+	s.requests.Add(1)
+	s.requestWindow.Add(1)
+
+	for attempt := 0; attempt <= MAX_RETRIES; attempt++ {
+		b, _ := s.pick(r)
+		if b == nil {
+			log.Printf("TCP %s refused, no healthy backend\n", r.RemoteAddr)
+			return
+		}
+		if b = s.claim(r, b); b == nil {
+			log.Printf("TCP %s refused, all backends at capacity\n", r.RemoteAddr)
+			return
+		}
+		upstream, err := dialBackend(r.Context(), b)
+		if err != nil {
+			s.releaseBackend(b)
+			log.Printf("[%s] %s\n", b.Name(), err)
+			b.recordResult(true)
+			s.canary.record(b, true)
+			s.observeOutcome(b, true)
+			b.setAliveFor(false, err.Error())
+			s.failovers.Add(1)
+			r = r.WithContext(context.WithValue(r.Context(), FailedBackend, b))
+			continue
+		}
+		if proxyProtocolBackends != "" {
+			if err := writeProxyHeader(upstream, proxyProtocolBackends, client.RemoteAddr(), client.LocalAddr()); err != nil {
+				log.Printf("[%s] PROXY protocol header: %v\n", b.Name(), err)
+				_ = upstream.Close()
+				s.releaseBackend(b)
+				return
+			}
+		}
+		p.pipe(client, upstream, b)
+		s.releaseBackend(b)
+		return
+	}
+	log.Printf("TCP %s dropped, max attempts reached\n", r.RemoteAddr)
+}
+
+// pipe copies both ways until both sides are done. one side closing its
+// write half is passed on, so request/response protocols that rely on it
+// still work
+func (p *TCPProxy) pipe(client, upstream net.Conn, b *Backend) {
+	b.active.Add(1)
+	defer b.active.Add(-1)
+	t := newTunnel(upstream, nil)
+	defer t.Close()
+	if tcpIdleTimeout > 0 {
+		go t.closeIdle(tcpIdleTimeout, func(idle time.Duration) {
+			p.idleClosed.Add(1)
+			_ = client.Close()
+			log.Printf("TCP %s: closed connection to %s idle for %s\n", client.RemoteAddr(), b.Name(), idle.Round(time.Second))
+		})
+	}
+
+	start := time.Now()
+	var in, out int64
+	errc := make(chan error, 2)
+	go func() {
+		var err error
+		in, err = io.Copy(t, client)
+		closeWrite(upstream)
+		errc <- err
+	}()
+	go func() {
+		var err error
+		out, err = io.Copy(client, t)
+		closeWrite(client)
+		errc <- err
+	}()
+	if err := <-errc; err != nil {
+		// one side failed, so the other can't finish either
+		_ = client.Close()
+		_ = t.Close()
+	}
+	<-errc
+	b.recordResult(false)
+	p.Pool.canary.record(b, false)
+	b.latency.Observe(time.Since(start))
+	log.Printf("TCP %s -> %s closed after %s (%d bytes in, %d out)\n", client.RemoteAddr(), b.Name(),
+		time.Since(start).Round(time.Millisecond), in, out)
+}
+
+// closeWrite half-closes c, or closes it when it can't be half-closed, so
+// the peer learns there is nothing more either way
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// TCPTuning is how the balancer's TCP connections detect dead peers and
+// close. KeepAlive is the idle time before the first keepalive probe
+// (negative turns probes off), then one is sent every KeepAliveInterval and
+// the peer is given up on after KeepAliveCount unanswered. UserTimeout gives
+// up on a peer that hasn't acknowledged sent data for that long, which
+// keepalives don't cover. Linger, when not negative, is how many seconds
+// closing waits to send unsent data, 0 resetting the connection at once.
+// zero values keep the system's defaults; the interval, count and user
+// timeout only take effect on Linux and Windows, where the user timeout is
+// rounded up to whole seconds. client connections are tuned with the
+// -tcp-* flags and backend connections with the -upstream-tcp-* ones, e.g.
+// -upstream-tcp-keepalive 10s -upstream-tcp-keepalive-count 3 drops a
+// backend that vanished without a FIN in about 40s rather than the
+// system's two hours and more
+type TCPTuning struct {
+	KeepAlive         time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	UserTimeout       time.Duration
+	Linger            int
+}
+
+var (
+	clientTCP   = TCPTuning{Linger: -1}
+	upstreamTCP = TCPTuning{KeepAlive: 30 * time.Second, Linger: -1}
+)
+
+// apply sets t on c if it is a TCP connection; errors leave the system's
+// defaults in place
+func (t TCPTuning) apply(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	switch {
+	case t.KeepAlive < 0:
+		_ = tc.SetKeepAlive(false)
+	case t.KeepAlive > 0:
+		_ = tc.SetKeepAlive(true)
+		_ = tc.SetKeepAlivePeriod(t.KeepAlive)
+	}
+	if t.Linger >= 0 {
+		_ = tc.SetLinger(t.Linger)
+	}
+	if t.KeepAliveInterval > 0 || t.KeepAliveCount > 0 || t.UserTimeout > 0 {
+		if raw, err := tc.SyscallConn(); err == nil {
+			_ = tuneSocket(raw, t)
+		}
+	}
+}
+
+// tuned reports whether t changes anything
+func (t TCPTuning) tuned() bool {
+	return t != TCPTuning{Linger: -1}
+}
+
+// tunedListener applies clientTCP to accepted connections
+type tunedListener struct {
+	net.Listener
+}
+
+// withClientTCP wraps l if any -tcp-* flag is set
+func withClientTCP(l net.Listener) net.Listener {
+	if !clientTCP.tuned() {
+		return l
+	}
+	return tunedListener{l}
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		clientTCP.apply(c)
+	}
+	return c, err
+}
+
+// tunedDial applies upstreamTCP to the connections dial makes
+func tunedDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err == nil {
+			upstreamTCP.apply(c)
+		}
+		return c, err
+	}
+}
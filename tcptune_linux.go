@@ -0,0 +1,35 @@
+package loadbalancer
+
+import (
+	"syscall"
+	"time"
+)
+
+// TCP_USER_TIMEOUT, missing from package syscall
+const tcpUserTimeout = 0x12
+
+// tuneSocket sets the keepalive probe interval and count and the user
+// timeout
+func tuneSocket(c syscall.RawConn, t TCPTuning) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		set := func(opt, v int) {
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt, v); err != nil && sockErr == nil {
+				sockErr = err
+			}
+		}
+		if t.KeepAliveInterval > 0 {
+			set(syscall.TCP_KEEPINTVL, max(int(t.KeepAliveInterval/time.Second), 1))
+		}
+		if t.KeepAliveCount > 0 {
+			set(syscall.TCP_KEEPCNT, t.KeepAliveCount)
+		}
+		if t.UserTimeout > 0 {
+			set(tcpUserTimeout, int(t.UserTimeout/time.Millisecond))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package loadbalancer
+
+import "syscall"
+
+// tuneSocket leaves the probe interval and count and the user timeout to
+// the system elsewhere than Linux
+func tuneSocket(c syscall.RawConn, t TCPTuning) error {
+	return nil
+}
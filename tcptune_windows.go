@@ -0,0 +1,40 @@
+package loadbalancer
+
+import (
+	"syscall"
+	"time"
+)
+
+// TCP_KEEPCNT, TCP_KEEPINTVL and TCP_MAXRT, missing from package syscall.
+// the first two need Windows 10 1709 or later
+const (
+	tcpKeepCount    = 16
+	tcpKeepInterval = 17
+	tcpMaxRT        = 5
+)
+
+// tuneSocket sets the keepalive probe interval and count and, as the
+// maximum retransmission time, the user timeout
+func tuneSocket(c syscall.RawConn, t TCPTuning) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		set := func(opt, v int) {
+			if err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_TCP, opt, v); err != nil && sockErr == nil {
+				sockErr = err
+			}
+		}
+		if t.KeepAliveInterval > 0 {
+			set(tcpKeepInterval, max(int(t.KeepAliveInterval/time.Second), 1))
+		}
+		if t.KeepAliveCount > 0 {
+			set(tcpKeepCount, t.KeepAliveCount)
+		}
+		if t.UserTimeout > 0 {
+			set(tcpMaxRT, int((t.UserTimeout+time.Second-1)/time.Second))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,177 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Tenant is a named listener group: its own listeners, backend pool, routes
+// to pools of its own, connection limits, rate limit, auth and header rules,
+// isolated from every other tenant in the process. the connection limits
+// are shared by all of the tenant's listeners; the rate limit and auth
+// apply to every request it takes, ahead of its routes' own. the
+// flag-configured balancer is the "default" tenant.
+type Tenant struct {
+	Name               string          `json:"name"`
+	Listen             []string        `json:"listen"`
+	Backends           []string        `json:"backends"`
+	MaxConns           int             `json:"max_conns"`
+	MaxConnsPerClient  int             `json:"max_conns_per_client"`
+	QueueConns         bool            `json:"queue_conns"`
+	PoolMaxConns       int             `json:"pool_max_conns"`
+	Strategy           string          `json:"strategy"`
+	BandwidthPerConn   int64           `json:"bandwidth_per_conn"`
+	BandwidthPerClient int64           `json:"bandwidth_per_client"`
+	HeaderRules        []HeaderRuleSet `json:"header_rules"`
+	RateLimit          *RateLimit      `json:"rate_limit"`
+	Auth               *RouteAuth      `json:"auth"`
+
+	// routed pools, as in a -routes file. routes may only take the
+	// tenant's own pools, its default one by the tenant's name
+	Pools  map[string]PoolConfig `json:"pools"`
+	Routes []*Route              `json:"routes"`
+
+	pool    *ServerPool
+	handler http.Handler
+}
+
+// LoadTenants reads a JSON list of tenant sections
+func LoadTenants(path string) ([]*Tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []*Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	seen := map[string]bool{"default": true}
+	for _, t := range tenants {
+		if t.Name == "" || seen[t.Name] {
+			return nil, fmt.Errorf("%s: tenant names must be unique and non-empty (got %q)", path, t.Name)
+		}
+		seen[t.Name] = true
+		if len(t.Listen) == 0 || len(t.Backends) == 0 {
+			return nil, fmt.Errorf("%s: tenant %q needs at least one listener and backend", path, t.Name)
+		}
+		for _, set := range t.HeaderRules {
+			if err := validateHeaderRules(set.Request, set.Response); err != nil {
+				return nil, fmt.Errorf("%s: tenant %q: %w", path, t.Name, err)
+			}
+		}
+		for _, rt := range t.Routes {
+			if _, own := t.Pools[rt.Pool]; !own && rt.Pool != t.Name {
+				return nil, fmt.Errorf("%s: tenant %q: route %s: pool %q is not the tenant's", path, t.Name, rt.Name, rt.Pool)
+			}
+		}
+	}
+	return tenants, nil
+}
+
+// Start builds the tenant's pool and handler. Serve then opens its listeners
+func (t *Tenant) Start() error {
+	t.pool = &ServerPool{Name: t.Name, MaxConns: t.PoolMaxConns, Strategy: serverPool.Strategy, ReadWrites: serverPool.ReadWrites}
+	if t.Strategy != "" {
+		st, err := NewStrategy(t.Strategy, 0)
+		if err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		t.pool.Strategy = st
+	}
+	for _, tok := range t.Backends {
+		bc, err := backendConfigFromSpec(tok)
+		if err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		if isDiscoveryURL(bc.URL) {
+			if _, err := t.pool.Discover(bc); err != nil {
+				return fmt.Errorf("tenant %q: %w", t.Name, err)
+			}
+			log.Printf("[%s] Discovering backends from %s\n", t.Name, bc.URL)
+			continue
+		}
+		b, err := t.pool.AddBackendConfig(bc)
+		if err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		log.Printf("[%s] Configured backend: %s\n", t.Name, b.URL())
+	}
+	pools = append(pools, t.pool)
+
+	var handler http.Handler = t.pool
+	if len(t.Routes) > 0 {
+		rt, err := NewRouter(&RoutesConfig{Pools: t.Pools, Routes: t.Routes}, t.pool)
+		if err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		handler = rt
+	}
+	if len(t.HeaderRules) > 0 {
+		handler = WithHeaderRules(t.HeaderRules, handler)
+	}
+	if t.RateLimit != nil {
+		if err := t.RateLimit.init("tenant:" + t.Name); err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		handler = withTenantCheck(t.RateLimit.allow, handler)
+	}
+	if t.Auth != nil {
+		if err := t.Auth.init(t.Name); err != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		handler = withTenantCheck(t.Auth.allow, handler)
+	}
+	handler = WithVia(handler)
+	if maxInFlight > 0 {
+		handler = WithMaxInFlight(handler)
+	}
+	handler = WithStrictHTTP(handler)
+	handler = WithRequestID(handler)
+	if clientMaxAge > 0 {
+		handler = WithConnMaxAge(handler)
+	}
+	t.handler = handler
+	return nil
+}
+
+// Serve binds the tenant's listeners and serves them
+func (t *Tenant) Serve() error {
+	limits := ConnLimits{
+		MaxConns:           t.MaxConns,
+		MaxPerClient:       t.MaxConnsPerClient,
+		Queue:              t.QueueConns,
+		BandwidthPerConn:   t.BandwidthPerConn,
+		BandwidthPerClient: t.BandwidthPerClient,
+	}
+	// one listener over all of them, so the limits are the tenant's
+	l, err := listenAll(t.Listen)
+	if err != nil {
+		return fmt.Errorf("tenant %q: %w", t.Name, err)
+	}
+	log.Printf("[%s] Listening at %s\n", t.Name, boundAddrs(l))
+	if l, err = withProxyProtocol(withClientTCP(l)); err != nil {
+		return fmt.Errorf("tenant %q: %w", t.Name, err)
+	}
+	l = StrictListener(LimitListener(l, limits, t.Name, false))
+	srv := &http.Server{Handler: withH2C(t.handler), ConnContext: clientConnContext, IdleTimeout: clientIdleTimeout}
+	drainOnShutdown(srv)
+	go func() {
+		if err := srv.Serve(l); serveErr(err) {
+			log.Fatalf("[%s] %v", t.Name, err)
+		}
+	}()
+	return nil
+}
+
+// withTenantCheck lets through the requests allow doesn't answer itself
+func withTenantCheck(allow func(http.ResponseWriter, *http.Request) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allow(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -1,25 +1,474 @@
-package main
+package loadbalancer
 
 import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var Ports = []int{3031, 3032, 3033, 3034}
+// Echo is what the test servers reply with, so routing and header
+// manipulation can be checked end to end
+type Echo struct {
+	Method       string              `json:"method"`
+	Path         string              `json:"path"`
+	Query        string              `json:"query,omitempty"`
+	Host         string              `json:"host"`
+	RemoteAddr   string              `json:"remote_addr"`
+	Headers      map[string][]string `json:"headers"`
+	BodyBytes    int64               `json:"body_bytes"`
+	BodySHA256   string              `json:"body_sha256"`
+	BackendPort  int                 `json:"backend_port"`
+	RequestCount uint64              `json:"request_count"`
+}
+
+// TestBehavior changes how a single test server responds, to exercise
+// retries, timeouts and health checks against something less trivial than
+// a backend that always answers at once
+type TestBehavior struct {
+	Delay       Duration `json:"delay"`        // added before every response
+	Jitter      Duration `json:"jitter"`       // up to this much more delay, at random
+	Status      int      `json:"status"`       // forced status code (0 keeps the echo's 200)
+	ErrorRate   float64  `json:"error_rate"`   // fraction of requests answered with ErrorStatus
+	ErrorStatus int      `json:"error_status"` // 500 if 0
+	SlowBody    Duration `json:"slow_body"`    // the response body trickles out over this long
+	Flap        Duration `json:"flap"`         // the server stops and starts listening every Flap
+	Down        bool     `json:"down"`         // the server isn't listening
+}
+
+// TestBehaviors maps a test server port to its behavior and is filled from
+// repeated -test-behavior flags, e.g. -test-behavior 3033=delay:200ms. port
+// 0, given as *, is for the servers without a behavior of their own
+type TestBehaviors map[int]TestBehavior
+
+func (b TestBehaviors) String() string {
+	return fmt.Sprint(map[int]TestBehavior(b))
+}
+
+// Set parses port=behavior[+behavior...], where a behavior is delay:<duration>,
+// jitter:<duration>, status:<code>, error-rate:<fraction>, error-status:<code>,
+// slow-body:<duration>, flap:<duration> or down
+func (b TestBehaviors) Set(v string) error {
+	portStr, spec, ok := strings.Cut(v, "=")
+	port, err := strconv.Atoi(portStr)
+	if portStr == "*" {
+		port, err = 0, nil
+	}
+	if !ok || err != nil {
+		return fmt.Errorf("expected port=behavior or *=behavior, got %q", v)
+	}
+
+	tb := b[port]
+	for _, part := range strings.Split(spec, "+") {
+		name, arg, _ := strings.Cut(part, ":")
+		switch name {
+		case "delay", "jitter", "slow-body", "flap":
+			d, err := time.ParseDuration(arg)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid %s %q", name, arg)
+			}
+			switch name {
+			case "delay":
+				tb.Delay.Duration = d
+			case "jitter":
+				tb.Jitter.Duration = d
+			case "slow-body":
+				tb.SlowBody.Duration = d
+			default:
+				tb.Flap.Duration = d
+			}
+		case "status", "error-status":
+			code, err := strconv.Atoi(arg)
+			if err != nil || code < 100 || code > 599 {
+				return fmt.Errorf("invalid status %q", arg)
+			}
+			if name == "status" {
+				tb.Status = code
+			} else {
+				tb.ErrorStatus = code
+			}
+		case "error-rate":
+			if tb.ErrorRate, err = strconv.ParseFloat(arg, 64); err != nil || tb.ErrorRate < 0 || tb.ErrorRate > 1 {
+				return fmt.Errorf("invalid error rate %q, expected 0 to 1", arg)
+			}
+		case "down":
+			tb.Down = true
+		default:
+			return fmt.Errorf("unknown test behavior %q", name)
+		}
+	}
+	b[port] = tb
+	return nil
+}
+
+// testServer is one echo backend whose behavior can be changed while it runs
+type testServer struct {
+	addr     string // where it listens, the port fixed once bound
+	port     int
+	behavior atomic.Pointer[TestBehavior]
+	count    atomic.Uint64
+	handler  http.Handler
+
+	mux      sync.Mutex
+	srv      *http.Server // nil while down
+	stopFlap chan struct{}
+}
+
+func newTestServer(addr string, tb TestBehavior) *testServer {
+	s := &testServer{addr: addr}
+	s.behavior.Store(&tb)
+	s.handler = newEchoMux(s)
+	return s
+}
+
+// up starts listening, if it isn't already
+func (s *testServer) up() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.srv != nil {
+		return nil
+	}
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if s.port == 0 {
+		// an ephemeral port is kept when the server comes back up
+		s.port = l.Addr().(*net.TCPAddr).Port
+		host, _, _ := net.SplitHostPort(s.addr)
+		s.addr = net.JoinHostPort(host, strconv.Itoa(s.port))
+	}
+	srv := &http.Server{Handler: s.handler}
+	s.srv = srv
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server on port %d failed: %v", s.port, err)
+		}
+	}()
+	return nil
+}
+
+// down closes the listener and every connection, as a crash would
+func (s *testServer) down() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.srv == nil {
+		return nil
+	}
+	err := s.srv.Close()
+	s.srv = nil
+	return err
+}
+
+func (s *testServer) isUp() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.srv != nil
+}
+
+// setBehavior applies tb, bringing the server up or down and starting or
+// stopping its flapping to match
+func (s *testServer) setBehavior(tb TestBehavior) error {
+	s.behavior.Store(&tb)
+	s.mux.Lock()
+	if s.stopFlap != nil {
+		close(s.stopFlap)
+		s.stopFlap = nil
+	}
+	if tb.Flap.Duration > 0 && !tb.Down {
+		s.stopFlap = make(chan struct{})
+		go s.flap(tb.Flap.Duration, s.stopFlap)
+	}
+	s.mux.Unlock()
+	if tb.Down {
+		return s.down()
+	}
+	return s.up()
+}
+
+func (s *testServer) flap(every time.Duration, stop chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+		if s.isUp() {
+			_ = s.down()
+			log.Printf("Test server on port %d flapped down\n", s.port)
+		} else if err := s.up(); err != nil {
+			log.Printf("Test server on port %d can't come back up: %v\n", s.port, err)
+		} else {
+			log.Printf("Test server on port %d flapped up\n", s.port)
+		}
+	}
+}
+
+// TestServerStatus is a test server as GET /admin/test-servers shows it
+type TestServerStatus struct {
+	Port     int          `json:"port"`
+	Up       bool         `json:"up"`
+	Requests uint64       `json:"requests"`
+	Behavior TestBehavior `json:"behavior"`
+}
+
+func (s *testServer) status() TestServerStatus {
+	return TestServerStatus{Port: s.port, Up: s.isUp(), Requests: s.count.Load(), Behavior: *s.behavior.Load()}
+}
+
+// TestServers is a running set of local echo backends
+type TestServers struct {
+	URLs    []string
+	servers []*testServer
+}
 
-func StartServers(ready chan bool) {
-	for _, port := range Ports {
-		go func(port int) {
-			mux := http.NewServeMux()
-			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-				fmt.Fprintf(w, "Hello from server on port %d", port)
-			})
+// runningTestServers are the -test servers, for the admin API
+var runningTestServers *TestServers
+
+// StartServers listens on count consecutive ports from basePort and returns
+// once every listener is bound
+func StartServers(count, basePort int, behaviors TestBehaviors) (*TestServers, error) {
+	ts := &TestServers{}
+	for port := basePort; port < basePort+count; port++ {
+		// down servers are still listed so the balancer sees them fail
+		ts.URLs = append(ts.URLs, "http://localhost:"+strconv.Itoa(port))
+		behavior, ok := behaviors[port]
+		if !ok {
+			behavior = behaviors[0]
+		}
+		s := newTestServer(fmt.Sprintf(":%d", port), behavior)
+		s.port = port
+		ts.servers = append(ts.servers, s)
+		if err := s.setBehavior(behavior); err != nil {
+			_ = ts.Shutdown(context.Background())
+			return nil, err
+		}
+		if behavior.Down {
+			log.Printf("Test server on port %d is down\n", port)
+		} else {
 			log.Printf("Starting server on port %d\n", port)
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
-				log.Fatalf("Server on port %d failed: %v", port, err)
+		}
+	}
+	return ts, nil
+}
+
+func (ts *TestServers) find(port int) *testServer {
+	for _, s := range ts.servers {
+		if s.port == port {
+			return s
+		}
+	}
+	return nil
+}
+
+func (ts *TestServers) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, s := range ts.servers {
+		s.mux.Lock()
+		if s.stopFlap != nil {
+			close(s.stopFlap)
+			s.stopFlap = nil
+		}
+		if s.srv != nil {
+			errs = append(errs, s.srv.Shutdown(ctx))
+			s.srv = nil
+		}
+		s.mux.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// lists the -test servers and how they behave
+func getTestServers(w http.ResponseWriter, r *http.Request) {
+	if runningTestServers == nil {
+		http.Error(w, "not running test servers, see -test", http.StatusNotFound)
+		return
+	}
+	list := []TestServerStatus{}
+	for _, s := range runningTestServers.servers {
+		list = append(list, s.status())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// changes how a test server behaves, or all of them without {port}. accepts
+// a partial or full behavior, e.g. {"error_rate": 0.2, "delay": "150ms"}
+func putTestServer(w http.ResponseWriter, r *http.Request) {
+	if runningTestServers == nil {
+		http.Error(w, "not running test servers, see -test", http.StatusNotFound)
+		return
+	}
+	servers := runningTestServers.servers
+	if p := r.PathValue("port"); p != "" {
+		port, _ := strconv.Atoi(p)
+		s := runningTestServers.find(port)
+		if s == nil {
+			http.Error(w, fmt.Sprintf("no test server on port %q", p), http.StatusNotFound)
+			return
+		}
+		servers = []*testServer{s}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list := []TestServerStatus{}
+	for _, s := range servers {
+		tb := *s.behavior.Load()
+		if err := json.Unmarshal(body, &tb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tb.ErrorRate < 0 || tb.ErrorRate > 1 {
+			http.Error(w, "error_rate must be between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		if err := s.setBehavior(tb); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Test server on port %d: %+v\n", s.port, tb)
+		list = append(list, s.status())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func newEchoMux(s *testServer) http.Handler {
+	echo := func(w http.ResponseWriter, r *http.Request, status int) {
+		n := s.count.Add(1)
+		behavior := s.behavior.Load()
+		if behavior.Status != 0 {
+			status = behavior.Status
+		}
+		if behavior.ErrorRate > 0 && rand.Float64() < behavior.ErrorRate {
+			status = cmp.Or(behavior.ErrorStatus, http.StatusInternalServerError)
+		}
+		h := sha256.New()
+		size, _ := io.Copy(h, r.Body)
+
+		body, _ := json.Marshal(Echo{
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			Query:        r.URL.RawQuery,
+			Host:         r.Host,
+			RemoteAddr:   r.RemoteAddr,
+			Headers:      r.Header,
+			BodyBytes:    size,
+			BodySHA256:   hex.EncodeToString(h.Sum(nil)),
+			BackendPort:  s.port,
+			RequestCount: n,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Served-By", strconv.Itoa(s.port))
+		w.WriteHeader(status)
+		trickle(w, r, append(body, '\n'), behavior.SlowBody.Duration)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		echo(w, r, http.StatusOK)
+	})
+
+	// sleeps for the given number of milliseconds before echoing
+	mux.HandleFunc("/delay/{ms}", func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.Atoi(r.PathValue("ms"))
+		if err != nil || ms < 0 {
+			http.Error(w, "invalid delay", http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		echo(w, r, http.StatusOK)
+	})
+
+	// echoes with the given status code
+	mux.HandleFunc("/status/{code}", func(w http.ResponseWriter, r *http.Request) {
+		code, err := strconv.Atoi(r.PathValue("code"))
+		if err != nil || code < 200 || code > 599 {
+			http.Error(w, "invalid status code", http.StatusBadRequest)
+			return
+		}
+		echo(w, r, code)
+	})
+
+	// completes a websocket handshake, then closes the socket with a close frame
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		s.count.Add(1)
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+			http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nX-Served-By: %d\r\n\r\n\x88\x00", websocketAccept(key), s.port)
+		_ = buf.Flush()
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		behavior := s.behavior.Load()
+		delay := behavior.Delay.Duration
+		if behavior.Jitter.Duration > 0 {
+			delay += rand.N(behavior.Jitter.Duration)
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
 			}
-		}(port)
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// trickle writes body in pieces spread over d, flushing each, so the
+// response is slow to arrive rather than slow to start
+func trickle(w http.ResponseWriter, r *http.Request, body []byte, d time.Duration) {
+	if d <= 0 {
+		_, _ = w.Write(body)
+		return
+	}
+	const pieces = 10
+	rc := http.NewResponseController(w)
+	size := (len(body) + pieces - 1) / pieces
+	for len(body) > 0 {
+		n := min(size, len(body))
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		_ = rc.Flush()
+		if body = body[n:]; len(body) == 0 {
+			return
+		}
+		select {
+		case <-time.After(d / pieces):
+		case <-r.Context().Done():
+			return
+		}
 	}
-	ready <- true
 }
@@ -0,0 +1,92 @@
+package loadbalancer
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// largest write sent in one go to a throttled client, so a big response
+// trickles out smoothly instead of in one-second bursts
+const throttleChunk = 16 << 10
+
+// byteBucket meters bytes per second. callers reserve what they are about
+// to send and sleep off any deficit, so the long-run rate never exceeds rate
+type byteBucket struct {
+	mux    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate int64) *byteBucket {
+	return &byteBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n bytes and returns how long to wait before sending them
+func (b *byteBucket) reserve(n int) time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledConn limits what is written back to the client by its own bucket
+// and, when per-client limits are on, the bucket shared by its IP
+type throttledConn struct {
+	net.Conn
+	buckets []*byteBucket
+}
+
+func (c *throttledConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		var wait time.Duration
+		for _, b := range c.buckets {
+			wait = max(wait, b.reserve(len(chunk)))
+		}
+		time.Sleep(wait)
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttle wraps a new connection with the listener's bandwidth limits
+func (l *limitListener) throttle(c net.Conn, ip string) net.Conn {
+	var buckets []*byteBucket
+	if l.limits.BandwidthPerConn > 0 {
+		buckets = append(buckets, newByteBucket(l.limits.BandwidthPerConn))
+	}
+	if l.limits.BandwidthPerClient > 0 {
+		l.mux.Lock()
+		b, ok := l.bandwidth[ip]
+		if !ok {
+			b = newByteBucket(l.limits.BandwidthPerClient)
+			l.bandwidth[ip] = b
+		}
+		l.mux.Unlock()
+		buckets = append(buckets, b)
+	}
+	if len(buckets) == 0 {
+		return c
+	}
+	return &throttledConn{Conn: c, buckets: buckets}
+}
@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// TimeoutFallback answers a route's requests that time out, whether their
+// backends took too long or they ran past -request-timeout, with content of
+// its own instead of a 504:
+//
+//	"timeout_fallback": {"cached": true, "max_age": "10m", "file": "fallback/products.json"}
+//
+// with cached, the route keeps a copy of the last 200 each url got, for
+// GETs coalescing would share and of responses a shared cache could keep,
+// whatever their age, and a request that times out gets it, marked X-Cache:
+// STALE and aged, if it is no older than max_age (any age for 0). requests with no copy get the static body or file, if any, with
+// status (200 by default), or the usual 504 otherwise
+type TimeoutFallback struct {
+	Cached      bool     `json:"cached,omitempty" yaml:"cached"`
+	MaxAge      Duration `json:"max_age,omitempty" yaml:"max_age"`
+	CacheBytes  int64    `json:"cache_bytes,omitempty" yaml:"cache_bytes"` // copies kept, 16MB by default
+	Status      int      `json:"status,omitempty" yaml:"status"`
+	ContentType string   `json:"content_type,omitempty" yaml:"content_type"` // guessed from the file name or body otherwise
+	Body        string   `json:"body,omitempty" yaml:"body"`
+	File        string   `json:"file,omitempty" yaml:"file"`
+
+	route  string
+	body   []byte
+	copies *ResponseCache
+}
+
+const (
+	defaultTimeoutFallbackBytes = 16 << 20
+	timeoutFallbackMaxBody      = 1 << 20 // larger responses aren't kept
+)
+
+func (tf *TimeoutFallback) init(route string) error {
+	if !tf.Cached && tf.Body == "" && tf.File == "" {
+		return fmt.Errorf("route %s: timeout_fallback needs cached, body or file", route)
+	}
+	if tf.Body != "" && tf.File != "" {
+		return fmt.Errorf("route %s: timeout_fallback takes one of body and file", route)
+	}
+	if tf.Status != 0 && (tf.Status < 200 || tf.Status > 599) {
+		return fmt.Errorf("route %s: timeout_fallback status %d out of range", route, tf.Status)
+	}
+	if tf.MaxAge.Duration < 0 || tf.CacheBytes < 0 {
+		return fmt.Errorf("route %s: timeout_fallback max_age and cache_bytes must not be negative", route)
+	}
+	tf.route = route
+	tf.body = []byte(tf.Body)
+	if tf.File != "" {
+		data, err := os.ReadFile(tf.File)
+		if err != nil {
+			return fmt.Errorf("route %s: timeout_fallback: %w", route, err)
+		}
+		tf.body = data
+	}
+	if tf.ContentType == "" && len(tf.body) > 0 {
+		tf.ContentType = guessErrorPageType(tf.File, string(tf.body))
+	}
+	if tf.Cached {
+		tf.copies = NewResponseCache(cmp.Or(tf.CacheBytes, defaultTimeoutFallbackBytes), timeoutFallbackMaxBody)
+	}
+	return nil
+}
+
+type timeoutFallbackKey struct{}
+
+// a request's fallback, and whether it was served
+type timeoutFallbackState struct {
+	tf     *TimeoutFallback
+	served bool
+}
+
+// serve runs next with the fallback ready for r, keeping a copy of what it
+// answers when the route keeps them
+func (tf *TimeoutFallback) serve(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	st := &timeoutFallbackState{tf: tf}
+	r = r.WithContext(context.WithValue(r.Context(), timeoutFallbackKey{}, st))
+	key, ok := coalesceKey(r)
+	if tf.copies == nil || !ok {
+		next(w, r)
+		return
+	}
+	cw := &fallbackCopyWriter{ResponseWriter: w}
+	next(cw, r)
+	if st.served || cw.status != http.StatusOK || cw.overflow || r.Context().Err() != nil || !sharedCacheable(cw.header) {
+		return
+	}
+	tf.copies.put(&cachedResponse{
+		key:    key,
+		status: cw.status,
+		header: cw.header,
+		body:   cw.body.Bytes(),
+		stored: time.Now(),
+	})
+}
+
+// writeTimeoutFallback answers r with its route's fallback, if it has one
+// that can, and reports whether it did
+func writeTimeoutFallback(w http.ResponseWriter, r *http.Request) bool {
+	st, _ := r.Context().Value(timeoutFallbackKey{}).(*timeoutFallbackState)
+	if st == nil || st.served {
+		return false
+	}
+	tf := st.tf
+	if key, ok := coalesceKey(r); ok && tf.copies != nil {
+		if cr := tf.copies.peek(key); cr != nil && (tf.MaxAge.Duration == 0 || time.Since(cr.stored) <= tf.MaxAge.Duration) {
+			st.served = true
+			log.Printf("Route %s timed out, %s(%s) gets the copy from %s ago\n", tf.route, r.RemoteAddr, r.URL.Path, time.Since(cr.stored).Round(time.Second))
+			cr.serve(w, r, "STALE")
+			return true
+		}
+	}
+	if len(tf.body) == 0 {
+		return false
+	}
+	st.served = true
+	log.Printf("Route %s timed out, %s(%s) gets the fallback content\n", tf.route, r.RemoteAddr, r.URL.Path)
+	w.Header().Set("Content-Type", tf.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(tf.body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(cmp.Or(tf.Status, http.StatusOK))
+	_, _ = w.Write(tf.body)
+	return true
+}
+
+// fallbackCopyWriter passes a response through and keeps a copy of it, up
+// to timeoutFallbackMaxBody
+type fallbackCopyWriter struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (cw *fallbackCopyWriter) WriteHeader(status int) {
+	if cw.status == 0 && status >= 200 {
+		cw.status, cw.header = status, cw.ResponseWriter.Header().Clone()
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *fallbackCopyWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.overflow {
+		if cw.body.Len()+len(p) > timeoutFallbackMaxBody {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *fallbackCopyWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// a request is bounded three ways. -upstream-dial-timeout and
+// -upstream-response-timeout bound each attempt at connecting to a backend
+// and at getting its response headers, and a backend's dial_timeout and
+// response_timeout attributes override them for that backend, e.g.
+//
+//	http://10.0.0.5:8080;dial_timeout=500ms;response_timeout=2m
+//
+// -request-timeout bounds the whole request as the client sees it, from the
+// balancer taking it on to the end of the response, retries and queueing
+// included. upgraded connections are left out, as they are meant to last. a
+// request that runs out of time before its response starts is answered with
+// a 504, as is one whose attempts all timed out; one whose response has
+// started is cut off
+var requestTimeout time.Duration
+
+// WithRequestTimeout gives requests a deadline of -request-timeout
+func WithRequestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeoutCause(r.Context(), requestTimeout, errRequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+var errRequestTimeout = errors.New("request timeout")
+
+// requestTimedOut reports whether r ran past -request-timeout
+func requestTimedOut(r *http.Request) bool {
+	return context.Cause(r.Context()) == errRequestTimeout
+}
+
+// isTimeout reports whether err is a dial or response header timeout
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// writeTimeout answers a request that ran out of time with a 504, or its
+// route's timeout_fallback, and reports whether it did: one past
+// -request-timeout, or one whose backends timed out
+func writeTimeout(w http.ResponseWriter, r *http.Request) bool {
+	timedOut := requestTimedOut(r) || getRetryState(r) != nil && getRetryState(r).timedOut
+	switch {
+	case timedOut && writeTimeoutFallback(w, r):
+	case requestTimedOut(r):
+		writeError(w, r, http.StatusGatewayTimeout, "request_timeout", "The request took too long.", 0)
+	case getRetryState(r) != nil && getRetryState(r).timedOut:
+		writeError(w, r, http.StatusGatewayTimeout, "backend_timeout", "The backend took too long to respond.", 0)
+	default:
+		return false
+	}
+	return true
+}
+
+func (b *Backend) dialTimeout() time.Duration {
+	if b.DialTimeout > 0 {
+		return b.DialTimeout
+	}
+	return upstreamDialTimeout
+}
+
+func (b *Backend) responseTimeout() time.Duration {
+	if b.ResponseTimeout > 0 {
+		return b.ResponseTimeout
+	}
+	return upstreamResponseHeaderTimeout
+}
+
+// dialWithin bounds dial by the backend's dial timeout
+func (b *Backend) dialWithin(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, b.dialTimeout())
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
@@ -0,0 +1,229 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig terminates TLS on the front listener (-tls-cert, -tls-key), and
+// optionally answers plain HTTP on another port with a redirect to https
+type TLSConfig struct {
+	Cert         string     `json:"cert" yaml:"cert"`
+	Key          string     `json:"key" yaml:"key"`
+	ClientCA     string     `json:"client_ca" yaml:"client_ca"`         // verifies client certificates, which stay optional
+	RedirectPort int        `json:"redirect_port" yaml:"redirect_port"` // 0 disables
+	ACME         ACMEConfig `json:"acme" yaml:"acme"`
+}
+
+// ACMEConfig obtains and renews certificates for Hosts automatically, e.g.
+// from Let's Encrypt. the CA proves control of a host by connecting to it on
+// 443 (TLS-ALPN) or, with a redirect port of 80, over plain HTTP
+type ACMEConfig struct {
+	Hosts     []string `json:"hosts" yaml:"hosts"`
+	Cache     string   `json:"cache" yaml:"cache"` // directory keeping account key and certificates
+	Email     string   `json:"email" yaml:"email"`
+	Directory string   `json:"directory" yaml:"directory"` // CA directory url, Let's Encrypt by default
+}
+
+var frontTLS = TLSConfig{ACME: ACMEConfig{Cache: "acme-cache"}}
+
+// acmeManager is set when certificates come from ACME
+var acmeManager *autocert.Manager
+
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != "" || c.Key != "" || len(c.ACME.Hosts) > 0
+}
+
+// serverConfig loads the key pair and sets up ACME
+func (c TLSConfig) serverConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			return nil, fmt.Errorf("TLS needs both -tls-cert and -tls-key")
+		}
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("TLS key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("TLS client CA: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS client CA %s: no certificates", c.ClientCA)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if len(c.ACME.Hosts) == 0 {
+		return cfg, nil
+	}
+
+	acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.ACME.Hosts...),
+		Cache:      autocert.DirCache(c.ACME.Cache),
+		Email:      c.ACME.Email,
+	}
+	if c.ACME.Directory != "" {
+		acmeManager.Client = &acme.Client{DirectoryURL: c.ACME.Directory}
+	}
+	cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	// hosts outside the list get the static certificate, if there is one
+	static := cfg.Certificates
+	cfg.Certificates = nil
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := acmeManager.GetCertificate(hello)
+		if err != nil && len(static) > 0 {
+			return &static[0], nil
+		}
+		return cert, err
+	}
+	log.Printf("ACME certificates for %s (cache %s)\n", strings.Join(c.ACME.Hosts, ", "), c.ACME.Cache)
+	return cfg, nil
+}
+
+// TLSListener terminates TLS on the connections l accepts. it sits below
+// StrictListener so the framing scan sees the decrypted stream. with
+// -strict-http it hands connections on once their handshake is done, so
+// StrictListener can leave the ones that negotiated HTTP/2 unwrapped, the
+// only way net/http serves HTTP/2 on them
+func TLSListener(l net.Listener, cfg *tls.Config) net.Listener {
+	if cfg == nil {
+		return l
+	}
+	if !strictHTTP {
+		return tls.NewListener(l, cfg)
+	}
+	hl := &handshakeListener{Listener: l, cfg: cfg, conns: make(chan net.Conn), errs: make(chan error), closed: make(chan struct{})}
+	go hl.accept()
+	return hl
+}
+
+// how long a client has to finish the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// handshakeListener handshakes each connection on its own, so a slow client
+// doesn't hold up the ones behind it
+type handshakeListener struct {
+	net.Listener
+	cfg *tls.Config
+
+	conns  chan net.Conn
+	errs   chan error
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (hl *handshakeListener) accept() {
+	for {
+		c, err := hl.Listener.Accept()
+		if err != nil {
+			select {
+			case hl.errs <- err:
+			case <-hl.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go hl.handshake(tls.Server(c, hl.cfg))
+	}
+}
+
+func (hl *handshakeListener) handshake(c *tls.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := c.HandshakeContext(ctx); err != nil {
+		_ = c.Close()
+		return
+	}
+	select {
+	case hl.conns <- c:
+	case <-hl.closed:
+		_ = c.Close()
+	}
+}
+
+func (hl *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-hl.conns:
+		return c, nil
+	case err := <-hl.errs:
+		return nil, err
+	case <-hl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (hl *handshakeListener) Close() error {
+	err := net.ErrClosed
+	hl.once.Do(func() {
+		close(hl.closed)
+		err = hl.Listener.Close()
+	})
+	return err
+}
+
+// withTLSState restores r.TLS, which net/http only fills in when it holds the
+// *tls.Conn itself rather than the strict scanner wrapped around it
+func withTLSState(r *http.Request, c net.Conn) *http.Request {
+	tc, ok := c.(*tls.Conn)
+	if !ok || r.TLS != nil {
+		return r
+	}
+	state := tc.ConnectionState()
+	r = r.WithContext(r.Context())
+	r.TLS = &state
+	return r
+}
+
+// serveRedirect answers plain HTTP on port with a permanent redirect to the
+// same url on the https port. it also answers ACME HTTP challenges
+func serveRedirect(port, httpsPort int) {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	if acmeManager != nil {
+		handler = acmeManager.HTTPHandler(handler)
+	}
+	log.Printf("Redirecting HTTP at :%d to HTTPS\n", port)
+	l, err := listenTCP(fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
@@ -0,0 +1,298 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// a program embedding the balancer can transform request and response
+// bodies as they stream through, per route, e.g. to redact personal data
+// from JSON answers at the edge:
+//
+//	loadbalancer.RegisterBodyTransformer("redact-pii", loadbalancer.RedactJSON("email", "phone"))
+//	loadbalancer.Main()
+//
+// with routes naming them in the config file, applied in order:
+//
+//	{"path_prefix": "/users", "pool": "api", "response_transforms": ["redact-pii"]}
+//
+// responses are asked for uncompressed; one gzipped anyway is unzipped
+// first, while one in another encoding goes out untransformed. a
+// transformed body loses its Content-Length, so request bodies are sent
+// chunked and can't be retried on another backend. a transformer that fails
+// part way returns the error from Read, and the message is cut off there
+type BodyTransformer interface {
+	// Transform returns body transformed, reading it as it is read itself
+	// rather than all at once. header is the message's and may be changed,
+	// e.g. its Content-Type. r is the request, as sent to the backend when
+	// transforming a response. returning body leaves it as it is; a
+	// returned io.Closer is closed along with the message
+	Transform(r *http.Request, header http.Header, body io.Reader) io.Reader
+}
+
+// BodyTransformerFunc is a BodyTransformer as a function
+type BodyTransformerFunc func(r *http.Request, header http.Header, body io.Reader) io.Reader
+
+func (f BodyTransformerFunc) Transform(r *http.Request, header http.Header, body io.Reader) io.Reader {
+	return f(r, header, body)
+}
+
+var bodyTransformers struct {
+	mux sync.RWMutex
+	m   map[string]BodyTransformer
+}
+
+// RegisterBodyTransformer makes t available to routes as name. it panics
+// if the name is taken, as registering the same name twice is a bug
+func RegisterBodyTransformer(name string, t BodyTransformer) {
+	bodyTransformers.mux.Lock()
+	defer bodyTransformers.mux.Unlock()
+	if t == nil {
+		panic("loadbalancer: RegisterBodyTransformer " + name + " with a nil transformer")
+	}
+	if _, ok := bodyTransformers.m[name]; ok {
+		panic("loadbalancer: RegisterBodyTransformer called twice for " + name)
+	}
+	if bodyTransformers.m == nil {
+		bodyTransformers.m = map[string]BodyTransformer{}
+	}
+	bodyTransformers.m[name] = t
+}
+
+// lookupBodyTransformers finds the transformers a route names
+func lookupBodyTransformers(route string, names []string) ([]BodyTransformer, error) {
+	bodyTransformers.mux.RLock()
+	defer bodyTransformers.mux.RUnlock()
+	var ts []BodyTransformer
+	for _, name := range names {
+		t, ok := bodyTransformers.m[name]
+		if !ok {
+			return nil, fmt.Errorf("route %s: no body transformer %q is registered", route, name)
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// transformRequest runs r's body through the route's transformers
+func transformRequest(r *http.Request, ts []BodyTransformer) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	body, transformed := transform(r, r.Header, r.Body, ts)
+	if !transformed {
+		return
+	}
+	r.Body = body
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+}
+
+type responseTransformsKey struct{}
+
+// withResponseTransforms has the route's transformers applied to r's
+// response
+func withResponseTransforms(r *http.Request, ts []BodyTransformer) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), responseTransformsKey{}, ts))
+}
+
+// prepareTransforms asks the backend for an uncompressed body when its
+// response is to be transformed
+func prepareTransforms(r *http.Request) {
+	if ts, _ := r.Context().Value(responseTransformsKey{}).([]BodyTransformer); len(ts) > 0 {
+		r.Header.Del("Accept-Encoding")
+	}
+}
+
+// transformResponse runs a response's body through its route's
+// transformers
+func transformResponse(res *http.Response) {
+	ts, _ := res.Request.Context().Value(responseTransformsKey{}).([]BodyTransformer)
+	if len(ts) == 0 || res.Body == nil || res.Body == http.NoBody {
+		return
+	}
+	src := res.Body
+	switch ce := res.Header.Get("Content-Encoding"); ce {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			log.Printf("Not transforming the response to %s: %v\n", res.Request.URL.Path, err)
+			return
+		}
+		src = readCloser{zr, res.Body}
+		res.Header.Del("Content-Encoding")
+	default:
+		log.Printf("Not transforming the response to %s: it came %s encoded\n", res.Request.URL.Path, ce)
+		return
+	}
+	body, transformed := transform(res.Request, res.Header, src, ts)
+	if !transformed && src == res.Body {
+		return
+	}
+	res.Body = body
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+}
+
+// transform chains ts over src, and reports whether any changed it
+func transform(r *http.Request, h http.Header, src io.ReadCloser, ts []BodyTransformer) (io.ReadCloser, bool) {
+	body := &transformedBody{Reader: src, closers: []io.Closer{src}}
+	for _, t := range ts {
+		next := t.Transform(r, h, body.Reader)
+		if next == body.Reader {
+			continue
+		}
+		body.Reader = next
+		if c, ok := next.(io.Closer); ok {
+			body.closers = append(body.closers, c)
+		}
+	}
+	return body, len(body.closers) > 1 || body.Reader != src
+}
+
+// transformedBody closes the transformers' readers, outermost first, and
+// then the message's body
+type transformedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (tb *transformedBody) Close() error {
+	var err error
+	for i := len(tb.closers) - 1; i >= 0; i-- {
+		if e := tb.closers[i].Close(); i == 0 {
+			err = e
+		}
+	}
+	return err
+}
+
+// RedactJSON is a transformer replacing the values of the given object
+// keys, at any depth, with "[redacted]" in JSON bodies (application/json or
+// any +json type). it streams, holding no more than a value at a time, and
+// leaves other bodies alone
+func RedactJSON(keys ...string) BodyTransformer {
+	redact := map[string]bool{}
+	for _, k := range keys {
+		redact[k] = true
+	}
+	return BodyTransformerFunc(func(r *http.Request, h http.Header, body io.Reader) io.Reader {
+		mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+			return body
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(redactJSON(pw, body, redact))
+		}()
+		return pr
+	})
+}
+
+// redactJSON copies the JSON values in src to dst token by token, values
+// under a key to redact replaced
+func redactJSON(dst io.Writer, src io.Reader, redact map[string]bool) error {
+	dec := json.NewDecoder(src)
+	dec.UseNumber()
+	w := bufio.NewWriter(dst)
+	type frame struct {
+		object bool
+		n      int  // members or elements so far
+		value  bool // an object's key was written, its value comes next
+	}
+	var stack []frame
+	// each value at the top level, as in JSON lines, goes out once complete
+	done := func() error {
+		w.WriteByte('\n')
+		return w.Flush()
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF && len(stack) == 0 {
+			return w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			stack = stack[:len(stack)-1]
+			w.WriteByte(byte(d))
+			if len(stack) == 0 {
+				if err := done(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if n := len(stack); n > 0 {
+			f := &stack[n-1]
+			switch {
+			case f.object && !f.value:
+				// a key
+				if f.n > 0 {
+					w.WriteByte(',')
+				}
+				f.n++
+				key := tok.(string)
+				writeJSONToken(w, key)
+				w.WriteByte(':')
+				if redact[key] {
+					var skipped json.RawMessage
+					if err := dec.Decode(&skipped); err != nil {
+						return err
+					}
+					w.WriteString(`"[redacted]"`)
+				} else {
+					f.value = true
+				}
+				continue
+			case f.object:
+				f.value = false
+			default:
+				if f.n > 0 {
+					w.WriteByte(',')
+				}
+				f.n++
+			}
+		}
+		if d, ok := tok.(json.Delim); ok {
+			w.WriteByte(byte(d))
+			stack = append(stack, frame{object: d == '{'})
+			continue
+		}
+		writeJSONToken(w, tok)
+		if len(stack) == 0 {
+			if err := done(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeJSONToken(w *bufio.Writer, tok json.Token) {
+	switch v := tok.(type) {
+	case json.Number:
+		w.WriteString(string(v))
+	case nil:
+		w.WriteString("null")
+	case bool:
+		fmt.Fprint(w, v)
+	case string:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(v)
+		w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+}
@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstream connections normally come from whatever address the kernel
+// picks. -upstream-source-ip pins them to one local address, and
+// -transparent connects from each client's own address (IP_TRANSPARENT,
+// Linux only) so backends see the real client at L3. transparent mode needs
+// CAP_NET_ADMIN and routing that sends the backends' replies back through
+// this host
+var (
+	upstreamSourceIP string
+	transparentProxy bool
+)
+
+type clientIPKey struct{}
+
+func checkUpstreamSource() error {
+	if upstreamSourceIP != "" && net.ParseIP(upstreamSourceIP) == nil {
+		return fmt.Errorf("-upstream-source-ip: bad address %q", upstreamSourceIP)
+	}
+	if transparentProxy && !transparentSupported {
+		return fmt.Errorf("-transparent needs IP_TRANSPARENT, which this platform lacks")
+	}
+	return nil
+}
+
+// withClientIP remembers the client's address for a transparent dial
+func withClientIP(r *http.Request) *http.Request {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// upstreamDial returns the transport's dial function, or nil for the default
+func upstreamDial() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := sourceDial()
+	if upstreamResolver == nil && !spreadUpstreamIPs {
+		return dial
+	}
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if spreadUpstreamIPs {
+		return upstreamSpread.wrapDial(dial)
+	}
+	return upstreamResolver.wrapDial(dial)
+}
+
+// sourceDial binds upstream connections to the configured source address
+func sourceDial() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if upstreamSourceIP == "" && !transparentProxy {
+		return nil
+	}
+	base := &net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: 30 * time.Second}
+	if upstreamSourceIP != "" {
+		base.LocalAddr = &net.TCPAddr{IP: net.ParseIP(upstreamSourceIP)}
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ip, ok := ctx.Value(clientIPKey{}).(net.IP)
+		if !transparentProxy || !ok {
+			return base.DialContext(ctx, network, addr)
+		}
+		d := *base
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		d.Control = transparentControl
+		return d.DialContext(ctx, network, addr)
+	}
+}
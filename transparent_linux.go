@@ -0,0 +1,25 @@
+package loadbalancer
+
+import "syscall"
+
+const transparentSupported = true
+
+// ipv6Transparent is IPV6_TRANSPARENT from linux/in6.h, which the syscall
+// package doesn't define
+const ipv6Transparent = 75
+
+// transparentControl lets the socket bind to a non-local (client) address
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+		if network == "tcp6" {
+			level, opt = syscall.SOL_IPV6, ipv6Transparent
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
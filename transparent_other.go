@@ -0,0 +1,11 @@
+//go:build !linux
+
+package loadbalancer
+
+import "syscall"
+
+const transparentSupported = false
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return syscall.EINVAL
+}
@@ -0,0 +1,183 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// on SIGUSR2 the balancer restarts itself without closing its ports: it
+// starts whatever binary is now at its path, with the same arguments, and
+// hands it its listening sockets, UDP ones included, and in HA mode its
+// Consul session. once the new process is listening, or holds the lock, or
+// has settled as standby, it says so, and the old one drains as on SIGTERM
+// and exits. connections waiting to be accepted are picked up by the new
+// process from the same sockets, so none are refused along the way. a new
+// process that doesn't come up within -upgrade-timeout is killed and the
+// old one carries on serving; it doesn't -hold.
+//
+// -reuse-port instead binds with SO_REUSEPORT, so a supervisor can start the
+// new process itself next to the old one before stopping that. the kernel
+// spreads new connections over both sockets meanwhile, and connections still
+// queued on the old one when it closes are reset, which the handoff avoids
+var (
+	reusePort      bool
+	upgradeTimeout = 30 * time.Second
+)
+
+// envListenFDs tells a process started by an upgrade which address each
+// inherited file descriptor, from 3 on, is listening on, udp/ in front for
+// UDP sockets (cluster gossip, the DNS responder). the descriptor after
+// them is a pipe to write to once it is ready
+const envListenFDs = "LB_LISTEN_FDS"
+
+// udpPrefix marks a UDP socket's address in envListenFDs
+const udpPrefix = "udp/"
+
+var handoff struct {
+	mux       sync.Mutex
+	inherited map[string]net.Listener   // not yet claimed by listenTCP
+	packets   map[string]net.PacketConn // not yet claimed by listenUDP
+	ready     *os.File
+	bound     []handoffSocket // what the next upgrade hands over
+}
+
+type handoffSocket struct {
+	addr string // with udpPrefix for UDP
+	s    interface{ File() (*os.File, error) }
+}
+
+// upgrading reports whether this process is taking over from another
+func upgrading() bool {
+	handoff.mux.Lock()
+	defer handoff.mux.Unlock()
+	return handoff.ready != nil
+}
+
+// inheritListeners picks up the sockets an upgrading parent passed on
+func inheritListeners() {
+	spec := os.Getenv(envListenFDs)
+	if spec == "" {
+		return
+	}
+	_ = os.Unsetenv(envListenFDs)
+	addrs := strings.Split(spec, ",")
+	handoff.inherited = map[string]net.Listener{}
+	handoff.packets = map[string]net.PacketConn{}
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		var err error
+		if udpAddr, ok := strings.CutPrefix(addr, udpPrefix); ok {
+			var pc net.PacketConn
+			if pc, err = net.FilePacketConn(f); err == nil {
+				handoff.packets[udpAddr] = pc
+			}
+		} else {
+			var l net.Listener
+			if l, err = net.FileListener(f); err == nil {
+				handoff.inherited[addr] = l
+			}
+		}
+		_ = f.Close() // the socket has its own copy
+		if err != nil {
+			log.Printf("Not inheriting %s: %v\n", addr, err)
+		}
+	}
+	handoff.ready = os.NewFile(uintptr(3+len(addrs)), "upgrade ready")
+	log.Printf("Inherited %d sockets from process %d\n", len(handoff.inherited)+len(handoff.packets), os.Getppid())
+}
+
+// listenTCP binds addr, or takes the socket for it over from the process
+// this one is upgrading, and keeps it to hand over on the next upgrade
+func listenTCP(addr string) (net.Listener, error) {
+	handoff.mux.Lock()
+	defer handoff.mux.Unlock()
+	l, ok := handoff.inherited[addr]
+	if ok {
+		delete(handoff.inherited, addr)
+	} else {
+		lc := net.ListenConfig{}
+		if reusePort {
+			lc.Control = setReusePort
+		}
+		var err error
+		if l, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	if tl, ok := l.(*net.TCPListener); ok {
+		handoff.bound = append(handoff.bound, handoffSocket{addr, tl})
+	}
+	return l, nil
+}
+
+// listenUDP is listenTCP for UDP sockets
+func listenUDP(addr string) (*net.UDPConn, error) {
+	handoff.mux.Lock()
+	defer handoff.mux.Unlock()
+	var conn *net.UDPConn
+	if pc, ok := handoff.packets[addr]; ok {
+		delete(handoff.packets, addr)
+		if conn, ok = pc.(*net.UDPConn); !ok {
+			_ = pc.Close()
+			return nil, fmt.Errorf("inherited socket for %s is not UDP", addr)
+		}
+	} else {
+		ua, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if conn, err = net.ListenUDP("udp", ua); err != nil {
+			return nil, err
+		}
+	}
+	handoff.bound = append(handoff.bound, handoffSocket{udpPrefix + addr, conn})
+	return conn, nil
+}
+
+// upgradeReady tells the process this one is upgrading that it can drain,
+// and closes any inherited socket nothing has claimed
+func upgradeReady() {
+	handoff.mux.Lock()
+	defer handoff.mux.Unlock()
+	for addr, l := range handoff.inherited {
+		log.Printf("Closing inherited listener %s, no longer configured\n", addr)
+		_ = l.Close()
+	}
+	for addr, pc := range handoff.packets {
+		log.Printf("Closing inherited UDP socket %s, no longer configured\n", addr)
+		_ = pc.Close()
+	}
+	handoff.inherited, handoff.packets = nil, nil
+	if handoff.ready != nil {
+		_, _ = handoff.ready.Write([]byte{1})
+		_ = handoff.ready.Close()
+		handoff.ready = nil
+	}
+}
+
+// handoffFiles duplicates the bound sockets for a new process, skipping
+// ones closed since, e.g. when an HA standby gave its port up
+func handoffFiles() ([]*os.File, []string) {
+	handoff.mux.Lock()
+	defer handoff.mux.Unlock()
+	var files []*os.File
+	var addrs []string
+	open := handoff.bound[:0]
+	for _, hs := range handoff.bound {
+		f, err := hs.s.File()
+		if err != nil {
+			continue
+		}
+		files = append(files, f)
+		addrs = append(addrs, hs.addr)
+		open = append(open, hs)
+	}
+	handoff.bound = open
+	return files, addrs
+}
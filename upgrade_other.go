@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package loadbalancer
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("-reuse-port is not supported on this system")
+}
+
+// upgradeOnSignal does nothing where sockets can't be handed to a new process
+func upgradeOnSignal() {}
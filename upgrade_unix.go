@@ -0,0 +1,110 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// upgradeOnSignal starts a new process on each SIGUSR2 until one takes over,
+// then drains this one
+func upgradeOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+	for range sig {
+		log.Println("Received SIGUSR2, starting a new process")
+		pid, err := upgrade()
+		if err != nil {
+			log.Printf("Upgrade failed, carrying on: %v\n", err)
+			continue
+		}
+		log.Printf("Process %d took over, draining\n", pid)
+		signal.Ignore(syscall.SIGUSR2) // a late one mustn't kill us mid-drain
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		return
+	}
+}
+
+// upgrade starts the new process and waits for it to be ready
+func upgrade() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	files, addrs := handoffFiles()
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	if len(files) == 0 {
+		return 0, errors.New("no listeners to hand over")
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envListenFDs+"=") && !strings.HasPrefix(kv, envHASession+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, envListenFDs+"="+strings.Join(addrs, ","))
+	if elector != nil && elector.Session() != "" {
+		cmd.Env = append(cmd.Env, envHASession+"="+elector.Session())
+	}
+	err = cmd.Start()
+	_ = readyW.Close() // the child has its own, so a read ends if it exits
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := ready.Read(buf)
+		done <- n == 1
+	}()
+	t := time.NewTimer(upgradeTimeout)
+	defer t.Stop()
+	select {
+	case ok := <-done:
+		if ok {
+			go func() { _ = cmd.Wait() }() // reaped should it exit before we do
+			if elector != nil {
+				elector.handOver()
+			}
+			return cmd.Process.Pid, nil
+		}
+		err = fmt.Errorf("process %d exited before listening", cmd.Process.Pid)
+	case <-t.C:
+		err = fmt.Errorf("process %d not listening after %s, killed", cmd.Process.Pid, upgradeTimeout)
+		_ = cmd.Process.Kill()
+	}
+	_ = cmd.Wait()
+	return 0, err
+}
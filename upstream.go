@@ -0,0 +1,53 @@
+package loadbalancer
+
+import (
+	"log"
+	"time"
+)
+
+// a backend restart leaves the transport holding pooled connections to a
+// process that no longer exists; the next traffic spike would pick them up
+// and fail. idle connections are therefore capped in age, swept
+// periodically, and flushed whenever a backend changes health state
+
+// upstreamDialTimeout bounds connecting to a backend (-upstream-dial-timeout)
+var upstreamDialTimeout = 30 * time.Second
+
+// upstreamIdleTimeout closes pooled connections idle for longer (-upstream-idle-timeout)
+var upstreamIdleTimeout = 90 * time.Second
+
+// upstreamResponseHeaderTimeout fails a request whose backend hasn't answered
+// in time (-upstream-response-timeout, 0 waits forever)
+var upstreamResponseHeaderTimeout time.Duration
+
+// flushIdle drops the backend's pooled idle connections so the next request
+// dials fresh
+func (b *Backend) flushIdle(reason string) {
+	if b.closeIdle() {
+		log.Printf("Backend %s: closed idle connections (%s)\n", b.Name(), reason)
+	}
+}
+
+// closeIdle is flushIdle without the log line
+func (b *Backend) closeIdle() bool {
+	t := b.target.Load()
+	if t == nil {
+		return false
+	}
+	t.transport.CloseIdleConnections()
+	return true
+}
+
+// sweepIdleConns closes every pool's idle upstream connections each
+// interval, so none is reused after sitting longer than that
+func sweepIdleConns(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		for _, p := range pools {
+			for _, b := range p.Backends() {
+				b.target.Load().transport.CloseIdleConnections()
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// upstream failures are told apart by cause, in lb_upstream_errors_total,
+// the error log line, the access log's upstream_error and the failure
+// journal, so a refused connection doesn't read like a slow backend
+type upstreamErrorKind int
+
+const (
+	upstreamDNS             upstreamErrorKind = iota // the backend's name didn't resolve
+	upstreamConnectRefused                           // nothing listening
+	upstreamConnectTimeout                           // no answer to the dial within its timeout
+	upstreamConnect                                  // any other dial failure, e.g. no route to host
+	upstreamTLS                                      // the handshake or the certificate failed
+	upstreamReset                                    // the connection was reset or closed before a response
+	upstreamResponseTimeout                          // connected, but the response took too long
+	upstreamCanceled                                 // the client went away first
+	upstream5xx                                      // the backend answered with a 5xx
+	upstreamOther
+	numUpstreamErrorKinds
+)
+
+var upstreamErrorNames = [numUpstreamErrorKinds]string{
+	"dns", "connect_refused", "connect_timeout", "connect", "tls", "reset",
+	"response_timeout", "canceled", "5xx", "other",
+}
+
+func (k upstreamErrorKind) String() string {
+	return upstreamErrorNames[k]
+}
+
+// what the transport's TLSHandshakeTimeout fails with. the error type is
+// unexported and is a timeout, so it is matched by its text
+const errTLSHandshakeTimeout = "net/http: TLS handshake timeout"
+
+// classifyUpstreamError finds the cause of a transport error
+func classifyUpstreamError(err error) upstreamErrorKind {
+	var (
+		dnsErr     *net.DNSError
+		op         *net.OpError
+		recordErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		verifyErr  *tls.CertificateVerificationError
+		unknownCA  x509.UnknownAuthorityError
+		invalidErr x509.CertificateInvalidError
+		hostErr    x509.HostnameError
+	)
+	var statusErr *retryStatusError
+	dial := errors.As(err, &op) && op.Op == "dial"
+	switch {
+	case errors.As(err, &statusErr) && statusErr.status >= 500:
+		return upstream5xx
+	case errors.As(err, &dnsErr):
+		return upstreamDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return upstreamConnectRefused
+	case dial && op.Timeout():
+		return upstreamConnectTimeout
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &unknownCA), errors.As(err, &invalidErr), errors.As(err, &hostErr),
+		strings.Contains(err.Error(), "tls: "), strings.Contains(err.Error(), errTLSHandshakeTimeout):
+		return upstreamTLS
+	case dial:
+		return upstreamConnect
+	case errors.Is(err, context.Canceled):
+		return upstreamCanceled
+	case isTimeout(err), errors.Is(err, context.DeadlineExceeded):
+		return upstreamResponseTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return upstreamReset
+	}
+	return upstreamOther
+}
+
+// countUpstreamError counts a failed attempt at b against its cause
+func countUpstreamError(r *http.Request, b *Backend, kind upstreamErrorKind) {
+	b.upstreamErrors[kind].Add(1)
+	if e := accessLogEntry(r); e != nil {
+		e.UpstreamError = kind.String()
+	}
+}
+
+// UpstreamErrors returns the backend's failed attempts by cause
+func (b *Backend) UpstreamErrors() map[string]uint64 {
+	m := map[string]uint64{}
+	for k := range b.upstreamErrors {
+		if n := b.upstreamErrors[k].Load(); n > 0 {
+			m[upstreamErrorKind(k).String()] = n
+		}
+	}
+	return m
+}
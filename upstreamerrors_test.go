@@ -0,0 +1,40 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+// timeoutError is a net.Error that timed out, like the transport's
+type timeoutError string
+
+func (e timeoutError) Error() string { return string(e) }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyUpstreamError(t *testing.T) {
+	get := func(err error) error { return &url.Error{Op: "Get", URL: "http://10.0.0.5:8080/", Err: err} }
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{get(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), "connect_refused"},
+		{get(&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError("i/o timeout")}), "connect_timeout"},
+		{get(&net.DNSError{Err: "no such host", Name: "api.internal"}), "dns"},
+		{get(timeoutError(errTLSHandshakeTimeout)), "tls"},
+		{get(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), "tls"},
+		{get(timeoutError("net/http: timeout awaiting response headers")), "response_timeout"},
+		{get(context.Canceled), "canceled"},
+		{get(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}), "reset"},
+		{get(errors.New("something else")), "other"},
+	} {
+		if got := classifyUpstreamError(tc.err).String(); got != tc.want {
+			t.Errorf("%v: got %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// with -version-header, HTTP health checks read the version each backend
+// reports and /status and the admin API show it, so a half finished deploy
+// is easy to spot. a pool expecting a version (-expected-version, or a
+// pool's health_check.expected_version) keeps backends on any other version
+// out of rotation, and the admin API and discovery refuse to add them
+var (
+	versionHeader   string
+	expectedVersion string
+)
+
+// Version is what the backend last reported, "" if nothing yet
+func (b *Backend) Version() string {
+	if v := b.version.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// observeVersion reads the version header from a health check answer and
+// reports whether it is the one hs expects
+func (b *Backend) observeVersion(h http.Header, hs HealthSettings) bool {
+	if versionHeader == "" {
+		return true
+	}
+	v := h.Get(versionHeader)
+	if old := b.version.Swap(&v); old != nil && *old != v {
+		log.Printf("Backend %s: version %q, was %q\n", b.Name(), v, *old)
+	}
+	if hs.Version != "" && v != hs.Version {
+		b.unavailable("%s reports version %q, want %q", b.Name(), v, hs.Version)
+		return false
+	}
+	return true
+}
+
+// checkVersion probes a backend before it is added, and fails if the pool
+// expects another version. without an HTTP health check there is nothing
+// to go on, so anything passes
+func (s *ServerPool) checkVersion(b *Backend) error {
+	hs := s.healthSettings()
+	if versionHeader == "" || hs.Version == "" || hs.Path == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hs.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL().JoinPath(hs.Path).String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := healthClientFor(b).Do(req)
+	if err != nil {
+		return fmt.Errorf("backend %s: checking its version: %w", b.Name(), err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+	_ = res.Body.Close()
+	if v := res.Header.Get(versionHeader); v != hs.Version {
+		return fmt.Errorf("backend %s: reports version %q, pool %s expects %q", b.Name(), v, s.Name, hs.Version)
+	}
+	return nil
+}
+
+// versions counts the pool's backends by reported version
+func (s *ServerPool) versions() map[string]int {
+	if versionHeader == "" {
+		return nil
+	}
+	counts := map[string]int{}
+	for _, b := range s.Backends() {
+		counts[b.Version()]++
+	}
+	return counts
+}
+
+// formatVersions is e.g. "1.4.2=3 1.5.0=1", "-" for none
+func formatVersions(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "-"
+	}
+	var parts []string
+	for v, n := range counts {
+		if v == "" {
+			v = "unknown"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%d", v, n))
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, " ")
+}
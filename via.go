@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hop-by-hop headers (Connection and everything it lists, Keep-Alive, TE,
+// Trailer, Transfer-Encoding, Upgrade, Proxy-*) are already stripped in both
+// directions by httputil.ReverseProxy as RFC 7230 requires. what a proxy must
+// add on top is a Via entry, which also lets us detect forwarding loops.
+
+// viaPseudonym names this balancer in Via headers; empty disables Via. it
+// defaults to one per host, so a balancer in front of another isn't taken
+// for a loop
+var viaPseudonym = defaultViaPseudonym()
+
+func defaultViaPseudonym() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "load-balancer"
+	}
+	return "load-balancer-" + host
+}
+
+func viaEntry(major, minor int) string {
+	version := strconv.Itoa(major)
+	if major < 2 {
+		version += "." + strconv.Itoa(minor)
+	}
+	return version + " " + viaPseudonym
+}
+
+// WithVia rejects requests that already passed through this balancer, which
+// means a backend points back at us
+func WithVia(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if viaPseudonym != "" && viaContains(r.Header.Values("Via"), viaPseudonym) {
+			log.Printf("%s(%s) Forwarding loop detected via %q\n", r.RemoteAddr, r.URL.Path, r.Header.Get("Via"))
+			writeError(w, r, http.StatusLoopDetected, "forwarding_loop", "Loop detected.", 0)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func viaContains(values []string, pseudonym string) bool {
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && fields[1] == pseudonym {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addVia(h http.Header, major, minor int) {
+	if viaPseudonym == "" {
+		return
+	}
+	h.Add("Via", viaEntry(major, minor))
+}
@@ -0,0 +1,74 @@
+package loadbalancer
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// warmupPath, when set (-health-warmup), is requested through the backend's
+// real proxy before a down backend is marked up again. unlike the probe it
+// goes through the same transport, TLS setup and header handling as client
+// traffic
+var warmupPath string
+
+type warmupKey struct{}
+
+func isWarmup(r *http.Request) bool {
+	return r.Context().Value(warmupKey{}) != nil
+}
+
+// discardWriter keeps the status, and a proxy error if there was one, and
+// drops the body
+type discardWriter struct {
+	header http.Header
+	status int
+	err    error
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+// warmUp sends one synthetic request through the proxy and reports whether
+// it got an acceptable answer. the proxy neither retries it nor fails it
+// over to another backend
+func (b *Backend) warmUp() bool {
+	return b.warmRequest(warmupPath)
+}
+
+func (b *Backend) warmRequest(path string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	w := &discardWriter{header: http.Header{}}
+	ctx = context.WithValue(ctx, warmupKey{}, w)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		log.Printf("Backend %s: warm-up failed: %v\n", b.Name(), err)
+		return false
+	}
+	r.RemoteAddr = "127.0.0.1:0"
+	r.Header.Set("User-Agent", "load-balancer-warmup")
+
+	b.target.Load().proxy.ServeHTTP(w, r)
+	if w.err != nil {
+		log.Printf("Backend %s: warm-up failed: %v\n", b.Name(), w.err)
+		return false
+	}
+	if !healthCheckStatus.Contains(w.status) {
+		log.Printf("Backend %s: warm-up answered %d\n", b.Name(), w.status)
+		return false
+	}
+	return true
+}
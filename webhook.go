@@ -0,0 +1,180 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HealthEvent is what -webhook urls are sent when a backend goes down or
+// comes back up. while a pool settles after a reload (-reload-settle) its
+// transitions are sent as one event with only Pool, Summary and Time
+type HealthEvent struct {
+	Pool    string    `json:"pool,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	From    string    `json:"from,omitempty"` // up or down
+	To      string    `json:"to,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Summary string    `json:"summary,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// webhooks POST health events to urls, in the order they happen, from one
+// goroutine so a slow receiver never holds up the health check or a request.
+// Format json sends the HealthEvent, slack a {"text": ...} message that
+// Slack, Mattermost and most chat incoming webhooks accept
+type webhooks struct {
+	urls   []string
+	format string
+	queue  chan HealthEvent
+	client *http.Client
+
+	sent    atomic.Uint64
+	failed  atomic.Uint64 // deliveries given up on after retries
+	dropped atomic.Uint64 // events lost to a full queue
+}
+
+// healthWebhooks is set from -webhook, nil when there are none
+var healthWebhooks *webhooks
+
+func newWebhooks(urls []string, format string) (*webhooks, error) {
+	if format != "json" && format != "slack" {
+		return nil, fmt.Errorf("-webhook-format must be json or slack, got %q", format)
+	}
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("webhook %q: expected an http(s) url", u)
+		}
+	}
+	return &webhooks{
+		urls:   urls,
+		format: format,
+		queue:  make(chan HealthEvent, 256),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// notify queues ev, dropping it rather than blocking when the receivers
+// have fallen far behind
+func (wh *webhooks) notify(ev HealthEvent) {
+	if wh == nil {
+		return
+	}
+	select {
+	case wh.queue <- ev:
+	default:
+		wh.dropped.Add(1)
+		if ev.Summary != "" {
+			log.Printf("Webhook queue full, dropped pool %s's summary\n", ev.Pool)
+		} else {
+			log.Printf("Webhook queue full, dropped %s going %s\n", ev.Backend, ev.To)
+		}
+	}
+}
+
+func (wh *webhooks) run() {
+	for ev := range wh.queue {
+		body, err := wh.payload(ev)
+		if err != nil {
+			log.Printf("Webhook: %s\n", err)
+			continue
+		}
+		for _, u := range wh.urls {
+			wh.deliver(u, body)
+		}
+	}
+}
+
+// deliver tries a few times with growing pauses, since a receiver that is
+// briefly away shouldn't cost on-call the news
+func (wh *webhooks) deliver(url string, body []byte) {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = wh.post(url, body); err == nil {
+			wh.sent.Add(1)
+			return
+		}
+	}
+	wh.failed.Add(1)
+	log.Printf("Webhook %s: %s\n", url, err)
+}
+
+func (wh *webhooks) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "load-balancer")
+	return checkSinkResponse(wh.client.Do(req))
+}
+
+func (wh *webhooks) payload(ev HealthEvent) ([]byte, error) {
+	if wh.format == "slack" {
+		return json.Marshal(map[string]string{"text": ev.message()})
+	}
+	return json.Marshal(ev)
+}
+
+// message is ev as one line of chat
+func (ev HealthEvent) message() string {
+	if ev.Summary != "" {
+		return fmt.Sprintf(":information_source: Pool %s %s at %s", ev.Pool, ev.Summary, ev.Time.UTC().Format(time.RFC3339))
+	}
+	icon := ":red_circle:"
+	if ev.To == "up" {
+		icon = ":large_green_circle:"
+	}
+	msg := fmt.Sprintf("%s Backend %s (%s)", icon, ev.Backend, ev.URL)
+	if ev.Pool != "" {
+		msg += " in pool " + ev.Pool
+	}
+	msg += " is " + ev.To
+	if ev.Reason != "" {
+		msg += ": " + ev.Reason
+	}
+	return msg + " at " + ev.Time.UTC().Format(time.RFC3339)
+}
+
+// notifyHealth tells the webhooks b went up or down
+func notifyHealth(b *Backend, alive bool, reason string) {
+	if healthWebhooks == nil {
+		return
+	}
+	ev := HealthEvent{
+		Backend: b.Name(),
+		URL:     b.URL().String(),
+		From:    "up",
+		To:      "down",
+		Reason:  reason,
+		Time:    time.Now(),
+	}
+	if alive {
+		ev.From, ev.To = "down", "up"
+	}
+	if p := poolOf(b); p != nil {
+		ev.Pool = p.Name
+	}
+	healthWebhooks.notify(ev)
+}
+
+// poolOf is the pool b is in, nil if it has been removed since
+func poolOf(b *Backend) *ServerPool {
+	for _, p := range pools {
+		for _, pb := range p.Backends() {
+			if pb == b {
+				return p
+			}
+		}
+	}
+	return nil
+}
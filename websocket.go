@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upgraded connections (WebSocket and other 101 Switching Protocols
+// responses) are tunnelled by ReverseProxy for as long as either side keeps
+// them open. one with no traffic in either direction for
+// websocketIdleTimeout (-websocket-idle-timeout, 0 never) is closed, so a
+// hung backend or a vanished client doesn't hold it forever
+var websocketIdleTimeout = 10 * time.Minute
+
+var websocketsOpen atomic.Int64
+var websocketsIdleClosed atomic.Uint64
+
+// tunnel is the backend side of an upgraded connection or a TCP proxied
+// one. everything either way is read or written through it, so it knows
+// when traffic last passed
+type tunnel struct {
+	io.ReadWriteCloser
+	last   atomic.Int64 // unix ns of the last read or write
+	once   sync.Once
+	done   chan struct{}
+	closed func() // run once on Close
+}
+
+func newTunnel(rwc io.ReadWriteCloser, closed func()) *tunnel {
+	t := &tunnel{ReadWriteCloser: rwc, done: make(chan struct{}), closed: closed}
+	t.last.Store(time.Now().UnixNano())
+	return t
+}
+
+func (t *tunnel) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	t.last.Store(time.Now().UnixNano())
+	return n, err
+}
+
+func (t *tunnel) Write(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(p)
+	t.last.Store(time.Now().UnixNano())
+	return n, err
+}
+
+func (t *tunnel) Close() error {
+	err := t.ReadWriteCloser.Close()
+	t.once.Do(func() {
+		close(t.done)
+		if t.closed != nil {
+			t.closed()
+		}
+	})
+	return err
+}
+
+// closeIdle closes the tunnel once it has gone timeout without traffic,
+// which ends the copies both ways, and then calls idled
+func (t *tunnel) closeIdle(timeout time.Duration, idled func(idle time.Duration)) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(time.Unix(0, t.last.Load()))
+		if idle >= timeout {
+			_ = t.Close()
+			idled(idle)
+			return
+		}
+		timer.Reset(timeout - idle)
+	}
+}
+
+// watchUpgrade takes over the body of a 101 response, which is the raw
+// connection to the backend. it must stay an io.ReadWriteCloser for
+// ReverseProxy to tunnel it, so none of the body rewriting applies
+func watchUpgrade(res *http.Response, b *Backend) {
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+	websocketsOpen.Add(1)
+	t := newTunnel(rwc, func() { websocketsOpen.Add(-1) })
+	res.Body = t
+	if websocketIdleTimeout > 0 {
+		go t.closeIdle(websocketIdleTimeout, func(idle time.Duration) {
+			websocketsIdleClosed.Add(1)
+			log.Printf("Backend %s: closed upgraded connection idle for %s\n", b.Name(), idle.Round(time.Second))
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// with -weight-decay a backend that starts failing loses weight in step
+// with its recent error rate instead of keeping all of it until it is
+// marked down: one failing a third of its requests balances at two thirds
+// of its weight, down to -weight-decay-floor. the rate is smoothed over
+// about the last weightDecaySmoothing requests and halves every
+// -weight-decay of its own, so the weight comes back gradually as the
+// errors stop, even to a backend getting little traffic meanwhile
+var (
+	weightDecayHalfLife time.Duration
+	weightDecayFloor    = 10 // percent of its weight a failing backend keeps
+)
+
+// weightDecaySmoothing is about how many of the latest results the error
+// rate covers
+const weightDecaySmoothing = 20
+
+// errorDecay is a backend's smoothed error rate
+type errorDecay struct {
+	mux  sync.Mutex    // serializes observeErrorRate
+	rate atomic.Uint64 // float64 bits, 0 to 1, as of at
+	at   atomic.Int64  // unix ns
+	cut  bool          // logged as cut, under mux
+}
+
+// current is the error rate decayed to now
+func (d *errorDecay) current() float64 {
+	rate := math.Float64frombits(d.rate.Load())
+	if rate == 0 {
+		return 0
+	}
+	since := time.Since(time.Unix(0, d.at.Load()))
+	return rate * math.Exp2(-float64(since)/float64(weightDecayHalfLife))
+}
+
+// observeErrorRate folds a result into the error rate
+func (b *Backend) observeErrorRate(failed bool) {
+	if weightDecayHalfLife <= 0 {
+		return
+	}
+	d := &b.errorDecay
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	rate := d.current()
+	if failed {
+		rate += (1 - rate) / weightDecaySmoothing
+	} else {
+		rate -= rate / weightDecaySmoothing
+	}
+	d.rate.Store(math.Float64bits(rate))
+	d.at.Store(time.Now().UnixNano())
+
+	switch share := b.decayShare(); {
+	case share < 0.9 && !d.cut:
+		d.cut = true
+		log.Printf("Backend %s: failing, weight cut to %.0f%%\n", b.Name(), share*100)
+	case share >= 0.99 && d.cut:
+		d.cut = false
+		log.Printf("Backend %s: errors subsided, weight back to full\n", b.Name())
+	}
+}
+
+// decayShare is the part of its weight the backend keeps for its errors
+func (b *Backend) decayShare() float64 {
+	if weightDecayHalfLife <= 0 {
+		return 1
+	}
+	return max(1-b.errorDecay.current(), float64(weightDecayFloor)/100)
+}
+
+// ErrorRate is the backend's smoothed recent error rate with -weight-decay
+func (b *Backend) ErrorRate() float64 {
+	if weightDecayHalfLife <= 0 {
+		return 0
+	}
+	return b.errorDecay.current()
+}
@@ -0,0 +1,183 @@
+package loadbalancer
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// responseBuffer is how much of a response may be held for a slow client
+// (-response-buffer, 0 off). the backend's response is read into memory as
+// fast as it comes and written out to the client behind it, so a client on a
+// slow link ties up a buffer rather than a backend connection and a pool
+// slot, and backend latency is measured as the backend's alone. a response
+// bigger than the budget waits for the client once the buffer is full, as
+// without one. upgrades and gRPC streams are passed straight through
+var responseBuffer int64
+
+var (
+	writeBehindBytes atomic.Int64  // held across all requests
+	writeBehindFull  atomic.Uint64 // responses that filled their buffer
+)
+
+// WithWriteBehind buffers responses for slow clients, see responseBuffer
+func WithWriteBehind(max int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || r.Method == http.MethodConnect || isGRPC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wb := newWriteBehind(w, max)
+		defer wb.finish()
+		next.ServeHTTP(wb, r)
+	})
+}
+
+// writeBehind queues what the handler writes and a goroutine writes it to
+// the client. the handler only waits when max bytes are queued
+type writeBehind struct {
+	w      http.ResponseWriter
+	header http.Header
+	max    int64
+
+	mux     sync.Mutex
+	cond    sync.Cond
+	queue   []writeOp
+	size    int64
+	wrote   bool // a final status was queued
+	full    bool
+	closing bool
+	err     error // the client's, once a write failed
+	done    chan struct{}
+}
+
+// writeOp is a status line with its headers, body bytes or a flush
+type writeOp struct {
+	status int
+	header http.Header
+	data   []byte
+	flush  bool
+}
+
+func newWriteBehind(w http.ResponseWriter, max int64) *writeBehind {
+	wb := &writeBehind{w: w, header: w.Header().Clone(), max: max, done: make(chan struct{})}
+	wb.cond.L = &wb.mux
+	go wb.drain()
+	return wb
+}
+
+func (wb *writeBehind) Header() http.Header {
+	return wb.header
+}
+
+func (wb *writeBehind) WriteHeader(status int) {
+	if wb.wrote {
+		return
+	}
+	// 1xx go out as they come, ahead of the final status
+	wb.wrote = status >= 200
+	wb.push(writeOp{status: status, header: wb.header.Clone()})
+}
+
+func (wb *writeBehind) Write(p []byte) (int, error) {
+	if !wb.wrote {
+		wb.WriteHeader(http.StatusOK)
+	}
+	if err := wb.push(writeOp{data: append([]byte(nil), p...)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (wb *writeBehind) Flush() {
+	_ = wb.push(writeOp{flush: true})
+}
+
+func (wb *writeBehind) Unwrap() http.ResponseWriter {
+	return wb.w
+}
+
+// push queues op, first waiting for room if the buffer is full
+func (wb *writeBehind) push(op writeOp) error {
+	n := int64(len(op.data))
+	wb.mux.Lock()
+	defer wb.mux.Unlock()
+	for wb.err == nil && wb.size > 0 && wb.size+n > wb.max {
+		if !wb.full {
+			wb.full = true
+			writeBehindFull.Add(1)
+		}
+		wb.cond.Wait()
+	}
+	if wb.err != nil {
+		return wb.err
+	}
+	wb.queue = append(wb.queue, op)
+	wb.size += n
+	writeBehindBytes.Add(n)
+	wb.cond.Broadcast()
+	return nil
+}
+
+func (wb *writeBehind) drain() {
+	defer close(wb.done)
+	for {
+		wb.mux.Lock()
+		for len(wb.queue) == 0 && !wb.closing {
+			wb.cond.Wait()
+		}
+		if len(wb.queue) == 0 {
+			wb.mux.Unlock()
+			return
+		}
+		op := wb.queue[0]
+		wb.queue = wb.queue[1:]
+		failed := wb.err != nil
+		wb.mux.Unlock()
+
+		var err error
+		switch {
+		case failed:
+			// the client is gone, so this is only freeing the buffer
+		case op.header != nil:
+			h := wb.w.Header()
+			clear(h)
+			maps.Copy(h, op.header)
+			wb.w.WriteHeader(op.status)
+		case op.flush:
+			if err = http.NewResponseController(wb.w).Flush(); errors.Is(err, http.ErrNotSupported) {
+				err = nil
+			}
+		default:
+			_, err = wb.w.Write(op.data)
+		}
+
+		n := int64(len(op.data))
+		wb.mux.Lock()
+		wb.size -= n
+		writeBehindBytes.Add(-n)
+		if err != nil && wb.err == nil {
+			wb.err = err
+		}
+		wb.cond.Broadcast()
+		wb.mux.Unlock()
+	}
+}
+
+// finish waits for the client to have everything, then passes on what
+// the handler set since: trailers, or all the headers if it wrote nothing
+func (wb *writeBehind) finish() {
+	wb.mux.Lock()
+	wb.closing = true
+	wb.cond.Broadcast()
+	wb.mux.Unlock()
+	<-wb.done
+	h := wb.w.Header()
+	if !wb.wrote {
+		clear(h)
+	}
+	// after the status, only trailers take
+	maps.Copy(h, wb.header)
+}